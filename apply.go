@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// 残す画像の選び方
+var keepPolicies = map[string]func(a, b groupMemberStat) bool{
+	"first":         func(a, b groupMemberStat) bool { return false },
+	"largest":       func(a, b groupMemberStat) bool { return a.Size > b.Size },
+	"smallest":      func(a, b groupMemberStat) bool { return a.Size < b.Size },
+	"newest":        func(a, b groupMemberStat) bool { return a.ModTime.After(b.ModTime) },
+	"oldest":        func(a, b groupMemberStat) bool { return a.ModTime.Before(b.ModTime) },
+	"shortest-path": func(a, b groupMemberStat) bool { return len(a.Filepath) < len(b.Filepath) },
+	"resolution":    func(a, b groupMemberStat) bool { return a.Width*a.Height > b.Width*b.Height },
+	"quality":       func(a, b groupMemberStat) bool { return qualityScore(a) > qualityScore(b) },
+}
+
+// qualityScore 画質の点数（計算できなかった画像は-1）
+func qualityScore(stat groupMemberStat) float64 {
+	if stat.Quality == nil {
+		return -1
+	}
+	return stat.Quality.Score
+}
+
+// scoreMissingQualities 画質の点数がないグループの画質を計算する
+// NOTE: group -qualityを指定せずに作ったグループでも-keep=qualityを使えるようにする
+func scoreMissingQualities(stats []groupMemberStat) {
+	for _, stat := range stats {
+		if stat.IsExist && stat.Quality == nil {
+			qualities := make([]*imageQuality, len(stats))
+			for i := range stats {
+				if stats[i].IsExist {
+					qualities[i], _ = measureImageQuality(stats[i].Filepath)
+				}
+			}
+			scoreImageQualities(qualities)
+			for i := range stats {
+				stats[i].Quality = qualities[i]
+			}
+			return
+		}
+	}
+}
+
+// selectKeepMember 残す画像のインデックスを選ぶ（なければ-1）
+// NOTE: 同順位ならグループ内で先にあるものを残す
+func selectKeepMember(stats []groupMemberStat, isBetter func(a, b groupMemberStat) bool) int {
+	keepIndex := -1
+	for i, stat := range stats {
+		if !stat.IsExist {
+			continue
+		}
+		if keepIndex < 0 || isBetter(stat, stats[keepIndex]) {
+			keepIndex = i
+		}
+	}
+	return keepIndex
+}
+
+// relationToKeep 残す画像と重複した画像の関係
+// NOTE: 関係はグループの基準の画像（関係が空の要素）に対するものなので、どちらも基準でなければ弱い方の関係とみなす
+func relationToKeep(keep, duplicate groupMemberStat) string {
+	switch {
+	case len(duplicate.Relation) == 0:
+		return keep.Relation
+	case len(keep.Relation) == 0:
+		return duplicate.Relation
+	case slices.Index(relations, keep.Relation) > slices.Index(relations, duplicate.Relation):
+		return keep.Relation
+	default:
+		return duplicate.Relation
+	}
+}
+
+// duplicateApplier 重複した画像への操作
+type duplicateApplier struct {
+	Action   string
+	MoveTo   string
+	IsDryRun bool
+}
+
+// Apply 残す画像以外に操作を行い、行った操作を返す
+func (applier *duplicateApplier) Apply(keep, duplicate groupMemberStat) (string, error) {
+	switch applier.Action {
+	case "list":
+		return "duplicate: " + duplicate.Filepath, nil
+	case "move":
+		destination := applier.moveDestination(duplicate)
+		if !applier.IsDryRun {
+			if err := moveFile(duplicate.Filepath, destination); err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("move: %s -> %s", duplicate.Filepath, destination), nil
+	case "delete":
+		if !applier.IsDryRun {
+			if err := os.Remove(duplicate.Filepath); err != nil {
+				return "", fmt.Errorf("failed os.Remove: %s %w", duplicate.Filepath, err)
+			}
+		}
+		return "delete: " + duplicate.Filepath, nil
+	case "hardlink":
+		// NOTE: 既に同じ実体ならrenameが何もしないので一時ファイルが残ってしまう
+		if isSameFile(keep.Filepath, duplicate.Filepath) {
+			return "linked: " + duplicate.Filepath, nil
+		}
+		if !applier.IsDryRun {
+			err := replaceFile(duplicate.Filepath, func(tempPath string) error {
+				return os.Link(keep.Filepath, tempPath)
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("hardlink: %s -> %s", duplicate.Filepath, keep.Filepath), nil
+	case "symlink":
+		target, err := filepath.Abs(keep.Filepath)
+		if err != nil {
+			return "", fmt.Errorf("failed filepath.Abs: %s %w", keep.Filepath, err)
+		}
+		if !applier.IsDryRun {
+			err := replaceFile(duplicate.Filepath, func(tempPath string) error {
+				return os.Symlink(target, tempPath)
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("symlink: %s -> %s", duplicate.Filepath, target), nil
+	default:
+		return "", fmt.Errorf("invalid action: %s", applier.Action)
+	}
+}
+
+// moveDestination 移動先のパス
+// NOTE: 走査元からの相対パスを保って移動し、走査元が分からなければファイル名だけにする
+func (applier *duplicateApplier) moveDestination(member groupMemberStat) string {
+	if len(member.Root) != 0 {
+		if relPath, err := filepath.Rel(member.Root, member.Filepath); err == nil && relPath != "." && !strings.HasPrefix(relPath, "..") {
+			return filepath.Join(applier.MoveTo, relPath)
+		}
+	}
+	return filepath.Join(applier.MoveTo, filepath.Base(member.Filepath))
+}
+
+// isSameFile 2つのパスが同じ実体のファイルか
+func isSameFile(pathA, pathB string) bool {
+	infoA, err := os.Stat(pathA)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(pathB)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(infoA, infoB)
+}
+
+// moveFile ファイルを移動する（移動先に既にあればエラー）
+func moveFile(path, destination string) error {
+	if _, err := os.Lstat(destination); err == nil {
+		return fmt.Errorf("failed moveFile: %s %w", destination, fs.ErrExist)
+	}
+	if err := os.MkdirAll(filepath.Dir(destination), 0o755); err != nil {
+		return fmt.Errorf("failed os.MkdirAll: %s %w", filepath.Dir(destination), err)
+	}
+	if err := os.Rename(path, destination); err != nil {
+		return fmt.Errorf("failed os.Rename: %s %w", path, err)
+	}
+	return nil
+}
+
+// replaceFile 一時ファイルとしてリンクを作成してから置き換える
+// NOTE: 途中で失敗しても元のファイルが消えないようにする
+func replaceFile(path string, createLink func(tempPath string) error) error {
+	tempPath := path + ".similar_images_grouping.tmp"
+	if err := createLink(tempPath); err != nil {
+		return fmt.Errorf("failed to create link: %s %w", tempPath, err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed os.Rename: %s %w", tempPath, err)
+	}
+	return nil
+}
+
+// runApply applyサブコマンド
+func runApply(args []string, env *cliEnv) error {
+	cmd := struct {
+		Groups    string
+		Action    string
+		Keep      string
+		MoveTo    string
+		IsDryRun  bool
+		Relations relationListFlag
+	}{}
+	flags := env.newFlagSet("apply", "", "Keep one image per group and apply an action to the others.\nNothing is changed unless -dry-run=false is given.")
+	flags.StringVar(&cmd.Groups, "groups", "similar_groups.json", "read groups filename(json)")
+	flags.StringVar(&cmd.Action, "action", "list", "action to the duplicates: list, move, delete, hardlink or symlink")
+	flags.StringVar(&cmd.Keep, "keep", "first", "image to keep: first, largest, smallest, newest, oldest, shortest-path, resolution or quality(score of group -quality, measured if missing)")
+	flags.StringVar(&cmd.MoveTo, "to", "", "destination dir of move action")
+	flags.BoolVar(&cmd.IsDryRun, "dry-run", true, "only print the actions")
+	flags.Var(&cmd.Relations, "relations", "apply only to members with these relations to the kept image, comma separated (e.g. identical-bytes,identical-pixels,re-encoded,resized; default all)")
+	if err := env.parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return env.usageError(flags, "apply: unexpected arguments: %v", flags.Args())
+	}
+
+	isBetter, ok := keepPolicies[cmd.Keep]
+	if !ok {
+		return env.usageError(flags, "apply: invalid keep: %s", cmd.Keep)
+	}
+	switch cmd.Action {
+	case "list", "delete", "hardlink", "symlink":
+	case "move":
+		if len(cmd.MoveTo) == 0 {
+			return env.usageError(flags, "apply: -to is required for move action")
+		}
+	default:
+		return env.usageError(flags, "apply: invalid action: %s", cmd.Action)
+	}
+
+	membersList, err := readSimilarGroups(cmd.Groups)
+	if err != nil {
+		return err
+	}
+
+	applier := &duplicateApplier{
+		Action:   cmd.Action,
+		MoveTo:   cmd.MoveTo,
+		IsDryRun: cmd.IsDryRun || cmd.Action == "list",
+	}
+	prefix := ""
+	if applier.IsDryRun && cmd.Action != "list" {
+		prefix = "(dry-run) "
+	}
+
+	appliedCount := 0
+	skippedCount := 0
+	var errs []error
+	for _, stats := range statSimilarGroups(membersList) {
+		if cmd.Keep == "quality" {
+			scoreMissingQualities(stats)
+		}
+		keepIndex := selectKeepMember(stats, isBetter)
+		if keepIndex < 0 {
+			skippedCount += len(stats)
+			continue
+		}
+		fmt.Fprintf(env.Stdout, "keep: %s\n", stats[keepIndex].Filepath)
+
+		for i, stat := range stats {
+			if i == keepIndex {
+				continue
+			}
+			if !stat.IsExist {
+				// NOTE: zip内の画像などは操作できない
+				fmt.Fprintf(env.Stdout, "skip: %s\n", stat.Filepath)
+				skippedCount++
+				continue
+			}
+			if relation := relationToKeep(stats[keepIndex], stat); !cmd.Relations.Contains(relation) {
+				// NOTE: 関係が分からない要素（paths形式のグループ）も操作しない
+				fmt.Fprintf(env.Stdout, "skip (relation %q): %s\n", relation, stat.Filepath)
+				skippedCount++
+				continue
+			}
+
+			message, err := applier.Apply(stats[keepIndex], stat)
+			if err != nil {
+				// NOTE: 1つ失敗しても残りは続ける
+				errs = append(errs, err)
+				skippedCount++
+				continue
+			}
+			fmt.Fprintf(env.Stdout, "%s%s\n", prefix, message)
+			appliedCount++
+		}
+	}
+	fmt.Fprintf(env.Stdout, "Applied: %v (%v skipped)\n", appliedCount, skippedCount)
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/akinobufujii/similar_images_grouping/readimageutil"
+	"github.com/corona10/goimagehash"
+	"golang.org/x/sync/errgroup"
+)
+
+// 組のラベル
+const (
+	pairLabelSame      = "same"
+	pairLabelDifferent = "different"
+)
+
+// calibratePair ラベル付きの画像の組
+type calibratePair struct {
+	PathA  string
+	PathB  string
+	IsSame bool
+}
+
+// parsePairLabel 組のラベルを解釈する（same/different, 1/0, true/false, yes/no）
+func parsePairLabel(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case pairLabelSame, "1", "true", "yes":
+		return true, nil
+	case pairLabelDifferent, "0", "false", "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid label: %s (%s or %s)", value, pairLabelSame, pairLabelDifferent)
+}
+
+// readCalibratePairs ラベル付きの組のcsv（path_a,path_b,label）を読み込む
+// NOTE: 1行目のラベルが解釈できなければ見出しとみなす。相対パスはcsvのあるディレクトリからのパスとみなす
+func readCalibratePairs(path string) ([]calibratePair, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed os.ReadFile: %s %w", path, err)
+	}
+	csvReader := csv.NewReader(bytes.NewReader(data))
+	csvReader.FieldsPerRecord = 3
+	csvReader.TrimLeadingSpace = true
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed csv.ReadAll: %s %w", path, err)
+	}
+
+	resolve := func(pairPath string) string {
+		if filepath.IsAbs(pairPath) {
+			return pairPath
+		}
+		return filepath.Join(filepath.Dir(path), pairPath)
+	}
+
+	pairs := []calibratePair{}
+	for i, record := range records {
+		isSame, err := parsePairLabel(record[2])
+		if err != nil {
+			if i == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("failed parsePairLabel: %s:%d %w", path, i+1, err)
+		}
+		pairs = append(pairs, calibratePair{PathA: resolve(record[0]), PathB: resolve(record[1]), IsSame: isSame})
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no pairs: %s", path)
+	}
+	return pairs, nil
+}
+
+// hashListFlag カンマ区切りのハッシュの計算方法のリストを受け取るフラグ
+type hashListFlag []string
+
+func (list *hashListFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *hashListFlag) Set(value string) error {
+	*list = nil
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+		algorithm := hashAlgorithmFlag("")
+		if err := algorithm.Set(field); err != nil {
+			return err
+		}
+		*list = append(*list, field)
+	}
+	return nil
+}
+
+// sampleSizeListFlag カンマ区切りのハッシュの一辺の大きさのリストを受け取るフラグ
+// NOTE: samplewとsamplehを同じ大きさにする（phashは画素数が2のべき乗でなければならない）
+type sampleSizeListFlag []int
+
+func (sizes *sampleSizeListFlag) String() string {
+	values := make([]string, 0, len(*sizes))
+	for _, size := range *sizes {
+		values = append(values, strconv.Itoa(size))
+	}
+	return strings.Join(values, ",")
+}
+
+func (sizes *sampleSizeListFlag) Set(value string) error {
+	*sizes = nil
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+		size, err := strconv.Atoi(field)
+		if err != nil || size < 8 || size > 64 || size&(size-1) != 0 {
+			return fmt.Errorf("invalid sample size: %s (8, 16, 32 or 64)", field)
+		}
+		*sizes = append(*sizes, size)
+	}
+	return nil
+}
+
+// calibrateConfig 比較するハッシュの設定
+type calibrateConfig struct {
+	Hash       string
+	SampleSize int
+}
+
+// Bits ハッシュのビット数（しきい値の上限）
+func (config calibrateConfig) Bits() int {
+	return config.SampleSize * config.SampleSize
+}
+
+// Flags この設定で走査・グループ化するときのフラグ
+func (config calibrateConfig) Flags(threshold int) string {
+	return fmt.Sprintf("-hash=%s -samplew=%d -sampleh=%d -threshold=%d", config.Hash, config.SampleSize, config.SampleSize, threshold)
+}
+
+// calibratePoint しきい値ごとの判定の集計
+// NOTE: 距離がしきい値以下の組を似ていると判定する（groupやrunと同じ）
+type calibratePoint struct {
+	Threshold      int
+	TruePositives  int
+	FalsePositives int
+	FalseNegatives int
+	TrueNegatives  int
+	Precision      float64
+	Recall         float64
+	F1             float64
+	// NOTE: ROCの横軸（縦軸はRecall）
+	FalsePositiveRate float64
+}
+
+// calibrateResult ハッシュの設定ごとの集計
+type calibrateResult struct {
+	Hash       string
+	SampleSize int
+	// NOTE: ROC曲線の下の面積（1なら全てのしきい値の中に完全に見分けられるものがある）
+	AUC float64
+	// NOTE: F1が一番高いしきい値（同じなら小さいほう）
+	Best   calibratePoint
+	Points []calibratePoint
+}
+
+// calibrateReport calibrateサブコマンドの結果
+type calibrateReport struct {
+	Pairs         int
+	SamePairs     int
+	SkippedPairs  int
+	Results       []calibrateResult
+	Recommended   calibrateConfig
+	RecommendedF1 float64
+	// NOTE: 推奨する設定で走査・グループ化するときのフラグ
+	RecommendedFlags string
+}
+
+// ratio 0除算なら0にする割合
+func ratio(numerator, denominator int) float64 {
+	if denominator == 0 {
+		return 0
+	}
+	return float64(numerator) / float64(denominator)
+}
+
+// evaluateThresholds 組の距離（-1は計算できなかった組）からしきい値ごとの判定とROCを集計する
+func evaluateThresholds(config calibrateConfig, pairs []calibratePair, distances []int) calibrateResult {
+	result := calibrateResult{Hash: config.Hash, SampleSize: config.SampleSize}
+	positives, negatives := 0, 0
+	for i, pair := range pairs {
+		if distances[i] < 0 {
+			continue
+		}
+		if pair.IsSame {
+			positives++
+		} else {
+			negatives++
+		}
+	}
+
+	previousRate, previousRecall := 0.0, 0.0
+	for threshold := 0; threshold <= config.Bits(); threshold++ {
+		point := calibratePoint{Threshold: threshold}
+		for i, pair := range pairs {
+			if distances[i] < 0 {
+				continue
+			}
+			isMatched := distances[i] <= threshold
+			switch {
+			case pair.IsSame && isMatched:
+				point.TruePositives++
+			case pair.IsSame:
+				point.FalseNegatives++
+			case isMatched:
+				point.FalsePositives++
+			default:
+				point.TrueNegatives++
+			}
+		}
+		point.Precision = ratio(point.TruePositives, point.TruePositives+point.FalsePositives)
+		point.Recall = ratio(point.TruePositives, positives)
+		point.FalsePositiveRate = ratio(point.FalsePositives, negatives)
+		if point.Precision+point.Recall > 0 {
+			point.F1 = 2 * point.Precision * point.Recall / (point.Precision + point.Recall)
+		}
+
+		// NOTE: しきい値を上げるほど右上に進むので台形で面積を足していく
+		result.AUC += (point.FalsePositiveRate - previousRate) * (point.Recall + previousRecall) / 2
+		previousRate, previousRecall = point.FalsePositiveRate, point.Recall
+
+		if point.F1 > result.Best.F1 || threshold == 0 {
+			result.Best = point
+		}
+		result.Points = append(result.Points, point)
+	}
+	return result
+}
+
+// calcCalibrateDistances 全ての組の距離を設定ごとに計算する（距離-1は読み込めなかった組）
+// NOTE: 画像は1回だけデコードして全ての設定のハッシュを計算する
+func calcCalibrateDistances(pairs []calibratePair, configs []calibrateConfig, parallels int) ([][]int, int, error) {
+	paths := []string{}
+	for _, pair := range pairs {
+		paths = append(paths, pair.PathA, pair.PathB)
+	}
+	slices.Sort(paths)
+	paths = slices.Compact(paths)
+
+	hashes := make([][]*goimagehash.ExtImageHash, len(paths))
+	eg := errgroup.Group{}
+	eg.SetLimit(max(1, parallels))
+	for i, path := range paths {
+		eg.Go(func() error {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				slog.Warn("skipped calibrate image", "path", path, "error", err)
+				return nil
+			}
+			imageData, _, err := readimageutil.DecodeImage(bytes.NewReader(data))
+			if err != nil {
+				slog.Warn("skipped calibrate image", "path", path, "error", err)
+				return nil
+			}
+			pathHashes := make([]*goimagehash.ExtImageHash, len(configs))
+			for j, config := range configs {
+				info, err := calcImageHash(imageData, path, hashAlgorithmFlag(config.Hash), config.SampleSize, config.SampleSize)
+				if err != nil {
+					return err
+				}
+				pathHashes[j] = info.ImageHash
+			}
+			hashes[i] = pathHashes
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, 0, err
+	}
+
+	index := func(path string) int {
+		i, _ := slices.BinarySearch(paths, path)
+		return i
+	}
+	distancesList := make([][]int, len(configs))
+	for j := range configs {
+		distancesList[j] = make([]int, len(pairs))
+	}
+	skipped := 0
+	for i, pair := range pairs {
+		hashesA, hashesB := hashes[index(pair.PathA)], hashes[index(pair.PathB)]
+		for j := range configs {
+			distancesList[j][i] = -1
+			if hashesA == nil || hashesB == nil {
+				continue
+			}
+			distance, err := hashesA[j].Distance(hashesB[j])
+			if err != nil {
+				return nil, 0, fmt.Errorf("failed Distance: %s %s %w", pair.PathA, pair.PathB, err)
+			}
+			distancesList[j][i] = distance
+		}
+		if hashesA == nil || hashesB == nil {
+			skipped++
+		}
+	}
+	return distancesList, skipped, nil
+}
+
+// calibrate ラベル付きの組から設定ごとにしきい値を評価し、F1が一番高い設定を推奨する
+// NOTE: F1が同じならAUCが高いほう、それも同じなら先に指定した設定を推奨する
+func calibrate(pairs []calibratePair, configs []calibrateConfig, parallels int) (*calibrateReport, error) {
+	distancesList, skipped, err := calcCalibrateDistances(pairs, configs, parallels)
+	if err != nil {
+		return nil, err
+	}
+	if skipped == len(pairs) {
+		return nil, errors.New("no readable pairs")
+	}
+
+	report := &calibrateReport{Pairs: len(pairs) - skipped, SkippedPairs: skipped}
+	for i, pair := range pairs {
+		if pair.IsSame && distancesList[0][i] >= 0 {
+			report.SamePairs++
+		}
+	}
+	for j, config := range configs {
+		result := evaluateThresholds(config, pairs, distancesList[j])
+		report.Results = append(report.Results, result)
+	}
+
+	best := report.Results[0]
+	for _, candidate := range report.Results[1:] {
+		if candidate.Best.F1 > best.Best.F1 || (candidate.Best.F1 == best.Best.F1 && candidate.AUC > best.AUC) {
+			best = candidate
+		}
+	}
+	report.Recommended = calibrateConfig{Hash: best.Hash, SampleSize: best.SampleSize}
+	report.RecommendedF1 = best.Best.F1
+	report.RecommendedFlags = report.Recommended.Flags(best.Best.Threshold)
+	return report, nil
+}
+
+// writeCalibrateText 設定ごとに判定が変わるしきい値の表と推奨する設定を書き出す
+func writeCalibrateText(writer io.Writer, report *calibrateReport) error {
+	text := &strings.Builder{}
+	fmt.Fprintf(text, "pairs: %d (same %d, different %d, skipped %d)\n", report.Pairs, report.SamePairs, report.Pairs-report.SamePairs, report.SkippedPairs)
+	for _, result := range report.Results {
+		fmt.Fprintf(text, "\n%s %dx%d (AUC %.3f)\n", result.Hash, result.SampleSize, result.SampleSize, result.AUC)
+		fmt.Fprintf(text, "%9s %5s %5s %5s %5s %9s %6s %6s %6s\n", "threshold", "tp", "fp", "fn", "tn", "precision", "recall", "f1", "fpr")
+		for i, point := range result.Points {
+			// NOTE: 判定が変わらないしきい値は省く（全部一致した後も省く）
+			if i > 0 && point.TruePositives == result.Points[i-1].TruePositives && point.FalsePositives == result.Points[i-1].FalsePositives {
+				continue
+			}
+			fmt.Fprintf(text, "%9d %5d %5d %5d %5d %9.3f %6.3f %6.3f %6.3f\n", point.Threshold, point.TruePositives, point.FalsePositives, point.FalseNegatives, point.TrueNegatives, point.Precision, point.Recall, point.F1, point.FalsePositiveRate)
+		}
+		fmt.Fprintf(text, "best: threshold %d (precision %.3f, recall %.3f, f1 %.3f)\n", result.Best.Threshold, result.Best.Precision, result.Best.Recall, result.Best.F1)
+	}
+	fmt.Fprintf(text, "\nrecommended: %s (f1 %.3f)\n", report.RecommendedFlags, report.RecommendedF1)
+
+	if _, err := io.WriteString(writer, text.String()); err != nil {
+		return fmt.Errorf("failed io.WriteString: %w", err)
+	}
+	return nil
+}
+
+// runCalibrate calibrateサブコマンド
+func runCalibrate(args []string, env *cliEnv) error {
+	cmd := struct {
+		Pairs        string
+		Synthetic    int
+		SyntheticDir string
+		Hashes       hashListFlag
+		SampleSizes  sampleSizeListFlag
+		Format       string
+		Output       string
+		Parallels    int
+	}{
+		Hashes:      hashListFlag{"phash", "ahash", "dhash"},
+		SampleSizes: sampleSizeListFlag{8, 16},
+	}
+	flags := env.newFlagSet("calibrate", "", "Measure precision, recall and ROC of each hash and sample size over labelled image pairs, and recommend a threshold.")
+	flags.StringVar(&cmd.Pairs, "pairs", "", "labelled pairs filename(csv: path_a,path_b,label where label is same or different)")
+	flags.IntVar(&cmd.Synthetic, "synthetic", 0, "generate this many synthetic scenes with resized, recompressed, cropped and rotated copies instead of -pairs")
+	flags.StringVar(&cmd.SyntheticDir, "synthetic-dir", "", "keep the synthetic images and pairs.csv in this dir (empty is a temporary dir)")
+	flags.Var(&cmd.Hashes, "hashes", "hash algorithms to compare (comma separated: phash, ahash, dhash)")
+	flags.Var(&cmd.SampleSizes, "sample-sizes", "hash sizes to compare (comma separated, used as both samplew and sampleh)")
+	flags.StringVar(&cmd.Format, "format", "text", "output format: text or json(with every threshold)")
+	flags.StringVar(&cmd.Output, "o", "", "output filename (empty is stdout)")
+	flags.IntVar(&cmd.Parallels, "j", runtime.NumCPU(), "parallel num")
+	if err := env.parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return env.usageError(flags, "calibrate: unexpected arguments: %v", flags.Args())
+	}
+	if (len(cmd.Pairs) == 0) == (cmd.Synthetic == 0) {
+		return env.usageError(flags, "calibrate: either -pairs or -synthetic is required")
+	}
+	if len(cmd.Hashes) == 0 || len(cmd.SampleSizes) == 0 {
+		return env.usageError(flags, "calibrate: -hashes and -sample-sizes must not be empty")
+	}
+
+	writeCalibrate := writeCalibrateText
+	switch cmd.Format {
+	case "text":
+	case "json":
+		writeCalibrate = func(writer io.Writer, report *calibrateReport) error {
+			return writeJsonTo(writer, report)
+		}
+	default:
+		return env.usageError(flags, "calibrate: invalid format: %s", cmd.Format)
+	}
+
+	pairsPath := cmd.Pairs
+	if cmd.Synthetic > 0 {
+		dir := cmd.SyntheticDir
+		if len(dir) == 0 {
+			tempDir, err := os.MkdirTemp("", "calibrate")
+			if err != nil {
+				return fmt.Errorf("failed os.MkdirTemp: %w", err)
+			}
+			defer os.RemoveAll(tempDir)
+			dir = tempDir
+		}
+		generated, err := generateSyntheticPairs(dir, cmd.Synthetic)
+		if err != nil {
+			return err
+		}
+		pairsPath = generated
+	}
+
+	pairs, err := readCalibratePairs(pairsPath)
+	if err != nil {
+		return err
+	}
+	configs := []calibrateConfig{}
+	for _, hash := range cmd.Hashes {
+		for _, size := range cmd.SampleSizes {
+			configs = append(configs, calibrateConfig{Hash: hash, SampleSize: size})
+		}
+	}
+	report, err := calibrate(pairs, configs, cmd.Parallels)
+	if err != nil {
+		return err
+	}
+
+	if len(cmd.Output) == 0 {
+		return writeCalibrate(env.Stdout, report)
+	}
+
+	file, err := os.Create(cmd.Output)
+	if err != nil {
+		return fmt.Errorf("failed os.Create: %s %w", cmd.Output, err)
+	}
+	defer file.Close()
+
+	return writeCalibrate(file, report)
+}
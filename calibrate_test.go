@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestEvaluateThresholds しきい値ごとの集計とAUC、F1が一番高いしきい値のテスト
+func TestEvaluateThresholds(t *testing.T) {
+	pairs := []calibratePair{{IsSame: true}, {IsSame: true}, {IsSame: false}, {IsSame: false}, {IsSame: true}}
+	distances := []int{1, 3, 2, 6, -1}
+	result := evaluateThresholds(calibrateConfig{Hash: "phash", SampleSize: 8}, pairs, distances)
+
+	if len(result.Points) != 65 {
+		t.Fatalf("unexpected points: %v", len(result.Points))
+	}
+	point := result.Points[2]
+	if point.TruePositives != 1 || point.FalsePositives != 1 || point.FalseNegatives != 1 || point.TrueNegatives != 1 {
+		t.Errorf("unexpected point: %+v", point)
+	}
+	if result.Best.Threshold != 3 || result.Best.Precision != 2.0/3 || result.Best.Recall != 1 {
+		t.Errorf("unexpected best: %+v", result.Best)
+	}
+	if result.AUC != 0.75 {
+		t.Errorf("unexpected auc: %v", result.AUC)
+	}
+}
+
+// TestCalibrate 合成データと読み込めない画像を含むcsvで推奨するしきい値を出せるかのテスト
+func TestCalibrate(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(t.TempDir(), "calibrate.json")
+	code, stdout, stderr := runTestCli(t, "calibrate", "-synthetic", "4", "-synthetic-dir", dir, "-hashes", "phash,dhash", "-sample-sizes", "8", "-format", "json", "-o", output)
+	if code != 0 {
+		t.Fatalf("unexpected exit code: %v %s %s", code, stdout, stderr)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := calibrateReport{}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	expectedPairs := 4 * len(syntheticTransforms) * 2
+	if report.Pairs != expectedPairs || report.SamePairs != expectedPairs/2 || len(report.Results) != 2 {
+		t.Errorf("unexpected report: %v %v %v", report.Pairs, report.SamePairs, len(report.Results))
+	}
+	if report.RecommendedF1 < 0.9 || report.Recommended.SampleSize != 8 {
+		t.Errorf("unexpected recommendation: %v %v", report.RecommendedFlags, report.RecommendedF1)
+	}
+
+	// NOTE: 見出しなし、相対パス、読み込めない画像を含むcsv
+	pairs := "scene000.png,scene000_jpeg50.jpg,1\nscene000.png,scene001.png,0\nscene000.png,missing.png,same\n"
+	pairsPath := filepath.Join(dir, "labelled.csv")
+	if err := os.WriteFile(pairsPath, []byte(pairs), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	code, stdout, stderr = runTestCli(t, "calibrate", "-pairs", pairsPath, "-hashes", "ahash", "-sample-sizes", "8", "-format", "json")
+	if code != 0 {
+		t.Fatalf("unexpected exit code: %v %s %s", code, stdout, stderr)
+	}
+	report = calibrateReport{}
+	if err := json.Unmarshal([]byte(stdout), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Pairs != 2 || report.SkippedPairs != 1 || report.RecommendedF1 != 1 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	if code, _, _ := runTestCli(t, "calibrate", "-pairs", pairsPath, "-synthetic", "2"); code == 0 {
+		t.Error("expected usage error")
+	}
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/bradhe/stopwatch"
+)
+
+// cliName 使い方に表示するコマンド名
+const cliName = "similar_images_grouping"
+
+// errCliUsage 引数の誤り（使い方は表示済み）
+var errCliUsage = errors.New("invalid usage")
+
+// errFlagProbe フラグセットの取り出しのために中断した
+var errFlagProbe = errors.New("flag probe")
+
+// cliEnv サブコマンドの入出力先
+type cliEnv struct {
+	Stdin     io.Reader
+	Stdout    io.Writer
+	Stderr    io.Writer
+	LookupEnv func(string) (string, bool)
+
+	logs logFlags
+
+	// NOTE: -metrics-addrが指定されていればサブコマンドの実行中だけ公開する
+	metricsAddr   string
+	metricsServer *metricsServer
+
+	// NOTE: 設定されていればフラグの解析直前にフラグセットを渡して中断する
+	probeFlags func(*flag.FlagSet)
+}
+
+// subcommand サブコマンドの定義
+type subcommand struct {
+	Name    string
+	Summary string
+	Run     func(args []string, env *cliEnv) error
+}
+
+// subcommands サブコマンド一覧（使い方の表示順）
+// NOTE: 設定ファイルの検証でサブコマンドからこの一覧を参照するので、初期化の循環を避けてinitで設定する
+var subcommands []subcommand
+
+func init() {
+	subcommands = []subcommand{
+		{Name: "run", Summary: "scan and group in one shot (default when no command is given)", Run: runOneShot},
+		{Name: "scan", Summary: "compute image hashes and write them to a midfile", Run: runScan},
+		{Name: "group", Summary: "group similar images in a midfile", Run: runGroup},
+		{Name: "query", Summary: "search a midfile for images similar to the given images", Run: runQuery},
+		{Name: "report", Summary: "show size and dimensions of each grouped image", Run: runReport},
+		{Name: "stats", Summary: "show distance, bit balance and group size statistics of a midfile", Run: runStats},
+		{Name: "calibrate", Summary: "measure hash settings over labelled pairs and recommend a threshold", Run: runCalibrate},
+		{Name: "apply", Summary: "move, delete or link duplicates in the groups", Run: runApply},
+		{Name: "serve", Summary: "serve a midfile over HTTP", Run: runServe},
+		{Name: "coordinator", Summary: "collect hashes from workers and group them", Run: runCoordinator},
+		{Name: "worker", Summary: "compute hashes and upload them to a coordinator", Run: runWorker},
+		{Name: "watch", Summary: "watch a directory and report new duplicates", Run: runWatch},
+	}
+}
+
+// findSubcommand 名前からサブコマンドを探す
+func findSubcommand(name string) *subcommand {
+	for i := range subcommands {
+		if subcommands[i].Name == name {
+			return &subcommands[i]
+		}
+	}
+	return nil
+}
+
+// printCliUsage コマンド全体の使い方を表示する
+func printCliUsage(writer io.Writer) {
+	fmt.Fprintf(writer, "Usage: %s <command> [flags]\n\nCommands:\n", cliName)
+	for _, command := range subcommands {
+		fmt.Fprintf(writer, "  %-12s %s\n", command.Name, command.Summary)
+	}
+	fmt.Fprintf(writer, "\nRun '%s help <command>' for the flags of each command.\n", cliName)
+}
+
+// runCli サブコマンドを実行して終了コードを返す
+// NOTE: コマンド名が省略された場合は従来通りrunとして扱う
+func runCli(args []string, env *cliEnv) int {
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name = args[0]
+		args = args[1:]
+	}
+
+	if name == "help" {
+		if len(args) == 0 {
+			printCliUsage(env.Stdout)
+			return 0
+		}
+		// NOTE: サブコマンドの使い方は-hと同じものを表示する
+		name = args[0]
+		args = []string{"-h"}
+	}
+
+	command := findSubcommand(name)
+	if command == nil {
+		fmt.Fprintf(env.Stderr, "unknown command: %s\n\n", name)
+		printCliUsage(env.Stderr)
+		return 2
+	}
+
+	err := command.Run(args, env)
+	env.metricsServer.Close()
+	if err != nil {
+		switch {
+		case errors.Is(err, flag.ErrHelp):
+			return 0
+		case errors.Is(err, errCliUsage):
+			return 2
+		}
+		fmt.Fprintln(env.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// newFlagSet サブコマンドのフラグセットを作成する
+func (env *cliEnv) newFlagSet(name, arguments, description string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(env.Stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags]%s\n\n%s\n\nFlags:\n", cliName, name, arguments, description)
+		flags.PrintDefaults()
+	}
+	registerConfigFlags(flags)
+	registerLogFlags(flags, &env.logs)
+	registerMetricsFlag(flags, &env.metricsAddr)
+	return flags
+}
+
+// parseFlags フラグを解析し、明示されなかったフラグには環境変数・設定ファイルの値を設定する
+// NOTE: -hの場合は使い方を標準出力に表示する
+func (env *cliEnv) parseFlags(flags *flag.FlagSet, args []string) error {
+	if env.probeFlags != nil {
+		env.probeFlags(flags)
+		return errFlagProbe
+	}
+
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "-h" || arg == "-help" || arg == "--help" {
+			flags.SetOutput(env.Stdout)
+			flags.Usage()
+			return flag.ErrHelp
+		}
+	}
+
+	if err := flags.Parse(args); err != nil {
+		// NOTE: エラー内容と使い方はflag側で表示済み
+		return fmt.Errorf("%w: %w", errCliUsage, err)
+	}
+	if err := env.applyConfig(flags); err != nil {
+		return err
+	}
+
+	slog.SetDefault(env.logs.newLogger(env.Stderr))
+
+	if len(env.metricsAddr) != 0 && env.metricsServer == nil {
+		server, err := startMetricsServer(env.metricsAddr, metrics)
+		if err != nil {
+			return err
+		}
+		env.metricsServer = server
+		slog.Info("serving metrics", "addr", server.Addr())
+	}
+	return nil
+}
+
+// usageError 引数の誤りを使い方と共に表示する
+func (env *cliEnv) usageError(flags *flag.FlagSet, format string, args ...any) error {
+	fmt.Fprintf(env.Stderr, format+"\n", args...)
+	flags.Usage()
+	return errCliUsage
+}
+
+// scanFlags 画像を走査するサブコマンド共通のフラグ
+type scanFlags struct {
+	Roots         stringListFlag
+	FilesFrom     string
+	Parallels     int
+	IOWorkers     int
+	CPUWorkers    int
+	HashAlgorithm hashAlgorithmFlag
+	SampleWidth   int
+	SampleHeight  int
+	Filter        walkFilter
+	Links         linkFlags
+	Decode        decodeFlags
+	Crop          cropOptions
+	Progress      progressModeFlag
+	ErrorsOut     string
+}
+
+// registerScanFlags 走査関連のフラグを登録する
+func registerScanFlags(flags *flag.FlagSet, scan *scanFlags) {
+	flags.Var(&scan.Roots, "root", "search dir (repeatable)")
+	flags.StringVar(&scan.FilesFrom, "files-from", "", "read newline or NUL separated file list (- is stdin)")
+	flags.IntVar(&scan.Parallels, "j", runtime.NumCPU(), "parallel num")
+	registerWorkerFlags(flags, &scan.IOWorkers, &scan.CPUWorkers)
+	flags.Var(&scan.HashAlgorithm, "hash", "hash algorithm: phash, ahash or dhash")
+	flags.IntVar(&scan.SampleWidth, "samplew", 16, "hash width")
+	flags.IntVar(&scan.SampleHeight, "sampleh", 16, "hash height")
+	registerFilterFlags(flags, &scan.Filter)
+	registerLinkFlags(flags, &scan.Links)
+	registerDecodeFlags(flags, &scan.Decode)
+	registerCropFlags(flags, &scan.Crop)
+	registerProgressFlag(flags, &scan.Progress)
+	flags.StringVar(&scan.ErrorsOut, "errors-out", "", "write skipped or failed files with the reason (json lines)")
+}
+
+// registerWorkerFlags 読み込みとハッシュ計算のgoroutineの数のフラグを登録する
+func registerWorkerFlags(flags *flag.FlagSet, ioWorkers, cpuWorkers *int) {
+	flags.IntVar(ioWorkers, "io-workers", 0, "parallel num of file reads (0 is -j, raise it for network shares)")
+	flags.IntVar(cpuWorkers, "cpu-workers", 0, "parallel num of decodes and hashes (0 is -j)")
+}
+
+// Options フラグの内容から走査設定を作成する
+func (scan *scanFlags) Options() *scanOptions {
+	options := &scanOptions{
+		HashAlgorithm: scan.HashAlgorithm,
+		SampleWidth:   scan.SampleWidth,
+		SampleHeight:  scan.SampleHeight,
+		Parallels:     scan.Parallels,
+		IOWorkers:     scan.IOWorkers,
+		CPUWorkers:    scan.CPUWorkers,
+		Filter:        &scan.Filter,
+		Issues:        &scanIssueLog{},
+		Crop:          scan.Crop,
+	}
+	scan.Links.Apply(options)
+	scan.Decode.Apply(options)
+	return options
+}
+
+// WriteIssues 読み込めなかったファイルの数を表示し、指定があれば書き出す
+func (scan *scanFlags) WriteIssues(env *cliEnv, options *scanOptions) error {
+	fmt.Fprintf(env.Stdout, "Errors: %v\n", options.Issues.String())
+	if len(scan.ErrorsOut) == 0 {
+		return nil
+	}
+	return options.Issues.WriteJsonLines(scan.ErrorsOut)
+}
+
+// Sources フラグの内容から走査元を作成する
+// NOTE: 走査元の指定がなければカレントディレクトリを走査する
+func (scan *scanFlags) Sources(env *cliEnv) (*scanSources, io.Closer, error) {
+	sources := newRootSources(scan.Roots...)
+	if len(scan.FilesFrom) == 0 {
+		if len(sources.Roots) == 0 {
+			sources = newRootSources("")
+		}
+		return sources, io.NopCloser(nil), nil
+	}
+
+	fileList, err := openFileList(scan.FilesFrom, env.Stdin)
+	if err != nil {
+		return nil, nil, err
+	}
+	sources.FileList = fileList
+	sources.FileListName = scan.FilesFrom
+	return sources, fileList, nil
+}
+
+// Scan 走査元から画像のハッシュを計算する
+// NOTE: 進捗はoptionsに残るので続くグルーピングでも使える
+func (scan *scanFlags) Scan(env *cliEnv, options *scanOptions) (*ParallelCompList, bool, error) {
+	sources, closer, err := scan.Sources(env)
+	if err != nil {
+		return nil, false, err
+	}
+	defer closer.Close()
+
+	if options.Progress == nil {
+		options.Progress = newProgressTracker(env.Stderr, scan.Progress)
+	}
+	options.Progress.StartPhase(progressPhaseScan)
+	container := &ParallelCompList{}
+	err = createParallelCompList(context.Background(), container, sources, options)
+	options.Progress.EndPhase()
+	if err != nil {
+		return nil, false, err
+	}
+	fmt.Fprintf(env.Stdout, "Filtered: %v\n", options.Filter.Stats.String())
+	fmt.Fprintf(env.Stdout, "HardLinks: %v\n", options.HardLinks.Count())
+	if err := scan.WriteIssues(env, options); err != nil {
+		return nil, false, err
+	}
+
+	return container, sources.IsMultiple(), nil
+}
+
+// openFileList ファイルリストを開く（-なら標準入力）
+func openFileList(path string, stdin io.Reader) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(stdin), nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed os.Open: %s %w", path, err)
+	}
+	return file, nil
+}
+
+// runScan scanサブコマンド
+func runScan(args []string, env *cliEnv) error {
+	cmd := struct {
+		Output string
+	}{}
+	scan := &scanFlags{}
+	flags := env.newFlagSet("scan", "", "Compute image hashes of the search dirs and write them to a midfile.")
+	flags.StringVar(&cmd.Output, "o", "midfile.json", "output intermediate filename(json)")
+	registerScanFlags(flags, scan)
+	if err := env.parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return env.usageError(flags, "scan: unexpected arguments: %v", flags.Args())
+	}
+
+	watch := stopwatch.Start()
+
+	container, _, err := scan.Scan(env, scan.Options())
+	if err != nil {
+		return err
+	}
+
+	watch.Stop()
+	fmt.Fprintf(env.Stdout, "ReadFiles: %v (%v images)\n", watch.String(), len(*container))
+
+	// NOTE: 空でも後続のgroupなどが読めるように書き出す
+	return container.Serialize(cmd.Output)
+}
+
+// runGroup groupサブコマンド
+func runGroup(args []string, env *cliEnv) error {
+	cmd := struct {
+		Midfile       string
+		Output        string
+		GroupFormat   string
+		Threshold     int
+		Parallels     int
+		VerifyInliers int
+		Color         colorOptions
+		Lsh           lshOptions
+		IsQuality     bool
+		Progress      progressModeFlag
+	}{}
+	flags := env.newFlagSet("group", "", "Group similar images in a midfile written by scan.")
+	flags.StringVar(&cmd.Midfile, "midfile", "midfile.json", "read intermediate filename(json)")
+	flags.StringVar(&cmd.Output, "o", "similar_groups.json", "output filename(json)")
+	flags.StringVar(&cmd.GroupFormat, "group-format", groupFormatAuto, "output group format: paths, members(path and root) or auto(members if multiple roots or crop, inliers, color or quality details)")
+	flags.IntVar(&cmd.Threshold, "threshold", 10, "pHash threshold")
+	flags.IntVar(&cmd.Parallels, "j", runtime.NumCPU(), "parallel num of comparisons")
+	registerVerifyInliersFlag(flags, &cmd.VerifyInliers)
+	registerColorFlags(flags, &cmd.Color)
+	registerLshFlags(flags, &cmd.Lsh)
+	registerQualityFlag(flags, &cmd.IsQuality)
+	registerProgressFlag(flags, &cmd.Progress)
+	if err := env.parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return env.usageError(flags, "group: unexpected arguments: %v", flags.Args())
+	}
+	if err := cmd.Color.Validate(); err != nil {
+		return env.usageError(flags, "group: %v", err)
+	}
+	if err := cmd.Lsh.Validate(); err != nil {
+		return env.usageError(flags, "group: %v", err)
+	}
+
+	container := &ParallelCompList{}
+	if err := container.Deserialize(cmd.Midfile); err != nil {
+		return err
+	}
+
+	watch := stopwatch.Start()
+
+	// NOTE: グルーピングでcontainerは空になるので走査元などを先に控えておく
+	infos := container.InfoMap()
+	verifier := newKeypointVerifier(cmd.VerifyInliers)
+	approximate := newApproximateSearch(cmd.Lsh)
+	grouping := &groupingOptions{Threshold: cmd.Threshold, Parallels: cmd.Parallels, Verifier: verifier, Color: cmd.Color, Approximate: approximate}
+	similarGroupsList, err := groupingSimilarImages(container, grouping, newProgressTracker(env.Stderr, cmd.Progress))
+	if err != nil {
+		return err
+	}
+
+	if cmd.IsQuality {
+		scoreSimilarGroups(similarGroupsList, infos, cmd.Parallels)
+	}
+
+	watch.Stop()
+	fmt.Fprintf(env.Stdout, "GroupingFiles: %v (%v groups)\n", watch.String(), len(similarGroupsList))
+	fmt.Fprintf(env.Stdout, "KeypointVerify: %v\n", verifier.String())
+	fmt.Fprintf(env.Stdout, "Approximate: %v\n", approximate.String())
+
+	outputData, err := similarGroupsOutput(similarGroupsList, infos, cmd.GroupFormat)
+	if err != nil {
+		return err
+	}
+	return writeJson(cmd.Output, outputData)
+}
+
+// runQuery queryサブコマンド
+func runQuery(args []string, env *cliEnv) error {
+	cmd := struct {
+		Midfile       string
+		Output        string
+		Threshold     int
+		MaxMatches    int
+		HashAlgorithm hashAlgorithmFlag
+		SampleWidth   int
+		SampleHeight  int
+		Crop          cropOptions
+	}{}
+	flags := env.newFlagSet("query", " <image or dir>...", "Search a midfile for images similar to the given images.\nThe results are written as json (stdout by default).")
+	flags.StringVar(&cmd.Midfile, "midfile", "midfile.json", "read intermediate filename(json)")
+	flags.StringVar(&cmd.Output, "o", "", "output filename(json, empty is stdout)")
+	flags.IntVar(&cmd.Threshold, "threshold", 10, "pHash threshold")
+	flags.IntVar(&cmd.MaxMatches, "max-matches", 5, "max matches per image (0 is unlimited)")
+	// NOTE: 中間ファイルと同じサイズで計算しないと比較できない
+	flags.Var(&cmd.HashAlgorithm, "hash", "hash algorithm (same as the midfile): phash, ahash or dhash")
+	flags.IntVar(&cmd.SampleWidth, "samplew", 16, "hash width (same as the midfile)")
+	flags.IntVar(&cmd.SampleHeight, "sampleh", 16, "hash height (same as the midfile)")
+	registerCropFlags(flags, &cmd.Crop)
+	if err := env.parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return env.usageError(flags, "query: no images given")
+	}
+
+	indexed := &ParallelCompList{}
+	if err := indexed.Deserialize(cmd.Midfile); err != nil {
+		return err
+	}
+
+	queries := &ParallelCompList{}
+	options := &scanOptions{
+		HashAlgorithm: cmd.HashAlgorithm,
+		SampleWidth:   cmd.SampleWidth,
+		SampleHeight:  cmd.SampleHeight,
+		Parallels:     runtime.NumCPU(),
+		Crop:          cmd.Crop,
+	}
+	if err := createParallelCompList(context.Background(), queries, newRootSources(flags.Args()...), options); err != nil {
+		return err
+	}
+
+	result, err := crossCompare(queries, indexed, cmd.Threshold, cmd.MaxMatches)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: 似ている画像がなかったものも空の結果として出力する
+	matches := result.Matches
+	for _, path := range result.OnlyA {
+		matches = append(matches, CrossMatch{Filepath: path, Matches: []SimilarImage{}})
+	}
+
+	if len(cmd.Output) == 0 {
+		return writeJsonTo(env.Stdout, matches)
+	}
+	return writeJson(cmd.Output, matches)
+}
+
+// runOneShot runサブコマンド（走査からグルーピングまでを一度に行う）
+func runOneShot(args []string, env *cliEnv) error {
+	cmd := struct {
+		GroupFormat               string
+		RootA                     string
+		RootB                     string
+		ReadIntermediateFilenameA string
+		ReadIntermediateFilenameB string
+		WriteIntermediateFilename string
+		ReadIntermediateFilename  string
+		Output                    string
+		Threshold                 int
+		MaxMatches                int
+		VerifyInliers             int
+		Color                     colorOptions
+		Lsh                       lshOptions
+		IsQuality                 bool
+	}{}
+	scan := &scanFlags{}
+	flags := env.newFlagSet("run", "", "Scan the search dirs and group similar images in one shot.\nWith -root-a/-root-b (or their midfiles) compare two sets instead.")
+	registerScanFlags(flags, scan)
+	flags.StringVar(&cmd.WriteIntermediateFilename, "write-midfile", "midfile.json", "write intermediate filename(json, empty is disabled)")
+	flags.StringVar(&cmd.ReadIntermediateFilename, "read-midfile", "", "read intermediate filename(json)")
+	flags.StringVar(&cmd.Output, "o", "similar_groups.json", "output filename(json)")
+	flags.StringVar(&cmd.GroupFormat, "group-format", groupFormatAuto, "output group format: paths, members(path and root) or auto(members if multiple sources or crop, inliers, color or quality details)")
+	flags.StringVar(&cmd.RootA, "root-a", "", "search dir of set A (cross-set comparison)")
+	flags.StringVar(&cmd.RootB, "root-b", "", "search dir of set B (cross-set comparison)")
+	flags.StringVar(&cmd.ReadIntermediateFilenameA, "read-midfile-a", "", "read intermediate filename(json) of set A (cross-set comparison)")
+	flags.StringVar(&cmd.ReadIntermediateFilenameB, "read-midfile-b", "", "read intermediate filename(json) of set B (cross-set comparison)")
+	flags.IntVar(&cmd.Threshold, "threshold", 10, "pHash threshold")
+	flags.IntVar(&cmd.MaxMatches, "max-matches", 5, "max matches of set B per set A image (cross-set comparison, 0 is unlimited)")
+	registerVerifyInliersFlag(flags, &cmd.VerifyInliers)
+	registerColorFlags(flags, &cmd.Color)
+	registerLshFlags(flags, &cmd.Lsh)
+	registerQualityFlag(flags, &cmd.IsQuality)
+	if err := env.parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return env.usageError(flags, "run: unexpected arguments: %v", flags.Args())
+	}
+	if err := cmd.Color.Validate(); err != nil {
+		return env.usageError(flags, "run: %v", err)
+	}
+	if err := cmd.Lsh.Validate(); err != nil {
+		return env.usageError(flags, "run: %v", err)
+	}
+
+	// NOTE: セットA・セットBはそれぞれ走査先か中間ファイルのどちらか1つを指定する（片方だけでは比較しない）
+	sets := []struct {
+		name, rootFlag, midfileFlag string
+		root, midfile               string
+	}{
+		{"A", "root-a", "read-midfile-a", cmd.RootA, cmd.ReadIntermediateFilenameA},
+		{"B", "root-b", "read-midfile-b", cmd.RootB, cmd.ReadIntermediateFilenameB},
+	}
+	isCrossCompare := false
+	for _, set := range sets {
+		isCrossCompare = isCrossCompare || len(set.root) != 0 || len(set.midfile) != 0
+	}
+	for _, set := range sets {
+		if len(set.root) != 0 && len(set.midfile) != 0 {
+			return env.usageError(flags, "run: set %s needs only one of -%s and -%s", set.name, set.rootFlag, set.midfileFlag)
+		}
+		if isCrossCompare && len(set.root) == 0 && len(set.midfile) == 0 {
+			return env.usageError(flags, "run: set %s needs one of -%s and -%s for cross-set comparison", set.name, set.rootFlag, set.midfileFlag)
+		}
+	}
+
+	options := scan.Options()
+	options.Progress = newProgressTracker(env.Stderr, scan.Progress)
+
+	if isCrossCompare {
+		// NOTE: セットA・セットB間の比較のみ行う
+		err := runCrossCompare(env, cmd.RootA, cmd.ReadIntermediateFilenameA, cmd.RootB, cmd.ReadIntermediateFilenameB, cmd.Output,
+			options, cmd.Threshold, cmd.MaxMatches)
+		if err != nil {
+			return err
+		}
+		return scan.WriteIssues(env, options)
+	}
+
+	isWriteMidFile := len(cmd.WriteIntermediateFilename) != 0
+	isReadMidFile := len(cmd.ReadIntermediateFilename) != 0
+
+	watch := stopwatch.Start()
+
+	// NOTE: 要素をすべてコンテナに集約して比較する
+	container := &ParallelCompList{}
+	isMultipleSources := false
+	if isReadMidFile {
+		// NOTE: 中間ファイルがあるならそれをデシリアライズする
+		if err := container.Deserialize(cmd.ReadIntermediateFilename); err != nil {
+			return err
+		}
+	} else {
+		// NOTE: 並行して見つけた画像のハッシュを計算する
+		var err error
+		container, isMultipleSources, err = scan.Scan(env, options)
+		if err != nil {
+			return err
+		}
+
+		if isWriteMidFile && !container.IsEmpty() {
+			// NOTE: 復帰できるようにSerializeしてファイル保存する
+			if err := container.Serialize(cmd.WriteIntermediateFilename); err != nil {
+				return err
+			}
+		}
+	}
+
+	watch.Stop()
+	fmt.Fprintf(env.Stdout, "ReadFiles: %v\n", watch.String())
+
+	watch = stopwatch.Start()
+
+	// NOTE: グルーピングでcontainerは空になるので走査元などを先に控えておく
+	infos := container.InfoMap()
+	if isReadMidFile {
+		isMultipleSources = hasMultipleRoots(infos)
+	}
+
+	// NOTE: 似ている画像をグルーピングする（比較はハッシュ計算と同じ数で並行に行う）
+	_, cpuWorkers := options.Workers()
+	verifier := newKeypointVerifier(cmd.VerifyInliers)
+	approximate := newApproximateSearch(cmd.Lsh)
+	grouping := &groupingOptions{Threshold: cmd.Threshold, Parallels: cpuWorkers, Verifier: verifier, Color: cmd.Color, Approximate: approximate}
+	similarGroupsList, err := groupingSimilarImages(container, grouping, options.Progress)
+	if err != nil {
+		return err
+	}
+
+	if cmd.IsQuality {
+		scoreSimilarGroups(similarGroupsList, infos, cpuWorkers)
+	}
+
+	watch.Stop()
+	fmt.Fprintf(env.Stdout, "GroupingFiles: %v\n", watch.String())
+	fmt.Fprintf(env.Stdout, "KeypointVerify: %v\n", verifier.String())
+	fmt.Fprintf(env.Stdout, "Approximate: %v\n", approximate.String())
+
+	// NOTE: 走査元が複数ある場合や切り抜き・特徴点・色・画質の情報がある場合は要素ごとの情報も出力する
+	groupFormat := cmd.GroupFormat
+	if groupFormat == groupFormatAuto {
+		groupFormat = groupFormatPaths
+		if isMultipleSources || hasMatchDetails(infos) {
+			groupFormat = groupFormatMembers
+		}
+	}
+	outputData, err := similarGroupsOutput(similarGroupsList, infos, groupFormat)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: json書き出し
+	return writeJson(cmd.Output, outputData)
+}
+
+// loadParallelCompList 中間ファイルがあればデシリアライズし、なければrootから画像を探してParallelCompListを作成する
+// NOTE: ハードリンクはセットの中だけでまとめる（別のセットのハードリンクはそれぞれハッシュを計算する）
+func loadParallelCompList(ctx context.Context, root, midfile string, options *scanOptions) (*ParallelCompList, error) {
+	container := &ParallelCompList{}
+	if len(midfile) != 0 {
+		if err := container.Deserialize(midfile); err != nil {
+			return nil, err
+		}
+		return container, nil
+	}
+
+	setOptions := *options
+	if options.HardLinks != nil {
+		setOptions.HardLinks = newHardLinkTracker()
+	}
+	if err := createParallelCompList(ctx, container, newRootSources(root), &setOptions); err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
+// runCrossCompare セットA・セットB間の比較を行い結果を書き出す
+func runCrossCompare(env *cliEnv, rootA, midfileA, rootB, midfileB, output string, options *scanOptions, threshold, maxMatches int) error {
+	watch := stopwatch.Start()
+
+	setA, err := loadParallelCompList(context.Background(), rootA, midfileA, options)
+	if err != nil {
+		return fmt.Errorf("failed loadParallelCompList(A): %w", err)
+	}
+	setB, err := loadParallelCompList(context.Background(), rootB, midfileB, options)
+	if err != nil {
+		return fmt.Errorf("failed loadParallelCompList(B): %w", err)
+	}
+
+	watch.Stop()
+	fmt.Fprintf(env.Stdout, "ReadFiles: %v\n", watch.String())
+	fmt.Fprintf(env.Stdout, "Filtered: %v\n", options.Filter.Stats.String())
+
+	watch = stopwatch.Start()
+
+	result, err := crossCompare(setA, setB, threshold, maxMatches)
+	if err != nil {
+		return err
+	}
+
+	watch.Stop()
+	fmt.Fprintf(env.Stdout, "CrossCompareFiles: %v\n", watch.String())
+
+	return writeJson(output, result)
+}
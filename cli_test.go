@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// runTestCli メモリ上の入出力でCLIを実行する
+func runTestCli(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := runCli(args, &cliEnv{Stdin: strings.NewReader(""), Stdout: stdout, Stderr: stderr})
+	return code, stdout.String(), stderr.String()
+}
+
+// TestCliSubcommands scan→group→query→report→applyの流れをCLIの入口から確認する
+func TestCliSubcommands(t *testing.T) {
+	root := t.TempDir()
+	writeTestImages(t, root, map[string]int{"a.png": 0, filepath.Join("sub", "a-copy.png"): 0, "b.png": 1, "c.png": 2})
+	work := t.TempDir()
+	midfile := filepath.Join(work, "midfile.json")
+	groups := filepath.Join(work, "groups.json")
+
+	if code, _, stderr := runTestCli(t, "scan", "-root", root, "-o", midfile, "-j", "2"); code != 0 {
+		t.Fatalf("scan failed: %v %s", code, stderr)
+	}
+	if code, _, stderr := runTestCli(t, "group", "-midfile", midfile, "-o", groups, "-group-format", "members"); code != 0 {
+		t.Fatalf("group failed: %v %s", code, stderr)
+	}
+
+	membersList, err := readSimilarGroups(groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(membersList) != 1 || len(membersList[0]) != 2 {
+		t.Fatalf("unexpected groups: %+v", membersList)
+	}
+	paths := []string{membersList[0][0].Filepath, membersList[0][1].Filepath}
+	sort.Strings(paths)
+	if !reflect.DeepEqual(paths, []string{filepath.Join(root, "a.png"), filepath.Join(root, "sub", "a-copy.png")}) {
+		t.Fatalf("unexpected group paths: %v", paths)
+	}
+
+	// NOTE: queryの結果は標準出力にjsonで出る
+	queryDir := t.TempDir()
+	writeTestImages(t, queryDir, map[string]int{"q.png": 0, "r.png": 3})
+	code, stdout, stderr := runTestCli(t, "query", "-midfile", midfile, queryDir)
+	if code != 0 {
+		t.Fatalf("query failed: %v %s", code, stderr)
+	}
+	matches := []CrossMatch{}
+	if err := json.Unmarshal([]byte(stdout), &matches); err != nil {
+		t.Fatalf("failed json.Unmarshal: %v %s", err, stdout)
+	}
+	if len(matches) != 2 || len(matches[0].Matches) != 2 || len(matches[1].Matches) != 0 {
+		t.Fatalf("unexpected query result: %+v", matches)
+	}
+
+	code, stdout, _ = runTestCli(t, "report", "-groups", groups)
+	if code != 0 || !strings.Contains(stdout, "Summary: 1 groups, 2 images") {
+		t.Fatalf("unexpected report: %v %s", code, stdout)
+	}
+	code, stdout, _ = runTestCli(t, "report", "-groups", groups, "-format", "csv")
+	if code != 0 || strings.Count(stdout, "\n") != 3 {
+		t.Fatalf("unexpected csv report: %v %s", code, stdout)
+	}
+
+	// NOTE: 既定はdry-runなのでファイルは動かない
+	// NOTE: members形式なので走査元からの相対パスを保って移動される
+	moveTo := filepath.Join(work, "duplicates")
+	code, stdout, _ = runTestCli(t, "apply", "-groups", groups, "-action", "move", "-keep", "shortest-path", "-to", moveTo)
+	if code != 0 || !strings.Contains(stdout, "(dry-run) move: "+filepath.Join(root, "sub", "a-copy.png")) {
+		t.Fatalf("unexpected dry-run: %v %s", code, stdout)
+	}
+	if _, err := os.Stat(filepath.Join(root, "sub", "a-copy.png")); err != nil {
+		t.Fatal(err)
+	}
+
+	code, _, stderr = runTestCli(t, "apply", "-groups", groups, "-action", "move", "-keep", "shortest-path", "-to", moveTo, "-dry-run=false")
+	if code != 0 {
+		t.Fatalf("apply failed: %v %s", code, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(moveTo, "sub", "a-copy.png")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.png")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCliRun コマンド名を省略すると従来通り一度に実行されるかのテスト
+func TestCliRun(t *testing.T) {
+	root := t.TempDir()
+	writeTestImages(t, root, map[string]int{"a.png": 0, "b.png": 0, "c.png": 1})
+
+	for _, algorithm := range []string{"phash", "ahash", "dhash"} {
+		output := filepath.Join(t.TempDir(), "similar_groups.json")
+		code, _, stderr := runTestCli(t, "-root", root, "-o", output, "-write-midfile", "", "-hash", algorithm)
+		if code != 0 {
+			t.Fatalf("run failed: %v %v %s", algorithm, code, stderr)
+		}
+
+		data, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		similarGroupsList := [][]string{}
+		if err := json.Unmarshal(data, &similarGroupsList); err != nil {
+			t.Fatal(err)
+		}
+		if len(similarGroupsList) != 1 || len(similarGroupsList[0]) != 2 {
+			t.Fatalf("unexpected groups: %v %v", algorithm, similarGroupsList)
+		}
+	}
+}
+
+func TestCliUsage(t *testing.T) {
+	cases := []struct {
+		args   []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{[]string{"help"}, 0, "Commands:", ""},
+		{[]string{"help", "group"}, 0, "-threshold", ""},
+		{[]string{"scan", "-h"}, 0, "-files-from", ""},
+		{[]string{"unknown"}, 2, "", "unknown command: unknown"},
+		{[]string{"group", "-no-such-flag"}, 2, "", "flag provided but not defined"},
+		{[]string{"query"}, 2, "", "no images given"},
+		{[]string{"apply", "-action", "move"}, 2, "", "-to is required"},
+		{[]string{"coordinator", "-workers", "0"}, 2, "", "invalid workers: 0"},
+		{[]string{"run", "-root-a", "a"}, 2, "", "set B needs one of -root-b and -read-midfile-b"},
+		{[]string{"run", "-read-midfile-b", "b.json"}, 2, "", "set A needs one of -root-a and -read-midfile-a"},
+		{[]string{"run", "-root-a", "a", "-read-midfile-a", "a.json", "-root-b", "b"}, 2, "", "set A needs only one of -root-a and -read-midfile-a"},
+		{[]string{"group", "-midfile", filepath.Join(t.TempDir(), "missing.json")}, 1, "", "failed os.Open"},
+	}
+
+	for _, c := range cases {
+		code, stdout, stderr := runTestCli(t, c.args...)
+		if code != c.code || !strings.Contains(stdout, c.stdout) || !strings.Contains(stderr, c.stderr) {
+			t.Errorf("unexpected result of %v: %v\nstdout: %s\nstderr: %s", c.args, code, stdout, stderr)
+		}
+	}
+}
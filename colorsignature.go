@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"math"
+)
+
+// 色相のヒストグラムの設定
+const (
+	// NOTE: 30度ずつに分ける
+	colorHueBins = 12
+	// NOTE: 縦横それぞれこの数くらいの画素に間引いて数える
+	colorSampleSide = 64
+	// NOTE: これ未満の彩度・明度の画素は色相が不安定なので無彩色として数えない
+	colorMinSaturation = 0.25
+	colorMinValue      = 0.2
+	// NOTE: 有彩色の画素がこの割合未満なら白黒（無彩色）の画像とみなす
+	colorMinChroma = 0.02
+)
+
+// 色の違いの扱い
+const (
+	colorVariantsMerge = "merge"
+	colorVariantsSplit = "split"
+)
+
+// 色の違いのラベル
+const (
+	colorMatchDuplicate = "duplicate"
+	colorMatchVariant   = "color-variant"
+)
+
+// colorVariantsFlag 色違いの画像をグループにまとめるか分けるかのフラグ
+type colorVariantsFlag string
+
+func (variants *colorVariantsFlag) String() string {
+	return string(*variants)
+}
+
+func (variants *colorVariantsFlag) Set(value string) error {
+	switch value {
+	case colorVariantsMerge, colorVariantsSplit:
+		*variants = colorVariantsFlag(value)
+		return nil
+	}
+	return fmt.Errorf("invalid color-variants: %s (%s or %s)", value, colorVariantsMerge, colorVariantsSplit)
+}
+
+// colorOptions グルーピングでの色の違いの扱い
+type colorOptions struct {
+	// NOTE: 0なら色を見ない。大きいほど小さな色の違いでも色違いと判定する
+	Sensitivity float64
+	Variants    colorVariantsFlag
+}
+
+// registerColorFlags 色の違いの扱いのフラグを登録する
+func registerColorFlags(flags *flag.FlagSet, color *colorOptions) {
+	color.Variants = colorVariantsMerge
+	flags.Float64Var(&color.Sensitivity, "color-sensitivity", 0, "label pairs whose hue histograms differ as color variants (0-1, higher treats smaller differences as variants, 0 is disabled)")
+	flags.Var(&color.Variants, "color-variants", "color variants are kept in the group with a label (merge) or grouped separately (split)")
+}
+
+// Validate 指定の範囲を確認する
+func (color *colorOptions) Validate() error {
+	if color.Sensitivity < 0 || color.Sensitivity > 1 {
+		return fmt.Errorf("invalid color-sensitivity: %v (0-1)", color.Sensitivity)
+	}
+	return nil
+}
+
+// IsEnabled 色を見るか
+func (color *colorOptions) IsEnabled() bool {
+	return color.Sensitivity > 0
+}
+
+// IsVariant 色の距離が色違いと判定する距離か
+func (color *colorOptions) IsVariant(distance float64) bool {
+	return distance >= 1-color.Sensitivity
+}
+
+// IsSplit 色違いを別のグループにするか
+func (color *colorOptions) IsSplit() bool {
+	return color.Variants == colorVariantsSplit
+}
+
+// colorMatchLabel 色違いかの表示
+func colorMatchLabel(isVariant bool) string {
+	if isVariant {
+		return colorMatchVariant
+	}
+	return colorMatchDuplicate
+}
+
+// calcColorSignature 画像の色相のヒストグラムを計算する
+// NOTE: 各要素は有彩色の画素の色相ごとの割合（全画素に対する割合を0-255にしたもの）。輝度だけのハッシュでは区別できない色違いを見分けるのに使う
+func calcColorSignature(imageData image.Image) []byte {
+	bounds := imageData.Bounds()
+	if bounds.Empty() {
+		return nil
+	}
+	stepX := max(1, bounds.Dx()/colorSampleSide)
+	stepY := max(1, bounds.Dy()/colorSampleSide)
+
+	histogram := [colorHueBins]float64{}
+	samples := 0
+	for y := bounds.Min.Y + stepY/2; y < bounds.Max.Y; y += stepY {
+		for x := bounds.Min.X + stepX/2; x < bounds.Max.X; x += stepX {
+			samples++
+			r, g, b, _ := imageData.At(x, y).RGBA()
+			if hue, ok := chromaticHue(float64(r)/0xffff, float64(g)/0xffff, float64(b)/0xffff); ok {
+				// NOTE: 境目の色相が再エンコードで隣の区間に移っても大きく変わらないように隣り合う区間に按分する
+				position := hue*colorHueBins/360 - 0.5
+				lower := math.Floor(position)
+				weight := position - lower
+				histogram[(int(lower)+colorHueBins)%colorHueBins] += 1 - weight
+				histogram[(int(lower)+1)%colorHueBins] += weight
+			}
+		}
+	}
+
+	signature := make([]byte, colorHueBins)
+	for i, count := range histogram {
+		signature[i] = byte(math.Round(count * 255 / float64(samples)))
+	}
+	return signature
+}
+
+// chromaticHue 有彩色なら色相（0-360度）を返す
+func chromaticHue(r, g, b float64) (float64, bool) {
+	maxValue := max(r, g, b)
+	minValue := min(r, g, b)
+	chroma := maxValue - minValue
+	if maxValue < colorMinValue || chroma/maxValue < colorMinSaturation {
+		return 0, false
+	}
+
+	var hue float64
+	switch maxValue {
+	case r:
+		hue = math.Mod((g-b)/chroma+6, 6)
+	case g:
+		hue = (b-r)/chroma + 2
+	default:
+		hue = (r-g)/chroma + 4
+	}
+	return hue * 60, true
+}
+
+// colorSignatureDistance 2つの色相のヒストグラムの距離（0-1）
+// NOTE: 両方とも白黒なら0、片方だけ白黒なら1、それ以外は有彩色の画素の色相の分布の差（全変動距離）
+// NOTE: 色相のヒストグラムがない（古い中間ファイルの）場合は比較できないのでfalseを返す
+func colorSignatureDistance(lhs, rhs []byte) (float64, bool) {
+	if len(lhs) != colorHueBins || len(rhs) != colorHueBins {
+		return 0, false
+	}
+
+	lhsChroma, rhsChroma := 0, 0
+	for i := range lhs {
+		lhsChroma += int(lhs[i])
+		rhsChroma += int(rhs[i])
+	}
+	lhsIsGray := float64(lhsChroma) < colorMinChroma*255
+	rhsIsGray := float64(rhsChroma) < colorMinChroma*255
+	switch {
+	case lhsIsGray && rhsIsGray:
+		return 0, true
+	case lhsIsGray || rhsIsGray:
+		return 1, true
+	}
+
+	distance := 0.0
+	for i := range lhs {
+		distance += math.Abs(float64(lhs[i])/float64(lhsChroma) - float64(rhs[i])/float64(rhsChroma))
+	}
+	return min(1, distance/2), true
+}
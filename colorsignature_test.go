@@ -0,0 +1,131 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTintedImage 画像の明るさを形として、白地に指定の色で塗った画像（色違いのアイコンの代わり）
+func newTintedImage(shape image.Image, tint color.RGBA) *image.RGBA {
+	bounds := shape.Bounds()
+	tinted := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			// NOTE: 暗いところほど濃く塗る
+			strength := 255 - int(color.GrayModel.Convert(shape.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray).Y)
+			mix := func(c uint8) uint8 {
+				return uint8(255 - (255-int(c))*strength/255)
+			}
+			tinted.Set(x, y, color.RGBA{mix(tint.R), mix(tint.G), mix(tint.B), 255})
+		}
+	}
+	return tinted
+}
+
+// TestColorSignatureDistance 色違いと同じ色の画像の色相のヒストグラムの距離のテスト
+func TestColorSignatureDistance(t *testing.T) {
+	shape := newTestMosaic(256, 256, 12)
+	red := newTintedImage(shape, color.RGBA{220, 30, 30, 255})
+	redSmall := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			redSmall.Set(x, y, red.At(x*256/100, y*256/100))
+		}
+	}
+	blue := newTintedImage(shape, color.RGBA{30, 30, 220, 255})
+	gray := newTintedImage(shape, color.RGBA{40, 40, 40, 255})
+
+	tests := []struct {
+		name     string
+		lhs, rhs image.Image
+		min, max float64
+	}{
+		{"same color", red, redSmall, 0, 0.1},
+		{"recolored", red, blue, 0.9, 1},
+		{"grayscale", gray, gray, 0, 0},
+		{"grayscale and color", gray, red, 1, 1},
+	}
+	for _, test := range tests {
+		distance, ok := colorSignatureDistance(calcColorSignature(test.lhs), calcColorSignature(test.rhs))
+		if !ok || distance < test.min || distance > test.max {
+			t.Errorf("%s: unexpected distance: %v %v", test.name, distance, ok)
+		}
+	}
+
+	// NOTE: 色相のヒストグラムがない（古い中間ファイルの）画像とは比較できない
+	if _, ok := colorSignatureDistance(nil, calcColorSignature(red)); ok {
+		t.Errorf("compared without signature")
+	}
+}
+
+// TestColorVariants 色違いの画像にラベルが付き、-color-variants=splitで別のグループになるかのテスト
+func TestColorVariants(t *testing.T) {
+	root := t.TempDir()
+	shape := newTestMosaic(256, 256, 12)
+	red := newTintedImage(shape, color.RGBA{220, 30, 30, 255})
+	images := map[string]image.Image{
+		"red.png":      red,
+		"red-copy.png": newFramedImage(red, 0, 0, 0, 0, color.White),
+		"blue.png":     newTintedImage(shape, color.RGBA{30, 30, 220, 255}),
+		"gray.png":     newTintedImage(shape, color.RGBA{40, 40, 40, 255}),
+	}
+	for name, imageData := range images {
+		if err := os.WriteFile(filepath.Join(root, name), encodeTestPng(t, imageData), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	groups := filepath.Join(t.TempDir(), "groups.json")
+	args := []string{"run", "-root", root, "-o", groups, "-write-midfile", "", "-threshold", "10", "-progress", "none"}
+
+	// NOTE: 輝度のハッシュだけでは色違いも同じグループになる
+	if code, _, stderr := runTestCli(t, args...); code != 0 {
+		t.Fatalf("run failed: %v %s", code, stderr)
+	}
+	membersList, err := readSimilarGroups(groups)
+	if err != nil || len(membersList) != 1 || len(membersList[0]) != len(images) {
+		t.Fatalf("unexpected groups: %v %v", membersList, err)
+	}
+
+	if code, _, stderr := runTestCli(t, append(args, "-color-sensitivity", "0.5")...); code != 0 {
+		t.Fatalf("run failed: %v %s", code, stderr)
+	}
+	membersList, err = readSimilarGroups(groups)
+	if err != nil || len(membersList) != 1 || len(membersList[0]) != len(images) {
+		t.Fatalf("unexpected groups: %v %v", membersList, err)
+	}
+	labels := map[string]int{}
+	for _, member := range membersList[0] {
+		labels[member.Color]++
+	}
+	// NOTE: 基準の画像以外にラベルが付く（どれが基準でも色違いは1つ以上ある）
+	if labels[""] != 1 || labels[colorMatchVariant] == 0 {
+		t.Errorf("unexpected labels: %v", membersList[0])
+	}
+
+	code, stdout, stderr := runTestCli(t, "report", "-groups", groups)
+	if code != 0 || !strings.Contains(stdout, "color: "+colorMatchVariant) {
+		t.Errorf("unexpected report: %v %s %s", code, stdout, stderr)
+	}
+
+	if code, _, stderr := runTestCli(t, append(args, "-color-sensitivity", "0.5", "-color-variants", "split")...); code != 0 {
+		t.Fatalf("run failed: %v %s", code, stderr)
+	}
+	membersList, err = readSimilarGroups(groups)
+	if err != nil || len(membersList) != 1 || len(membersList[0]) != 2 {
+		t.Fatalf("unexpected groups: %v %v", membersList, err)
+	}
+	for _, member := range membersList[0] {
+		if !strings.HasPrefix(filepath.Base(member.Filepath), "red") || (len(member.Color) != 0 && member.Color != colorMatchDuplicate) {
+			t.Errorf("unexpected member: %v", member)
+		}
+	}
+
+	if code, _, _ := runTestCli(t, append(args, "-color-sensitivity", "2")...); code == 0 {
+		t.Errorf("invalid color-sensitivity is accepted")
+	}
+}
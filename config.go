@@ -0,0 +1,383 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// 設定ファイルのキー
+// NOTE: トップレベルの各キーはフラグ名で、そのフラグを持つすべてのサブコマンドに適用される
+// NOTE: サブコマンド名のキーの中はそのサブコマンドだけに適用される
+const (
+	configProfilesKey = "profiles"
+	configFlagName    = "config"
+	profileFlagName   = "profile"
+	configEnvPrefix   = "SIMILAR_IMAGES_GROUPING_"
+)
+
+// cliConfig 設定ファイル
+type cliConfig struct {
+	Path   string
+	Values map[string]any
+}
+
+// configLayer 優先順位ごとの設定ファイルの中身
+type configLayer struct {
+	prefix  string
+	section map[string]any
+}
+
+// configEntry 設定ファイルから取り出したフラグの値
+type configEntry struct {
+	Key    string
+	Values []string
+}
+
+// loadCliConfig 拡張子に応じてyamlまたはtomlの設定ファイルを読み込む
+func loadCliConfig(path string) (*cliConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed os.ReadFile: %s %w", path, err)
+	}
+
+	config := &cliConfig{
+		Path:   path,
+		Values: map[string]any{},
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &config.Values); err != nil {
+			return nil, fmt.Errorf("failed yaml.Unmarshal: %s %w", path, err)
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, &config.Values); err != nil {
+			return nil, fmt.Errorf("failed toml.Unmarshal: %s %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config format: %s (.yaml, .yml or .toml)", path)
+	}
+
+	// NOTE: 空のyamlはnilになる
+	if config.Values == nil {
+		config.Values = map[string]any{}
+	}
+	return config, nil
+}
+
+// keyError キーを示す設定ファイルのエラー
+func (config *cliConfig) keyError(key string, format string, args ...any) error {
+	return fmt.Errorf("invalid config: %s: key %q: %s", config.Path, key, fmt.Sprintf(format, args...))
+}
+
+// Validate すべてのキーと値がいずれかのサブコマンドのフラグとして正しいか検証する
+func (config *cliConfig) Validate(flagSets map[string]*flag.FlagSet) error {
+	if err := config.validateSection("", config.Values, flagSets, true); err != nil {
+		return err
+	}
+
+	profiles, err := config.profiles()
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedKeys(profiles) {
+		profile, ok := profiles[name].(map[string]any)
+		if !ok {
+			return config.keyError(configProfilesKey+"."+name, "expected a table of flags")
+		}
+		if err := config.validateSection(configProfilesKey+"."+name+".", profile, flagSets, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateSection トップレベルまたはプロファイルの中身を検証する
+func (config *cliConfig) validateSection(prefix string, section map[string]any, flagSets map[string]*flag.FlagSet, isTopLevel bool) error {
+	for _, key := range sortedKeys(section) {
+		value := section[key]
+		switch {
+		case key == configProfilesKey && isTopLevel:
+			continue
+		case key == configFlagName || key == profileFlagName:
+			return config.keyError(prefix+key, "cannot be set in config file")
+		}
+
+		// NOTE: workerの-coordinatorのようにサブコマンド名と同じフラグもあるので値が表のときだけサブコマンドとみなす
+		flags, isCommand := flagSets[key]
+		commandSection, isSection := value.(map[string]any)
+		if isCommand && isSection {
+			for _, flagName := range sortedKeys(commandSection) {
+				if err := config.validateValue(prefix+key+"."+flagName, flagName, commandSection[flagName], flags); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		// NOTE: 共通のキーはどれか1つのサブコマンドで受け付けられればよい（rootの複数指定など）
+		var errValue error
+		isKnown := false
+		for _, name := range sortedKeys(flagSets) {
+			if flagSets[name].Lookup(key) == nil {
+				continue
+			}
+			isKnown = true
+			if errValue = config.validateValue(prefix+key, key, value, flagSets[name]); errValue == nil {
+				break
+			}
+		}
+		if !isKnown {
+			return config.keyError(prefix+key, "unknown key")
+		}
+		if errValue != nil {
+			return errValue
+		}
+	}
+	return nil
+}
+
+// validateValue 値がフラグとして設定できるか検証する
+func (config *cliConfig) validateValue(key, flagName string, value any, flags *flag.FlagSet) error {
+	if flags.Lookup(flagName) == nil || flagName == configFlagName || flagName == profileFlagName {
+		return config.keyError(key, "unknown key for %s", flags.Name())
+	}
+	entry, err := config.entry(key, value)
+	if err != nil {
+		return err
+	}
+	return config.setFlag(flags, flagName, entry)
+}
+
+// profiles プロファイルの一覧
+func (config *cliConfig) profiles() (map[string]any, error) {
+	value, ok := config.Values[configProfilesKey]
+	if !ok {
+		return map[string]any{}, nil
+	}
+	profiles, ok := value.(map[string]any)
+	if !ok {
+		return nil, config.keyError(configProfilesKey, "expected a table of profiles")
+	}
+	return profiles, nil
+}
+
+// Resolve サブコマンドに適用する値をフラグ名ごとに返す
+// NOTE: トップレベル < トップレベルのサブコマンド < プロファイル < プロファイルのサブコマンド の順で後のものを優先する
+func (config *cliConfig) Resolve(flags *flag.FlagSet, profileName string) (map[string]configEntry, error) {
+	layers := []configLayer{{prefix: "", section: config.Values}}
+
+	if len(profileName) != 0 {
+		profiles, err := config.profiles()
+		if err != nil {
+			return nil, err
+		}
+		profile, ok := profiles[profileName].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid config: %s: unknown profile %q", config.Path, profileName)
+		}
+		layers = append(layers, configLayer{prefix: configProfilesKey + "." + profileName + ".", section: profile})
+	}
+
+	entries := map[string]configEntry{}
+	for _, layer := range layers {
+		sections := []configLayer{layer}
+		if commandSection, ok := layer.section[flags.Name()].(map[string]any); ok {
+			sections = append(sections, configLayer{prefix: layer.prefix + flags.Name() + ".", section: commandSection})
+		}
+
+		for _, section := range sections {
+			for key, value := range section.section {
+				if _, isSection := value.(map[string]any); isSection {
+					continue
+				}
+				if flags.Lookup(key) == nil || key == configFlagName || key == profileFlagName {
+					// NOTE: 他のサブコマンド向けのキーは無視する（検証済み）
+					continue
+				}
+				entry, err := config.entry(section.prefix+key, value)
+				if err != nil {
+					return nil, err
+				}
+				entries[key] = entry
+			}
+		}
+	}
+	return entries, nil
+}
+
+// entry 設定ファイルの値をフラグに設定できる文字列にする
+func (config *cliConfig) entry(key string, value any) (configEntry, error) {
+	entry := configEntry{Key: key}
+	switch value := value.(type) {
+	case []any:
+		for _, element := range value {
+			text, ok := configScalar(element)
+			if !ok {
+				return entry, config.keyError(key, "expected a list of values")
+			}
+			entry.Values = append(entry.Values, text)
+		}
+	default:
+		text, ok := configScalar(value)
+		if !ok {
+			return entry, config.keyError(key, "expected a value")
+		}
+		entry.Values = []string{text}
+	}
+	return entry, nil
+}
+
+// configScalar 文字列・数値・真偽値を文字列にする
+func configScalar(value any) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		return value, true
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(value), true
+	default:
+		return "", false
+	}
+}
+
+// setFlag 設定ファイルの値をフラグに設定する
+// NOTE: 複数指定できるフラグ以外にリストは指定できない
+func (config *cliConfig) setFlag(flags *flag.FlagSet, flagName string, entry configEntry) error {
+	if len(entry.Values) != 1 && !isListFlag(flags, flagName) {
+		return config.keyError(entry.Key, "%s accepts a single value", flags.Name())
+	}
+	for _, value := range entry.Values {
+		if err := flags.Set(flagName, value); err != nil {
+			return config.keyError(entry.Key, "%v", err)
+		}
+	}
+	return nil
+}
+
+// isListFlag 複数指定できるフラグか
+func isListFlag(flags *flag.FlagSet, name string) bool {
+	_, ok := flags.Lookup(name).Value.(*stringListFlag)
+	return ok
+}
+
+// configEnvName フラグに対応する環境変数名
+func configEnvName(flagName string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// sortedKeys エラーを決まった順で返すためにキーを並べる
+func sortedKeys[T any](values map[string]T) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// registerConfigFlags 設定ファイル関連のフラグを登録する
+func registerConfigFlags(flags *flag.FlagSet) {
+	flags.String(configFlagName, "", "config file (yaml or toml) with defaults of the flags (env "+configEnvName(configFlagName)+")")
+	flags.String(profileFlagName, "", "profile name in the config file (env "+configEnvName(profileFlagName)+")")
+}
+
+// applyConfig 明示されなかったフラグに環境変数・設定ファイルの値を設定する
+// NOTE: 優先順位はフラグ > 環境変数 > 設定ファイル > 既定値
+func (env *cliEnv) applyConfig(flags *flag.FlagSet) error {
+	explicit := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	lookup := func(name string) string {
+		if explicit[name] {
+			return flags.Lookup(name).Value.String()
+		}
+		return env.getenv(configEnvName(name))
+	}
+	configPath := lookup(configFlagName)
+	profileName := lookup(profileFlagName)
+
+	config := &cliConfig{}
+	entries := map[string]configEntry{}
+	if len(configPath) != 0 {
+		var err error
+		if config, err = loadCliConfig(configPath); err != nil {
+			return err
+		}
+		if err := config.Validate(subcommandFlagSets()); err != nil {
+			return err
+		}
+		if entries, err = config.Resolve(flags, profileName); err != nil {
+			return err
+		}
+	} else if len(profileName) != 0 {
+		return fmt.Errorf("profile %q is given without config file", profileName)
+	}
+
+	var errApply error
+	flags.VisitAll(func(f *flag.Flag) {
+		if errApply != nil || explicit[f.Name] || f.Name == configFlagName || f.Name == profileFlagName {
+			return
+		}
+
+		envName := configEnvName(f.Name)
+		if value, ok := env.lookupEnv(envName); ok {
+			values := []string{value}
+			if isListFlag(flags, f.Name) {
+				// NOTE: 複数指定できるフラグはパスと同じ区切り文字で区切る
+				values = filepath.SplitList(value)
+			}
+			for _, value := range values {
+				if err := flags.Set(f.Name, value); err != nil {
+					errApply = fmt.Errorf("invalid env: %s: %w", envName, err)
+					return
+				}
+			}
+			return
+		}
+
+		if entry, ok := entries[f.Name]; ok {
+			errApply = config.setFlag(flags, f.Name, entry)
+		}
+	})
+	return errApply
+}
+
+// lookupEnv 環境変数を取得する（LookupEnvが未設定なら環境変数は使わない）
+func (env *cliEnv) lookupEnv(name string) (string, bool) {
+	if env.LookupEnv == nil {
+		return "", false
+	}
+	return env.LookupEnv(name)
+}
+
+func (env *cliEnv) getenv(name string) string {
+	value, _ := env.lookupEnv(name)
+	return value
+}
+
+// subcommandFlagSets 検証用にすべてのサブコマンドのフラグセットを作成する
+// NOTE: 各サブコマンドはフラグの解析より前に副作用を持たないので、解析の直前で止めてフラグセットだけ取り出す
+func subcommandFlagSets() map[string]*flag.FlagSet {
+	flagSets := map[string]*flag.FlagSet{}
+	for _, command := range subcommands {
+		env := &cliEnv{
+			Stdin:  strings.NewReader(""),
+			Stdout: io.Discard,
+			Stderr: io.Discard,
+			probeFlags: func(flags *flag.FlagSet) {
+				flagSets[command.Name] = flags
+			},
+		}
+		command.Run(nil, env)
+	}
+	return flagSets
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfigYaml = `
+threshold: 5
+exclude: ["*.psd"]
+group:
+  group-format: members
+profiles:
+  photos:
+    threshold: 6
+    root: [/mnt/a, /mnt/b]
+    hash: dhash
+    apply:
+      keep: resolution
+  scans:
+    group:
+      threshold: 3
+`
+
+const testConfigToml = `
+threshold = 5
+
+[group]
+group-format = "members"
+
+[profiles.scans.group]
+threshold = 3
+`
+
+// parseTestFlags 指定のサブコマンドのフラグを環境変数付きで解析する
+func parseTestFlags(t *testing.T, environ map[string]string, name string, args ...string) (map[string]string, error) {
+	t.Helper()
+	flags := subcommandFlagSets()[name]
+	env := &cliEnv{
+		Stdin:  strings.NewReader(""),
+		Stdout: &strings.Builder{},
+		Stderr: &strings.Builder{},
+		LookupEnv: func(key string) (string, bool) {
+			value, ok := environ[key]
+			return value, ok
+		},
+	}
+	if err := env.parseFlags(flags, args); err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	for _, flagName := range []string{"threshold", "group-format", "root", "hash", "keep", "exclude"} {
+		if f := flags.Lookup(flagName); f != nil {
+			values[flagName] = f.Value.String()
+		}
+	}
+	return values, nil
+}
+
+func writeTestConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestConfigPrecedence フラグ > 環境変数 > 設定ファイル（プロファイル > 共通）の優先順位のテスト
+func TestConfigPrecedence(t *testing.T) {
+	yamlPath := writeTestConfig(t, "config.yaml", testConfigYaml)
+	tomlPath := writeTestConfig(t, "config.toml", testConfigToml)
+
+	cases := []struct {
+		environ  map[string]string
+		command  string
+		args     []string
+		flagName string
+		expected string
+	}{
+		{nil, "group", nil, "threshold", "10"},
+		{nil, "group", []string{"-config", yamlPath}, "threshold", "5"},
+		{nil, "group", []string{"-config", yamlPath}, "group-format", "members"},
+		{nil, "group", []string{"-config", yamlPath, "-profile", "photos"}, "threshold", "6"},
+		{nil, "group", []string{"-config", yamlPath, "-profile", "scans"}, "threshold", "3"},
+		{nil, "group", []string{"-config", tomlPath, "-profile", "scans"}, "threshold", "3"},
+		{nil, "group", []string{"-config", tomlPath}, "group-format", "members"},
+		{map[string]string{"SIMILAR_IMAGES_GROUPING_THRESHOLD": "7"}, "group", []string{"-config", yamlPath, "-profile", "photos"}, "threshold", "7"},
+		{map[string]string{"SIMILAR_IMAGES_GROUPING_THRESHOLD": "7"}, "group", []string{"-config", yamlPath, "-threshold", "8"}, "threshold", "8"},
+		{map[string]string{"SIMILAR_IMAGES_GROUPING_CONFIG": yamlPath, "SIMILAR_IMAGES_GROUPING_PROFILE": "photos"}, "apply", nil, "keep", "resolution"},
+		{nil, "scan", []string{"-config", yamlPath, "-profile", "photos"}, "root", "/mnt/a,/mnt/b"},
+		{nil, "scan", []string{"-config", yamlPath, "-profile", "photos", "-root", "/c"}, "root", "/c"},
+		{nil, "scan", []string{"-config", yamlPath, "-profile", "photos"}, "hash", "dhash"},
+		{nil, "scan", []string{"-config", yamlPath}, "exclude", "*.psd"},
+		{map[string]string{"SIMILAR_IMAGES_GROUPING_EXCLUDE": "*.psd" + string(os.PathListSeparator) + "*.tmp"}, "scan", nil, "exclude", "*.psd,*.tmp"},
+	}
+
+	for _, c := range cases {
+		values, err := parseTestFlags(t, c.environ, c.command, c.args...)
+		if err != nil {
+			t.Errorf("%v %v: %v", c.command, c.args, err)
+			continue
+		}
+		if values[c.flagName] != c.expected {
+			t.Errorf("%v %v: %s = %q, expected %q", c.command, c.args, c.flagName, values[c.flagName], c.expected)
+		}
+	}
+}
+
+// TestConfigValidation 設定ファイルの誤りが該当のキーを示すかのテスト
+func TestConfigValidation(t *testing.T) {
+	cases := []struct {
+		content  string
+		args     []string
+		expected string
+	}{
+		{"thresold: 5\n", nil, `key "thresold": unknown key`},
+		{"profiles:\n  photos:\n    threshold: abc\n", nil, `key "profiles.photos.threshold"`},
+		{"group:\n  keep: first\n", nil, `key "group.keep": unknown key for group`},
+		{"hash: md5\n", nil, `key "hash": unknown hash algorithm`},
+		{"threshold: [1, 2]\n", nil, `key "threshold"`},
+		{"profile: photos\n", nil, `key "profile": cannot be set`},
+		{"threshold: 5\n", []string{"-profile", "nope"}, `unknown profile "nope"`},
+		// NOTE: rootはscanではリストで指定できるが、watchは1つしか受け付けない
+		{"root: [/a, /b]\n", nil, ""},
+	}
+
+	for _, c := range cases {
+		path := writeTestConfig(t, "config.yaml", c.content)
+		_, err := parseTestFlags(t, nil, "group", append([]string{"-config", path}, c.args...)...)
+		if len(c.expected) == 0 {
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", c.content, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("%q: unexpected error: %v", c.content, err)
+		}
+	}
+
+	path := writeTestConfig(t, "config.yaml", "root: [/a, /b]\n")
+	if _, err := parseTestFlags(t, nil, "watch", "-config", path); err == nil || !strings.Contains(err.Error(), `key "root": watch accepts a single value`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
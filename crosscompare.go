@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CrossMatch セットAの画像1つに対するセットBの似ている画像
+type CrossMatch struct {
+	Filepath string
+	Matches  []SimilarImage
+}
+
+// CrossCompareResult セットA・セットB間の比較結果
+type CrossCompareResult struct {
+	Matches []CrossMatch
+	OnlyA   []string
+	OnlyB   []string
+}
+
+// crossCompare セットAの各画像についてセットBから似ている画像を探す
+// NOTE: 各セット内でのグルーピングは行わない
+func crossCompare(setA, setB *ParallelCompList, threshold, maxMatches int) (*CrossCompareResult, error) {
+	result := &CrossCompareResult{
+		Matches: []CrossMatch{},
+		OnlyA:   []string{},
+		OnlyB:   []string{},
+	}
+
+	matrixB, err := newHashMatrix(*setB)
+	if err != nil {
+		return nil, fmt.Errorf("failed newHashMatrix: %w", err)
+	}
+
+	matchedB := map[string]bool{}
+	for _, infoA := range *setA {
+		similarImages, err := matrixB.Search(infoA, threshold, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed hashMatrix.Search: %s %w", infoA.Filepath, err)
+		}
+
+		if len(similarImages) == 0 {
+			result.OnlyA = append(result.OnlyA, infoA.Filepath)
+			continue
+		}
+
+		for _, similarImage := range similarImages {
+			matchedB[similarImage.Filepath] = true
+		}
+
+		// NOTE: 距離の近い順に並んでいるので先頭から指定数だけ残す
+		if maxMatches > 0 && len(similarImages) > maxMatches {
+			similarImages = similarImages[:maxMatches]
+		}
+
+		result.Matches = append(result.Matches, CrossMatch{
+			Filepath: infoA.Filepath,
+			Matches:  similarImages,
+		})
+	}
+
+	for _, infoB := range *setB {
+		if !matchedB[infoB.Filepath] {
+			result.OnlyB = append(result.OnlyB, infoB.Filepath)
+		}
+	}
+
+	sort.Slice(result.Matches, func(i, j int) bool {
+		return result.Matches[i].Filepath < result.Matches[j].Filepath
+	})
+	sort.Strings(result.OnlyA)
+	sort.Strings(result.OnlyB)
+
+	return result, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/corona10/goimagehash"
+)
+
+// newTestImageHashInfo テスト用に指定ビット列からImageHashInfoを作成する
+func newTestImageHashInfo(path string, hash ...uint64) *ImageHashInfo {
+	return &ImageHashInfo{
+		Filepath:  path,
+		ImageHash: goimagehash.NewExtImageHash(hash, goimagehash.PHash, len(hash)*64),
+	}
+}
+
+// TestCrossCompare セットA・セットB間の比較テスト
+func TestCrossCompare(t *testing.T) {
+	setA := &ParallelCompList{
+		newTestImageHashInfo("a/same.jpg", 0x00ff, 0),
+		newTestImageHashInfo("a/near.jpg", 0xff00, 0),
+		newTestImageHashInfo("a/only.jpg", 0xffffffffffffffff, 0xffffffffffffffff),
+	}
+	setB := &ParallelCompList{
+		newTestImageHashInfo("b/same.jpg", 0x00ff, 0),
+		newTestImageHashInfo("b/near1.jpg", 0xff01, 0),
+		newTestImageHashInfo("b/near3.jpg", 0xff07, 0),
+		newTestImageHashInfo("b/only.jpg", 0x0f0f0f0f0f0f0f0f, 0xf0f0f0f0f0f0f0f0),
+	}
+
+	result, err := crossCompare(setA, setB, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &CrossCompareResult{
+		Matches: []CrossMatch{
+			{Filepath: "a/near.jpg", Matches: []SimilarImage{{Filepath: "b/near1.jpg", Distance: 1}, {Filepath: "b/near3.jpg", Distance: 3}}},
+			{Filepath: "a/same.jpg", Matches: []SimilarImage{{Filepath: "b/same.jpg", Distance: 0}}},
+		},
+		OnlyA: []string{"a/only.jpg"},
+		OnlyB: []string{"b/only.jpg"},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	// NOTE: 比較でコンテナが変更されないこと
+	if len(*setA) != 3 || len(*setB) != 4 {
+		t.Fatalf("container modified: %v %v", len(*setA), len(*setB))
+	}
+
+	// NOTE: 最大件数で距離の近いものだけ残ること
+	result, err = crossCompare(setA, setB, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.Matches[0].Matches; len(got) != 1 || got[0].Filepath != "b/near1.jpg" {
+		t.Fatalf("unexpected max matches result: %+v", got)
+	}
+	if !reflect.DeepEqual(result.OnlyB, []string{"b/only.jpg"}) {
+		t.Fatalf("unexpected OnlyB: %v", result.OnlyB)
+	}
+}
+
+// TestCrossCompareHardLink セットをまたいだハードリンクがそれぞれのセットでハッシュされて一致するかのテスト
+func TestCrossCompareHardLink(t *testing.T) {
+	dir := t.TempDir()
+	rootA, rootB := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	writeTestImages(t, rootA, map[string]int{"img0.png": 0})
+	writeTestImages(t, rootB, map[string]int{"other.png": 1})
+	if err := os.Link(filepath.Join(rootA, "img0.png"), filepath.Join(rootB, "img0.png")); err != nil {
+		t.Skipf("hard link is not supported: %v", err)
+	}
+
+	output := filepath.Join(dir, "cross_result.json")
+	code, _, stderr := runTestCli(t, "run", "-root-a", rootA, "-root-b", rootB, "-o", output)
+	if code != 0 {
+		t.Fatalf("run failed: %v %s", code, stderr)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &CrossCompareResult{}
+	if err := json.Unmarshal(data, result); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Matches) != 1 || len(result.Matches[0].Matches) != 1 || len(result.OnlyA) != 0 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if match := result.Matches[0].Matches[0]; match.Filepath != filepath.Join(rootB, "img0.png") || match.Relation != "identical-bytes" {
+		t.Fatalf("unexpected match: %+v", match)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"time"
+
+	"github.com/akinobufujii/similar_images_grouping/readimageutil"
+	"golang.org/x/sync/semaphore"
+)
+
+// errTooManyPixels 画素数が-max-pixelsを超えた
+var errTooManyPixels = errors.New("too many pixels")
+
+// decodeMemory デコード中の画像の合計バイト数を制限する
+// NOTE: nilなら制限しない
+type decodeMemory struct {
+	limit     int64
+	semaphore *semaphore.Weighted
+}
+
+func newDecodeMemory(limit int64) *decodeMemory {
+	if limit <= 0 {
+		return nil
+	}
+	return &decodeMemory{
+		limit:     limit,
+		semaphore: semaphore.NewWeighted(limit),
+	}
+}
+
+// Acquire 指定バイト数を確保できるまで待ち、解放する関数を返す
+// NOTE: 上限より大きい画像は上限いっぱいを確保して1枚ずつデコードする
+func (memory *decodeMemory) Acquire(ctx context.Context, size int64) (func(), error) {
+	if memory == nil {
+		return func() {}, nil
+	}
+
+	size = min(max(size, 1), memory.limit)
+	if err := memory.semaphore.Acquire(ctx, size); err != nil {
+		return nil, err
+	}
+	return func() { memory.semaphore.Release(size) }, nil
+}
+
+// decodeFlags 画像のデコードの上限のフラグ
+type decodeFlags struct {
+	MaxPixels    int64
+	MaxMemory    byteSizeFlag
+	IsReduceJpeg bool
+}
+
+// registerDecodeFlags 画像のデコードの上限のフラグを登録する
+func registerDecodeFlags(flags *flag.FlagSet, decode *decodeFlags) {
+	decode.MaxMemory = 1 << 30
+	flags.Int64Var(&decode.MaxPixels, "max-pixels", 0, "max pixels (width*height) of an image, larger ones are reported as too-large (0 is unlimited)")
+	flags.Var(&decode.MaxMemory, "decode-memory", "max bytes of images being decoded at once across workers (e.g. 512M, 0 is unlimited)")
+	flags.BoolVar(&decode.IsReduceJpeg, "jpeg-reduce", true, "decode large JPEGs at 1/8 size (DCT scaling) when still larger than the hash needs")
+}
+
+// Apply フラグの内容を走査設定に反映する
+func (decode *decodeFlags) Apply(options *scanOptions) {
+	options.MaxPixels = decode.MaxPixels
+	options.DecodeMemory = newDecodeMemory(int64(decode.MaxMemory))
+	options.IsReduceJpeg = decode.IsReduceJpeg
+}
+
+// decodedImageBytes デコードした画像のおおよそのバイト数
+func decodedImageBytes(header readimageutil.ImageHeader, scale int) int64 {
+	bytesPerPixel := int64(4)
+	switch header.ColorModel {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+		bytesPerPixel = 8
+	}
+	width := int64((header.Width + scale - 1) / scale)
+	height := int64((header.Height + scale - 1) / scale)
+	return width * height * bytesPerPixel
+}
+
+// reduceScale 縮小デコードする倍率（縮小しないなら1）
+// NOTE: ハッシュ計算で縮小する大きさ（samplew*sampleh四方）を下回らない場合だけ縮小する
+func reduceScale(header readimageutil.ImageHeader, options *scanOptions) int {
+	if !options.IsReduceJpeg || !header.IsReducible {
+		return 1
+	}
+	hashSize := options.SampleWidth * options.SampleHeight
+	if min(header.Width, header.Height)/readimageutil.JpegReduceScale < hashSize {
+		return 1
+	}
+	return readimageutil.JpegReduceScale
+}
+
+// decodeImageBounded 画像の大きさを確認し、除外・上限の判定をしてからメモリの上限内でデコードする
+// NOTE: 除外した場合はnilを返す。releaseはハッシュを計算し終えてから呼ぶ。縮小デコードしても元の大きさはheaderで分かる
+func decodeImageBounded(ctx context.Context, open func() (io.ReadCloser, error), options *scanOptions) (image.Image, readimageutil.ImageHeader, func(), error) {
+	reader, err := open()
+	if err != nil {
+		return nil, readimageutil.ImageHeader{}, nil, err
+	}
+	header, err := readimageutil.DecodeImageHeader(reader)
+	reader.Close()
+	if err != nil {
+		return nil, header, nil, err
+	}
+
+	filter := options.Filter
+	if filter.NeedDimensions() && filter.Skip(filter.FilterDimensions(header.Width, header.Height)) {
+		return nil, header, nil, nil
+	}
+	if options.MaxPixels > 0 && int64(header.Width)*int64(header.Height) > options.MaxPixels {
+		return nil, header, nil, fmt.Errorf("%w: %dx%d exceeds max-pixels %d", errTooManyPixels, header.Width, header.Height, options.MaxPixels)
+	}
+
+	scale := reduceScale(header, options)
+	release, err := options.DecodeMemory.Acquire(ctx, decodedImageBytes(header, scale))
+	if err != nil {
+		return nil, header, nil, err
+	}
+
+	reader, err = open()
+	if err != nil {
+		release()
+		return nil, header, nil, err
+	}
+	defer reader.Close()
+
+	start := time.Now()
+	var imageData image.Image
+	if scale == 1 {
+		imageData, _, err = readimageutil.DecodeImage(reader)
+	} else {
+		imageData, err = readimageutil.DecodeJpegReduced(reader)
+	}
+	if err != nil {
+		release()
+		return nil, header, nil, err
+	}
+	metrics.DecodeSeconds.ObserveSince(header.Format, start)
+
+	return imageData, header, release, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akinobufujii/similar_images_grouping/readimageutil"
+)
+
+// TestMaxPixels -max-pixelsを超える画像がtoo-largeとして記録されるかのテスト
+func TestMaxPixels(t *testing.T) {
+	root := t.TempDir()
+	writeTestImages(t, root, map[string]int{"a.png": 0, "b.png": 1})
+
+	midfile := filepath.Join(t.TempDir(), "midfile.json")
+	code, stdout, stderr := runTestCli(t, "scan", "-root", root, "-o", midfile, "-max-pixels", "4000", "-progress", "none")
+	if code != 0 || !strings.Contains(stdout, "Errors: too-large=2") || !strings.Contains(stderr, "exceeds max-pixels 4000") {
+		t.Fatalf("unexpected result: %v %s %s", code, stdout, stderr)
+	}
+
+	code, stdout, _ = runTestCli(t, "scan", "-root", root, "-o", midfile, "-max-pixels", "4096", "-progress", "none")
+	if code != 0 || !strings.Contains(stdout, "Errors: none") {
+		t.Fatalf("unexpected result: %v %s", code, stdout)
+	}
+}
+
+// TestDecodeMemory デコード中のメモリの合計が上限を超えないよう待たされるかのテスト
+func TestDecodeMemory(t *testing.T) {
+	memory := newDecodeMemory(100)
+	release, err := memory.Acquire(context.Background(), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := memory.Acquire(ctx, 60); err == nil {
+		t.Fatal("expected to wait for the release")
+	}
+
+	// NOTE: 上限より大きい画像も上限いっぱいで確保できる
+	release()
+	release, err = memory.Acquire(context.Background(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	if release, err := newDecodeMemory(0).Acquire(context.Background(), 1<<40); err != nil {
+		t.Fatal(err)
+	} else {
+		release()
+	}
+}
+
+// newTestMosaic ランダムな濃さのタイルを並べたテスト画像
+// NOTE: なめらかすぎる画像や周期的な模様はpHashが縮小方法の違いだけで大きく変わるので使わない
+func newTestMosaic(width, height, tiles int) image.Image {
+	random := rand.New(rand.NewSource(1))
+	levels := make([]uint8, tiles*tiles)
+	for i := range levels {
+		levels[i] = uint8(random.Intn(256))
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := levels[y*tiles/height*tiles+x*tiles/width]
+			img.Set(x, y, color.RGBA{v, 255 - v, v / 2, 255})
+		}
+	}
+	return img
+}
+
+// TestReduceJpeg 大きなJPEGを縮小デコードしても似ていると判定されるかのテスト
+func TestReduceJpeg(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "large.jpg")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(file, newTestMosaic(2112, 2048, 24), &jpeg.Options{Quality: 85}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	hashes := map[bool]*ImageHashInfo{}
+	for _, isReduceJpeg := range []bool{false, true} {
+		options := &scanOptions{SampleWidth: 16, SampleHeight: 16, Parallels: 1, IsReduceJpeg: isReduceJpeg}
+		imageHashes, err := readImageHashList(context.Background(), path, "", options)
+		if err != nil || len(imageHashes) != 1 {
+			t.Fatalf("unexpected hashes: %v %v", imageHashes, err)
+		}
+		hashes[isReduceJpeg] = imageHashes[0]
+	}
+
+	distance, err := hashes[false].ImageHash.Distance(hashes[true].ImageHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if distance > 10 {
+		t.Errorf("reduced hash is too far: %v", distance)
+	}
+
+	header, err := readimageutil.ReadImageHeader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := &scanOptions{SampleWidth: 16, SampleHeight: 16, IsReduceJpeg: true}
+	if scale := reduceScale(header, options); scale != readimageutil.JpegReduceScale {
+		t.Errorf("unexpected scale: %v", scale)
+	}
+	// NOTE: 縮小するとハッシュ計算の大きさを下回る場合は等倍でデコードする
+	options.SampleWidth, options.SampleHeight = 32, 32
+	if scale := reduceScale(header, options); scale != 1 {
+		t.Errorf("unexpected scale: %v", scale)
+	}
+}
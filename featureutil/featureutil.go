@@ -0,0 +1,500 @@
+package featureutil
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/bits"
+	"math/rand"
+	"slices"
+	"sort"
+)
+
+const (
+	// MaxSide 特徴点を探す前に縮小する長辺の画素数
+	MaxSide = 384
+	// MaxKeypoints 1枚の画像から取り出す特徴点の最大数
+	MaxKeypoints = 500
+
+	// fastThreshold FASTで周囲の画素が明るい（暗い）とみなす差
+	fastThreshold = 20
+	// patchRadius 向きと記述子を計算する範囲の半径
+	patchRadius = 15
+	// briefRadius 記述子で比べる画素の範囲の半径（回転しても範囲内に収まるようにpatchRadiusより小さくする）
+	briefRadius = 13
+	// maxMatchDistance 対応とみなす記述子の最大のハミング距離
+	maxMatchDistance = 64
+	// matchRatio 一番近い記述子が二番目よりこの割合以上近い場合だけ対応とみなす
+	matchRatio = 0.8
+	// ransacIterations RANSACの試行回数
+	ransacIterations = 1000
+	// inlierTolerance 射影した位置と対応点の距離の許容値（縮小後の画素数）
+	inlierTolerance = 3.0
+)
+
+// Keypoint 特徴点
+// NOTE: 座標は長辺をMaxSideに縮小した画像での位置
+type Keypoint struct {
+	X, Y  float64
+	Score int
+	Angle float64
+}
+
+// Descriptor 特徴点の周りの明るさの大小を256bitにしたもの（向きで回転済み）
+type Descriptor [4]uint64
+
+// Features 1枚の画像の特徴点と記述子
+type Features struct {
+	Keypoints   []Keypoint
+	Descriptors []Descriptor
+}
+
+// Match 2枚の画像の特徴点の対応
+type Match struct {
+	A, B     int
+	Distance int
+}
+
+// briefPairs 記述子で明るさを比べる画素の組
+// NOTE: 結果が変わらないよう固定のシードで生成する
+var briefPairs = func() [256][4]float64 {
+	random := rand.New(rand.NewSource(31))
+	sample := func() (float64, float64) {
+		for {
+			x := random.NormFloat64() * (2*patchRadius + 1) / 5
+			y := random.NormFloat64() * (2*patchRadius + 1) / 5
+			if x*x+y*y <= briefRadius*briefRadius {
+				return x, y
+			}
+		}
+	}
+
+	pairs := [256][4]float64{}
+	for i := range pairs {
+		pairs[i][0], pairs[i][1] = sample()
+		pairs[i][2], pairs[i][3] = sample()
+	}
+	return pairs
+}()
+
+// fastCircle FASTで調べる半径3の円周上の16画素
+var fastCircle = [16]image.Point{
+	{0, -3}, {1, -3}, {2, -2}, {3, -1}, {3, 0}, {3, 1}, {2, 2}, {1, 3},
+	{0, 3}, {-1, 3}, {-2, 2}, {-3, 1}, {-3, 0}, {-3, -1}, {-2, -2}, {-1, -3},
+}
+
+// grayImage 縮小したグレースケール画像
+type grayImage struct {
+	width, height int
+	pix           []uint8
+}
+
+func (gray *grayImage) at(x, y int) int {
+	return int(gray.pix[y*gray.width+x])
+}
+
+// toGray 長辺がmaxSide以下になるよう面積平均で縮小したグレースケール画像を作る
+func toGray(img image.Image, maxSide int) *grayImage {
+	bounds := img.Bounds()
+	scale := max(float64(max(bounds.Dx(), bounds.Dy()))/float64(maxSide), 1)
+	width := max(int(float64(bounds.Dx())/scale), 1)
+	height := max(int(float64(bounds.Dy())/scale), 1)
+
+	luma := func(x, y int) int {
+		return int(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+	}
+	switch src := img.(type) {
+	case *image.YCbCr:
+		luma = func(x, y int) int { return int(src.Y[src.YOffset(x, y)]) }
+	case *image.Gray:
+		luma = func(x, y int) int { return int(src.Pix[src.PixOffset(x, y)]) }
+	}
+
+	gray := &grayImage{width: width, height: height, pix: make([]uint8, width*height)}
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + int(float64(y)*scale)
+		y1 := max(bounds.Min.Y+int(float64(y+1)*scale), y0+1)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + int(float64(x)*scale)
+			x1 := max(bounds.Min.X+int(float64(x+1)*scale), x0+1)
+			sum, count := 0, 0
+			for sy := y0; sy < min(y1, bounds.Max.Y); sy++ {
+				for sx := x0; sx < min(x1, bounds.Max.X); sx++ {
+					sum += luma(sx, sy)
+					count++
+				}
+			}
+			gray.pix[y*width+x] = uint8(sum / max(count, 1))
+		}
+	}
+	return gray
+}
+
+// blur 5x5の平均でぼかした画像（記述子をノイズに強くする）
+func (gray *grayImage) blur() *grayImage {
+	const radius = 2
+	blurred := &grayImage{width: gray.width, height: gray.height, pix: make([]uint8, len(gray.pix))}
+	horizontal := make([]int, len(gray.pix))
+	for y := 0; y < gray.height; y++ {
+		for x := 0; x < gray.width; x++ {
+			sum, count := 0, 0
+			for dx := -radius; dx <= radius; dx++ {
+				if sx := x + dx; sx >= 0 && sx < gray.width {
+					sum += gray.at(sx, y)
+					count++
+				}
+			}
+			horizontal[y*gray.width+x] = sum * 16 / count
+		}
+	}
+	for y := 0; y < gray.height; y++ {
+		for x := 0; x < gray.width; x++ {
+			sum, count := 0, 0
+			for dy := -radius; dy <= radius; dy++ {
+				if sy := y + dy; sy >= 0 && sy < gray.height {
+					sum += horizontal[sy*gray.width+x]
+					count++
+				}
+			}
+			blurred.pix[y*gray.width+x] = uint8(sum / count / 16)
+		}
+	}
+	return blurred
+}
+
+// fastScore FAST-9の判定（円周上の連続した9画素以上が中心より明るいか暗い）をして強さを返す
+// NOTE: 特徴点でなければ0
+func (gray *grayImage) fastScore(x, y int) int {
+	center := gray.at(x, y)
+	classes := [16]int{}
+	for i, offset := range fastCircle {
+		switch value := gray.at(x+offset.X, y+offset.Y); {
+		case value > center+fastThreshold:
+			classes[i] = 1
+		case value < center-fastThreshold:
+			classes[i] = -1
+		}
+	}
+
+	// NOTE: 連続した9画素は上下左右の4画素のうち2画素以上を必ず含む
+	brighter, darker := 0, 0
+	for i := 0; i < 16; i += 4 {
+		switch classes[i] {
+		case 1:
+			brighter++
+		case -1:
+			darker++
+		}
+	}
+	if brighter < 2 && darker < 2 {
+		return 0
+	}
+
+	for _, class := range []int{1, -1} {
+		run := 0
+		for i := 0; i < 16+9; i++ {
+			if classes[i%16] != class {
+				run = 0
+				continue
+			}
+			run++
+			if run < 9 {
+				continue
+			}
+
+			score := 0
+			for j, offset := range fastCircle {
+				if classes[j] == class {
+					score += abs(gray.at(x+offset.X, y+offset.Y)-center) - fastThreshold
+				}
+			}
+			return score
+		}
+	}
+	return 0
+}
+
+// detect FASTで特徴点を探し、近傍で一番強いものだけを強い順にmaxKeypoints個まで返す
+func (gray *grayImage) detect(maxKeypoints int) []Keypoint {
+	margin := patchRadius + 1
+	if gray.width <= 2*margin || gray.height <= 2*margin {
+		return nil
+	}
+
+	scores := make([]int, len(gray.pix))
+	for y := margin; y < gray.height-margin; y++ {
+		for x := margin; x < gray.width-margin; x++ {
+			scores[y*gray.width+x] = gray.fastScore(x, y)
+		}
+	}
+
+	keypoints := []Keypoint{}
+	for y := margin; y < gray.height-margin; y++ {
+		for x := margin; x < gray.width-margin; x++ {
+			score := scores[y*gray.width+x]
+			if score == 0 {
+				continue
+			}
+
+			isMax := true
+			for dy := -1; dy <= 1 && isMax; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					neighbor := scores[(y+dy)*gray.width+x+dx]
+					// NOTE: 同じ強さなら先に見つかった方（左上）を残す
+					if (dx != 0 || dy != 0) && (neighbor > score || (neighbor == score && (dy < 0 || (dy == 0 && dx < 0)))) {
+						isMax = false
+						break
+					}
+				}
+			}
+			if isMax {
+				keypoints = append(keypoints, Keypoint{X: float64(x), Y: float64(y), Score: score})
+			}
+		}
+	}
+
+	sort.SliceStable(keypoints, func(i, j int) bool {
+		return keypoints[i].Score > keypoints[j].Score
+	})
+	if len(keypoints) > maxKeypoints {
+		keypoints = keypoints[:maxKeypoints]
+	}
+	return keypoints
+}
+
+// orientation 特徴点の周りの明るさの重心の向き
+func (gray *grayImage) orientation(x, y int) float64 {
+	m10, m01 := 0, 0
+	for dy := -patchRadius; dy <= patchRadius; dy++ {
+		for dx := -patchRadius; dx <= patchRadius; dx++ {
+			if dx*dx+dy*dy > patchRadius*patchRadius {
+				continue
+			}
+			value := gray.at(x+dx, y+dy)
+			m10 += dx * value
+			m01 += dy * value
+		}
+	}
+	return math.Atan2(float64(m01), float64(m10))
+}
+
+// describe 向きで回転した組で明るさを比べて記述子を作る
+func (gray *grayImage) describe(keypoint Keypoint) Descriptor {
+	x, y := int(keypoint.X), int(keypoint.Y)
+	sin, cos := math.Sincos(keypoint.Angle)
+	rotate := func(px, py float64) int {
+		rx := int(math.Round(px*cos - py*sin))
+		ry := int(math.Round(px*sin + py*cos))
+		return gray.at(x+rx, y+ry)
+	}
+
+	descriptor := Descriptor{}
+	for i, pair := range briefPairs {
+		if rotate(pair[0], pair[1]) < rotate(pair[2], pair[3]) {
+			descriptor[i/64] |= 1 << (i % 64)
+		}
+	}
+	return descriptor
+}
+
+// Extract 画像の特徴点と記述子を計算する
+// NOTE: 長辺をMaxSideに縮小してから探すので、大きさの違う同じ画像でもおおよそ同じ特徴点になる
+func Extract(img image.Image) *Features {
+	gray := toGray(img, MaxSide)
+	blurred := gray.blur()
+
+	keypoints := gray.detect(MaxKeypoints)
+	features := &Features{
+		Keypoints:   make([]Keypoint, 0, len(keypoints)),
+		Descriptors: make([]Descriptor, 0, len(keypoints)),
+	}
+	for _, keypoint := range keypoints {
+		keypoint.Angle = gray.orientation(int(keypoint.X), int(keypoint.Y))
+		features.Keypoints = append(features.Keypoints, keypoint)
+		features.Descriptors = append(features.Descriptors, blurred.describe(keypoint))
+	}
+	return features
+}
+
+// hammingDistance 記述子のハミング距離
+func hammingDistance(lhs, rhs *Descriptor) int {
+	return bits.OnesCount64(lhs[0]^rhs[0]) + bits.OnesCount64(lhs[1]^rhs[1]) + bits.OnesCount64(lhs[2]^rhs[2]) + bits.OnesCount64(lhs[3]^rhs[3])
+}
+
+// nearest descriptorsの中でdescriptorに一番近いものと、その距離・二番目に近い距離
+func nearest(descriptor *Descriptor, descriptors []Descriptor) (int, int, int) {
+	best, second, bestIndex := math.MaxInt, math.MaxInt, -1
+	for i := range descriptors {
+		distance := hammingDistance(descriptor, &descriptors[i])
+		if distance < best {
+			best, second, bestIndex = distance, best, i
+		} else if distance < second {
+			second = distance
+		}
+	}
+	return bestIndex, best, second
+}
+
+// MatchFeatures aとbの特徴点でお互いに一番近いもの同士を対応付ける
+// NOTE: 二番目に近いものと区別がつかない対応（繰り返し模様など）は除く
+func MatchFeatures(a, b *Features) []Match {
+	matches := []Match{}
+	for i := range a.Descriptors {
+		j, best, second := nearest(&a.Descriptors[i], b.Descriptors)
+		if j < 0 || best > maxMatchDistance {
+			continue
+		}
+		if second != math.MaxInt && float64(best) >= matchRatio*float64(second) {
+			continue
+		}
+		if reverse, _, _ := nearest(&b.Descriptors[j], a.Descriptors); reverse != i {
+			continue
+		}
+		matches = append(matches, Match{A: i, B: j, Distance: best})
+	}
+	return matches
+}
+
+// homography 3x3の射影変換（h[8]は1）
+type homography [9]float64
+
+// project 点を射影する
+func (h *homography) project(x, y float64) (float64, float64, bool) {
+	w := h[6]*x + h[7]*y + h[8]
+	if math.Abs(w) < 1e-9 {
+		return 0, 0, false
+	}
+	return (h[0]*x + h[1]*y + h[2]) / w, (h[3]*x + h[4]*y + h[5]) / w, true
+}
+
+// solveHomography 4組の対応点から射影変換を求める
+// NOTE: 3点が同一直線上にあるなど解けない場合はfalse
+func solveHomography(src, dst [4][2]float64) (homography, bool) {
+	system := [8][9]float64{}
+	for i := 0; i < 4; i++ {
+		x, y := src[i][0], src[i][1]
+		u, v := dst[i][0], dst[i][1]
+		system[2*i] = [9]float64{x, y, 1, 0, 0, 0, -u * x, -u * y, u}
+		system[2*i+1] = [9]float64{0, 0, 0, x, y, 1, -v * x, -v * y, v}
+	}
+
+	// NOTE: 部分ピボット選択付きのガウスの消去法
+	for col := 0; col < 8; col++ {
+		pivot := col
+		for row := col + 1; row < 8; row++ {
+			if math.Abs(system[row][col]) > math.Abs(system[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(system[pivot][col]) < 1e-9 {
+			return homography{}, false
+		}
+		system[col], system[pivot] = system[pivot], system[col]
+		for row := 0; row < 8; row++ {
+			if row == col {
+				continue
+			}
+			factor := system[row][col] / system[col][col]
+			for k := col; k < 9; k++ {
+				system[row][k] -= factor * system[col][k]
+			}
+		}
+	}
+
+	h := homography{}
+	for i := 0; i < 8; i++ {
+		h[i] = system[i][8] / system[i][i]
+	}
+	h[8] = 1
+	return h, true
+}
+
+// Transform 対応から推定したaからbへの変換
+type Transform struct {
+	// NOTE: 推定した射影変換に当てはまる対応の数
+	Inliers int
+	// NOTE: 回転の角度（度、-180から180）
+	Rotation float64
+}
+
+// rotation 射影変換の回転の角度（度）
+// NOTE: 縦横の縮尺が同じ相似変換に近いとみなして線形部分から求める
+func (h *homography) rotation() float64 {
+	return math.Atan2(h[3]-h[1], h[0]+h[4]) * 180 / math.Pi
+}
+
+// CountInliers RANSACで対応に当てはまる射影変換を推定し、当てはまる対応の数を返す
+// NOTE: 4組あれば必ず当てはまるので、4組以下なら0を返す
+func CountInliers(a, b *Features, matches []Match) int {
+	return EstimateTransform(a, b, matches).Inliers
+}
+
+// EstimateTransform RANSACで対応に当てはまる射影変換を推定する
+// NOTE: 4組あれば必ず当てはまるので、4組以下なら空のTransformを返す
+func EstimateTransform(a, b *Features, matches []Match) Transform {
+	if len(matches) <= 4 {
+		return Transform{}
+	}
+
+	points := func(indices [4]int) ([4][2]float64, [4][2]float64) {
+		src, dst := [4][2]float64{}, [4][2]float64{}
+		for i, index := range indices {
+			match := matches[index]
+			src[i] = [2]float64{a.Keypoints[match.A].X, a.Keypoints[match.A].Y}
+			dst[i] = [2]float64{b.Keypoints[match.B].X, b.Keypoints[match.B].Y}
+		}
+		return src, dst
+	}
+
+	// NOTE: 結果が変わらないよう固定のシードを使う
+	random := rand.New(rand.NewSource(1))
+	best := Transform{}
+	for iteration := 0; iteration < ransacIterations; iteration++ {
+		indices := [4]int{}
+		for i := 0; i < len(indices); {
+			index := random.Intn(len(matches))
+			if !slices.Contains(indices[:i], index) {
+				indices[i] = index
+				i++
+			}
+		}
+
+		h, ok := solveHomography(points(indices))
+		if !ok {
+			continue
+		}
+
+		inliers := 0
+		for _, match := range matches {
+			keypointA, keypointB := a.Keypoints[match.A], b.Keypoints[match.B]
+			x, y, ok := h.project(keypointA.X, keypointA.Y)
+			if ok && math.Hypot(x-keypointB.X, y-keypointB.Y) <= inlierTolerance {
+				inliers++
+			}
+		}
+		if inliers > best.Inliers {
+			best = Transform{Inliers: inliers, Rotation: h.rotation()}
+		}
+		if best.Inliers == len(matches) {
+			break
+		}
+	}
+	return best
+}
+
+// Verify 2枚の画像の特徴点を対応付け、幾何的に整合する対応の数を返す
+func Verify(a, b *Features) int {
+	return CountInliers(a, b, MatchFeatures(a, b))
+}
+
+// VerifyTransform 2枚の画像の特徴点を対応付け、幾何的に整合する変換を推定する
+func VerifyTransform(a, b *Features) Transform {
+	return EstimateTransform(a, b, MatchFeatures(a, b))
+}
+
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,156 @@
+package featureutil
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// newTestScene 大きさと色がばらばらの四角と円を重ねたテスト画像
+func newTestScene(seed int64, width, height int) *image.RGBA {
+	random := rand.New(rand.NewSource(seed))
+	scene := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			scene.Set(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), 128, 255})
+		}
+	}
+
+	for i := 0; i < 80; i++ {
+		c := color.RGBA{uint8(random.Intn(256)), uint8(random.Intn(256)), uint8(random.Intn(256)), 255}
+		x, y := random.Intn(width), random.Intn(height)
+		size := 8 + random.Intn(width/6)
+		if i%2 == 0 {
+			draw.Draw(scene, image.Rect(x, y, x+size, y+size*2/3), image.NewUniform(c), image.Point{}, draw.Src)
+			continue
+		}
+		for dy := -size / 2; dy <= size/2; dy++ {
+			for dx := -size / 2; dx <= size/2; dx++ {
+				if dx*dx+dy*dy <= size*size/4 {
+					scene.Set(x+dx, y+dy, c)
+				}
+			}
+		}
+	}
+	return scene
+}
+
+// resizeNearest 最近傍で拡大縮小した画像
+func resizeNearest(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dst.Set(x, y, src.At(bounds.Min.X+x*bounds.Dx()/width, bounds.Min.Y+y*bounds.Dy()/height))
+		}
+	}
+	return dst
+}
+
+// reencodeJpeg JPEGで圧縮し直した画像
+func reencodeJpeg(t *testing.T, src image.Image, quality int) image.Image {
+	t.Helper()
+	encoded := &bytes.Buffer{}
+	if err := jpeg.Encode(encoded, src, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+// TestVerify 同じ画像の加工違いは対応が多く、別の画像は少ないかのテスト
+func TestVerify(t *testing.T) {
+	original := newTestScene(1, 640, 480)
+	features := Extract(original)
+	if len(features.Keypoints) < 100 || len(features.Keypoints) != len(features.Descriptors) {
+		t.Fatalf("too few keypoints: %v", len(features.Keypoints))
+	}
+
+	brighter := image.NewRGBA(original.Bounds())
+	for i, value := range original.Pix {
+		if i%4 != 3 {
+			value = uint8(min(int(value)+24, 255))
+		}
+		brighter.Pix[i] = value
+	}
+
+	variants := map[string]image.Image{
+		"same":     original,
+		"resized":  resizeNearest(original, 400, 300),
+		"jpeg":     reencodeJpeg(t, original, 60),
+		"brighter": brighter,
+		"cropped":  original.SubImage(image.Rect(32, 24, 608, 456)),
+	}
+	for name, variant := range variants {
+		if inliers := Verify(features, Extract(variant)); inliers < 30 {
+			t.Errorf("%s: too few inliers: %v", name, inliers)
+		}
+	}
+
+	for seed := int64(2); seed < 5; seed++ {
+		if inliers := Verify(features, Extract(newTestScene(seed, 640, 480))); inliers >= 10 {
+			t.Errorf("seed %d: too many inliers for a different image: %v", seed, inliers)
+		}
+	}
+}
+
+// TestSolveHomography 4組の対応点から射影変換を求められるかのテスト
+func TestSolveHomography(t *testing.T) {
+	src := [4][2]float64{{0, 0}, {100, 0}, {100, 100}, {0, 100}}
+	dst := [4][2]float64{{10, 20}, {60, 20}, {60, 70}, {10, 70}}
+	h, ok := solveHomography(src, dst)
+	if !ok {
+		t.Fatal("failed to solve")
+	}
+	if x, y, ok := h.project(50, 50); !ok || x < 34.99 || x > 35.01 || y < 44.99 || y > 45.01 {
+		t.Errorf("unexpected projection: %v %v", x, y)
+	}
+
+	collinear := [4][2]float64{{0, 0}, {1, 1}, {2, 2}, {3, 3}}
+	if _, ok := solveHomography(collinear, collinear); ok {
+		t.Error("expected degenerate points")
+	}
+}
+
+// rotateNearest 中心で指定の角度（度）だけ回転した画像（はみ出した部分は黒）
+func rotateNearest(src *image.RGBA, degrees float64) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	sin, cos := math.Sincos(degrees * math.Pi / 180)
+	centerX, centerY := float64(bounds.Dx())/2, float64(bounds.Dy())/2
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			// NOTE: 回転後の画素から回転前の画素を逆に求める
+			dx, dy := float64(x)-centerX, float64(y)-centerY
+			srcX, srcY := int(cos*dx+sin*dy+centerX), int(-sin*dx+cos*dy+centerY)
+			if image.Pt(srcX, srcY).In(bounds) {
+				dst.Set(x, y, src.At(srcX, srcY))
+			}
+		}
+	}
+	return dst
+}
+
+// TestVerifyTransform 回転した画像の回転の角度を推定できるかのテスト
+func TestVerifyTransform(t *testing.T) {
+	original := newTestScene(1, 640, 480)
+	features := Extract(original)
+
+	if transform := VerifyTransform(features, Extract(resizeNearest(original, 400, 300))); transform.Inliers < 30 || math.Abs(transform.Rotation) > 1 {
+		t.Errorf("unexpected transform of resized image: %+v", transform)
+	}
+	for _, degrees := range []float64{-10, 5, 15} {
+		transform := VerifyTransform(features, Extract(rotateNearest(original, degrees)))
+		if transform.Inliers < 30 || math.Abs(transform.Rotation-degrees) > 1.5 {
+			t.Errorf("%v degrees: unexpected transform: %+v", degrees, transform)
+		}
+	}
+}
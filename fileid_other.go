@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import (
+	"io/fs"
+)
+
+// getFileID inodeを持たない環境では同一性を判定できない
+func getFileID(info fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// グループの出力形式
+const (
+	groupFormatPaths   = "paths"
+	groupFormatMembers = "members"
+	groupFormatAuto    = "auto"
+)
+
+// SimilarGroupMember 出力するグループの要素
+type SimilarGroupMember struct {
+	Filepath  string
+	Root      string
+	HardLinks []string `json:",omitempty"`
+	// NOTE: グループの基準の画像と切り抜き同士が似ていた場合にどの切り抜きか
+	Crop string `json:",omitempty"`
+	// NOTE: 特徴点で確かめた場合の幾何的に整合する対応の数
+	Inliers int `json:",omitempty"`
+	// NOTE: -color-sensitivityを指定した場合にグループの基準の画像の色違いか（"duplicate"か"color-variant"）
+	Color         string  `json:",omitempty"`
+	ColorDistance float64 `json:",omitempty"`
+	// NOTE: グループの基準の画像との関係（"identical-bytes"、"resized"など）
+	Relation string `json:",omitempty"`
+	// NOTE: -qualityを指定した場合のグループ内での画質（apply -keep=qualityで使う）
+	Quality *imageQuality `json:",omitempty"`
+}
+
+// toSimilarGroupMembers パスだけのグループを走査元付きのグループに変換する
+func toSimilarGroupMembers(similarGroupsList [][]string, infos map[string]*ImageHashInfo) [][]SimilarGroupMember {
+	membersList := make([][]SimilarGroupMember, 0, len(similarGroupsList))
+	for _, similarGroups := range similarGroupsList {
+		members := make([]SimilarGroupMember, 0, len(similarGroups))
+		for _, path := range similarGroups {
+			member := SimilarGroupMember{Filepath: path}
+			if info, ok := infos[path]; ok {
+				member.Root = info.Root
+				member.HardLinks = info.HardLinks
+				member.Quality = info.Quality
+				if matched := info.Matched; matched != nil {
+					member.Crop = matched.Crop
+					member.Inliers = matched.Inliers
+					member.Color = matched.Color
+					member.ColorDistance = matched.ColorDistance
+					member.Relation = matched.Relation
+				}
+			}
+			members = append(members, member)
+		}
+		membersList = append(membersList, members)
+	}
+	return membersList
+}
+
+// hasMultipleRoots 走査元が複数あるか
+func hasMultipleRoots(infos map[string]*ImageHashInfo) bool {
+	uniqueRoots := map[string]bool{}
+	for _, info := range infos {
+		uniqueRoots[info.Root] = true
+	}
+	return len(uniqueRoots) > 1
+}
+
+// hasMatchDetails 切り抜き同士が似ていた画像や特徴点・色で確かめた画像、画質を計算した画像があるか
+// NOTE: 基準の画像との関係はほぼ全ての画像にあるので含めない（関係を出力するにはmembers形式を指定する）
+func hasMatchDetails(infos map[string]*ImageHashInfo) bool {
+	for _, info := range infos {
+		if info.Quality != nil {
+			return true
+		}
+		if matched := info.Matched; matched != nil && (len(matched.Crop) != 0 || matched.Inliers != 0 || len(matched.Color) != 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// similarGroupsOutput 出力形式に合わせてグループを変換する
+// NOTE: autoの場合は走査元が複数あるか、切り抜きや特徴点、色、画質の情報があるときだけmembers形式にする
+func similarGroupsOutput(similarGroupsList [][]string, infos map[string]*ImageHashInfo, groupFormat string) (any, error) {
+	switch groupFormat {
+	case groupFormatPaths:
+		return similarGroupsList, nil
+	case groupFormatMembers:
+		return toSimilarGroupMembers(similarGroupsList, infos), nil
+	case groupFormatAuto:
+		if hasMultipleRoots(infos) || hasMatchDetails(infos) {
+			return toSimilarGroupMembers(similarGroupsList, infos), nil
+		}
+		return similarGroupsList, nil
+	default:
+		return nil, fmt.Errorf("invalid group-format: %s", groupFormat)
+	}
+}
+
+// readSimilarGroups グループの出力ファイルを読み込む
+// NOTE: paths形式・members形式のどちらでも読めるようにする
+func readSimilarGroups(path string) ([][]SimilarGroupMember, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed os.ReadFile: %s %w", path, err)
+	}
+
+	rawGroupsList := [][]json.RawMessage{}
+	if err := json.Unmarshal(data, &rawGroupsList); err != nil {
+		return nil, fmt.Errorf("failed json.Unmarshal: %s %w", path, err)
+	}
+
+	membersList := make([][]SimilarGroupMember, 0, len(rawGroupsList))
+	for _, rawGroups := range rawGroupsList {
+		members := make([]SimilarGroupMember, 0, len(rawGroups))
+		for _, raw := range rawGroups {
+			member := SimilarGroupMember{}
+			if err := json.Unmarshal(raw, &member.Filepath); err != nil {
+				if err := json.Unmarshal(raw, &member); err != nil {
+					return nil, fmt.Errorf("failed json.Unmarshal: %s %w", path, err)
+				}
+			}
+			members = append(members, member)
+		}
+		membersList = append(membersList, members)
+	}
+	return membersList, nil
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/akinobufujii/similar_images_grouping/hashcollectorpb"
+	"github.com/bradhe/stopwatch"
+	"github.com/corona10/goimagehash"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// hashCollectorWorkerKey ワーカー名を渡すメタデータのキー
+const hashCollectorWorkerKey = "x-worker-name"
+
+// NOTE: ワーカーからの応答がない接続を確認する間隔と、確認の応答を待つ時間
+const (
+	hashCollectorKeepaliveTime    = 30 * time.Second
+	hashCollectorKeepaliveTimeout = 10 * time.Second
+)
+
+// hashKinds goimagehash.Kindとprotoのハッシュの種類（値は同じ）
+var hashKinds = map[goimagehash.Kind]hashcollectorpb.HashKind{
+	goimagehash.AHash: hashcollectorpb.HashKind_HASH_KIND_AHASH,
+	goimagehash.PHash: hashcollectorpb.HashKind_HASH_KIND_PHASH,
+	goimagehash.DHash: hashcollectorpb.HashKind_HASH_KIND_DHASH,
+	goimagehash.WHash: hashcollectorpb.HashKind_HASH_KIND_WHASH,
+}
+
+// imageHashToProto ハッシュをprotoのメッセージにする
+func imageHashToProto(imageHash *goimagehash.ExtImageHash) *hashcollectorpb.ImageHash {
+	return &hashcollectorpb.ImageHash{
+		Kind:  hashKinds[imageHash.GetKind()],
+		Bits:  int32(imageHash.Bits()),
+		Words: imageHash.GetHash(),
+	}
+}
+
+// imageHashFromProto protoのメッセージからハッシュを作る
+// NOTE: ビット数と語数が合わないハッシュは比較できないのでエラー
+func imageHashFromProto(message *hashcollectorpb.ImageHash) (*goimagehash.ExtImageHash, error) {
+	kind := goimagehash.Kind(message.GetKind())
+	if _, ok := hashKinds[kind]; !ok {
+		return nil, fmt.Errorf("unknown hash kind: %v", message.GetKind())
+	}
+	bits := int(message.GetBits())
+	if bits <= 0 || len(message.GetWords()) != (bits+63)/64 {
+		return nil, fmt.Errorf("invalid hash size: %v bits %v words", bits, len(message.GetWords()))
+	}
+	return goimagehash.NewExtImageHash(message.GetWords(), kind, bits), nil
+}
+
+// imageHashInfoToProto ImageHashInfoをprotoのメッセージにする（中間ファイルに書き出す項目と同じ）
+func imageHashInfoToProto(info *ImageHashInfo) *hashcollectorpb.ImageHashInfo {
+	message := &hashcollectorpb.ImageHashInfo{
+		Filepath:       info.Filepath,
+		Root:           info.Root,
+		HardLinks:      info.HardLinks,
+		Hash:           imageHashToProto(info.ImageHash),
+		IsTrimmed:      info.IsTrimmed,
+		ColorSignature: info.ColorSignature,
+		Width:          int32(info.Width),
+		Height:         int32(info.Height),
+		ContentHash:    info.ContentHash,
+		PixelHash:      info.PixelHash,
+	}
+	for _, crop := range info.Crops {
+		message.Crops = append(message.Crops, &hashcollectorpb.CropHash{Name: crop.Name, Hash: imageHashToProto(crop.ImageHash)})
+	}
+	return message
+}
+
+// imageHashInfoFromProto protoのメッセージからImageHashInfoを作る
+func imageHashInfoFromProto(message *hashcollectorpb.ImageHashInfo) (*ImageHashInfo, error) {
+	imageHash, err := imageHashFromProto(message.GetHash())
+	if err != nil {
+		return nil, fmt.Errorf("failed imageHashFromProto: %s %w", message.GetFilepath(), err)
+	}
+	info := &ImageHashInfo{
+		Filepath:       message.GetFilepath(),
+		Root:           message.GetRoot(),
+		HardLinks:      message.GetHardLinks(),
+		ImageHash:      imageHash,
+		IsTrimmed:      message.GetIsTrimmed(),
+		ColorSignature: message.GetColorSignature(),
+		Width:          int(message.GetWidth()),
+		Height:         int(message.GetHeight()),
+		ContentHash:    message.GetContentHash(),
+		PixelHash:      message.GetPixelHash(),
+	}
+	for _, crop := range message.GetCrops() {
+		cropHash, err := imageHashFromProto(crop.GetHash())
+		if err != nil {
+			return nil, fmt.Errorf("failed imageHashFromProto: %s %s %w", message.GetFilepath(), crop.GetName(), err)
+		}
+		info.Crops = append(info.Crops, CropHash{Name: crop.GetName(), ImageHash: cropHash})
+	}
+	return info, nil
+}
+
+// workerState コーディネータから見たワーカーの状態
+type workerState int
+
+const (
+	workerUploading workerState = iota
+	workerFinished
+	workerFailed
+)
+
+// workerStatus ワーカー1つ分の状態と失敗した理由
+type workerStatus struct {
+	State workerState
+	Err   error
+}
+
+// hashCollector ワーカーから送られてきたハッシュを1つのParallelCompListにまとめるコーディネータ
+// NOTE: ワーカーは名前で区別する。予定していた数のワーカーがすべて送信し終えるか失敗したらDoneをcloseする
+type hashCollector struct {
+	hashcollectorpb.UnimplementedHashCollectorServer
+
+	mu              sync.Mutex
+	container       ParallelCompList
+	expectedWorkers int
+	workers         map[string]*workerStatus
+	// NOTE: 最初に受信したハッシュ。種類とビット数がワーカー間でそろっていないとグルーピングできない
+	layout *goimagehash.ExtImageHash
+	isDone bool
+	done   chan struct{}
+}
+
+func newHashCollector(expectedWorkers int) *hashCollector {
+	return &hashCollector{
+		expectedWorkers: expectedWorkers,
+		workers:         map[string]*workerStatus{},
+		done:            make(chan struct{}),
+	}
+}
+
+// begin ワーカーのアップロードを受け付ける
+// NOTE: 失敗したワーカーは同じ名前でやり直せるが、送信中や送信し終えたワーカーと同じ名前は受け付けない
+func (collector *hashCollector) begin(worker string) error {
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+
+	if collector.isDone {
+		return status.Errorf(codes.Unavailable, "coordinator is no longer accepting uploads")
+	}
+	if len(worker) == 0 {
+		return status.Errorf(codes.InvalidArgument, "worker name is required")
+	}
+	if workerStatus, ok := collector.workers[worker]; ok {
+		if workerStatus.State != workerFailed {
+			return status.Errorf(codes.AlreadyExists, "worker %q has already uploaded", worker)
+		}
+	} else if len(collector.workers) >= collector.expectedWorkers {
+		return status.Errorf(codes.ResourceExhausted, "unexpected worker %q: already %v workers", worker, collector.expectedWorkers)
+	}
+	collector.workers[worker] = &workerStatus{State: workerUploading}
+	return nil
+}
+
+// finish ワーカーから受信し終えたハッシュを追加する
+// NOTE: 期限切れなどで既に失敗扱いにしたワーカーの結果は混ぜない
+func (collector *hashCollector) finish(worker string, received ParallelCompList) error {
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+
+	workerStatus := collector.workers[worker]
+	if workerStatus.State != workerUploading {
+		return status.Errorf(codes.DeadlineExceeded, "worker %q: %v", worker, workerStatus.Err)
+	}
+	collector.container = append(collector.container, received...)
+	workerStatus.State = workerFinished
+	collector.closeIfDoneLocked()
+	return nil
+}
+
+// checkLayout ハッシュ（切り抜きも含む）の種類とビット数が最初に受信したハッシュと同じか確かめる
+// NOTE: -hashや-samplew/-samplehを間違えたワーカーを、全員を待ってからのグルーピングではなく受信した時点で見つける
+func (collector *hashCollector) checkLayout(info *ImageHashInfo) error {
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+
+	for _, imageHash := range packCropHashes(info) {
+		if collector.layout == nil {
+			collector.layout = imageHash
+			continue
+		}
+		if imageHash.GetKind() != collector.layout.GetKind() || imageHash.Bits() != collector.layout.Bits() {
+			return status.Errorf(codes.InvalidArgument, "hash layout mismatch: %s %v %v bits, expected %v %v bits (use the same -hash, -samplew and -sampleh on all workers)",
+				info.Filepath, imageHash.GetKind(), imageHash.Bits(), collector.layout.GetKind(), collector.layout.Bits())
+		}
+	}
+	return nil
+}
+
+// fail ワーカーのストリームが途中で切れたなどで失敗扱いにする
+func (collector *hashCollector) fail(worker string, err error) {
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+
+	if workerStatus := collector.workers[worker]; workerStatus.State == workerUploading {
+		workerStatus.State = workerFailed
+		workerStatus.Err = err
+	}
+	collector.closeIfDoneLocked()
+}
+
+// closeIfDoneLocked 予定していた数のワーカーが送信し終えるか失敗していればDoneをcloseする
+func (collector *hashCollector) closeIfDoneLocked() {
+	if collector.isDone || len(collector.workers) < collector.expectedWorkers {
+		return
+	}
+	for _, workerStatus := range collector.workers {
+		if workerStatus.State == workerUploading {
+			return
+		}
+	}
+	collector.isDone = true
+	close(collector.done)
+}
+
+// Expire 送信中のワーカーを失敗扱いにして受け付けを終える
+// NOTE: 一度も接続しなかったワーカーはFailuresのmissingに数える
+func (collector *hashCollector) Expire(err error) {
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+
+	if collector.isDone {
+		return
+	}
+	for _, workerStatus := range collector.workers {
+		if workerStatus.State == workerUploading {
+			workerStatus.State = workerFailed
+			workerStatus.Err = err
+		}
+	}
+	collector.isDone = true
+	close(collector.done)
+}
+
+// Failures 失敗したワーカー（名前の順に"名前: 理由"）と、一度も接続しなかったワーカーの数
+func (collector *hashCollector) Failures() ([]string, int) {
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+
+	failures := []string{}
+	for _, worker := range slices.Sorted(maps.Keys(collector.workers)) {
+		if workerStatus := collector.workers[worker]; workerStatus.State == workerFailed {
+			failures = append(failures, fmt.Sprintf("%s: %v", worker, workerStatus.Err))
+		}
+	}
+	return failures, max(0, collector.expectedWorkers-len(collector.workers))
+}
+
+// Upload ワーカーからのストリームを受信し終わるまでcontainerに追加する
+func (collector *hashCollector) Upload(stream grpc.ClientStreamingServer[hashcollectorpb.ImageHashInfo, hashcollectorpb.UploadSummary]) error {
+	worker := ""
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok && len(md.Get(hashCollectorWorkerKey)) != 0 {
+		worker = md.Get(hashCollectorWorkerKey)[0]
+	}
+	if err := collector.begin(worker); err != nil {
+		return err
+	}
+
+	// NOTE: ストリームが途中で切れた場合にも中途半端に混ざらないよう受信し終えてからまとめて追加する
+	received := ParallelCompList{}
+	for {
+		message, err := stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			collector.fail(worker, err)
+			return err
+		}
+		info, err := imageHashInfoFromProto(message)
+		if err != nil {
+			err = status.Errorf(codes.InvalidArgument, "%v", err)
+			collector.fail(worker, err)
+			return err
+		}
+		if err := collector.checkLayout(info); err != nil {
+			collector.fail(worker, err)
+			return err
+		}
+
+		// NOTE: ワーカー間でパスが衝突しないようにワーカー名を付ける
+		info.Filepath = worker + ":" + info.Filepath
+		received.Append(info)
+	}
+
+	if err := collector.finish(worker, received); err != nil {
+		return err
+	}
+	return stream.SendAndClose(&hashcollectorpb.UploadSummary{Worker: worker, Received: int64(len(received))})
+}
+
+// Done 予定していたワーカーがすべて送信し終えるか失敗したらcloseされる
+func (collector *hashCollector) Done() <-chan struct{} {
+	return collector.done
+}
+
+// Container これまでに受信したハッシュを取り出す
+func (collector *hashCollector) Container() *ParallelCompList {
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+
+	container := make(ParallelCompList, len(collector.container))
+	copy(container, collector.container)
+	return &container
+}
+
+// uploadImageHash root以下の画像のハッシュを計算しながらコーディネータに送信する
+func uploadImageHash(ctx context.Context, conn grpc.ClientConnInterface, worker, root string, options *scanOptions) (*hashcollectorpb.UploadSummary, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if len(worker) != 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, hashCollectorWorkerKey, worker)
+	}
+
+	stream, err := hashcollectorpb.NewHashCollectorClient(conn).Upload(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed HashCollectorClient.Upload: %w", err)
+	}
+
+	err = walkImageHash(ctx, newRootSources(root), options, func(info *ImageHashInfo) error {
+		return stream.Send(imageHashInfoToProto(info))
+	})
+	if errors.Is(err, io.EOF) {
+		// NOTE: コーディネータがストリームを終えた場合はCloseAndRecvで理由を受け取る
+		_, err = stream.CloseAndRecv()
+		return nil, fmt.Errorf("failed HashCollectorClient.Upload: %w", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed walkImageHash: %w", err)
+	}
+
+	summary, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, fmt.Errorf("failed CloseAndRecv: %w", err)
+	}
+	return summary, nil
+}
+
+// runCoordinator coordinatorサブコマンド
+func runCoordinator(args []string, env *cliEnv) error {
+	cmd := struct {
+		Addr                      string
+		Workers                   int
+		WriteIntermediateFilename string
+		Output                    string
+		Threshold                 int
+		Parallels                 int
+		Timeout                   time.Duration
+	}{}
+	flags := env.newFlagSet("coordinator", "", "Wait for workers to upload image hashes, then group them.")
+	flags.StringVar(&cmd.Addr, "addr", ":50051", "listen address")
+	flags.IntVar(&cmd.Workers, "workers", 1, "number of workers to wait for")
+	flags.StringVar(&cmd.WriteIntermediateFilename, "write-midfile", "midfile.json", "write intermediate filename(json)")
+	flags.StringVar(&cmd.Output, "o", "similar_groups.json", "output filename(json)")
+	flags.IntVar(&cmd.Threshold, "threshold", 10, "pHash threshold")
+	flags.IntVar(&cmd.Parallels, "j", runtime.NumCPU(), "parallel num of comparisons while grouping")
+	flags.DurationVar(&cmd.Timeout, "timeout", 0, "give up on workers that have not finished uploading after this duration and group the rest (0 is no limit)")
+	if err := env.parseFlags(flags, args); err != nil {
+		return err
+	}
+	if cmd.Workers < 1 {
+		return env.usageError(flags, "coordinator: invalid workers: %v", cmd.Workers)
+	}
+	if cmd.Timeout < 0 {
+		return env.usageError(flags, "coordinator: invalid timeout: %v", cmd.Timeout)
+	}
+
+	listener, err := net.Listen("tcp", cmd.Addr)
+	if err != nil {
+		return fmt.Errorf("failed net.Listen: %s %w", cmd.Addr, err)
+	}
+
+	collector := newHashCollector(cmd.Workers)
+	// NOTE: 落ちたマシンのワーカーは接続が切れないことがあるので、応答がなければストリームを切って失敗扱いにする
+	server := grpc.NewServer(grpc.KeepaliveParams(keepalive.ServerParameters{Time: hashCollectorKeepaliveTime, Timeout: hashCollectorKeepaliveTimeout}))
+	hashcollectorpb.RegisterHashCollectorServer(server, collector)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var deadline <-chan time.Time
+	if cmd.Timeout > 0 {
+		timer := time.NewTimer(cmd.Timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	go func() {
+		// NOTE: 全ワーカーの送信完了（失敗も含む）、期限切れか中断でサーバを止める
+		select {
+		case <-collector.Done():
+			server.GracefulStop()
+		case <-deadline:
+			collector.Expire(fmt.Errorf("timed out after %v", cmd.Timeout))
+			server.Stop()
+		case <-ctx.Done():
+			server.Stop()
+		}
+	}()
+
+	watch := stopwatch.Start()
+
+	fmt.Fprintf(env.Stdout, "Listen: %v (waiting for %v workers)\n", cmd.Addr, cmd.Workers)
+	if err := server.Serve(listener); err != nil {
+		return fmt.Errorf("failed Serve: %w", err)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	container := collector.Container()
+
+	watch.Stop()
+	fmt.Fprintf(env.Stdout, "ReadFiles: %v\n", watch.String())
+
+	// NOTE: 失敗したワーカーの分を除いてグルーピングし、最後にエラーにする
+	failures, missing := collector.Failures()
+	for _, failure := range failures {
+		fmt.Fprintf(env.Stdout, "FailedWorker: %v\n", failure)
+	}
+	if missing > 0 {
+		fmt.Fprintf(env.Stdout, "MissingWorkers: %v\n", missing)
+	}
+
+	if len(cmd.WriteIntermediateFilename) != 0 && !container.IsEmpty() {
+		if err := container.Serialize(cmd.WriteIntermediateFilename); err != nil {
+			return err
+		}
+	}
+
+	watch = stopwatch.Start()
+
+	similarGroupsList, err := groupingSimilarImages(container, &groupingOptions{Threshold: cmd.Threshold, Parallels: cmd.Parallels}, nil)
+	if err != nil {
+		return err
+	}
+
+	watch.Stop()
+	fmt.Fprintf(env.Stdout, "GroupingFiles: %v\n", watch.String())
+
+	if err := writeJson(cmd.Output, similarGroupsList); err != nil {
+		return err
+	}
+	if len(failures) != 0 || missing > 0 {
+		return fmt.Errorf("%v of %v workers did not finish uploading", len(failures)+missing, cmd.Workers)
+	}
+	return nil
+}
+
+// runWorker workerサブコマンド
+func runWorker(args []string, env *cliEnv) error {
+	cmd := struct {
+		Coordinator   string
+		Name          string
+		Root          string
+		Parallels     int
+		IOWorkers     int
+		CPUWorkers    int
+		HashAlgorithm hashAlgorithmFlag
+		SampleWidth   int
+		SampleHeight  int
+		Crop          cropOptions
+		Progress      progressModeFlag
+	}{}
+	flags := env.newFlagSet("worker", "", "Compute image hashes of a search dir and upload them to a coordinator.")
+	flags.StringVar(&cmd.Coordinator, "coordinator", "localhost:50051", "coordinator address")
+	hostname, _ := os.Hostname()
+	flags.StringVar(&cmd.Name, "name", hostname, "unique worker name prefixed to each path (default is the host name)")
+	flags.StringVar(&cmd.Root, "root", "", "search dir")
+	flags.IntVar(&cmd.Parallels, "j", runtime.NumCPU(), "parallel num")
+	registerWorkerFlags(flags, &cmd.IOWorkers, &cmd.CPUWorkers)
+	flags.Var(&cmd.HashAlgorithm, "hash", "hash algorithm: phash, ahash or dhash")
+	flags.IntVar(&cmd.SampleWidth, "samplew", 16, "hash width")
+	flags.IntVar(&cmd.SampleHeight, "sampleh", 16, "hash height")
+	filter := &walkFilter{}
+	registerFilterFlags(flags, filter)
+	links := &linkFlags{}
+	registerLinkFlags(flags, links)
+	decode := &decodeFlags{}
+	registerDecodeFlags(flags, decode)
+	registerCropFlags(flags, &cmd.Crop)
+	registerProgressFlag(flags, &cmd.Progress)
+	if err := env.parseFlags(flags, args); err != nil {
+		return err
+	}
+	if len(cmd.Name) == 0 {
+		return env.usageError(flags, "worker: -name is required")
+	}
+
+	conn, err := grpc.NewClient(cmd.Coordinator, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("failed grpc.NewClient: %s %w", cmd.Coordinator, err)
+	}
+	defer conn.Close()
+
+	options := &scanOptions{
+		HashAlgorithm: cmd.HashAlgorithm,
+		SampleWidth:   cmd.SampleWidth,
+		SampleHeight:  cmd.SampleHeight,
+		Parallels:     cmd.Parallels,
+		IOWorkers:     cmd.IOWorkers,
+		CPUWorkers:    cmd.CPUWorkers,
+		Filter:        filter,
+		Progress:      newProgressTracker(env.Stderr, cmd.Progress),
+		Crop:          cmd.Crop,
+	}
+	links.Apply(options)
+	decode.Apply(options)
+
+	watch := stopwatch.Start()
+
+	options.Progress.StartPhase(progressPhaseScan)
+	summary, err := uploadImageHash(context.Background(), conn, cmd.Name, filepath.Clean(cmd.Root), options)
+	options.Progress.EndPhase()
+	if err != nil {
+		return err
+	}
+
+	watch.Stop()
+	fmt.Fprintf(env.Stdout, "UploadFiles: %v (%v images)\n", watch.String(), summary.Received)
+	fmt.Fprintf(env.Stdout, "Filtered: %v\n", filter.Stats.String())
+
+	return nil
+}
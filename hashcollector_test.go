@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akinobufujii/similar_images_grouping/hashcollectorpb"
+	"github.com/corona10/goimagehash"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// writeTestImages テスト用の画像をディレクトリに書き出す
+func writeTestImages(t testing.TB, dir string, images map[string]int) {
+	t.Helper()
+	for name, pattern := range images {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, encodeTestPng(t, newTestImage(pattern, 64, 64)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestHashCollectorConn bufconnでネットワークを使わずにcollectorに接続する
+func newTestHashCollectorConn(t testing.TB, collector *hashCollector) *grpc.ClientConn {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	hashcollectorpb.RegisterHashCollectorServer(server, collector)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitHashCollector collectorのDoneを待つ
+func waitHashCollector(t testing.TB, collector *hashCollector) {
+	t.Helper()
+	select {
+	case <-collector.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("collector is not done")
+	}
+}
+
+// waitHashCollectorWorkers collectorがcount個のワーカーを受け付けるまで待つ
+func waitHashCollectorWorkers(t testing.TB, collector *hashCollector, count int) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		collector.mu.Lock()
+		workers := len(collector.workers)
+		collector.mu.Unlock()
+		if workers >= count {
+			return
+		}
+	}
+	t.Fatalf("collector has not accepted %v workers", count)
+}
+
+// TestHashCollector bufconnでネットワークを使わずにワーカー→コーディネータの流れを確認する
+func TestHashCollector(t *testing.T) {
+	collector := newHashCollector(2)
+	conn := newTestHashCollectorConn(t, collector)
+
+	// NOTE: 別々のマシンが見ている共有フォルダを想定
+	rootA := t.TempDir()
+	writeTestImages(t, rootA, map[string]int{"x.png": 0, "y.png": 1})
+	rootB := t.TempDir()
+	writeTestImages(t, rootB, map[string]int{"x.png": 0, "z.png": 2})
+
+	for worker, root := range map[string]string{"a": rootA, "b": rootB} {
+		summary, err := uploadImageHash(context.Background(), conn, worker, root, &scanOptions{SampleWidth: 16, SampleHeight: 16, Parallels: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary.Worker != worker || summary.Received != 2 {
+			t.Fatalf("unexpected summary: %+v", summary)
+		}
+	}
+
+	select {
+	case <-collector.Done():
+	default:
+		t.Fatal("collector is not done")
+	}
+	if failures, missing := collector.Failures(); len(failures) != 0 || missing != 0 {
+		t.Fatalf("unexpected failures: %v %v", failures, missing)
+	}
+
+	container := collector.Container()
+	if len(*container) != 4 {
+		t.Fatalf("unexpected container size: %v", len(*container))
+	}
+
+	similarGroupsList, err := groupingSimilarImages(container, &groupingOptions{Threshold: 10}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(similarGroupsList) != 1 {
+		t.Fatalf("unexpected groups: %v", similarGroupsList)
+	}
+
+	group := similarGroupsList[0]
+	sort.Strings(group)
+	expected := []string{"a:" + filepath.Join(rootA, "x.png"), "b:" + filepath.Join(rootB, "x.png")}
+	if len(group) != 2 || group[0] != expected[0] || group[1] != expected[1] {
+		t.Fatalf("unexpected group: %v", group)
+	}
+}
+
+// TestHashCollectorWorkerDropout 途中で切れたワーカーや同じ名前のワーカー、期限切れでもコーディネータが待ち続けないかのテスト
+func TestHashCollectorWorkerDropout(t *testing.T) {
+	root := t.TempDir()
+	writeTestImages(t, root, map[string]int{"x.png": 0, "y.png": 1})
+	options := &scanOptions{SampleWidth: 16, SampleHeight: 16, Parallels: 2}
+
+	collector := newHashCollector(2)
+	conn := newTestHashCollectorConn(t, collector)
+
+	// NOTE: 同じ名前で二重には送れず、2つ目のワーカーとしては数えない
+	if _, err := uploadImageHash(context.Background(), conn, "b", root, options); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploadImageHash(context.Background(), conn, "b", root, options); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("unexpected error of duplicate worker: %v", err)
+	}
+	if _, err := uploadImageHash(context.Background(), conn, "", root, options); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("unexpected error of unnamed worker: %v", err)
+	}
+	select {
+	case <-collector.Done():
+		t.Fatal("collector is done before the second worker")
+	default:
+	}
+
+	// NOTE: 1枚送ったところでワーカーが落ちる
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(context.Background(), hashCollectorWorkerKey, "a"))
+	stream, err := hashcollectorpb.NewHashCollectorClient(conn).Upload(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &ImageHashInfo{Filepath: "dropped.png", ImageHash: goimagehash.NewExtImageHash([]uint64{1, 2, 3, 4}, goimagehash.PHash, 256)}
+	if err := stream.Send(imageHashInfoToProto(info)); err != nil {
+		t.Fatal(err)
+	}
+	waitHashCollectorWorkers(t, collector, 2)
+	cancel()
+
+	waitHashCollector(t, collector)
+	failures, missing := collector.Failures()
+	if len(failures) != 1 || !strings.HasPrefix(failures[0], "a: ") || missing != 0 {
+		t.Fatalf("unexpected failures: %v %v", failures, missing)
+	}
+	if container := collector.Container(); len(*container) != 2 {
+		t.Fatalf("unexpected container size: %v", len(*container))
+	}
+
+	// NOTE: 期限切れなら送信中のワーカーは失敗、接続しなかったワーカーは数だけ返す
+	collector = newHashCollector(3)
+	conn = newTestHashCollectorConn(t, collector)
+	if _, err := uploadImageHash(context.Background(), conn, "a", root, options); err != nil {
+		t.Fatal(err)
+	}
+	stream, err = hashcollectorpb.NewHashCollectorClient(conn).Upload(metadata.AppendToOutgoingContext(context.Background(), hashCollectorWorkerKey, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(imageHashInfoToProto(info)); err != nil {
+		t.Fatal(err)
+	}
+	// NOTE: bの受け付けが済むまで待ってから期限切れにする
+	waitHashCollectorWorkers(t, collector, 2)
+	collector.Expire(errors.New("timed out"))
+	waitHashCollector(t, collector)
+	if _, err := stream.CloseAndRecv(); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("unexpected error of expired worker: %v", err)
+	}
+	failures, missing = collector.Failures()
+	if !reflect.DeepEqual(failures, []string{"b: timed out"}) || missing != 1 {
+		t.Fatalf("unexpected failures: %v %v", failures, missing)
+	}
+	if container := collector.Container(); len(*container) != 2 {
+		t.Fatalf("unexpected container size: %v", len(*container))
+	}
+}
+
+// TestHashCollectorLayoutMismatch ハッシュの大きさが違うワーカーを受信した時点で失敗扱いにするかのテスト
+func TestHashCollectorLayoutMismatch(t *testing.T) {
+	root := t.TempDir()
+	writeTestImages(t, root, map[string]int{"x.png": 0, "y.png": 1})
+
+	collector := newHashCollector(2)
+	conn := newTestHashCollectorConn(t, collector)
+	if _, err := uploadImageHash(context.Background(), conn, "a", root, &scanOptions{SampleWidth: 16, SampleHeight: 16, Parallels: 2}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := uploadImageHash(context.Background(), conn, "b", root, &scanOptions{SampleWidth: 8, SampleHeight: 8, Parallels: 2})
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "hash layout mismatch") {
+		t.Fatalf("unexpected error of mismatched worker: %v", err)
+	}
+
+	waitHashCollector(t, collector)
+	failures, missing := collector.Failures()
+	if len(failures) != 1 || !strings.HasPrefix(failures[0], "b: ") || missing != 0 {
+		t.Fatalf("unexpected failures: %v %v", failures, missing)
+	}
+	if container := collector.Container(); len(*container) != 2 {
+		t.Fatalf("unexpected container size: %v", len(*container))
+	}
+}
+
+// TestImageHashInfoProto protoのメッセージとの変換で中間ファイルに書き出す項目が変わらないかのテスト
+func TestImageHashInfoProto(t *testing.T) {
+	info := &ImageHashInfo{
+		Filepath:       "a/x.png",
+		Root:           "a",
+		HardLinks:      []string{"a/y.png"},
+		ImageHash:      goimagehash.NewExtImageHash([]uint64{1, 2, 3, 4}, goimagehash.PHash, 256),
+		IsTrimmed:      true,
+		Crops:          []CropHash{{Name: "center80", ImageHash: goimagehash.NewExtImageHash([]uint64{5, 6, 7, 8}, goimagehash.PHash, 256)}},
+		ColorSignature: []byte{1, 2, 3},
+		Width:          640,
+		Height:         480,
+		ContentHash:    "content",
+		PixelHash:      "pixel",
+	}
+	data, err := proto.Marshal(imageHashInfoToProto(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := &hashcollectorpb.ImageHashInfo{}
+	if err := proto.Unmarshal(data, message); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := imageHashInfoFromProto(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, info) {
+		t.Errorf("unexpected info: %+v, expected %+v", decoded, info)
+	}
+
+	// NOTE: ビット数と語数が合わないハッシュは受け付けない
+	message.Hash.Words = message.Hash.Words[:3]
+	if _, err := imageHashInfoFromProto(message); err == nil {
+		t.Error("expected error of invalid hash size")
+	}
+}
@@ -0,0 +1,4 @@
+package hashcollectorpb
+
+// NOTE: hashcollector.protoから生成する（protoc、protoc-gen-go v1.36.6、protoc-gen-go-grpc v1.5.1が必要）
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative hashcollector.proto
@@ -0,0 +1,475 @@
+// ワーカーが計算した画像のハッシュをコーディネータに集めるサービス
+// NOTE: 変更したら go generate ./hashcollectorpb でhashcollector.pb.goとhashcollector_grpc.pb.goを作り直す
+//       フィールドの番号は変えずに追加だけする（互換性のない変更はパッケージをv2にする）
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: hashcollector.proto
+
+package hashcollectorpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// HashKind ハッシュの種類（goimagehash.Kindと同じ値）
+type HashKind int32
+
+const (
+	HashKind_HASH_KIND_UNKNOWN HashKind = 0
+	HashKind_HASH_KIND_AHASH   HashKind = 1
+	HashKind_HASH_KIND_PHASH   HashKind = 2
+	HashKind_HASH_KIND_DHASH   HashKind = 3
+	HashKind_HASH_KIND_WHASH   HashKind = 4
+)
+
+// Enum value maps for HashKind.
+var (
+	HashKind_name = map[int32]string{
+		0: "HASH_KIND_UNKNOWN",
+		1: "HASH_KIND_AHASH",
+		2: "HASH_KIND_PHASH",
+		3: "HASH_KIND_DHASH",
+		4: "HASH_KIND_WHASH",
+	}
+	HashKind_value = map[string]int32{
+		"HASH_KIND_UNKNOWN": 0,
+		"HASH_KIND_AHASH":   1,
+		"HASH_KIND_PHASH":   2,
+		"HASH_KIND_DHASH":   3,
+		"HASH_KIND_WHASH":   4,
+	}
+)
+
+func (x HashKind) Enum() *HashKind {
+	p := new(HashKind)
+	*p = x
+	return p
+}
+
+func (x HashKind) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (HashKind) Descriptor() protoreflect.EnumDescriptor {
+	return file_hashcollector_proto_enumTypes[0].Descriptor()
+}
+
+func (HashKind) Type() protoreflect.EnumType {
+	return &file_hashcollector_proto_enumTypes[0]
+}
+
+func (x HashKind) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use HashKind.Descriptor instead.
+func (HashKind) EnumDescriptor() ([]byte, []int) {
+	return file_hashcollector_proto_rawDescGZIP(), []int{0}
+}
+
+// ImageHash ビット数を指定したハッシュ（goimagehash.ExtImageHash）
+type ImageHash struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Kind  HashKind               `protobuf:"varint,1,opt,name=kind,proto3,enum=similarimages.v1.HashKind" json:"kind,omitempty"`
+	Bits  int32                  `protobuf:"varint,2,opt,name=bits,proto3" json:"bits,omitempty"`
+	// NOTE: 下位のビットから64bitごと
+	Words         []uint64 `protobuf:"fixed64,3,rep,packed,name=words,proto3" json:"words,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ImageHash) Reset() {
+	*x = ImageHash{}
+	mi := &file_hashcollector_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ImageHash) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ImageHash) ProtoMessage() {}
+
+func (x *ImageHash) ProtoReflect() protoreflect.Message {
+	mi := &file_hashcollector_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ImageHash.ProtoReflect.Descriptor instead.
+func (*ImageHash) Descriptor() ([]byte, []int) {
+	return file_hashcollector_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ImageHash) GetKind() HashKind {
+	if x != nil {
+		return x.Kind
+	}
+	return HashKind_HASH_KIND_UNKNOWN
+}
+
+func (x *ImageHash) GetBits() int32 {
+	if x != nil {
+		return x.Bits
+	}
+	return 0
+}
+
+func (x *ImageHash) GetWords() []uint64 {
+	if x != nil {
+		return x.Words
+	}
+	return nil
+}
+
+// CropHash 画像の一部分を切り抜いて計算したハッシュ
+type CropHash struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Hash          *ImageHash             `protobuf:"bytes,2,opt,name=hash,proto3" json:"hash,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CropHash) Reset() {
+	*x = CropHash{}
+	mi := &file_hashcollector_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CropHash) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CropHash) ProtoMessage() {}
+
+func (x *CropHash) ProtoReflect() protoreflect.Message {
+	mi := &file_hashcollector_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CropHash.ProtoReflect.Descriptor instead.
+func (*CropHash) Descriptor() ([]byte, []int) {
+	return file_hashcollector_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *CropHash) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *CropHash) GetHash() *ImageHash {
+	if x != nil {
+		return x.Hash
+	}
+	return nil
+}
+
+// ImageHashInfo 1枚の画像のハッシュと判定に使う情報（中間ファイルの1要素と同じ内容）
+type ImageHashInfo struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Filepath       string                 `protobuf:"bytes,1,opt,name=filepath,proto3" json:"filepath,omitempty"`
+	Root           string                 `protobuf:"bytes,2,opt,name=root,proto3" json:"root,omitempty"`
+	HardLinks      []string               `protobuf:"bytes,3,rep,name=hard_links,json=hardLinks,proto3" json:"hard_links,omitempty"`
+	Hash           *ImageHash             `protobuf:"bytes,4,opt,name=hash,proto3" json:"hash,omitempty"`
+	IsTrimmed      bool                   `protobuf:"varint,5,opt,name=is_trimmed,json=isTrimmed,proto3" json:"is_trimmed,omitempty"`
+	Crops          []*CropHash            `protobuf:"bytes,6,rep,name=crops,proto3" json:"crops,omitempty"`
+	ColorSignature []byte                 `protobuf:"bytes,7,opt,name=color_signature,json=colorSignature,proto3" json:"color_signature,omitempty"`
+	Width          int32                  `protobuf:"varint,8,opt,name=width,proto3" json:"width,omitempty"`
+	Height         int32                  `protobuf:"varint,9,opt,name=height,proto3" json:"height,omitempty"`
+	ContentHash    string                 `protobuf:"bytes,10,opt,name=content_hash,json=contentHash,proto3" json:"content_hash,omitempty"`
+	PixelHash      string                 `protobuf:"bytes,11,opt,name=pixel_hash,json=pixelHash,proto3" json:"pixel_hash,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *ImageHashInfo) Reset() {
+	*x = ImageHashInfo{}
+	mi := &file_hashcollector_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ImageHashInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ImageHashInfo) ProtoMessage() {}
+
+func (x *ImageHashInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_hashcollector_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ImageHashInfo.ProtoReflect.Descriptor instead.
+func (*ImageHashInfo) Descriptor() ([]byte, []int) {
+	return file_hashcollector_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ImageHashInfo) GetFilepath() string {
+	if x != nil {
+		return x.Filepath
+	}
+	return ""
+}
+
+func (x *ImageHashInfo) GetRoot() string {
+	if x != nil {
+		return x.Root
+	}
+	return ""
+}
+
+func (x *ImageHashInfo) GetHardLinks() []string {
+	if x != nil {
+		return x.HardLinks
+	}
+	return nil
+}
+
+func (x *ImageHashInfo) GetHash() *ImageHash {
+	if x != nil {
+		return x.Hash
+	}
+	return nil
+}
+
+func (x *ImageHashInfo) GetIsTrimmed() bool {
+	if x != nil {
+		return x.IsTrimmed
+	}
+	return false
+}
+
+func (x *ImageHashInfo) GetCrops() []*CropHash {
+	if x != nil {
+		return x.Crops
+	}
+	return nil
+}
+
+func (x *ImageHashInfo) GetColorSignature() []byte {
+	if x != nil {
+		return x.ColorSignature
+	}
+	return nil
+}
+
+func (x *ImageHashInfo) GetWidth() int32 {
+	if x != nil {
+		return x.Width
+	}
+	return 0
+}
+
+func (x *ImageHashInfo) GetHeight() int32 {
+	if x != nil {
+		return x.Height
+	}
+	return 0
+}
+
+func (x *ImageHashInfo) GetContentHash() string {
+	if x != nil {
+		return x.ContentHash
+	}
+	return ""
+}
+
+func (x *ImageHashInfo) GetPixelHash() string {
+	if x != nil {
+		return x.PixelHash
+	}
+	return ""
+}
+
+// UploadSummary ワーカー1つ分のアップロード結果
+type UploadSummary struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Worker        string                 `protobuf:"bytes,1,opt,name=worker,proto3" json:"worker,omitempty"`
+	Received      int64                  `protobuf:"varint,2,opt,name=received,proto3" json:"received,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UploadSummary) Reset() {
+	*x = UploadSummary{}
+	mi := &file_hashcollector_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UploadSummary) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UploadSummary) ProtoMessage() {}
+
+func (x *UploadSummary) ProtoReflect() protoreflect.Message {
+	mi := &file_hashcollector_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UploadSummary.ProtoReflect.Descriptor instead.
+func (*UploadSummary) Descriptor() ([]byte, []int) {
+	return file_hashcollector_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *UploadSummary) GetWorker() string {
+	if x != nil {
+		return x.Worker
+	}
+	return ""
+}
+
+func (x *UploadSummary) GetReceived() int64 {
+	if x != nil {
+		return x.Received
+	}
+	return 0
+}
+
+var File_hashcollector_proto protoreflect.FileDescriptor
+
+const file_hashcollector_proto_rawDesc = "" +
+	"\n" +
+	"\x13hashcollector.proto\x12\x10similarimages.v1\"e\n" +
+	"\tImageHash\x12.\n" +
+	"\x04kind\x18\x01 \x01(\x0e2\x1a.similarimages.v1.HashKindR\x04kind\x12\x12\n" +
+	"\x04bits\x18\x02 \x01(\x05R\x04bits\x12\x14\n" +
+	"\x05words\x18\x03 \x03(\x06R\x05words\"O\n" +
+	"\bCropHash\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12/\n" +
+	"\x04hash\x18\x02 \x01(\v2\x1b.similarimages.v1.ImageHashR\x04hash\"\xf9\x02\n" +
+	"\rImageHashInfo\x12\x1a\n" +
+	"\bfilepath\x18\x01 \x01(\tR\bfilepath\x12\x12\n" +
+	"\x04root\x18\x02 \x01(\tR\x04root\x12\x1d\n" +
+	"\n" +
+	"hard_links\x18\x03 \x03(\tR\thardLinks\x12/\n" +
+	"\x04hash\x18\x04 \x01(\v2\x1b.similarimages.v1.ImageHashR\x04hash\x12\x1d\n" +
+	"\n" +
+	"is_trimmed\x18\x05 \x01(\bR\tisTrimmed\x120\n" +
+	"\x05crops\x18\x06 \x03(\v2\x1a.similarimages.v1.CropHashR\x05crops\x12'\n" +
+	"\x0fcolor_signature\x18\a \x01(\fR\x0ecolorSignature\x12\x14\n" +
+	"\x05width\x18\b \x01(\x05R\x05width\x12\x16\n" +
+	"\x06height\x18\t \x01(\x05R\x06height\x12!\n" +
+	"\fcontent_hash\x18\n" +
+	" \x01(\tR\vcontentHash\x12\x1d\n" +
+	"\n" +
+	"pixel_hash\x18\v \x01(\tR\tpixelHash\"C\n" +
+	"\rUploadSummary\x12\x16\n" +
+	"\x06worker\x18\x01 \x01(\tR\x06worker\x12\x1a\n" +
+	"\breceived\x18\x02 \x01(\x03R\breceived*u\n" +
+	"\bHashKind\x12\x15\n" +
+	"\x11HASH_KIND_UNKNOWN\x10\x00\x12\x13\n" +
+	"\x0fHASH_KIND_AHASH\x10\x01\x12\x13\n" +
+	"\x0fHASH_KIND_PHASH\x10\x02\x12\x13\n" +
+	"\x0fHASH_KIND_DHASH\x10\x03\x12\x13\n" +
+	"\x0fHASH_KIND_WHASH\x10\x042]\n" +
+	"\rHashCollector\x12L\n" +
+	"\x06Upload\x12\x1f.similarimages.v1.ImageHashInfo\x1a\x1f.similarimages.v1.UploadSummary(\x01BAZ?github.com/akinobufujii/similar_images_grouping/hashcollectorpbb\x06proto3"
+
+var (
+	file_hashcollector_proto_rawDescOnce sync.Once
+	file_hashcollector_proto_rawDescData []byte
+)
+
+func file_hashcollector_proto_rawDescGZIP() []byte {
+	file_hashcollector_proto_rawDescOnce.Do(func() {
+		file_hashcollector_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_hashcollector_proto_rawDesc), len(file_hashcollector_proto_rawDesc)))
+	})
+	return file_hashcollector_proto_rawDescData
+}
+
+var file_hashcollector_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_hashcollector_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_hashcollector_proto_goTypes = []any{
+	(HashKind)(0),         // 0: similarimages.v1.HashKind
+	(*ImageHash)(nil),     // 1: similarimages.v1.ImageHash
+	(*CropHash)(nil),      // 2: similarimages.v1.CropHash
+	(*ImageHashInfo)(nil), // 3: similarimages.v1.ImageHashInfo
+	(*UploadSummary)(nil), // 4: similarimages.v1.UploadSummary
+}
+var file_hashcollector_proto_depIdxs = []int32{
+	0, // 0: similarimages.v1.ImageHash.kind:type_name -> similarimages.v1.HashKind
+	1, // 1: similarimages.v1.CropHash.hash:type_name -> similarimages.v1.ImageHash
+	1, // 2: similarimages.v1.ImageHashInfo.hash:type_name -> similarimages.v1.ImageHash
+	2, // 3: similarimages.v1.ImageHashInfo.crops:type_name -> similarimages.v1.CropHash
+	3, // 4: similarimages.v1.HashCollector.Upload:input_type -> similarimages.v1.ImageHashInfo
+	4, // 5: similarimages.v1.HashCollector.Upload:output_type -> similarimages.v1.UploadSummary
+	5, // [5:6] is the sub-list for method output_type
+	4, // [4:5] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_hashcollector_proto_init() }
+func file_hashcollector_proto_init() {
+	if File_hashcollector_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_hashcollector_proto_rawDesc), len(file_hashcollector_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_hashcollector_proto_goTypes,
+		DependencyIndexes: file_hashcollector_proto_depIdxs,
+		EnumInfos:         file_hashcollector_proto_enumTypes,
+		MessageInfos:      file_hashcollector_proto_msgTypes,
+	}.Build()
+	File_hashcollector_proto = out.File
+	file_hashcollector_proto_goTypes = nil
+	file_hashcollector_proto_depIdxs = nil
+}
@@ -0,0 +1,126 @@
+// ワーカーが計算した画像のハッシュをコーディネータに集めるサービス
+// NOTE: 変更したら go generate ./hashcollectorpb でhashcollector.pb.goとhashcollector_grpc.pb.goを作り直す
+//       フィールドの番号は変えずに追加だけする（互換性のない変更はパッケージをv2にする）
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: hashcollector.proto
+
+package hashcollectorpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	HashCollector_Upload_FullMethodName = "/similarimages.v1.HashCollector/Upload"
+)
+
+// HashCollectorClient is the client API for HashCollector service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// HashCollector ワーカーからハッシュを受け取るコーディネータ
+type HashCollectorClient interface {
+	// Upload ワーカーは走査し終えたらストリームを閉じる
+	// NOTE: ワーカー名はメタデータのx-worker-nameで渡す（必須、同じ名前で二重には送れない）
+	Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[ImageHashInfo, UploadSummary], error)
+}
+
+type hashCollectorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewHashCollectorClient(cc grpc.ClientConnInterface) HashCollectorClient {
+	return &hashCollectorClient{cc}
+}
+
+func (c *hashCollectorClient) Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[ImageHashInfo, UploadSummary], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &HashCollector_ServiceDesc.Streams[0], HashCollector_Upload_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ImageHashInfo, UploadSummary]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type HashCollector_UploadClient = grpc.ClientStreamingClient[ImageHashInfo, UploadSummary]
+
+// HashCollectorServer is the server API for HashCollector service.
+// All implementations must embed UnimplementedHashCollectorServer
+// for forward compatibility.
+//
+// HashCollector ワーカーからハッシュを受け取るコーディネータ
+type HashCollectorServer interface {
+	// Upload ワーカーは走査し終えたらストリームを閉じる
+	// NOTE: ワーカー名はメタデータのx-worker-nameで渡す（必須、同じ名前で二重には送れない）
+	Upload(grpc.ClientStreamingServer[ImageHashInfo, UploadSummary]) error
+	mustEmbedUnimplementedHashCollectorServer()
+}
+
+// UnimplementedHashCollectorServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedHashCollectorServer struct{}
+
+func (UnimplementedHashCollectorServer) Upload(grpc.ClientStreamingServer[ImageHashInfo, UploadSummary]) error {
+	return status.Errorf(codes.Unimplemented, "method Upload not implemented")
+}
+func (UnimplementedHashCollectorServer) mustEmbedUnimplementedHashCollectorServer() {}
+func (UnimplementedHashCollectorServer) testEmbeddedByValue()                       {}
+
+// UnsafeHashCollectorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to HashCollectorServer will
+// result in compilation errors.
+type UnsafeHashCollectorServer interface {
+	mustEmbedUnimplementedHashCollectorServer()
+}
+
+func RegisterHashCollectorServer(s grpc.ServiceRegistrar, srv HashCollectorServer) {
+	// If the following call pancis, it indicates UnimplementedHashCollectorServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&HashCollector_ServiceDesc, srv)
+}
+
+func _HashCollector_Upload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(HashCollectorServer).Upload(&grpc.GenericServerStream[ImageHashInfo, UploadSummary]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type HashCollector_UploadServer = grpc.ClientStreamingServer[ImageHashInfo, UploadSummary]
+
+// HashCollector_ServiceDesc is the grpc.ServiceDesc for HashCollector service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var HashCollector_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "similarimages.v1.HashCollector",
+	HandlerType: (*HashCollectorServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Upload",
+			Handler:       _HashCollector_Upload_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "hashcollector.proto",
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/corona10/goimagehash"
+)
+
+// hashMatrix 比較用にハッシュを連続した[]uint64へ詰めたもの
+// NOTE: 比較のたびにExtImageHash.Distanceのエラー判定やスライスの参照をしないよう、読み込み後に一度だけ変換する
+//
+//	i番目の画像のv番目（0は元のハッシュ、1以降は切り抜き）のハッシュはhashes[(i*variants+v)*words:]からwords個
+//	切り抜きの数が足りない画像は元のハッシュで埋める
+type hashMatrix struct {
+	Infos    ParallelCompList
+	kind     goimagehash.Kind
+	bits     int
+	words    int
+	variants int
+	hashes   []uint64
+
+	// NOTE: nilでなければハッシュで似ている組を特徴点の対応でも確かめる
+	Verifier *keypointVerifier
+	// NOTE: 有効なら色相のヒストグラムで色違いかを判定する
+	Color colorOptions
+
+	// NOTE: 比較する範囲を絞るため行をpopcountKeyの順に並べたときのキー（nilなら並べ替えていないので総当たり）
+	//       キーの順に並んでいるのは先頭のsorted行で、Appendで追加した行は並べ直すまで末尾に置く
+	keys        []int32
+	isSignedKey bool
+	sorted      int
+	// NOTE: 元のlistの順の行の位置（nilなら行の順が元の順）。cursorより前は取り除いた画像
+	sequence []int32
+	cursor   int
+	// NOTE: 取り除いてnilにしたまままだ詰めていない行の数
+	removed int
+
+	// NOTE: nilでなければLSHの候補の行とだけ比較する（近似なので総当たりのグループと一致するとは限らない）
+	lsh         *lshIndex
+	Approximate *approximateSearch
+}
+
+// errHashMatrixLayout 行列の形（ハッシュの大きさや切り抜きの数）が決まっていないか合わないので追加できない
+// NOTE: 追加する画像を含めてnewHashMatrixで作り直す
+var errHashMatrixLayout = errors.New("hash matrix layout mismatch")
+
+// hashMatrixMinUnsorted 並べ直さずに末尾に置いておく行の数の下限（これと並べた行の1/8の大きいほうを超えたら並べ直す）
+const hashMatrixMinUnsorted = 64
+
+// newHashMatrix ParallelCompListからhashMatrixを作成する
+// NOTE: listは変更しない。種類やビット数の違うハッシュが混ざっていればエラー
+func newHashMatrix(list ParallelCompList) (*hashMatrix, error) {
+	matrix := &hashMatrix{Infos: make(ParallelCompList, 0, len(list))}
+	if len(list) == 0 {
+		return matrix, nil
+	}
+
+	first := list[0].ImageHash
+	matrix.kind = first.GetKind()
+	matrix.bits = first.Bits()
+	matrix.words = len(first.GetHash())
+	matrix.variants = 1
+	for _, info := range list {
+		matrix.variants = max(matrix.variants, len(info.Crops)+1)
+	}
+	matrix.hashes = make([]uint64, 0, len(list)*matrix.variants*matrix.words)
+	for _, info := range list {
+		hashes, err := matrix.PackInfo(info)
+		if err != nil {
+			return nil, fmt.Errorf("failed hashMatrix.PackInfo: %s %w", info.Filepath, err)
+		}
+		matrix.Infos = append(matrix.Infos, info)
+		matrix.hashes = append(matrix.hashes, hashes...)
+	}
+	matrix.buildPopcountFilter()
+	return matrix, nil
+}
+
+// Len 登録されている画像数
+func (matrix *hashMatrix) Len() int {
+	return len(matrix.Infos) - matrix.removed
+}
+
+// Append 画像を追加する
+// NOTE: 作り直さずに末尾に足し、並べていない行が増えたら詰めてキーの順に並べ直す
+//
+//	空の行列や切り抜きの数が増える画像、LSHのテーブルがある場合はerrHashMatrixLayoutを返す
+func (matrix *hashMatrix) Append(info *ImageHashInfo) error {
+	if matrix.words == 0 || len(info.Crops)+1 > matrix.variants || matrix.lsh != nil {
+		return errHashMatrixLayout
+	}
+	hashes, err := matrix.PackInfo(info)
+	if err != nil {
+		return err
+	}
+	matrix.Infos = append(matrix.Infos, info)
+	matrix.hashes = append(matrix.hashes, hashes...)
+	if matrix.keys != nil {
+		matrix.keys = append(matrix.keys, popcountKey(hashes[:matrix.words], matrix.isSignedKey))
+	}
+	if matrix.sequence != nil {
+		matrix.sequence = append(matrix.sequence, int32(len(matrix.Infos)-1))
+	}
+
+	if matrix.variants == 1 && len(matrix.Infos)-matrix.sorted > max(hashMatrixMinUnsorted, matrix.sorted/8) {
+		matrix.compaction()
+		matrix.buildPopcountFilter()
+	}
+	return nil
+}
+
+// RemoveFunc isRemoveがtrueを返した画像を取り除き、取り除いた数を返す
+// NOTE: GroupingSimilarImageと同じく行をnilにするだけで、取り除いた行が半分を超えたら詰める
+func (matrix *hashMatrix) RemoveFunc(isRemove func(*ImageHashInfo) bool) int {
+	removed := 0
+	for i, info := range matrix.Infos {
+		if info != nil && isRemove(info) {
+			matrix.Infos[i] = nil
+			removed++
+		}
+	}
+	matrix.removed += removed
+	if removed > 0 && matrix.lsh == nil && matrix.removed*2 >= len(matrix.Infos) {
+		matrix.compaction()
+	}
+	return removed
+}
+
+// Pack 比較できるハッシュか確認し、比較に使う[]uint64を返す
+func (matrix *hashMatrix) Pack(hash *goimagehash.ExtImageHash) ([]uint64, error) {
+	if len(matrix.Infos) == 0 && matrix.words == 0 {
+		// NOTE: 空なら比較しないので何でもよい
+		return hash.GetHash(), nil
+	}
+	if hash.GetKind() != matrix.kind {
+		return nil, fmt.Errorf("hash kind mismatch: %v %v", hash.GetKind(), matrix.kind)
+	}
+	if hash.Bits() != matrix.bits || len(hash.GetHash()) != matrix.words {
+		return nil, fmt.Errorf("hash bits mismatch: %v %v", hash.Bits(), matrix.bits)
+	}
+	return hash.GetHash(), nil
+}
+
+// PackInfo 元のハッシュと切り抜きのハッシュをvariants個分つなげた[]uint64を返す
+func (matrix *hashMatrix) PackInfo(info *ImageHashInfo) ([]uint64, error) {
+	variants := max(matrix.variants, 1)
+	hashes := make([]uint64, 0, variants*max(matrix.words, len(info.ImageHash.GetHash())))
+	cropHashes := packCropHashes(info)
+	for v := 0; v < variants; v++ {
+		imageHash := info.ImageHash
+		if v < len(cropHashes) {
+			imageHash = cropHashes[v]
+		}
+		hash, err := matrix.Pack(imageHash)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash...)
+	}
+	return hashes, nil
+}
+
+// hammingDistance ハミング距離
+// NOTE: thresholdを超えた時点で打ち切るので、超えた場合の値はthreshold+1以上としか言えない
+func hammingDistance(lhs, rhs []uint64, threshold int) int {
+	rhs = rhs[:len(lhs)]
+	distance := 0
+	for i, word := range lhs {
+		distance += bits.OnesCount64(word ^ rhs[i])
+		if distance > threshold {
+			return distance
+		}
+	}
+	return distance
+}
+
+// hammingDistance256 256bit（16x16）のハッシュ用に固定長配列で展開したhammingDistance
+func hammingDistance256(lhs, rhs *[4]uint64, threshold int) int {
+	distance := bits.OnesCount64(lhs[0]^rhs[0]) + bits.OnesCount64(lhs[1]^rhs[1])
+	if distance > threshold {
+		return distance
+	}
+	return distance + bits.OnesCount64(lhs[2]^rhs[2]) + bits.OnesCount64(lhs[3]^rhs[3])
+}
+
+// distance 2つのハッシュのハミング距離
+func (matrix *hashMatrix) distance(lhs, rhs []uint64, threshold int) int {
+	if matrix.words == 4 {
+		return hammingDistance256((*[4]uint64)(lhs), (*[4]uint64)(rhs), threshold)
+	}
+	return hammingDistance(lhs, rhs, threshold)
+}
+
+// variantsDistance 切り抜きも含めたハッシュの組み合わせで一番近い距離と、その組み合わせ（srcVariant, rowVariant）
+// NOTE: 距離が同じなら元のハッシュに近い組み合わせを優先する
+func (matrix *hashMatrix) variantsDistance(src, row []uint64, threshold int) (int, int, int) {
+	words := matrix.words
+	best, bestSrc, bestRow := threshold+1, 0, 0
+	for s := 0; s < matrix.variants; s++ {
+		srcHash := src[s*words : (s+1)*words]
+		for r := 0; r < matrix.variants; r++ {
+			// NOTE: これまでの一番近い距離を超えた時点で打ち切る
+			if distance := matrix.distance(srcHash, row[r*words:(r+1)*words], best-1); distance < best {
+				best, bestSrc, bestRow = distance, s, r
+			}
+		}
+	}
+	return best, bestSrc, bestRow
+}
+
+// rowDistance srcとi番目の行の切り抜きも含めた一番近い距離と、その組み合わせ（srcVariant, rowVariant）
+func (matrix *hashMatrix) rowDistance(src []uint64, i, threshold int) (int, int, int) {
+	rowSize := matrix.variants * matrix.words
+	row := matrix.hashes[i*rowSize : (i+1)*rowSize]
+	if matrix.variants == 1 {
+		return matrix.distance(src[:matrix.words], row, threshold), 0, 0
+	}
+	return matrix.variantsDistance(src, row, threshold)
+}
+
+// compRange [begin, end)の画像とsrcを比較し、似ている画像をchに送る
+// NOTE: srcInfoは切り抜き同士が似ていた場合の表示に使う。rowsがnilでなければrows[begin:end]の行と比較する
+func (matrix *hashMatrix) compRange(ch chan<- SimilarImage, srcInfo *ImageHashInfo, src []uint64, rows []int32, begin, end, threshold int, isRemoveSimilar bool) {
+	rowSize := matrix.variants * matrix.words
+	isHash256 := rowSize == 4
+	compared := 0
+	defer func() {
+		metrics.Comparisons.Add("", float64(compared))
+	}()
+	for position := begin; position < end; position++ {
+		i := position
+		if rows != nil {
+			i = int(rows[position])
+		}
+		info := matrix.Infos[i]
+		if info == nil {
+			continue
+		}
+		compared++
+
+		row := matrix.hashes[i*rowSize : (i+1)*rowSize]
+		var distance, srcVariant, rowVariant int
+		switch {
+		case isHash256:
+			distance = hammingDistance256((*[4]uint64)(src), (*[4]uint64)(row), threshold)
+		case matrix.variants == 1:
+			distance = hammingDistance(src, row, threshold)
+		default:
+			distance, srcVariant, rowVariant = matrix.variantsDistance(src, row, threshold)
+		}
+		if distance > threshold {
+			continue
+		}
+
+		// NOTE: 似てるという判定
+		similarImage := SimilarImage{Filepath: info.Filepath, Distance: distance}
+		if matrix.variants > 1 {
+			similarImage.Crop = cropMatchLabel(info, rowVariant, srcInfo, srcVariant)
+		}
+		if matrix.Color.IsEnabled() {
+			// NOTE: 色相のヒストグラムがなければ色違いかは分からないので輝度のハッシュの判定のままにする
+			if colorDistance, ok := colorSignatureDistance(srcInfo.ColorSignature, info.ColorSignature); ok {
+				isVariant := matrix.Color.IsVariant(colorDistance)
+				if isVariant && matrix.Color.IsSplit() {
+					continue
+				}
+				similarImage.Color = colorMatchLabel(isVariant)
+				similarImage.ColorDistance = math.Round(colorDistance*1000) / 1000
+			}
+		}
+		rotation := 0.0
+		if matrix.Verifier != nil {
+			transform, ok := matrix.Verifier.Verify(srcInfo.Filepath, info.Filepath)
+			if !ok {
+				continue
+			}
+			similarImage.Inliers = transform.Inliers
+			rotation = transform.Rotation
+		}
+		similarImage.Relation = classifyRelation(srcInfo, info, &similarImage, matrix.bits, rotation)
+		ch <- similarImage
+		if isRemoveSimilar {
+			// NOTE: 別々の要素に同時に書き込むだけなので大丈夫
+			info.Matched = &similarImage
+			matrix.Infos[i] = nil
+		}
+	}
+}
+
+// parallelComp [begin, end)の行（rowsがnilでなければrows[begin:end]の行）を分割して並行にcompRangeを実行し、似ている画像を返す
+// NOTE: parallelsが0以下なら論理スレッド数にする
+func (matrix *hashMatrix) parallelComp(srcInfo *ImageHashInfo, src []uint64, rows []int32, begin, end, threshold int, isRemoveSimilar bool, parallels int) []SimilarImage {
+	size := end - begin
+	if size <= 0 {
+		return nil
+	}
+
+	if parallels < 1 {
+		parallels = runtime.NumCPU()
+	}
+	parallels = min(parallels, size)
+
+	ch := make(chan SimilarImage, parallels)
+	wg := sync.WaitGroup{}
+	for i := 0; i < parallels; i++ {
+		// NOTE: 余剰は先頭のgoroutineから1要素ずつ割り当てる
+		viewBegin := begin + size*i/parallels
+		viewEnd := begin + size*(i+1)/parallels
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			matrix.compRange(ch, srcInfo, src, rows, viewBegin, viewEnd, threshold, isRemoveSimilar)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	similarImages := []SimilarImage{}
+	for similarImage := range ch {
+		similarImages = append(similarImages, similarImage)
+	}
+	return similarImages
+}
+
+// Search 指定画像と似ている画像を距離の近い順に返す
+func (matrix *hashMatrix) Search(srcInfo *ImageHashInfo, threshold, parallels int) ([]SimilarImage, error) {
+	src, err := matrix.PackInfo(srcInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	similarImages := []SimilarImage{}
+	for _, r := range matrix.ranges(src, threshold) {
+		similarImages = append(similarImages, matrix.parallelComp(srcInfo, src, nil, r[0], r[1], threshold, false, parallels)...)
+	}
+	sort.SliceStable(similarImages, func(i, j int) bool {
+		if similarImages[i].Distance != similarImages[j].Distance {
+			return similarImages[i].Distance < similarImages[j].Distance
+		}
+		return similarImages[i].Filepath < similarImages[j].Filepath
+	})
+
+	return similarImages, nil
+}
+
+// nextSourceRow 残っている画像のうち元のlistで先頭の画像の行
+func (matrix *hashMatrix) nextSourceRow() int {
+	for ; ; matrix.cursor++ {
+		row := matrix.cursor
+		if matrix.sequence != nil {
+			row = int(matrix.sequence[matrix.cursor])
+		}
+		if matrix.Infos[row] != nil {
+			return row
+		}
+	}
+}
+
+// GroupingSimilarImage 先頭の画像と似ている画像を取り除いてグループとして返す
+// NOTE: 似ている画像がなければ先頭の画像だけ取り除いてnilを返す
+//
+//	先頭は元のlistの順で、キーで絞った範囲の行とだけ比較する（総当たりと同じグループになる）
+func (matrix *hashMatrix) GroupingSimilarImage(threshold, parallels int) []string {
+	if matrix.Len() == 0 {
+		return nil
+	}
+
+	rowSize := matrix.variants * matrix.words
+	row := matrix.nextSourceRow()
+	src := matrix.Infos[row]
+	matrix.Infos[row] = nil
+	srcHash := matrix.hashes[row*rowSize : (row+1)*rowSize]
+	var similarImages []SimilarImage
+	if matrix.lsh != nil {
+		candidates := matrix.lsh.Candidates(matrix, srcHash, nil)
+		matrix.Approximate.candidates.Add(int64(len(candidates)))
+		similarImages = matrix.parallelComp(src, srcHash, candidates, 0, len(candidates), threshold, true, parallels)
+	} else {
+		for _, r := range matrix.ranges(srcHash, threshold) {
+			similarImages = append(similarImages, matrix.parallelComp(src, srcHash, nil, r[0], r[1], threshold, true, parallels)...)
+		}
+	}
+	matrix.removed += len(similarImages) + 1
+
+	var similarGroups []string
+	if len(similarImages) > 0 {
+		similarGroups = make([]string, 0, len(similarImages)+1)
+		for _, similarImage := range similarImages {
+			similarGroups = append(similarGroups, similarImage.Filepath)
+		}
+		similarGroups = append(similarGroups, src.Filepath)
+	}
+
+	// NOTE: 詰めるのは取り除いた行が半分を超えてから（毎回詰めると比較と同じくらい時間がかかる）
+	//	LSHのテーブルは行の位置で登録しているので、全て取り除くまで詰めない
+	if (matrix.lsh == nil && matrix.removed*2 >= len(matrix.Infos)) || matrix.Len() == 0 {
+		matrix.compaction()
+	}
+
+	return similarGroups
+}
+
+// compaction 取り除いた画像を詰める
+// NOTE: 行の順（キーの順）は変えず、元のlistの順の行の位置も詰めた後の位置にする
+func (matrix *hashMatrix) compaction() {
+	words := matrix.variants * matrix.words
+	if matrix.sequence != nil {
+		rows := make([]int32, len(matrix.Infos))
+		count := int32(0)
+		for i, info := range matrix.Infos {
+			rows[i] = count
+			if info != nil {
+				count++
+			}
+		}
+		sequence := matrix.sequence[:0]
+		for _, row := range matrix.sequence[matrix.cursor:] {
+			if matrix.Infos[row] != nil {
+				sequence = append(sequence, rows[row])
+			}
+		}
+		matrix.sequence = sequence
+	}
+
+	count := 0
+	sorted := 0
+	for i, info := range matrix.Infos {
+		if info == nil {
+			continue
+		}
+		if i < matrix.sorted {
+			sorted++
+		}
+		if count != i {
+			matrix.Infos[count] = info
+			copy(matrix.hashes[count*words:(count+1)*words], matrix.hashes[i*words:(i+1)*words])
+			if matrix.keys != nil {
+				matrix.keys[count] = matrix.keys[i]
+			}
+		}
+		count++
+	}
+
+	clear(matrix.Infos[count:])
+	matrix.Infos = matrix.Infos[:count]
+	matrix.hashes = matrix.hashes[:count*words]
+	if matrix.keys != nil {
+		matrix.keys = matrix.keys[:count]
+	}
+	matrix.sorted = sorted
+	matrix.cursor = 0
+	matrix.removed = 0
+}
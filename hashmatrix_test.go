@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/corona10/goimagehash"
+)
+
+// newRandomHashList ランダムなハッシュのリスト
+// NOTE: 似ている画像ができるよう、半分は既存のハッシュの数ビットを反転したものにする
+func newRandomHashList(count, words int) ParallelCompList {
+	random := rand.New(rand.NewSource(1))
+	list := ParallelCompList{}
+	for i := 0; i < count; i++ {
+		hash := make([]uint64, words)
+		if i%2 == 1 {
+			copy(hash, list[random.Intn(len(list))].ImageHash.GetHash())
+			for flips := random.Intn(words * 8); flips > 0; flips-- {
+				bit := random.Intn(words * 64)
+				hash[bit/64] ^= 1 << (bit % 64)
+			}
+		} else {
+			for j := range hash {
+				hash[j] = random.Uint64()
+			}
+		}
+		list = append(list, &ImageHashInfo{Filepath: fmt.Sprint(i), ImageHash: goimagehash.NewExtImageHash(hash, goimagehash.PHash, words*64)})
+	}
+	return list
+}
+
+// TestHashMatrix 詰めたハッシュでの比較がExtImageHash.Distanceと同じ結果になるかのテスト
+func TestHashMatrix(t *testing.T) {
+	for _, words := range []int{1, 4, 16} {
+		list := newRandomHashList(300, words)
+		threshold := words * 6
+
+		// NOTE: ExtImageHash.Distanceで総当たりしたグルーピング
+		expected := [][]string{}
+		rest := append(ParallelCompList{}, list...)
+		for len(rest) > 0 {
+			src, others := rest[0], rest[1:]
+			group, remains := []string{}, ParallelCompList{}
+			for _, info := range others {
+				distance, err := src.ImageHash.Distance(info.ImageHash)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if distance <= threshold {
+					group = append(group, info.Filepath)
+				} else {
+					remains = append(remains, info)
+				}
+			}
+			if len(group) > 0 {
+				group = append(group, src.Filepath)
+				sort.Strings(group)
+				expected = append(expected, group)
+			}
+			rest = remains
+		}
+
+		container := append(ParallelCompList{}, list...)
+		groups, err := groupingSimilarImages(&container, &groupingOptions{Threshold: threshold, Parallels: 3}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, group := range groups {
+			sort.Strings(group)
+		}
+		if len(expected) == 0 || !reflect.DeepEqual(groups, expected) {
+			t.Fatalf("words=%d: unexpected groups: %v, expected %v", words, groups, expected)
+		}
+
+		// NOTE: 検索では打ち切らずに数えた距離と一致すること
+		matrix, err := newHashMatrix(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		similarImages, err := matrix.Search(list[1], threshold, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos := list.InfoMap()
+		for _, similarImage := range similarImages {
+			distance, _ := list[1].ImageHash.Distance(infos[similarImage.Filepath].ImageHash)
+			if distance != similarImage.Distance {
+				t.Errorf("words=%d: %s distance %v, expected %v", words, similarImage.Filepath, similarImage.Distance, distance)
+			}
+		}
+		if len(similarImages) < 2 || matrix.Len() != len(list) {
+			t.Errorf("words=%d: unexpected search result: %v", words, similarImages)
+		}
+	}
+}
+
+// TestHashMatrixMismatch 種類やビット数の違うハッシュが混ざっていればエラーになるかのテスト
+func TestHashMatrixMismatch(t *testing.T) {
+	list := ParallelCompList{
+		newTestImageHashInfo("a.jpg", 0, 0),
+		{Filepath: "b.jpg", ImageHash: goimagehash.NewExtImageHash([]uint64{0, 0}, goimagehash.DHash, 128)},
+	}
+	if _, err := newHashMatrix(list); err == nil {
+		t.Error("expected kind mismatch error")
+	}
+
+	matrix, err := newHashMatrix(list[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := matrix.Search(newTestImageHashInfo("c.jpg", 0), 10, 1); err == nil {
+		t.Error("expected bits mismatch error")
+	}
+}
+
+// sourceOrder グループの基準に選ぶ順（元のlistの順）に残っている画像のパスを返す
+func sourceOrder(matrix *hashMatrix) []string {
+	paths := []string{}
+	for k := matrix.cursor; k < len(matrix.Infos); k++ {
+		row := k
+		if matrix.sequence != nil {
+			row = int(matrix.sequence[k])
+		}
+		if info := matrix.Infos[row]; info != nil {
+			paths = append(paths, info.Filepath)
+		}
+	}
+	return paths
+}
+
+// groupingAll 全ての画像をグルーピングする（グループ内はパスの順、グループは見つけた順）
+func groupingAll(matrix *hashMatrix, threshold int) [][]string {
+	groups := [][]string{}
+	for matrix.Len() > 0 {
+		if group := matrix.GroupingSimilarImage(threshold, 2); group != nil {
+			slices.Sort(group)
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// TestHashMatrixIncremental 追加・削除を繰り返しても作り直した行列と同じ検索結果になるかのテスト
+func TestHashMatrixIncremental(t *testing.T) {
+	const threshold = 12
+	for _, isBalanced := range []bool{false, true} {
+		all := newDensityHashList(1200, 4, isBalanced)
+		list := append(ParallelCompList{}, all[:100]...)
+		matrix, err := newHashMatrix(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		random := rand.New(rand.NewSource(3))
+		for i, info := range all[100:] {
+			if err := matrix.Append(info); err != nil {
+				t.Fatal(err)
+			}
+			list = append(list, info)
+			if i%3 == 0 {
+				removed := list[random.Intn(len(list))]
+				if count := matrix.RemoveFunc(func(info *ImageHashInfo) bool { return info == removed }); count != 1 {
+					t.Fatalf("unexpected removed count: %v", count)
+				}
+				list = slices.DeleteFunc(list, func(info *ImageHashInfo) bool { return info == removed })
+			}
+			if i%50 != 0 {
+				continue
+			}
+
+			if matrix.Len() != len(list) {
+				t.Fatalf("unexpected len: %v, expected %v", matrix.Len(), len(list))
+			}
+			rebuilt, err := newHashMatrix(list)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// NOTE: 並べ直してもグループの基準は追加した順に選ぶ
+			if order, expected := sourceOrder(matrix), sourceOrder(rebuilt); !reflect.DeepEqual(order, expected) {
+				t.Fatalf("balanced=%v step %d: unexpected source order", isBalanced, i)
+			}
+			for _, src := range []*ImageHashInfo{info, list[0], all[random.Intn(len(all))]} {
+				similarImages, err := matrix.Search(src, threshold, 2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected, err := rebuilt.Search(src, threshold, 2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(similarImages, expected) {
+					t.Fatalf("balanced=%v step %d: unexpected result: %v, expected %v", isBalanced, i, similarImages, expected)
+				}
+			}
+		}
+		// NOTE: 末尾に足した行は並べ直されて絞り込みの対象になる
+		if matrix.keys == nil || matrix.sorted*2 < len(matrix.Infos) {
+			t.Errorf("balanced=%v: not sorted: %v of %v", isBalanced, matrix.sorted, len(matrix.Infos))
+		}
+
+		// NOTE: 半分以上取り除くと、並べていない末尾の行を残したまま詰める
+		for _, info := range all[:50] {
+			if err := matrix.Append(&ImageHashInfo{Filepath: "tail-" + info.Filepath, ImageHash: info.ImageHash}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		isRemove := func(info *ImageHashInfo) bool {
+			return !strings.HasPrefix(info.Filepath, "tail-") && info.Filepath[len(info.Filepath)-1] != '7'
+		}
+		removed := matrix.RemoveFunc(isRemove)
+		if matrix.removed != 0 || matrix.sorted == len(matrix.Infos) || removed == 0 {
+			t.Fatalf("balanced=%v: unexpected compaction: removed %v sorted %v of %v", isBalanced, removed, matrix.sorted, len(matrix.Infos))
+		}
+		list = slices.DeleteFunc(list, isRemove)
+		for _, info := range all[:50] {
+			list = append(list, &ImageHashInfo{Filepath: "tail-" + info.Filepath, ImageHash: info.ImageHash})
+		}
+		rebuilt, err := newHashMatrix(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, src := range all[:100] {
+			similarImages, err := matrix.Search(src, threshold, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := rebuilt.Search(src, threshold, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(similarImages, expected) {
+				t.Fatalf("balanced=%v after compaction: unexpected result: %v, expected %v", isBalanced, similarImages, expected)
+			}
+		}
+
+		// NOTE: 追加・削除した行列でも作り直した行列と同じ順に同じグループになる
+		for _, info := range all[100:200] {
+			more := &ImageHashInfo{Filepath: "more-" + info.Filepath, ImageHash: info.ImageHash}
+			if err := matrix.Append(more); err != nil {
+				t.Fatal(err)
+			}
+			list = append(list, more)
+		}
+		rebuilt, err = newHashMatrix(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if order, expected := sourceOrder(matrix), sourceOrder(rebuilt); !reflect.DeepEqual(order, expected) {
+			t.Fatalf("balanced=%v: unexpected source order", isBalanced)
+		}
+		if groups, expected := groupingAll(matrix, threshold), groupingAll(rebuilt, threshold); !reflect.DeepEqual(groups, expected) {
+			t.Fatalf("balanced=%v: unexpected groups: %v, expected %v", isBalanced, len(groups), len(expected))
+		}
+	}
+
+	// NOTE: 空の行列や切り抜きの数が増える画像は作り直す
+	matrix, err := newHashMatrix(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := matrix.Append(newTestImageHashInfo("a.jpg", 0)); err != errHashMatrixLayout {
+		t.Errorf("unexpected error of empty matrix: %v", err)
+	}
+	matrix, err = newHashMatrix(ParallelCompList{newTestImageHashInfo("a.jpg", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crop := newTestImageHashInfo("b.jpg", 0)
+	crop.Crops = []CropHash{{Name: "center80", ImageHash: crop.ImageHash}}
+	if err := matrix.Append(crop); err != errHashMatrixLayout {
+		t.Errorf("unexpected error of crops: %v", err)
+	}
+}
+
+// BenchmarkHashDistance 1枚と全体の比較をExtImageHash.Distance（BenchmarkImageHashの経路）と詰めたハッシュで計測する
+func BenchmarkHashDistance(b *testing.B) {
+	const threshold = 10
+	list := newRandomHashList(2000, 4)
+	src := list[0].ImageHash
+
+	b.Run("ExtImageHash.Distance", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, info := range list {
+				distance, err := src.Distance(info.ImageHash)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if distance <= threshold {
+					_ = SimilarImage{Filepath: info.Filepath, Distance: distance}
+				}
+			}
+		}
+	})
+
+	matrix, err := newHashMatrix(list)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ch := make(chan SimilarImage, matrix.Len())
+	b.Run("packed", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			matrix.compRange(ch, list[0], src.GetHash(), nil, 0, matrix.Len(), threshold, false)
+			for len(ch) > 0 {
+				<-ch
+			}
+		}
+	})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/corona10/goimagehash"
+)
+
+// 切り抜きの名前
+const (
+	cropNameFull    = "full"
+	cropNameTrimmed = "trimmed"
+	cropNameCenter  = "center"
+)
+
+// percentListFlag カンマ区切りの百分率のリストを受け取るフラグ
+type percentListFlag []int
+
+func (percents *percentListFlag) String() string {
+	values := make([]string, 0, len(*percents))
+	for _, percent := range *percents {
+		values = append(values, strconv.Itoa(percent))
+	}
+	return strings.Join(values, ",")
+}
+
+func (percents *percentListFlag) Set(value string) error {
+	*percents = nil
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(field), "%"))
+		if len(field) == 0 {
+			continue
+		}
+		percent, err := strconv.Atoi(field)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return fmt.Errorf("invalid percent: %s (1-99)", field)
+		}
+		*percents = append(*percents, percent)
+	}
+	return nil
+}
+
+// cropOptions 余白の除去と切り抜きの設定
+type cropOptions struct {
+	IsTrimBorders   bool
+	BorderTolerance int
+	// NOTE: 空なら切り抜いたハッシュは計算しない
+	Percents percentListFlag
+}
+
+// registerCropFlags 余白の除去と切り抜きのフラグを登録する
+// NOTE: 中間ファイルと比較する場合は中間ファイルを作ったときと同じ指定にする
+func registerCropFlags(flags *flag.FlagSet, crop *cropOptions) {
+	flags.BoolVar(&crop.IsTrimBorders, "trim-borders", false, "trim uniform borders (letterbox, scan border, frame) before hashing")
+	flags.IntVar(&crop.BorderTolerance, "border-tolerance", 16, "max difference (0-255) of a border pixel from the border color")
+	flags.Var(&crop.Percents, "crops", "also hash centered sub-crops of the given percents (e.g. 90,80) to match cropped versions")
+}
+
+// borderLineSamples 余白の判定で1行（1列）あたりに調べる画素の最大数
+const borderLineSamples = 256
+
+// borderOutlierRatio 余白の行（列）に含まれていてもよい余白の色から外れた画素の割合
+// NOTE: JPEGのノイズやスキャンのゴミで余白と判定できなくならないようにする
+const borderOutlierRatio = 0.02
+
+// sameColor 2色の差がtolerance以内か
+func sameColor(lhs, rhs [3]int, tolerance int) bool {
+	for i := range lhs {
+		if diff := lhs[i] - rhs[i]; diff > tolerance || diff < -tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// pixelColor 指定座標の8bitのRGB
+func pixelColor(imageData image.Image, x, y int) [3]int {
+	r, g, b, _ := imageData.At(x, y).RGBA()
+	return [3]int{int(r >> 8), int(g >> 8), int(b >> 8)}
+}
+
+// borderLine startからstep方向にcount画素並んだ1行（1列）
+type borderLine struct {
+	start image.Point
+	step  image.Point
+	count int
+}
+
+// samples 間引いて調べる画素の座標
+func (line borderLine) samples() []image.Point {
+	stride := max(line.count/borderLineSamples, 1)
+	points := make([]image.Point, 0, line.count/stride+1)
+	for i := 0; i < line.count; i += stride {
+		points = append(points, line.start.Add(line.step.Mul(i)))
+	}
+	return points
+}
+
+// averageColor 行（列）の平均の色
+func (line borderLine) averageColor(imageData image.Image) [3]int {
+	points := line.samples()
+	sum := [3]int{}
+	for _, point := range points {
+		c := pixelColor(imageData, point.X, point.Y)
+		for i := range sum {
+			sum[i] += c[i]
+		}
+	}
+	for i := range sum {
+		sum[i] /= len(points)
+	}
+	return sum
+}
+
+// isUniform 行（列）がほぼreferenceの色だけでできているか
+func (line borderLine) isUniform(imageData image.Image, reference [3]int, tolerance int) bool {
+	points := line.samples()
+	outliers := 0
+	for _, point := range points {
+		if !sameColor(pixelColor(imageData, point.X, point.Y), reference, tolerance) {
+			outliers++
+			if float64(outliers) > float64(len(points))*borderOutlierRatio {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 余白を調べる辺
+const (
+	borderTop = iota
+	borderBottom
+	borderLeft
+	borderRight
+)
+
+// edgeLine 範囲の指定の辺の一番外側の行（列）
+func edgeLine(region image.Rectangle, side int) borderLine {
+	switch side {
+	case borderTop:
+		return borderLine{region.Min, image.Pt(1, 0), region.Dx()}
+	case borderBottom:
+		return borderLine{image.Pt(region.Min.X, region.Max.Y-1), image.Pt(1, 0), region.Dx()}
+	case borderLeft:
+		return borderLine{region.Min, image.Pt(0, 1), region.Dy()}
+	default:
+		return borderLine{image.Pt(region.Max.X-1, region.Min.Y), image.Pt(0, 1), region.Dy()}
+	}
+}
+
+// shrinkEdge 範囲の指定の辺を1画素内側に寄せる
+func shrinkEdge(region image.Rectangle, side int) image.Rectangle {
+	switch side {
+	case borderTop:
+		region.Min.Y++
+	case borderBottom:
+		region.Max.Y--
+	case borderLeft:
+		region.Min.X++
+	default:
+		region.Max.X--
+	}
+	return region
+}
+
+// detectContentRegion 上下左右の一様な余白を除いた内容の範囲を返す
+// NOTE: 各辺の一番外側の行（列）の平均の色を余白の色として、同じ色の行（列）が続く間を余白とする
+//
+//	額縁の内側に黒帯があるような重なった余白も除けるよう、変わらなくなるまで繰り返す
+//	ほぼ全体が一様な画像は余白と区別できないので元の範囲を返す
+func detectContentRegion(imageData image.Image, tolerance int) image.Rectangle {
+	bounds := imageData.Bounds()
+	minWidth := max(bounds.Dx()/8, 1)
+	minHeight := max(bounds.Dy()/8, 1)
+
+	region := bounds
+	for {
+		previous := region
+		for _, side := range []int{borderTop, borderBottom, borderLeft, borderRight} {
+			line := edgeLine(region, side)
+			reference := line.averageColor(imageData)
+			for line.isUniform(imageData, reference, tolerance) {
+				region = shrinkEdge(region, side)
+				if region.Dx() < minWidth || region.Dy() < minHeight {
+					return bounds
+				}
+				line = edgeLine(region, side)
+			}
+		}
+		if region == previous {
+			return region
+		}
+	}
+}
+
+// centerCrop 範囲の中央をpercent%の大きさで切り抜いた範囲
+func centerCrop(region image.Rectangle, percent int) image.Rectangle {
+	width := region.Dx() * percent / 100
+	height := region.Dy() * percent / 100
+	topLeft := region.Min.Add(image.Pt((region.Dx()-width)/2, (region.Dy()-height)/2))
+	return image.Rectangle{Min: topLeft, Max: topLeft.Add(image.Pt(width, height))}
+}
+
+// subImage 画像の一部分を返す
+// NOTE: SubImageを持たない画像はコピーする
+func subImage(imageData image.Image, region image.Rectangle) image.Image {
+	if region == imageData.Bounds() {
+		return imageData
+	}
+	if sub, ok := imageData.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(region)
+	}
+	rgba := image.NewRGBA(region)
+	draw.Draw(rgba, region, imageData, region.Min, draw.Src)
+	return rgba
+}
+
+// calcCroppedImageHash 設定に応じて余白を除いてからハッシュを計算し、中央の切り抜きのハッシュも追加する
+// NOTE: 切り抜くとハッシュの大きさを下回る場合はその切り抜きを省く
+func calcCroppedImageHash(imageData image.Image, path string, algorithm hashAlgorithmFlag, samplew, sampleh int, crop *cropOptions) (*ImageHashInfo, error) {
+	region := imageData.Bounds()
+	if crop.IsTrimBorders {
+		region = detectContentRegion(imageData, crop.BorderTolerance)
+	}
+
+	info, err := calcImageHash(subImage(imageData, region), path, algorithm, samplew, sampleh)
+	if err != nil {
+		return nil, err
+	}
+	info.IsTrimmed = region != imageData.Bounds()
+	info.ColorSignature = calcColorSignature(subImage(imageData, region))
+
+	for _, percent := range crop.Percents {
+		cropRegion := centerCrop(region, percent)
+		if cropRegion.Dx() < samplew || cropRegion.Dy() < sampleh {
+			continue
+		}
+
+		start := time.Now()
+		imagehash, err := hashAlgorithms[algorithm.String()](subImage(imageData, cropRegion), samplew, sampleh)
+		if err != nil {
+			return nil, fmt.Errorf("failed calcImageHash(%s): %w", algorithm.String(), err)
+		}
+		metrics.HashSeconds.ObserveSince(algorithm.String(), start)
+
+		info.Crops = append(info.Crops, CropHash{Name: fmt.Sprintf("%s%d", cropNameCenter, percent), ImageHash: imagehash})
+	}
+	return info, nil
+}
+
+// cropName i番目のハッシュ（0は元のハッシュ、1以降はCrops）の切り抜きの名前
+func cropName(info *ImageHashInfo, i int) string {
+	if i > 0 && i <= len(info.Crops) {
+		return info.Crops[i-1].Name
+	}
+	if info.IsTrimmed {
+		return cropNameTrimmed
+	}
+	return cropNameFull
+}
+
+// cropMatchLabel どの切り抜き同士が似ていたかの表示
+// NOTE: 両方とも画像全体なら空にする
+func cropMatchLabel(info *ImageHashInfo, i int, other *ImageHashInfo, j int) string {
+	lhs, rhs := cropName(info, i), cropName(other, j)
+	if lhs == cropNameFull && rhs == cropNameFull {
+		return ""
+	}
+	return lhs + " vs " + rhs
+}
+
+// packCropHashes 元のハッシュと切り抜きのハッシュを順に返す
+func packCropHashes(info *ImageHashInfo) []*goimagehash.ExtImageHash {
+	hashes := make([]*goimagehash.ExtImageHash, 0, len(info.Crops)+1)
+	hashes = append(hashes, info.ImageHash)
+	for _, crop := range info.Crops {
+		hashes = append(hashes, crop.ImageHash)
+	}
+	return hashes
+}
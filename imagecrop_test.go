@@ -0,0 +1,118 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newFramedImage 画像の周りに指定の色の余白を付けた画像
+func newFramedImage(content image.Image, top, bottom, left, right int, border color.Color) *image.RGBA {
+	bounds := content.Bounds()
+	framed := image.NewRGBA(image.Rect(0, 0, left+bounds.Dx()+right, top+bounds.Dy()+bottom))
+	draw.Draw(framed, framed.Bounds(), image.NewUniform(border), image.Point{}, draw.Src)
+	draw.Draw(framed, image.Rect(left, top, left+bounds.Dx(), top+bounds.Dy()), content, bounds.Min, draw.Src)
+	return framed
+}
+
+// TestDetectContentRegion 余白を除いた範囲を検出できるかのテスト
+func TestDetectContentRegion(t *testing.T) {
+	content := newTestMosaic(120, 90, 6)
+	framed := newFramedImage(content, 30, 30, 0, 0, color.Black)
+	framed = newFramedImage(framed, 12, 12, 20, 16, color.White)
+
+	expected := image.Rect(20, 42, 140, 132)
+	if region := detectContentRegion(framed, 16); region != expected {
+		t.Errorf("unexpected region: %v, expected %v", region, expected)
+	}
+
+	// NOTE: 余白がなければそのまま、全体が一様なら余白とみなさない
+	if region := detectContentRegion(content, 16); region != content.Bounds() {
+		t.Errorf("unexpected region: %v", region)
+	}
+	plain := newFramedImage(image.NewRGBA(image.Rect(0, 0, 0, 0)), 50, 50, 50, 50, color.White)
+	if region := detectContentRegion(plain, 16); region != plain.Bounds() {
+		t.Errorf("unexpected region: %v", region)
+	}
+
+	if region := centerCrop(image.Rect(10, 10, 110, 60), 80); region != image.Rect(20, 15, 100, 55) {
+		t.Errorf("unexpected crop: %v", region)
+	}
+}
+
+// TestCropMatching 余白付き・切り抜きの画像が元の画像とグルーピングされ、どの切り抜きかが出力されるかのテスト
+func TestCropMatching(t *testing.T) {
+	root := t.TempDir()
+	original := newTestMosaic(256, 256, 12)
+	images := map[string]image.Image{
+		"original.png":  original,
+		"framed.png":    newFramedImage(original, 48, 48, 48, 48, color.White),
+		"letterbox.png": newFramedImage(original, 64, 64, 0, 0, color.Black),
+		"cropped.png":   subImage(original, centerCrop(original.Bounds(), 80)),
+	}
+	for name, imageData := range images {
+		if err := os.WriteFile(filepath.Join(root, name), encodeTestPng(t, imageData), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	work := t.TempDir()
+	groups := filepath.Join(work, "groups.json")
+	args := []string{"run", "-root", root, "-o", groups, "-threshold", "10", "-progress", "none"}
+
+	// NOTE: 余白を除かなければ元の画像と似ていると判定されない
+	if code, _, stderr := runTestCli(t, append(args, "-write-midfile", "")...); code != 0 {
+		t.Fatalf("run failed: %v %s", code, stderr)
+	}
+	membersList, err := readSimilarGroups(groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, members := range membersList {
+		for _, member := range members {
+			if strings.HasSuffix(member.Filepath, "framed.png") {
+				t.Fatalf("framed image grouped without -trim-borders: %v", membersList)
+			}
+		}
+	}
+
+	midfile := filepath.Join(work, "midfile.json")
+	if code, _, stderr := runTestCli(t, append(args, "-trim-borders", "-crops", "80", "-write-midfile", midfile)...); code != 0 {
+		t.Fatalf("run failed: %v %s", code, stderr)
+	}
+	membersList, err = readSimilarGroups(groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(membersList) != 1 || len(membersList[0]) != len(images) {
+		t.Fatalf("unexpected groups: %v", membersList)
+	}
+	crops := map[string]string{}
+	for _, member := range membersList[0] {
+		crops[filepath.Base(member.Filepath)] = member.Crop
+	}
+	if !strings.Contains(crops["cropped.png"]+crops["original.png"], "center80") {
+		t.Errorf("crop match is not reported: %v", crops)
+	}
+
+	// NOTE: 切り抜いたハッシュは中間ファイルにも残る
+	container := &ParallelCompList{}
+	if err := container.Deserialize(midfile); err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range *container {
+		isFramed := strings.HasSuffix(info.Filepath, "framed.png") || strings.HasSuffix(info.Filepath, "letterbox.png")
+		if info.IsTrimmed != isFramed || len(info.Crops) != 1 || info.Crops[0].Name != "center80" {
+			t.Errorf("unexpected midfile entry: %v %v %v", info.Filepath, info.IsTrimmed, info.Crops)
+		}
+	}
+
+	code, stdout, stderr := runTestCli(t, "report", "-groups", groups)
+	if code != 0 || !strings.Contains(stdout, "(crop: ") {
+		t.Fatalf("unexpected report: %v %s %s", code, stdout, stderr)
+	}
+}
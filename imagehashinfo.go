@@ -12,29 +12,110 @@ import (
 
 type ImageHashInfo struct {
 	Filepath  string
+	Root      string
+	HardLinks []string
 	ImageHash *goimagehash.ExtImageHash
+	// NOTE: -trim-bordersで余白を除いてからImageHashを計算したか
+	IsTrimmed bool
+	// NOTE: -cropsで中央を切り抜いて計算したハッシュ
+	Crops []CropHash
+	// NOTE: 色違いを見分けるための色相のヒストグラム（calcColorSignature）
+	ColorSignature []byte
+	// NOTE: 基準の画像との関係の判定に使う元の画像の大きさ、ファイルの中身と画素のハッシュ（分からなければ0と空）
+	Width       int
+	Height      int
+	ContentHash string
+	PixelHash   string
+	// NOTE: グルーピングでグループの基準の画像と比較した結果（切り抜き、特徴点の対応の数、色の違い。中間ファイルには書き出さない）
+	Matched *SimilarImage
+	// NOTE: -qualityを指定した場合のグループ内での画質（中間ファイルには書き出さない）
+	Quality *imageQuality
+}
+
+// CropHash 画像の一部分を切り抜いて計算したハッシュ
+type CropHash struct {
+	Name      string
+	ImageHash *goimagehash.ExtImageHash
+}
+
+// cropHashDump CropHashのjson表現
+type cropHashDump struct {
+	Name          string
+	ImageHashDump string
 }
 
 type ImageHashInfoList []ImageHashInfo
 
-// MarshalJSON Jsonデータにエンコード
-func (p *ImageHashInfo) MarshalJSON() ([]byte, error) {
+// dumpImageHash ハッシュをbase64の文字列にする
+func dumpImageHash(imageHash *goimagehash.ExtImageHash) (string, error) {
 	b := bytes.Buffer{}
 	writer := bufio.NewWriter(&b)
-	if err := p.ImageHash.Dump(writer); err != nil {
-		return nil, fmt.Errorf("failed ImageHash.Dump: %w", err)
+	if err := imageHash.Dump(writer); err != nil {
+		return "", fmt.Errorf("failed ImageHash.Dump: %w", err)
 	}
 
 	if err := writer.Flush(); err != nil {
-		return nil, fmt.Errorf("failed Flush: %w", err)
+		return "", fmt.Errorf("failed Flush: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(b.Bytes()), nil
+}
+
+// loadImageHash base64の文字列からハッシュを読み込む
+func loadImageHash(dump string) (*goimagehash.ExtImageHash, error) {
+	data, err := base64.StdEncoding.DecodeString(dump)
+	if err != nil {
+		return nil, fmt.Errorf("failed DecodeString: %w", err)
+	}
+
+	reader := bufio.NewReader(bytes.NewBuffer(data))
+	imageHash, err := goimagehash.LoadExtImageHash(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed LoadExtImageHash: %w", err)
+	}
+	return imageHash, nil
+}
+
+// MarshalJSON Jsonデータにエンコード
+func (p *ImageHashInfo) MarshalJSON() ([]byte, error) {
+	imageHashDump, err := dumpImageHash(p.ImageHash)
+	if err != nil {
+		return nil, err
+	}
+
+	crops := make([]cropHashDump, 0, len(p.Crops))
+	for _, crop := range p.Crops {
+		dump, err := dumpImageHash(crop.ImageHash)
+		if err != nil {
+			return nil, err
+		}
+		crops = append(crops, cropHashDump{Name: crop.Name, ImageHashDump: dump})
 	}
 
 	encodeData := struct {
-		Filepath      string
-		ImageHashDump string
+		Filepath       string
+		Root           string   `json:",omitempty"`
+		HardLinks      []string `json:",omitempty"`
+		ImageHashDump  string
+		IsTrimmed      bool           `json:",omitempty"`
+		Crops          []cropHashDump `json:",omitempty"`
+		ColorSignature []byte         `json:",omitempty"`
+		Width          int            `json:",omitempty"`
+		Height         int            `json:",omitempty"`
+		ContentHash    string         `json:",omitempty"`
+		PixelHash      string         `json:",omitempty"`
 	}{
-		Filepath:      p.Filepath,
-		ImageHashDump: base64.StdEncoding.EncodeToString(b.Bytes()),
+		Filepath:       p.Filepath,
+		Root:           p.Root,
+		HardLinks:      p.HardLinks,
+		ImageHashDump:  imageHashDump,
+		IsTrimmed:      p.IsTrimmed,
+		Crops:          crops,
+		ColorSignature: p.ColorSignature,
+		Width:          p.Width,
+		Height:         p.Height,
+		ContentHash:    p.ContentHash,
+		PixelHash:      p.PixelHash,
 	}
 
 	data, err := json.Marshal(encodeData)
@@ -48,8 +129,17 @@ func (p *ImageHashInfo) MarshalJSON() ([]byte, error) {
 // UnmarshalJSON Jsonデータからデコード
 func (p *ImageHashInfo) UnmarshalJSON(b []byte) error {
 	decodeData := struct {
-		Filepath      string
-		ImageHashDump string
+		Filepath       string
+		Root           string
+		HardLinks      []string
+		ImageHashDump  string
+		IsTrimmed      bool
+		Crops          []cropHashDump
+		ColorSignature []byte
+		Width          int
+		Height         int
+		ContentHash    string
+		PixelHash      string
 	}{}
 
 	err := json.Unmarshal(b, &decodeData)
@@ -57,17 +147,27 @@ func (p *ImageHashInfo) UnmarshalJSON(b []byte) error {
 		return fmt.Errorf("failed Unmarshal: %w", err)
 	}
 
-	data, err := base64.StdEncoding.DecodeString(decodeData.ImageHashDump)
+	p.ImageHash, err = loadImageHash(decodeData.ImageHashDump)
 	if err != nil {
-		return fmt.Errorf("failed DecodeString: %w", err)
+		return err
 	}
-
-	reader := bufio.NewReader(bytes.NewBuffer(data))
-	p.ImageHash, err = goimagehash.LoadExtImageHash(reader)
-	if err != nil {
-		return fmt.Errorf("failed LoadExtImageHash: %w", err)
+	p.Crops = nil
+	for _, crop := range decodeData.Crops {
+		imageHash, err := loadImageHash(crop.ImageHashDump)
+		if err != nil {
+			return fmt.Errorf("failed loadImageHash: %s %w", crop.Name, err)
+		}
+		p.Crops = append(p.Crops, CropHash{Name: crop.Name, ImageHash: imageHash})
 	}
 	p.Filepath = decodeData.Filepath
+	p.Root = decodeData.Root
+	p.HardLinks = decodeData.HardLinks
+	p.IsTrimmed = decodeData.IsTrimmed
+	p.ColorSignature = decodeData.ColorSignature
+	p.Width = decodeData.Width
+	p.Height = decodeData.Height
+	p.ContentHash = decodeData.ContentHash
+	p.PixelHash = decodeData.PixelHash
 
 	return nil
 }
@@ -4,10 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"runtime"
-
-	"github.com/corona10/goimagehash"
-	"golang.org/x/sync/errgroup"
 )
 
 type ParallelCompList []*ImageHashInfo
@@ -20,105 +16,28 @@ func (container *ParallelCompList) Append(info *ImageHashInfo) {
 	*container = append(*container, info)
 }
 
-func compSrcImagehash(ch chan<- string, view ParallelCompList, srcImageHash *goimagehash.ExtImageHash, threshold int) error {
-	for i, data := range view {
-		if data == nil {
-			continue
-		}
-
-		distance, err := srcImageHash.Distance(data.ImageHash)
-		if err != nil {
-			return fmt.Errorf("failed ImageHash.Distance: %w", err)
-		}
-
-		if distance <= threshold {
-			// NOTE: 似てるという判定
-			// NOTE: ここで同時にcontainerに書き込みアクセスするが
-			//       別々の内容に同時に書き込むだけなので大丈夫なはず
-			ch <- data.Filepath
-			view[i] = nil
-		}
-	}
-	return nil
-}
-
-func (container *ParallelCompList) GroupingSimilarImage(threshold int) ([]string, error) {
-	// NOTE: 論理スレッド数分goroutineを生成し
-	//       その中で比較元の内容と近いかどうかを総当たりで全比較する
-	containerSize := len(*container)
-	if containerSize <= 1 {
-		// NOTE: 比較するものがないので空にして抜ける
-		*container = make(ParallelCompList, 0)
-		return nil, nil
-	}
-
-	// NOTE: 最初の要素を比較元にする
-	src := (*container)[0]
-
-	// NOTE: 残りの要素と比較するのでずらす
-	(*container) = (*container)[1:]
-	containerSize -= 1
-
-	parallels := runtime.NumCPU()
-	if parallels > containerSize {
-		parallels = containerSize
-	}
-	dataViewOffset := containerSize / parallels
-	remainder := containerSize % parallels
-
-	ch := make(chan string, parallels)
-	eg := errgroup.Group{}
-	nextViewBegin := 0
-	for i := 0; i < parallels; i++ {
-		viewBegin := nextViewBegin
-		viewEnd := nextViewBegin + dataViewOffset
-		if remainder != 0 && i < remainder {
-			// NOTE: 余剰が出る場合は比較数に偏りが出る可能性がある
-			//       goroutine起動index < (containerSize % parallels)なら1要素追加する
-			viewEnd += 1
-		}
-
-		if viewEnd > containerSize || i == parallels-1 {
-			viewEnd = containerSize
-		}
-
-		nextViewBegin = viewEnd
-
-		eg.Go(func() error {
-			return compSrcImagehash(ch, (*container)[viewBegin:viewEnd], src.ImageHash, threshold)
-		})
-	}
-
-	go func() {
-		eg.Wait()
-		close(ch)
-	}()
-
-	similarGroups := []string{}
-	for filepath := range ch {
-		// NOTE: ここでは似ているものだけ受け取るので
-		//       一つでも受信したら比較元とグルーピングできる
-		similarGroups = append(similarGroups, filepath)
-	}
-
-	if len(similarGroups) > 0 {
-		similarGroups = append(similarGroups, src.Filepath)
-	}
-
-	container.compaction()
-
-	return similarGroups, eg.Wait()
-}
-
-func (container *ParallelCompList) compaction() {
-	newList := make(ParallelCompList, 0, len(*container))
+// InfoMap パスからImageHashInfoを引けるマップを返す
+func (container *ParallelCompList) InfoMap() map[string]*ImageHashInfo {
+	infos := make(map[string]*ImageHashInfo, len(*container))
 	for _, info := range *container {
-		if info != nil {
-			newList = append(newList, info)
-		}
+		infos[info.Filepath] = info
 	}
+	return infos
+}
 
-	*container = newList
+// SimilarImage 比較元と似ていると判定された画像とその距離
+type SimilarImage struct {
+	Filepath string
+	Distance int
+	// NOTE: 切り抜き同士が似ていた場合にどの切り抜きか（"center80 vs full"など）
+	Crop string `json:",omitempty"`
+	// NOTE: 特徴点で確かめた場合の幾何的に整合する対応の数
+	Inliers int `json:",omitempty"`
+	// NOTE: -color-sensitivityを指定した場合に色違いか（"duplicate"か"color-variant"）と色相のヒストグラムの距離
+	Color         string  `json:",omitempty"`
+	ColorDistance float64 `json:",omitempty"`
+	// NOTE: 比較元の画像との関係（"identical-bytes"、"resized"など。classifyRelation）
+	Relation string `json:",omitempty"`
 }
 
 func (container *ParallelCompList) Serialize(path string) error {
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/akinobufujii/similar_images_grouping/featureutil"
+	"github.com/akinobufujii/similar_images_grouping/readimageutil"
+)
+
+// keypointFeatures 1枚の画像の特徴点（一度だけ計算する）
+type keypointFeatures struct {
+	once     sync.Once
+	features *featureutil.Features
+	err      error
+}
+
+// keypointVerifier ハッシュで似ていると判定した組を特徴点の対応で確かめる
+// NOTE: nilなら確かめない。特徴点は比較した画像の分だけメモリに残る
+type keypointVerifier struct {
+	MinInliers int
+
+	mu       sync.Mutex
+	features map[string]*keypointFeatures
+
+	checked  atomic.Int64
+	rejected atomic.Int64
+	skipped  atomic.Int64
+}
+
+// newKeypointVerifier 幾何的に整合する対応がminInliers以上ある組だけを残すkeypointVerifierを作成する
+// NOTE: minInliersが0以下ならnil（確かめない）を返す
+func newKeypointVerifier(minInliers int) *keypointVerifier {
+	if minInliers <= 0 {
+		return nil
+	}
+	return &keypointVerifier{
+		MinInliers: minInliers,
+		features:   map[string]*keypointFeatures{},
+	}
+}
+
+// registerVerifyInliersFlag 特徴点で確かめるかのフラグを登録する
+func registerVerifyInliersFlag(flags *flag.FlagSet, minInliers *int) {
+	flags.IntVar(minInliers, "verify-inliers", 0, "re-verify pairs under the threshold with keypoints and drop those with fewer geometric inliers (e.g. 12, 0 is disabled)")
+}
+
+// readFeatureImage 特徴点を探すための画像を読み込む
+// NOTE: 大きなJPEGは縮小してデコードする（特徴点は長辺featureutil.MaxSideに縮小してから探す）
+func readFeatureImage(path string) (image.Image, error) {
+	header, err := readimageutil.ReadImageHeader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed readimageutil.ReadImageHeader: %s %w", path, err)
+	}
+
+	if header.IsReducible && max(header.Width, header.Height)/readimageutil.JpegReduceScale >= featureutil.MaxSide {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed os.Open: %s %w", path, err)
+		}
+		defer file.Close()
+		return readimageutil.DecodeJpegReduced(file)
+	}
+
+	imageData, _, err := readimageutil.ReadImage(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed readimageutil.ReadImage: %s %w", path, err)
+	}
+	return imageData, nil
+}
+
+// Features 指定パスの画像の特徴点を返す
+func (verifier *keypointVerifier) Features(path string) (*featureutil.Features, error) {
+	verifier.mu.Lock()
+	entry, ok := verifier.features[path]
+	if !ok {
+		entry = &keypointFeatures{}
+		verifier.features[path] = entry
+	}
+	verifier.mu.Unlock()
+
+	entry.once.Do(func() {
+		imageData, err := readFeatureImage(path)
+		if err != nil {
+			entry.err = err
+			return
+		}
+		entry.features = featureutil.Extract(imageData)
+	})
+	return entry.features, entry.err
+}
+
+// Verify 2枚の画像の幾何的に整合する特徴点の対応（数と回転）と、組として残すかを返す
+// NOTE: zipの中身や消えたファイルなど読み込めない画像は確かめられないので残す（対応の数は0）
+func (verifier *keypointVerifier) Verify(lhsPath, rhsPath string) (featureutil.Transform, bool) {
+	lhs, err := verifier.Features(lhsPath)
+	if err == nil {
+		var rhs *featureutil.Features
+		rhs, err = verifier.Features(rhsPath)
+		if err == nil {
+			verifier.checked.Add(1)
+			transform := featureutil.VerifyTransform(lhs, rhs)
+			if transform.Inliers < verifier.MinInliers {
+				verifier.rejected.Add(1)
+				slog.Debug("rejected by keypoints", "path", rhsPath, "source", lhsPath, "inliers", transform.Inliers)
+				return transform, false
+			}
+			return transform, true
+		}
+	}
+
+	verifier.skipped.Add(1)
+	slog.Debug("skipped keypoint verification", "path", rhsPath, "source", lhsPath, "error", err)
+	return featureutil.Transform{}, true
+}
+
+// String 確かめた組の数の表示
+func (verifier *keypointVerifier) String() string {
+	if verifier == nil {
+		return "disabled"
+	}
+	return fmt.Sprintf("checked=%d rejected=%d skipped=%d", verifier.checked.Load(), verifier.rejected.Load(), verifier.skipped.Load())
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestKeypointVerify ハッシュでは似ていると判定される別の画像が特徴点の確認で除かれるかのテスト
+func TestKeypointVerify(t *testing.T) {
+	root := t.TempDir()
+	original := newSyntheticScene(1, 480, 360)
+	images := map[string]image.Image{
+		"scene1.png":       original,
+		"scene1-small.png": resizeImage(original, 336, 252),
+		"scene2.png":       newSyntheticScene(2, 480, 360),
+		"scene3.png":       newSyntheticScene(3, 480, 360),
+	}
+	for name, imageData := range images {
+		if err := os.WriteFile(filepath.Join(root, name), encodeTestPng(t, imageData), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// NOTE: 閾値を最大にしてハッシュでは全部が似ていると判定されるようにする
+	groups := filepath.Join(t.TempDir(), "groups.json")
+	args := []string{"run", "-root", root, "-o", groups, "-write-midfile", "", "-threshold", "256", "-progress", "none"}
+	if code, _, stderr := runTestCli(t, args...); code != 0 {
+		t.Fatalf("run failed: %v %s", code, stderr)
+	}
+	membersList, err := readSimilarGroups(groups)
+	if err != nil || len(membersList) != 1 || len(membersList[0]) != len(images) {
+		t.Fatalf("unexpected groups: %v %v", membersList, err)
+	}
+
+	code, stdout, stderr := runTestCli(t, append(args, "-verify-inliers", "12")...)
+	if code != 0 || !strings.Contains(stdout, "KeypointVerify: checked=") {
+		t.Fatalf("run failed: %v %s %s", code, stdout, stderr)
+	}
+	membersList, err = readSimilarGroups(groups)
+	if err != nil || len(membersList) != 1 || len(membersList[0]) != 2 {
+		t.Fatalf("unexpected groups: %v %v", membersList, err)
+	}
+	names := []string{}
+	inliers := 0
+	for _, member := range membersList[0] {
+		names = append(names, filepath.Base(member.Filepath))
+		inliers = max(inliers, member.Inliers)
+	}
+	if !strings.Contains(strings.Join(names, ","), "scene1-small.png") || !strings.Contains(strings.Join(names, ","), "scene1.png") || inliers < 12 {
+		t.Errorf("unexpected group: %v inliers=%v", names, inliers)
+	}
+
+	code, stdout, _ = runTestCli(t, "report", "-groups", groups)
+	if code != 0 || !strings.Contains(stdout, "inliers: ") {
+		t.Errorf("unexpected report: %v %s", code, stdout)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+)
+
+// lshOptions 近似のグルーピング（ビットサンプリングのLSH）の設定
+type lshOptions struct {
+	// NOTE: 0なら近似しない（総当たりと同じグループ）
+	Tables int
+	Bits   int
+	// NOTE: 総当たりと比べて再現率を推定するために選ぶ画像の数（0なら推定しない）
+	RecallSample int
+}
+
+// registerLshFlags 近似のグルーピングのフラグを登録する
+func registerLshFlags(flags *flag.FlagSet, lsh *lshOptions) {
+	flags.IntVar(&lsh.Tables, "lsh-tables", 0, "approximate grouping with bit-sampling LSH: number of hash tables (more tables find more pairs, 0 is exact grouping)")
+	flags.IntVar(&lsh.Bits, "lsh-bits", 16, "hash bits sampled per LSH table (fewer bits find more pairs but compare more)")
+	flags.IntVar(&lsh.RecallSample, "lsh-recall-sample", 200, "images sampled to estimate the recall of approximate grouping against brute force (0 is disabled)")
+}
+
+// Validate 指定の範囲を確認する
+func (lsh *lshOptions) Validate() error {
+	if lsh.Tables < 0 {
+		return fmt.Errorf("invalid lsh-tables: %d (0 or more)", lsh.Tables)
+	}
+	if lsh.Bits < 1 || lsh.Bits > 64 {
+		return fmt.Errorf("invalid lsh-bits: %d (1-64)", lsh.Bits)
+	}
+	if lsh.RecallSample < 0 {
+		return fmt.Errorf("invalid lsh-recall-sample: %d (0 or more)", lsh.RecallSample)
+	}
+	return nil
+}
+
+// approximateSearch 近似のグルーピングの設定と結果
+// NOTE: nilなら近似しない
+type approximateSearch struct {
+	Options lshOptions
+
+	// NOTE: 総当たりでしきい値以下だった組のうち、LSHの候補に入った組の割合
+	recall        float64
+	sampledImages int
+	sampledPairs  int
+	// NOTE: LSHの候補として比較した数
+	candidates atomic.Int64
+}
+
+// newApproximateSearch 近似のグルーピングを作成する
+// NOTE: テーブルの数が0ならnil
+func newApproximateSearch(options lshOptions) *approximateSearch {
+	if options.Tables <= 0 {
+		return nil
+	}
+	return &approximateSearch{Options: options}
+}
+
+func (approximate *approximateSearch) String() string {
+	if approximate == nil {
+		return "disabled"
+	}
+	recall := "not estimated"
+	if approximate.sampledImages > 0 {
+		recall = fmt.Sprintf("%.3f (sampled %d images, %d pairs)", approximate.recall, approximate.sampledImages, approximate.sampledPairs)
+	}
+	return fmt.Sprintf("tables=%d bits=%d candidates=%d recall=%s", approximate.Options.Tables, approximate.Options.Bits, approximate.candidates.Load(), recall)
+}
+
+// lshIndex ハッシュから選んだビットの値ごとに行をまとめたテーブル
+// NOTE: 距離dの組が1つのテーブルで同じバケットに入る確率は(1-d/bits)^Bits程度で、いずれかのテーブルで入れば候補になる
+type lshIndex struct {
+	positions [][]int
+	buckets   []map[uint64][]int32
+	// NOTE: 候補の重複を除くための印（行ごとに最後に候補にした回の番号）
+	stamps []uint32
+	stamp  uint32
+}
+
+// lshKey ハッシュから選んだビットを詰めた値
+func lshKey(hash []uint64, positions []int) uint64 {
+	key := uint64(0)
+	for i, position := range positions {
+		key |= (hash[position/64] >> (position % 64) & 1) << i
+	}
+	return key
+}
+
+// newLshIndex 行のハッシュ（切り抜きのハッシュも含む）をテーブルに登録する
+// NOTE: 選ぶビットはseedを固定して決めるので、同じ設定なら同じ結果になる
+func newLshIndex(matrix *hashMatrix, options lshOptions) (*lshIndex, error) {
+	if options.Bits > matrix.bits {
+		return nil, fmt.Errorf("lsh-bits %d exceeds the hash bits %d", options.Bits, matrix.bits)
+	}
+	random := rand.New(rand.NewSource(1))
+	rows := len(matrix.Infos)
+	index := &lshIndex{stamps: make([]uint32, rows)}
+	rowSize := matrix.variants * matrix.words
+	for t := 0; t < options.Tables; t++ {
+		positions := random.Perm(matrix.bits)[:options.Bits]
+		buckets := map[uint64][]int32{}
+		for row := 0; row < rows; row++ {
+			for v := 0; v < matrix.variants; v++ {
+				hash := matrix.hashes[row*rowSize+v*matrix.words : row*rowSize+(v+1)*matrix.words]
+				key := lshKey(hash, positions)
+				// NOTE: 切り抜きのハッシュが同じバケットに入った場合は1回だけ登録する
+				if bucket := buckets[key]; len(bucket) == 0 || bucket[len(bucket)-1] != int32(row) {
+					buckets[key] = append(bucket, int32(row))
+				}
+			}
+		}
+		index.positions = append(index.positions, positions)
+		index.buckets = append(index.buckets, buckets)
+	}
+	return index, nil
+}
+
+// Candidates srcと同じバケットに入った、取り除いていない行をrowsに追加して返す
+// NOTE: 印を使うのでgoroutineをまたいで同時に呼ばない
+func (index *lshIndex) Candidates(matrix *hashMatrix, src []uint64, rows []int32) []int32 {
+	index.stamp++
+	for t, positions := range index.positions {
+		for v := 0; v < len(src)/matrix.words; v++ {
+			key := lshKey(src[v*matrix.words:(v+1)*matrix.words], positions)
+			for _, row := range index.buckets[t][key] {
+				if index.stamps[row] == index.stamp || matrix.Infos[row] == nil {
+					continue
+				}
+				index.stamps[row] = index.stamp
+				rows = append(rows, row)
+			}
+		}
+	}
+	return rows
+}
+
+// estimateRecall 無作為に選んだ画像で、総当たりでしきい値以下になる組のうちLSHの候補に入る割合を数える
+// NOTE: グルーピングで取り除く前に呼ぶ。特徴点や色の判定はせずハッシュの距離だけで比べる
+func (approximate *approximateSearch) estimateRecall(matrix *hashMatrix, threshold int) {
+	rows := len(matrix.Infos)
+	sample := min(approximate.Options.RecallSample, rows)
+	if sample == 0 {
+		return
+	}
+	random := rand.New(rand.NewSource(1))
+	rowSize := matrix.variants * matrix.words
+	found := 0
+	candidates := []int32{}
+	for _, row := range random.Perm(rows)[:sample] {
+		src := matrix.hashes[row*rowSize : (row+1)*rowSize]
+		for other := 0; other < rows; other++ {
+			if distance, _, _ := matrix.rowDistance(src, other, threshold); other != row && distance <= threshold {
+				approximate.sampledPairs++
+			}
+		}
+		candidates = matrix.lsh.Candidates(matrix, src, candidates[:0])
+		for _, other := range candidates {
+			if distance, _, _ := matrix.rowDistance(src, int(other), threshold); int(other) != row && distance <= threshold {
+				found++
+			}
+		}
+	}
+
+	approximate.sampledImages = sample
+	approximate.recall = 1
+	if approximate.sampledPairs > 0 {
+		approximate.recall = float64(found) / float64(approximate.sampledPairs)
+	}
+}
+
+// enableApproximate LSHのテーブルを作成して近似のグルーピングにする
+// NOTE: 再現率は取り除く前の全ての行で推定する
+func (matrix *hashMatrix) enableApproximate(approximate *approximateSearch, threshold int) error {
+	if approximate == nil || len(matrix.Infos) == 0 {
+		return nil
+	}
+	index, err := newLshIndex(matrix, approximate.Options)
+	if err != nil {
+		return err
+	}
+	matrix.lsh = index
+	matrix.Approximate = approximate
+	approximate.estimateRecall(matrix, threshold)
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// groupingApproximate LSHで近似的にグルーピングする（グループ内はパスの順）
+func groupingApproximate(t testing.TB, list ParallelCompList, threshold int, options lshOptions) ([][]string, *approximateSearch) {
+	t.Helper()
+	container := append(ParallelCompList{}, list...)
+	approximate := newApproximateSearch(options)
+	groups, err := groupingSimilarImages(&container, &groupingOptions{Threshold: threshold, Parallels: 2, Approximate: approximate}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(container) != 0 {
+		t.Fatalf("container is not empty: %v", len(container))
+	}
+	for _, group := range groups {
+		sort.Strings(group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i][0] < groups[j][0]
+	})
+	return groups, approximate
+}
+
+// TestLshGrouping テーブルが十分なら総当たりと同じグループになり、少なければ再現率が下がるかのテスト
+func TestLshGrouping(t *testing.T) {
+	const threshold = 10
+	list := newDensityHashList(2000, 4, true)
+	expected := bruteForceGroups(t, list, threshold)
+	sort.Slice(expected, func(i, j int) bool {
+		return expected[i][0] < expected[j][0]
+	})
+
+	groups, approximate := groupingApproximate(t, list, threshold, lshOptions{Tables: 32, Bits: 8, RecallSample: 2000})
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("unexpected groups: %v, expected %v", len(groups), len(expected))
+	}
+	if approximate.recall != 1 || approximate.sampledImages != 2000 || approximate.sampledPairs == 0 {
+		t.Errorf("unexpected recall: %v", approximate)
+	}
+
+	t.Logf("exact: %v", approximate)
+
+	// NOTE: テーブルが少なくビットが多いと取りこぼすが、比較する数は総当たりより少ない
+	_, approximate = groupingApproximate(t, list, threshold, lshOptions{Tables: 2, Bits: 32, RecallSample: 500})
+	t.Logf("sparse: %v", approximate)
+	if approximate.recall >= 1 || approximate.recall < 0.3 {
+		t.Errorf("unexpected recall: %v", approximate)
+	}
+	if candidates := approximate.candidates.Load(); candidates >= int64(len(list)*len(list)/20) {
+		t.Errorf("not pruned: %v candidates", candidates)
+	}
+}
+
+// TestLshCli groupの-lsh-tablesで近似のグルーピングの結果が表示されるかのテスト
+func TestLshCli(t *testing.T) {
+	dir := t.TempDir()
+	midfile := filepath.Join(dir, "midfile.json")
+	container := newDensityHashList(200, 4, false)
+	if err := container.Serialize(midfile); err != nil {
+		t.Fatal(err)
+	}
+
+	code, stdout, stderr := runTestCli(t, "group", "-midfile", midfile, "-o", filepath.Join(dir, "groups.json"), "-lsh-tables", "8", "-lsh-bits", "12")
+	if code != 0 || !strings.Contains(stdout, "Approximate: tables=8 bits=12") || !strings.Contains(stdout, "sampled 200 images") {
+		t.Errorf("unexpected result: %v\nstdout: %s\nstderr: %s", code, stdout, stderr)
+	}
+
+	if code, _, stderr := runTestCli(t, "group", "-midfile", midfile, "-lsh-tables", "8", "-lsh-bits", "65"); code != 2 || !strings.Contains(stderr, "invalid lsh-bits") {
+		t.Errorf("unexpected result of invalid lsh-bits: %v %s", code, stderr)
+	}
+}
@@ -2,20 +2,20 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
 	"context"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"image"
+	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
+	"sync"
+	"time"
 	"unicode/utf8"
 
 	"github.com/akinobufujii/similar_images_grouping/charcodeutil"
-	"github.com/akinobufujii/similar_images_grouping/readimageutil"
-	"github.com/bradhe/stopwatch"
 	"github.com/corona10/goimagehash"
 	"golang.org/x/sync/errgroup"
 )
@@ -28,7 +28,12 @@ func writeJson(path string, targetData any) error {
 	}
 	defer file.Close()
 
-	encoder := json.NewEncoder(file)
+	return writeJsonTo(file, targetData)
+}
+
+// writeJsonTo 指定の出力先へのjson書き込み
+func writeJsonTo(writer io.Writer, targetData any) error {
+	encoder := json.NewEncoder(writer)
 	encoder.SetIndent("", "  ")
 
 	if err := encoder.Encode(&targetData); err != nil {
@@ -38,12 +43,41 @@ func writeJson(path string, targetData any) error {
 	return nil
 }
 
+// hashAlgorithms 画像ハッシュの計算方法
+var hashAlgorithms = map[string]func(image.Image, int, int) (*goimagehash.ExtImageHash, error){
+	"phash": goimagehash.ExtPerceptionHash,
+	"ahash": goimagehash.ExtAverageHash,
+	"dhash": goimagehash.ExtDifferenceHash,
+}
+
+// hashAlgorithmFlag 画像ハッシュの計算方法を指定するフラグ（空ならphash）
+// NOTE: 計算方法が違うハッシュ同士は比較できない
+type hashAlgorithmFlag string
+
+func (algorithm *hashAlgorithmFlag) String() string {
+	if len(*algorithm) == 0 {
+		return "phash"
+	}
+	return string(*algorithm)
+}
+
+func (algorithm *hashAlgorithmFlag) Set(value string) error {
+	if _, ok := hashAlgorithms[value]; !ok {
+		return fmt.Errorf("unknown hash algorithm: %s (phash, ahash or dhash)", value)
+	}
+	*algorithm = hashAlgorithmFlag(value)
+	return nil
+}
+
 // calcImageHash 画像ハッシュ計算関数
-func calcImageHash(imageData image.Image, path string, samplew, sampleh int) (*ImageHashInfo, error) {
-	imagehash, err := goimagehash.ExtPerceptionHash(imageData, samplew, sampleh)
+func calcImageHash(imageData image.Image, path string, algorithm hashAlgorithmFlag, samplew, sampleh int) (*ImageHashInfo, error) {
+	start := time.Now()
+	imagehash, err := hashAlgorithms[algorithm.String()](imageData, samplew, sampleh)
 	if err != nil {
-		return nil, fmt.Errorf("failed goimagehash.ExtPerceptionHash: %w", err)
+		return nil, fmt.Errorf("failed calcImageHash(%s): %w", algorithm.String(), err)
 	}
+	metrics.HashSeconds.ObserveSince(algorithm.String(), start)
+	metrics.HashesComputed.Add("", 1)
 
 	imageHash := &ImageHashInfo{
 		Filepath:  path,
@@ -53,28 +87,91 @@ func calcImageHash(imageData image.Image, path string, samplew, sampleh int) (*I
 	return imageHash, nil
 }
 
-// readImageFromZip zipファイルから画像を読み込み、指定のチャネルに送信する
-func readImageFromZip(path string, chCalcImagehash chan<- *ImageHashInfo, samplew, sampleh int) error {
+// scanOptions 画像の走査・ハッシュ計算の設定
+type scanOptions struct {
+	HashAlgorithm hashAlgorithmFlag
+	SampleWidth   int
+	SampleHeight  int
+	Parallels     int
+	Filter        *walkFilter
+
+	FollowSymlinks bool
+	OneFileSystem  bool
+	// NOTE: nilならハードリンクをまとめない
+	HardLinks *hardLinkTracker
+	// NOTE: nilなら進捗を集計しない
+	Progress *progressTracker
+	// NOTE: nilなら読み込めなかったファイルはログだけ出す
+	Issues *scanIssueLog
+
+	// NOTE: 0なら画素数で除外しない
+	MaxPixels int64
+	// NOTE: 大きなJPEGを1/8の大きさでデコードする
+	IsReduceJpeg bool
+	// NOTE: nilならデコード中のメモリを制限しない
+	DecodeMemory *decodeMemory
+
+	// NOTE: 0ならParallelsと同じ数にする
+	IOWorkers  int
+	CPUWorkers int
+
+	// NOTE: 余白の除去と切り抜いたハッシュの計算
+	Crop cropOptions
+}
+
+// Workers 読み込みとハッシュ計算それぞれのgoroutineの数
+func (options *scanOptions) Workers() (int, int) {
+	parallels := max(options.Parallels, 1)
+	ioWorkers, cpuWorkers := options.IOWorkers, options.CPUWorkers
+	if ioWorkers < 1 {
+		ioWorkers = parallels
+	}
+	if cpuWorkers < 1 {
+		cpuWorkers = parallels
+	}
+	return ioWorkers, cpuWorkers
+}
+
+// skipBySize サイズで除外するか判定する
+// NOTE: 大きすぎて除外したファイルはデータを見直せるように記録する
+func skipBySize(options *scanOptions, path, root string, size int64) bool {
+	reason := options.Filter.FilterSize(size)
+	if reason == filterReasonMaxSize {
+		options.Issues.Add(path, root, issueReasonTooLarge, fmt.Errorf("size %d exceeds max-size %d", size, options.Filter.MaxSize))
+	}
+	return options.Filter.Skip(reason)
+}
+
+// readRawFile ファイルの中身を読み込む
+// NOTE: ベンチマークで遅いストレージを模擬するために差し替えられるようにしている
+var readRawFile = os.ReadFile
+
+// rawImage 読み込んだだけでまだデコードしていない画像データ
+type rawImage struct {
+	Path string
+	Root string
+	Data []byte
+}
+
+// readRawImagesFromZip zipファイルの中身を読み込み、onRawImageに渡す
+func readRawImagesFromZip(path, root string, options *scanOptions, onRawImage func(*rawImage) error) error {
 	zipReader, err := zip.OpenReader(path)
 	if err != nil {
 		return fmt.Errorf("failed zip.OpenReader: %s %w", path, err)
 	}
 	defer zipReader.Close()
 
-	getImageData := func(file *zip.File) (image.Image, error) {
+	readEntry := func(file *zip.File) ([]byte, error) {
 		reader, err := file.Open()
 		if err != nil {
 			return nil, err
 		}
 		defer reader.Close()
 
-		imageData, _, err := readimageutil.DecodeImage(reader)
-		if err != nil {
-			return nil, err
-		}
-		return imageData, nil
+		return io.ReadAll(reader)
 	}
 
+	filter := options.Filter
 	for _, file := range zipReader.File {
 		if file.FileInfo().IsDir() {
 			continue
@@ -89,85 +186,241 @@ func readImageFromZip(path string, chCalcImagehash chan<- *ImageHashInfo, sample
 			}
 		}
 
-		imageData, err := getImageData(file)
 		fullFilename := filepath.Join(path, dispname)
-		if err != nil {
-			// NOTE: 画像として開けなければスルーして完走するようにする
-			fmt.Fprintf(os.Stderr, "%v: %s\n", err, fullFilename)
+		if filter.Skip(filter.FilterArchiveEntry(fullFilename, dispname)) || skipBySize(options, fullFilename, root, int64(file.UncompressedSize64)) {
+			continue
+		}
+
+		if file.Flags&0x1 != 0 {
+			// NOTE: archive/zipは暗号化に対応していない
+			options.Issues.Add(fullFilename, root, issueReasonEncrypted, nil)
+			options.Progress.Fail()
 			continue
 		}
 
-		imageHash, err := calcImageHash(imageData, fullFilename, samplew, sampleh)
+		data, err := readEntry(file)
 		if err != nil {
-			return fmt.Errorf("failed calcImageHash: %s %w", path, err)
+			// NOTE: 読めなければスルーして完走するようにする
+			options.Issues.Add(fullFilename, root, classifyReadError(err), err)
+			options.Progress.Fail()
+			continue
+		}
+
+		if err := onRawImage(&rawImage{Path: fullFilename, Root: root, Data: data}); err != nil {
+			return err
 		}
-		chCalcImagehash <- imageHash
 	}
 
 	return nil
 }
 
+// readRawImages 拡張子に応じて1ファイル分（zipなら中身すべて）の画像データを読み込み、onRawImageに渡す
+// NOTE: 読めなかった場合はログだけ出してnilを返す
+func readRawImages(ctx context.Context, path, root string, options *scanOptions, onRawImage func(*rawImage) error) error {
+	defer metrics.FilesScanned.Add("", 1)
+
+	// NOTE: 拡張子で処理を分岐
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".zip": // NOTE: zipファイル
+		err := readRawImagesFromZip(path, root, options, onRawImage)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			// NOTE: 読めなくてもログだけ出して継続
+			options.Issues.Add(path, root, classifyReadError(err), fmt.Errorf("failed readRawImagesFromZip: %w", err))
+			options.Progress.Fail()
+		}
+		return nil
+	default: // NOTE: その他（画像ファイルとして判断）
+		data, err := readRawFile(path)
+		if err != nil {
+			// NOTE: 読めなくてもログだけ出して継続
+			options.Issues.Add(path, root, classifyReadError(err), fmt.Errorf("failed os.ReadFile: %w", err))
+			options.Progress.Fail()
+			return nil
+		}
+		return onRawImage(&rawImage{Path: path, Root: root, Data: data})
+	}
+}
+
+// hashRawImage 画像データをデコードしてハッシュを計算する
+// NOTE: デコードできなかった場合はログだけ出してnilを返す（除外した場合もnil）
+func hashRawImage(ctx context.Context, raw *rawImage, options *scanOptions) (*ImageHashInfo, error) {
+	open := func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(raw.Data)), nil
+	}
+	imageData, header, release, err := decodeImageBounded(ctx, open, options)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// NOTE: 画像として開けなければスルーして完走するようにする
+		options.Issues.Add(raw.Path, raw.Root, classifyReadError(err), fmt.Errorf("failed decodeImageBounded: %s %w", raw.Path, err))
+		options.Progress.Fail()
+		return nil, nil
+	}
+	if imageData == nil {
+		return nil, nil
+	}
+
+	imageHash, err := calcCroppedImageHash(imageData, raw.Path, options.HashAlgorithm, options.SampleWidth, options.SampleHeight, &options.Crop)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("failed calcImageHash: %s %w", raw.Path, err)
+	}
+	// NOTE: 基準の画像との関係を判定するための情報
+	//       縮小デコードした画素はDC成分だけなので違う画像でも一致することがある。縮小した場合は画素のハッシュを空にして同じ画素とは判定しない
+	if bounds := imageData.Bounds(); bounds.Dx() == header.Width && bounds.Dy() == header.Height {
+		imageHash.PixelHash = calcPixelHash(imageData)
+	}
+	release()
+	imageHash.Root = raw.Root
+	imageHash.Width = header.Width
+	imageHash.Height = header.Height
+	imageHash.ContentHash = calcContentHash(raw.Data)
+	return imageHash, nil
+}
+
+// readImageHash 1ファイル分（zipなら中身すべて）の画像を読み込み、ハッシュを指定のチャネルに送信する
+// NOTE: 読み込みとハッシュ計算を同じgoroutineで順に行う（走査全体ではwalkImageHashで段ごとに分ける）
+func readImageHash(ctx context.Context, path, root string, chCalcImagehash chan<- *ImageHashInfo, options *scanOptions) error {
+	return readRawImages(ctx, path, root, options, func(raw *rawImage) error {
+		imageHash, err := hashRawImage(ctx, raw, options)
+		if err != nil || imageHash == nil {
+			return err
+		}
+
+		select {
+		case chCalcImagehash <- imageHash:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// filterWalkPath 走査中に見つけたパスを除外するか判定する
+// NOTE: ディレクトリを除外する場合はfilepath.SkipDirを返す
+func filterWalkPath(options *scanOptions, path, root string, d os.DirEntry) (bool, error) {
+	filter := options.Filter
+	if d.IsDir() {
+		if filter.Skip(filter.FilterDir(path)) {
+			return true, filepath.SkipDir
+		}
+		return true, nil
+	}
+
+	if strings.ToLower(filepath.Ext(path)) == ".zip" {
+		// NOTE: zipは中身ごとに判定するので、zip自体はサイズ以外の条件でだけ除外する
+		return filter.Skip(filter.FilterContainerPath(path)), nil
+	}
+
+	if filter.Skip(filter.FilterPath(path)) {
+		return true, nil
+	}
+
+	if filter != nil && (filter.MinSize > 0 || filter.MaxSize > 0) {
+		info, err := d.Info()
+		if err != nil {
+			return false, fmt.Errorf("failed DirEntry.Info: %s %w", path, err)
+		}
+		if skipBySize(options, path, root, info.Size()) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 // createParallelCompList ParallelCompListを作成する
-func createParallelCompList(ctx context.Context, container *ParallelCompList, root string, samplew, sampleh, parallels int) error {
+func createParallelCompList(ctx context.Context, container *ParallelCompList, sources *scanSources, options *scanOptions) error {
+	err := walkImageHash(ctx, sources, options, func(imageHash *ImageHashInfo) error {
+		container.Append(imageHash)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// NOTE: 走査し終わってからでないとハードリンクがすべて揃わないので最後に記録する
+	if options.HardLinks != nil {
+		for _, info := range *container {
+			info.HardLinks = options.HardLinks.LinksOf(info.Filepath)
+		}
+	}
+	return nil
+}
+
+// walkImageHash 走査元以下の画像のハッシュを並行に計算し、計算できたものから順にonImageHashに渡す
+// NOTE: onImageHashは単一のgoroutineから呼ばれる
+func walkImageHash(ctx context.Context, sources *scanSources, options *scanOptions, onImageHash func(*ImageHashInfo) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	eg, ctx := errgroup.WithContext(ctx)
 
+	ioWorkers, cpuWorkers := options.Workers()
+
 	// NOTE: ファイルのパスを送り続けるgoroutine
-	chPath := make(chan string, parallels)
+	chPath := make(chan walkPath, ioWorkers)
 	eg.Go(func() error {
 		defer close(chPath)
-		return filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
-			if err != nil {
-				return fmt.Errorf("failed filepath.WalkDir func: %w", err)
-			}
-
-			if d.IsDir() {
-				return nil
-			}
-
-			select {
-			case chPath <- path:
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-
-			return nil
-		})
+		if err := sources.sendPaths(ctx, options, chPath); err != nil {
+			return err
+		}
+		options.Progress.DiscoverDone()
+		return nil
 	})
 
-	// NOTE: 画像のハッシュを計算し続けるgoroutine
-	chCalcImagehash := make(chan *ImageHashInfo, parallels)
-	for i := 0; i < parallels; i++ {
+	// NOTE: ファイルを読み込み続けるgoroutine（I/O待ちが長くてもCPU側が止まらないよう別に数を指定できる）
+	// NOTE: chRawが詰まれば読み込みも止まるので、読み込み済みのデータはcpuWorkers程度に抑えられる
+	chRaw := make(chan *rawImage, cpuWorkers)
+	ioGroup := sync.WaitGroup{}
+	for i := 0; i < ioWorkers; i++ {
+		ioGroup.Add(1)
 		eg.Go(func() error {
+			defer ioGroup.Done()
 			for path := range chPath {
-				// NOTE: 拡張子で処理を分岐
-				switch strings.ToLower(filepath.Ext(path)) {
-				case ".zip": // NOTE: zipファイル
-					err := readImageFromZip(path, chCalcImagehash, samplew, sampleh)
-					if err != nil {
-						// NOTE: 読めなくてもログだけ出して継続
-						fmt.Fprintln(os.Stderr, fmt.Errorf("failed readImageFromZip: %s %w", path, err))
-						continue
-					}
-				default: // NOTE: その他（画像ファイルとして判断）
-					imageData, _, err := readimageutil.ReadImage(path)
-					if err != nil {
-						// NOTE: 読めなくてもログだけ出して継続
-						fmt.Fprintln(os.Stderr, fmt.Errorf("failed readimageutil.ReadImage: %s %w", path, err))
-						continue
-					}
-
-					imageHash, err := calcImageHash(imageData, path, samplew, sampleh)
-					if err != nil {
-						return fmt.Errorf("failed calcImageHash: %s %w", path, err)
-					}
-
+				err := readRawImages(ctx, path.Path, path.Root, options, func(raw *rawImage) error {
 					select {
-					case chCalcImagehash <- imageHash:
+					case chRaw <- raw:
+						return nil
 					case <-ctx.Done():
 						return ctx.Err()
 					}
+				})
+				if err != nil {
+					return err
 				}
+				options.Progress.Process(path.Size)
+			}
+			return nil
+		})
+	}
+	go func() {
+		ioGroup.Wait()
+		close(chRaw)
+	}()
 
+	// NOTE: 画像をデコードしてハッシュを計算し続けるgoroutine
+	// NOTE: デコードした画像は大きいので、デコードとハッシュ計算は同じgoroutineで続けて行いチャネルでは渡さない
+	chCalcImagehash := make(chan *ImageHashInfo, cpuWorkers)
+	for i := 0; i < cpuWorkers; i++ {
+		eg.Go(func() error {
+			for raw := range chRaw {
+				imageHash, err := hashRawImage(ctx, raw, options)
+				if err != nil {
+					return err
+				}
+				if imageHash == nil {
+					continue
+				}
+
+				select {
+				case chCalcImagehash <- imageHash:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
 			}
 			return nil
 		})
@@ -178,99 +431,72 @@ func createParallelCompList(ctx context.Context, container *ParallelCompList, ro
 		close(chCalcImagehash)
 	}()
 
+	var errImageHash error
 	for imageHash := range chCalcImagehash {
-		container.Append(imageHash)
-	}
-
-	return eg.Wait()
-}
-
-func main() {
-	cmd := struct {
-		Root                      string
-		WriteIntermediateFilename string
-		ReadIntermediateFilename  string
-		Output                    string
-		Parallels                 int
-		SampleWidth               int
-		SampleHeight              int
-		Threshold                 int
-	}{}
-	flag.StringVar(&cmd.Root, "root", "", "search dir")
-	flag.StringVar(&cmd.WriteIntermediateFilename, "write-midfile", "midfile.json", "write intermediate filename(json)")
-	flag.StringVar(&cmd.ReadIntermediateFilename, "read-midfile", "", "read intermediate filename(json)")
-	flag.StringVar(&cmd.Output, "o", "similar_groups.json", "output filename(json)")
-
-	flag.IntVar(&cmd.Parallels, "j", runtime.NumCPU(), "parallel num")
-	flag.IntVar(&cmd.SampleWidth, "samplew", 16, "pHash width")
-	flag.IntVar(&cmd.SampleHeight, "sampleh", 16, "pHash height")
-	flag.IntVar(&cmd.Threshold, "threshold", 10, "pHash threshold")
-	flag.Parse()
-
-	isWriteMidFile := len(cmd.WriteIntermediateFilename) != 0
-	isReadMidFile := len(cmd.ReadIntermediateFilename) != 0
-
-	watch := stopwatch.Start()
-
-	// NOTE: 要素をすべてコンテナに集約して比較する
-	container := &ParallelCompList{}
-	if isReadMidFile {
-		// NOTE: 中間ファイルがあるならそれをデシリアライズする
-		err := container.Deserialize(cmd.ReadIntermediateFilename)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		}
-	} else {
-		// NOTE: 並行して見つけた画像のハッシュを計算する
-		rootPath := filepath.Clean(cmd.Root)
-		parallels := cmd.Parallels
-		if parallels < 1 {
-			parallels = 1
-		}
-		err := createParallelCompList(context.Background(), container, rootPath, cmd.SampleWidth, cmd.SampleHeight, parallels)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+		if errImageHash != nil {
+			// NOTE: エラー後は送信側が止まるまで読み捨てる
+			continue
 		}
 
-		if isWriteMidFile && !container.IsEmpty() {
-			// NOTE: 復帰できるようにSerializeしてファイル保存する
-			err := container.Serialize(cmd.WriteIntermediateFilename)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				os.Exit(1)
-			}
+		options.Progress.Hash()
+		if err := onImageHash(imageHash); err != nil {
+			errImageHash = err
+			cancel()
 		}
 	}
 
-	watch.Stop()
-	fmt.Printf("ReadFiles: %v\n", watch.String())
+	if err := eg.Wait(); errImageHash == nil {
+		return err
+	}
+	return errImageHash
+}
 
-	watch = stopwatch.Start()
+// groupingOptions グルーピングの設定
+type groupingOptions struct {
+	Threshold int
+	// NOTE: 比較するgoroutineの数（0以下なら論理スレッド数）
+	Parallels int
+	// NOTE: nilでなければハッシュで似ている組を特徴点の対応でも確かめる
+	Verifier *keypointVerifier
+	Color    colorOptions
+	// NOTE: nilでなければLSHで候補を絞って近似的にグルーピングする
+	Approximate *approximateSearch
+}
+
+// groupingSimilarImages containerが空になるまで似ている画像をグルーピングする
+func groupingSimilarImages(container *ParallelCompList, options *groupingOptions, progress *progressTracker) ([][]string, error) {
+	total := len(*container)
+	progress.SetGroupTotal(total)
+	progress.StartPhase(progressPhaseGroup)
+	defer progress.EndPhase()
+
+	// NOTE: 比較の前に一度だけハッシュを詰めておく
+	matrix, err := newHashMatrix(*container)
+	if err != nil {
+		return nil, fmt.Errorf("failed newHashMatrix: %w", err)
+	}
+	matrix.Verifier = options.Verifier
+	matrix.Color = options.Color
+	if err := matrix.enableApproximate(options.Approximate, options.Threshold); err != nil {
+		return nil, fmt.Errorf("failed hashMatrix.enableApproximate: %w", err)
+	}
 
-	// NOTE: 似ている画像をグルーピングする
 	similarGroupsList := [][]string{}
-	for !container.IsEmpty() {
+	for matrix.Len() > 0 {
 		// NOTE: 似ている画像を獲得する
-		similarGroups, err := container.GroupingSimilarImage(cmd.Threshold)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		}
-
+		similarGroups := matrix.GroupingSimilarImage(options.Threshold, options.Parallels)
 		if len(similarGroups) > 0 {
 			// NOTE: 一つ以上要素が入っていれば何かしら似ていると判定
 			similarGroupsList = append(similarGroupsList, similarGroups)
+			metrics.GroupSizes.Observe("", float64(len(similarGroups)))
 		}
+		progress.SetGrouped(total - matrix.Len())
 	}
+	*container = matrix.Infos
 
-	watch.Stop()
-	fmt.Printf("GroupingFiles: %v\n", watch.String())
+	return similarGroupsList, nil
+}
 
-	// NOTE: json書き出し
-	if err := writeJson(cmd.Output, similarGroupsList); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
+func main() {
+	os.Exit(runCli(os.Args[1:], &cliEnv{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr, LookupEnv: os.LookupEnv}))
 }
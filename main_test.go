@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"math/bits"
+	"math/rand"
 	"os"
 	"reflect"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/akinobufujii/similar_images_grouping/readimageutil"
 	"github.com/corona10/goimagehash"
@@ -195,3 +199,84 @@ func BenchmarkImageHash(b *testing.B) {
 	}
 	b.StopTimer()
 }
+
+// TestWalkImageHashWorkers 読み込みとハッシュ計算のgoroutineの数によらず同じ結果になるかのテスト
+func TestWalkImageHashWorkers(t *testing.T) {
+	root := t.TempDir()
+	images := map[string]int{}
+	for i := 0; i < 16; i++ {
+		images[fmt.Sprintf("%02d.png", i)] = i
+	}
+	writeTestImages(t, root, images)
+
+	var expected []string
+	for _, workers := range [][2]int{{1, 1}, {4, 1}, {1, 4}, {8, 3}} {
+		container := &ParallelCompList{}
+		options := &scanOptions{SampleWidth: 16, SampleHeight: 16, IOWorkers: workers[0], CPUWorkers: workers[1]}
+		if err := createParallelCompList(context.Background(), container, newRootSources(root), options); err != nil {
+			t.Fatal(err)
+		}
+
+		hashes := []string{}
+		for _, info := range *container {
+			hashes = append(hashes, info.Filepath+" "+info.ImageHash.ToString())
+		}
+		sort.Strings(hashes)
+		if expected == nil {
+			expected = hashes
+		}
+		if len(hashes) != len(images) || !reflect.DeepEqual(hashes, expected) {
+			t.Errorf("io=%d cpu=%d: unexpected hashes: %v", workers[0], workers[1], hashes)
+		}
+	}
+}
+
+// BenchmarkWalkImageHash 遅いストレージを模擬して、読み込みとハッシュ計算のgoroutineの数による違いを計測する
+// NOTE: ネットワーク越しで1ファイルの読み込みに10msかかる想定で、io-workersを増やすとI/O待ちの間もハッシュ計算が進む
+func BenchmarkWalkImageHash(b *testing.B) {
+	root := b.TempDir()
+	images := map[string]int{}
+	for i := 0; i < 32; i++ {
+		images[fmt.Sprintf("%02d.png", i)] = i
+	}
+	writeTestImages(b, root, images)
+
+	readRawFile = func(path string) ([]byte, error) {
+		time.Sleep(10 * time.Millisecond)
+		return os.ReadFile(path)
+	}
+	defer func() { readRawFile = os.ReadFile }()
+
+	for _, workers := range [][2]int{{1, 1}, {16, 1}, {16, 4}} {
+		b.Run(fmt.Sprintf("io=%d,cpu=%d", workers[0], workers[1]), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				container := &ParallelCompList{}
+				options := &scanOptions{SampleWidth: 16, SampleHeight: 16, IOWorkers: workers[0], CPUWorkers: workers[1]}
+				if err := createParallelCompList(context.Background(), container, newRootSources(root), options); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkGroupingSimilarImages 比較のgoroutineの数による違いを計測する
+func BenchmarkGroupingSimilarImages(b *testing.B) {
+	random := rand.New(rand.NewSource(1))
+	source := ParallelCompList{}
+	for i := 0; i < 2000; i++ {
+		hash := []uint64{random.Uint64(), random.Uint64(), random.Uint64(), random.Uint64()}
+		source = append(source, &ImageHashInfo{Filepath: fmt.Sprint(i), ImageHash: goimagehash.NewExtImageHash(hash, goimagehash.PHash, 256)})
+	}
+
+	for _, parallels := range []int{1, 4} {
+		b.Run(fmt.Sprintf("j=%d", parallels), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				container := append(ParallelCompList{}, source...)
+				if _, err := groupingSimilarImages(&container, &groupingOptions{Threshold: 10, Parallels: parallels}, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsNamespace メトリクス名の接頭辞
+const metricsNamespace = "similar_images_"
+
+// counterVec ラベルごとの累積値
+// NOTE: labelが空ならラベルなしの1系列として出力する
+type counterVec struct {
+	name   string
+	help   string
+	label  string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{
+		name:   metricsNamespace + name,
+		help:   help,
+		label:  label,
+		values: map[string]float64{},
+	}
+}
+
+// Add 指定ラベルの値を加算する
+func (counter *counterVec) Add(labelValue string, delta float64) {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+
+	counter.values[labelValue] += delta
+}
+
+// Value 指定ラベルの現在の値
+func (counter *counterVec) Value(labelValue string) float64 {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+
+	return counter.values[labelValue]
+}
+
+func (counter *counterVec) writeTo(writer io.Writer) {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+	if len(counter.values) == 0 && len(counter.label) == 0 {
+		fmt.Fprintf(writer, "%s 0\n", counter.name)
+	}
+	for _, labelValue := range sortedKeys(counter.values) {
+		fmt.Fprintf(writer, "%s%s %s\n", counter.name, formatMetricLabels(counter.label, labelValue, "", ""), formatMetricValue(counter.values[labelValue]))
+	}
+}
+
+// histogram 1系列分のヒストグラム
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// histogramVec ラベルごとのヒストグラム
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{
+		name:    metricsNamespace + name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		values:  map[string]*histogram{},
+	}
+}
+
+// Observe 指定ラベルに値を1つ記録する
+func (vec *histogramVec) Observe(labelValue string, value float64) {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+
+	h, ok := vec.values[labelValue]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(vec.buckets))}
+		vec.values[labelValue] = h
+	}
+	for i, bound := range vec.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// ObserveSince 指定時刻からの経過秒数を記録する
+func (vec *histogramVec) ObserveSince(labelValue string, start time.Time) {
+	vec.Observe(labelValue, time.Since(start).Seconds())
+}
+
+// Count 指定ラベルに記録した数
+func (vec *histogramVec) Count(labelValue string) uint64 {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+
+	if h, ok := vec.values[labelValue]; ok {
+		return h.count
+	}
+	return 0
+}
+
+func (vec *histogramVec) writeTo(writer io.Writer) {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s histogram\n", vec.name, vec.help, vec.name)
+	for _, labelValue := range sortedKeys(vec.values) {
+		h := vec.values[labelValue]
+		for i, bound := range vec.buckets {
+			fmt.Fprintf(writer, "%s_bucket%s %d\n", vec.name, formatMetricLabels(vec.label, labelValue, "le", formatMetricValue(bound)), h.counts[i])
+		}
+		fmt.Fprintf(writer, "%s_bucket%s %d\n", vec.name, formatMetricLabels(vec.label, labelValue, "le", "+Inf"), h.count)
+		fmt.Fprintf(writer, "%s_sum%s %s\n", vec.name, formatMetricLabels(vec.label, labelValue, "", ""), formatMetricValue(h.sum))
+		fmt.Fprintf(writer, "%s_count%s %d\n", vec.name, formatMetricLabels(vec.label, labelValue, "", ""), h.count)
+	}
+}
+
+// formatMetricLabels {label="value",le="bound"}形式のラベル
+func formatMetricLabels(label, value, extraLabel, extraValue string) string {
+	labels := []string{}
+	if len(label) != 0 {
+		labels = append(labels, fmt.Sprintf("%s=%s", label, strconv.Quote(value)))
+	}
+	if len(extraLabel) != 0 {
+		labels = append(labels, fmt.Sprintf("%s=%s", extraLabel, strconv.Quote(extraValue)))
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// formatMetricValue Prometheusのテキスト形式の数値
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// imageMetrics 走査・ハッシュ計算・比較の計測値
+// NOTE: 計測は常に行い、-metrics-addrが指定されたときだけ公開する
+type imageMetrics struct {
+	FilesScanned   *counterVec
+	ScanIssues     *counterVec
+	DecodeSeconds  *histogramVec
+	HashSeconds    *histogramVec
+	Comparisons    *counterVec
+	GroupSizes     *histogramVec
+	HashesReused   *counterVec
+	HashesComputed *counterVec
+	startedAt      time.Time
+}
+
+func newImageMetrics() *imageMetrics {
+	latencyBuckets := []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	return &imageMetrics{
+		FilesScanned:   newCounterVec("files_scanned_total", "Files read by scan, serve, worker and watch (a zip counts as one file).", ""),
+		ScanIssues:     newCounterVec("scan_issues_total", "Files skipped or failed by reason.", "reason"),
+		DecodeSeconds:  newHistogramVec("decode_duration_seconds", "Image decode latency by format.", "format", latencyBuckets),
+		HashSeconds:    newHistogramVec("hash_duration_seconds", "Perceptual hash latency by algorithm.", "algorithm", latencyBuckets),
+		Comparisons:    newCounterVec("comparisons_total", "Hash distance comparisons performed.", ""),
+		GroupSizes:     newHistogramVec("group_size", "Number of images in each similar group.", "", []float64{2, 3, 4, 5, 10, 20, 50, 100}),
+		HashesReused:   newCounterVec("hashes_reused_total", "Hashes taken without decoding by source (hard-link: collapsed hard links, posted: precomputed hashes posted to serve).", "source"),
+		HashesComputed: newCounterVec("hashes_computed_total", "Hashes computed by decoding an image.", ""),
+		startedAt:      time.Now(),
+	}
+}
+
+// metrics プロセス全体の計測値
+var metrics = newImageMetrics()
+
+// writeText Prometheusのテキスト形式で書き出す
+func (m *imageMetrics) writeText(writer io.Writer) {
+	m.FilesScanned.writeTo(writer)
+	m.ScanIssues.writeTo(writer)
+	m.DecodeSeconds.writeTo(writer)
+	m.HashSeconds.writeTo(writer)
+	m.Comparisons.writeTo(writer)
+	m.GroupSizes.writeTo(writer)
+	m.HashesReused.writeTo(writer)
+	m.HashesComputed.writeTo(writer)
+
+	gauges := []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"uptime_seconds", "Seconds since the process started.", time.Since(m.startedAt).Seconds()},
+	}
+	for _, gauge := range gauges {
+		name := metricsNamespace + gauge.name
+		fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, gauge.help, name, name, formatMetricValue(gauge.value))
+	}
+}
+
+// metricsHandler /metricsと/debug/pprof/を公開するhttp.Handlerを返す
+func metricsHandler(m *imageMetrics) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.writeText(w)
+	})
+	// NOTE: http.DefaultServeMuxは使わず、同じポートでpprofも公開する
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// metricsServer バックグラウンドで動くメトリクスのHTTPサーバ
+type metricsServer struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// startMetricsServer 指定アドレスでメトリクスの公開を始める
+func startMetricsServer(addr string, m *imageMetrics) (*metricsServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed net.Listen: %s %w", addr, err)
+	}
+
+	server := &metricsServer{
+		server:   &http.Server{Handler: metricsHandler(m), ReadHeaderTimeout: 10 * time.Second},
+		listener: listener,
+	}
+	go func() {
+		if err := server.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed metrics server", "addr", addr, "error", err)
+		}
+	}()
+	return server, nil
+}
+
+// Addr 待ち受けているアドレス（ポート0を指定した場合に実際のポートを知るため）
+func (server *metricsServer) Addr() string {
+	return server.listener.Addr().String()
+}
+
+func (server *metricsServer) Close() error {
+	if server == nil {
+		return nil
+	}
+	return server.server.Close()
+}
+
+// registerMetricsFlag メトリクスの公開先のフラグを登録する
+func registerMetricsFlag(flags *flag.FlagSet, addr *string) {
+	flags.StringVar(addr, "metrics-addr", "", "listen address of Prometheus /metrics and /debug/pprof/ (empty is disabled)")
+}
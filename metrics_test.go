@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetrics /metricsを取得して系列ごとの値にする
+func scrapeMetrics(t *testing.T, addr string) map[string]float64 {
+	t.Helper()
+	response, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %v", response.Status)
+	}
+
+	values := map[string]float64{}
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		index := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[index+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid line: %q %v", line, err)
+		}
+		values[line[:index]] = value
+	}
+	return values
+}
+
+// TestMetricsScrape 走査・グルーピングの計測値をHTTPで取得できるかのテスト
+func TestMetricsScrape(t *testing.T) {
+	root := t.TempDir()
+	writeTestImages(t, root, map[string]int{"a.png": 0, "b.png": 0, "c.png": 1})
+	if err := os.WriteFile(filepath.Join(root, "broken.png"), []byte("broken"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(root, "a.png"), filepath.Join(root, "link.png")); err != nil {
+		t.Skip("hard link is not supported:", err)
+	}
+
+	server, err := startMetricsServer("127.0.0.1:0", metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// NOTE: 計測値はプロセス全体で共有しているので差分で確認する
+	before := scrapeMetrics(t, server.Addr())
+
+	work := t.TempDir()
+	midfile := filepath.Join(work, "midfile.json")
+	if code, _, stderr := runTestCli(t, "scan", "-root", root, "-o", midfile, "-progress", "none"); code != 0 {
+		t.Fatalf("scan failed: %v %s", code, stderr)
+	}
+	if code, _, stderr := runTestCli(t, "group", "-midfile", midfile, "-o", filepath.Join(work, "groups.json"), "-progress", "none"); code != 0 {
+		t.Fatalf("group failed: %v %s", code, stderr)
+	}
+
+	after := scrapeMetrics(t, server.Addr())
+	expected := map[string]float64{
+		"similar_images_files_scanned_total":                                       4,
+		`similar_images_scan_issues_total{reason="unsupported-format"}`:            1,
+		`similar_images_decode_duration_seconds_count{format="png"}`:               3,
+		`similar_images_hash_duration_seconds_count{algorithm="phash"}`:            3,
+		`similar_images_hash_duration_seconds_bucket{algorithm="phash",le="+Inf"}`: 3,
+		`similar_images_hashes_reused_total{source="hard-link"}`:                   1,
+		"similar_images_hashes_computed_total":                                     3,
+		"similar_images_group_size_count":                                          1,
+		`similar_images_group_size_bucket{le="2"}`:                                 1,
+		"similar_images_comparisons_total":                                         2,
+	}
+	for name, delta := range expected {
+		if actual := after[name] - before[name]; actual != delta {
+			t.Errorf("%s: increased %v, expected %v", name, actual, delta)
+		}
+	}
+
+	response, err := http.Get("http://" + server.Addr() + "/debug/pprof/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine") {
+		t.Errorf("unexpected pprof: %v", response.Status)
+	}
+}
+
+// TestMetricsFormat Prometheusのテキスト形式で出力されるかのテスト
+func TestMetricsFormat(t *testing.T) {
+	histogram := newHistogramVec("test_seconds", "Test latency.", "format", []float64{0.5, 1})
+	histogram.Observe("png", 0.25)
+	histogram.Observe("png", 2)
+
+	builder := &strings.Builder{}
+	histogram.writeTo(builder)
+	expected := `# HELP similar_images_test_seconds Test latency.
+# TYPE similar_images_test_seconds histogram
+similar_images_test_seconds_bucket{format="png",le="0.5"} 1
+similar_images_test_seconds_bucket{format="png",le="1"} 1
+similar_images_test_seconds_bucket{format="png",le="+Inf"} 2
+similar_images_test_seconds_sum{format="png"} 2.25
+similar_images_test_seconds_count{format="png"} 2
+`
+	if builder.String() != expected {
+		t.Errorf("unexpected histogram:\n%s", builder.String())
+	}
+
+	counter := newCounterVec("test_total", "Test counter.", "")
+	builder.Reset()
+	counter.writeTo(builder)
+	if !strings.HasSuffix(builder.String(), "similar_images_test_total 0\n") {
+		t.Errorf("unexpected counter:\n%s", builder.String())
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math/bits"
+	"slices"
+	"sort"
+)
+
+// popcountKey ハッシュの立っているビットの数から作る比較する範囲を絞るためのキー
+// NOTE: 2つのハッシュのキーの差の絶対値はハミング距離以下になるので、キーの差がしきい値を超える組は比較しなくてよい
+//
+//	isSignedでなければ立っているビットの数（|popcount(a)-popcount(b)| <= popcount(a^b)）
+//	isSignedなら32bitごとに符号を交互に変えて足したもの（32bitごとの差の絶対値の合計もハミング距離以下になる）
+//	phashは中央値で二値化するので立っているビットの数がほぼ一定になり、符号を変えたキーでないと絞れない
+func popcountKey(hash []uint64, isSigned bool) int32 {
+	key := 0
+	for _, word := range hash {
+		if isSigned {
+			key += bits.OnesCount32(uint32(word)) - bits.OnesCount32(uint32(word>>32))
+		} else {
+			key += bits.OnesCount64(word)
+		}
+	}
+	return int32(key)
+}
+
+// keyVariance キーの分散
+func keyVariance(hashes []uint64, stride, words int, isSigned bool) float64 {
+	count := len(hashes) / stride
+	sum, sumSquare := 0.0, 0.0
+	for i := 0; i < count; i++ {
+		key := float64(popcountKey(hashes[i*stride:i*stride+words], isSigned))
+		sum += key
+		sumSquare += key * key
+	}
+	mean := sum / float64(count)
+	return sumSquare/float64(count) - mean*mean
+}
+
+// buildPopcountFilter 行をキーの順に並べ替え、比較する範囲を絞れるようにする
+// NOTE: 切り抜きのハッシュがある場合は組み合わせの一番近い距離で比較するので並べ替えない
+//
+//	キーはばらつきが大きいほど絞れるので、2種類のキーのうち分散が大きいほうを使う
+//	グループの基準は元の順に選ぶので、元の順の行の位置をsequenceに控える
+//	Appendの後に並べ直す場合は今の行の順ではなくsequenceの元の順を引き継ぐ（作り直した場合と同じ順にする）
+func (matrix *hashMatrix) buildPopcountFilter() {
+	count := len(matrix.Infos)
+	if matrix.variants != 1 || count < 2 {
+		return
+	}
+	stride := matrix.words
+	matrix.isSignedKey = keyVariance(matrix.hashes, stride, matrix.words, true) > keyVariance(matrix.hashes, stride, matrix.words, false)
+
+	keys := make([]int32, count)
+	order := make([]int32, count)
+	for i := range keys {
+		keys[i] = popcountKey(matrix.hashes[i*stride:(i+1)*stride], matrix.isSignedKey)
+		order[i] = int32(i)
+	}
+	slices.SortStableFunc(order, func(lhs, rhs int32) int {
+		return int(keys[lhs] - keys[rhs])
+	})
+
+	infos := make(ParallelCompList, count)
+	hashes := make([]uint64, len(matrix.hashes))
+	rows := make([]int32, count)
+	matrix.keys = make([]int32, count)
+	for row, i := range order {
+		infos[row] = matrix.Infos[i]
+		copy(hashes[row*stride:(row+1)*stride], matrix.hashes[int(i)*stride:(int(i)+1)*stride])
+		matrix.keys[row] = keys[i]
+		rows[i] = int32(row)
+	}
+	// NOTE: sequenceがnilなら今の行の順が元の順（詰めた後に呼ぶのでsequenceは残っている行だけ）
+	sequence := rows
+	if matrix.sequence != nil {
+		sequence = make([]int32, count)
+		for k, i := range matrix.sequence {
+			sequence[k] = rows[i]
+		}
+	}
+	matrix.sequence = sequence
+	matrix.Infos = infos
+	matrix.hashes = hashes
+	matrix.sorted = count
+}
+
+// window srcと比較する必要がある並べ替えた行の範囲[begin, end)
+// NOTE: 並べ替えていなければ全ての行。Appendで末尾に追加したまま並べ替えていない行は含まない（rangesで足す）
+func (matrix *hashMatrix) window(src []uint64, threshold int) (int, int) {
+	if matrix.keys == nil {
+		return 0, len(matrix.Infos)
+	}
+	key := popcountKey(src[:matrix.words], matrix.isSignedKey)
+	begin := sort.Search(matrix.sorted, func(i int) bool {
+		return int(matrix.keys[i]) >= int(key)-threshold
+	})
+	end := sort.Search(matrix.sorted, func(i int) bool {
+		return int(matrix.keys[i]) > int(key)+threshold
+	})
+	return begin, end
+}
+
+// ranges srcと比較する必要がある行の範囲（windowと、並べ替えていない末尾の行）
+func (matrix *hashMatrix) ranges(src []uint64, threshold int) [][2]int {
+	begin, end := matrix.window(src, threshold)
+	ranges := [][2]int{{begin, end}}
+	if matrix.keys != nil && matrix.sorted < len(matrix.Infos) {
+		ranges = append(ranges, [2]int{matrix.sorted, len(matrix.Infos)})
+	}
+	return ranges
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/corona10/goimagehash"
+)
+
+// newDensityHashList 立っているビットの割合を画像ごとに変えたランダムなハッシュのリスト
+// NOTE: isBalancedならphashのように半分のビットが立ったハッシュにする。4枚に1枚は既存のハッシュの数ビットを反転したもの
+func newDensityHashList(count, words int, isBalanced bool) ParallelCompList {
+	random := rand.New(rand.NewSource(2))
+	list := ParallelCompList{}
+	for i := 0; i < count; i++ {
+		hash := make([]uint64, words)
+		switch {
+		case i%4 == 3:
+			copy(hash, list[random.Intn(len(list))].ImageHash.GetHash())
+			for flips := random.Intn(words * 4); flips > 0; flips-- {
+				bit := random.Intn(words * 64)
+				hash[bit/64] ^= 1 << (bit % 64)
+			}
+		case isBalanced:
+			for _, bit := range random.Perm(words * 64)[:words*32] {
+				hash[bit/64] |= 1 << (bit % 64)
+			}
+		default:
+			density := random.Float64()
+			for bit := 0; bit < words*64; bit++ {
+				if random.Float64() < density {
+					hash[bit/64] |= 1 << (bit % 64)
+				}
+			}
+		}
+		list = append(list, &ImageHashInfo{Filepath: fmt.Sprint(i), ImageHash: goimagehash.NewExtImageHash(hash, goimagehash.PHash, words*64)})
+	}
+	return list
+}
+
+// bruteForceGroups ExtImageHash.Distanceで総当たりしたグルーピング（グループ内はパスの順）
+func bruteForceGroups(t testing.TB, list ParallelCompList, threshold int) [][]string {
+	t.Helper()
+	groups := [][]string{}
+	rest := append(ParallelCompList{}, list...)
+	for len(rest) > 0 {
+		src, others := rest[0], rest[1:]
+		group, remains := []string{}, ParallelCompList{}
+		for _, info := range others {
+			distance, err := src.ImageHash.Distance(info.ImageHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if distance <= threshold {
+				group = append(group, info.Filepath)
+			} else {
+				remains = append(remains, info)
+			}
+		}
+		if len(group) > 0 {
+			group = append(group, src.Filepath)
+			sort.Strings(group)
+			groups = append(groups, group)
+		}
+		rest = remains
+	}
+	return groups
+}
+
+// TestPopcountKey キーの差がハミング距離を超えないかのテスト
+func TestPopcountKey(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for n := 0; n < 10000; n++ {
+		lhs, rhs := make([]uint64, 4), make([]uint64, 4)
+		for i := range lhs {
+			lhs[i] = random.Uint64() & random.Uint64()
+			rhs[i] = random.Uint64() | random.Uint64()
+		}
+		distance := 0
+		for i := range lhs {
+			distance += bits.OnesCount64(lhs[i] ^ rhs[i])
+		}
+		for _, isSigned := range []bool{false, true} {
+			if diff := popcountKey(lhs, isSigned) - popcountKey(rhs, isSigned); diff > int32(distance) || -diff > int32(distance) {
+				t.Fatalf("key difference %v exceeds distance %v (signed %v)", diff, distance, isSigned)
+			}
+		}
+	}
+}
+
+// TestPopcountPrefilter キーで比較する範囲を絞っても総当たりと同じグループになり、比較が減るかのテスト
+func TestPopcountPrefilter(t *testing.T) {
+	for _, words := range []int{1, 4} {
+		for _, isBalanced := range []bool{false, true} {
+			list := newDensityHashList(600, words, isBalanced)
+			for _, threshold := range []int{0, words * 3, words * 12} {
+				expected := bruteForceGroups(t, list, threshold)
+
+				matrix, err := newHashMatrix(list)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if matrix.keys == nil || matrix.isSignedKey != isBalanced {
+					t.Fatalf("words=%d balanced=%v: unexpected key: %v %v", words, isBalanced, matrix.keys == nil, matrix.isSignedKey)
+				}
+				compared := 0
+				groups := [][]string{}
+				for matrix.Len() > 0 {
+					begin, end := matrix.window(matrix.hashes[matrix.nextSourceRow()*words:], threshold)
+					compared += end - begin
+					if group := matrix.GroupingSimilarImage(threshold, 3); len(group) > 0 {
+						sort.Strings(group)
+						groups = append(groups, group)
+					}
+				}
+				if !reflect.DeepEqual(groups, expected) {
+					t.Fatalf("words=%d balanced=%v threshold=%d: unexpected groups: %v, expected %v", words, isBalanced, threshold, groups, expected)
+				}
+				if len(expected) == 0 || compared >= len(list)*len(list)/2 {
+					t.Errorf("words=%d balanced=%v threshold=%d: not pruned: %v groups, %v compared", words, isBalanced, threshold, len(expected), compared)
+				}
+			}
+		}
+	}
+
+	// NOTE: 切り抜きのハッシュがあれば並べ替えない
+	list := newDensityHashList(10, 4, false)
+	list[0] = &ImageHashInfo{Filepath: "crop", ImageHash: list[0].ImageHash, Crops: []CropHash{{Name: "center80", ImageHash: list[1].ImageHash}}}
+	matrix, err := newHashMatrix(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matrix.keys != nil || matrix.sequence != nil {
+		t.Error("expected no prefilter with crops")
+	}
+}
+
+// BenchmarkGroupingPrefilter グルーピング全体を総当たりとキーで絞った場合で計測する
+func BenchmarkGroupingPrefilter(b *testing.B) {
+	const threshold = 10
+	datasets := []struct {
+		name string
+		list ParallelCompList
+	}{
+		{"uniform", newRandomHashList(5000, 4)},
+		{"density", newDensityHashList(5000, 4, false)},
+		{"balanced", newDensityHashList(5000, 4, true)},
+	}
+	for _, dataset := range datasets {
+		for _, isPrefilter := range []bool{false, true} {
+			name := dataset.name + "/brute-force"
+			if isPrefilter {
+				name = dataset.name + "/prefilter"
+			}
+			b.Run(name, func(b *testing.B) {
+				for n := 0; n < b.N; n++ {
+					matrix, err := newHashMatrix(dataset.list)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if !isPrefilter {
+						// NOTE: 元の順のままキーだけ外して全ての行と比較させる
+						matrix.keys = nil
+					}
+					for matrix.Len() > 0 {
+						matrix.GroupingSimilarImage(threshold, 1)
+					}
+				}
+			})
+		}
+	}
+}
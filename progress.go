@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 進捗の表示方法
+const (
+	progressModeAuto = "auto"
+	progressModeBar  = "bar"
+	progressModeLog  = "log"
+	progressModeJson = "json"
+	progressModeNone = "none"
+)
+
+// 進捗の段階
+const (
+	progressPhaseScan  = "scan"
+	progressPhaseGroup = "group"
+)
+
+// progressModeFlag 進捗の表示方法を指定するフラグ
+type progressModeFlag string
+
+func (mode *progressModeFlag) String() string {
+	if len(*mode) == 0 {
+		return progressModeAuto
+	}
+	return string(*mode)
+}
+
+func (mode *progressModeFlag) Set(value string) error {
+	switch value {
+	case progressModeAuto, progressModeBar, progressModeLog, progressModeJson, progressModeNone:
+		*mode = progressModeFlag(value)
+		return nil
+	default:
+		return fmt.Errorf("unknown progress mode: %s (auto, bar, log, json or none)", value)
+	}
+}
+
+// ProgressEvent -progress=jsonで出力する進捗
+// NOTE: EtaSecondsは見積もれない間は-1
+type ProgressEvent struct {
+	Time            time.Time
+	Phase           string
+	Discovered      int64
+	IsDiscoveryDone bool
+	Processed       int64
+	Hashed          int64
+	Failed          int64
+	Bytes           int64
+	TotalBytes      int64
+	Grouped         int64
+	GroupTotal      int64
+	BytesPerSecond  float64
+	ElapsedSeconds  float64
+	EtaSeconds      float64
+	Done            bool
+}
+
+// progressTracker 走査・ハッシュ計算・グルーピングの進捗を集計して定期的に表示する
+// NOTE: nilなら何もしない
+type progressTracker struct {
+	discovered      atomic.Int64
+	isDiscoveryDone atomic.Bool
+	processed       atomic.Int64
+	hashed          atomic.Int64
+	failed          atomic.Int64
+	bytes           atomic.Int64
+	totalBytes      atomic.Int64
+	grouped         atomic.Int64
+	groupTotal      atomic.Int64
+
+	mode     string
+	interval time.Duration
+
+	mu         sync.Mutex
+	writer     io.Writer
+	phase      string
+	phaseStart time.Time
+	chStop     chan struct{}
+	chStopped  chan struct{}
+}
+
+// registerProgressFlag 進捗の表示方法のフラグを登録する
+func registerProgressFlag(flags *flag.FlagSet, mode *progressModeFlag) {
+	flags.Var(mode, "progress", "progress to stderr: auto(bar on terminal, otherwise log lines), bar, log, json or none")
+}
+
+// newProgressTracker 表示方法に応じた進捗を作成する（noneならnil）
+// NOTE: autoは端末ならプログレスバー、それ以外は定期的なログ行にする
+func newProgressTracker(writer io.Writer, mode progressModeFlag) *progressTracker {
+	resolvedMode := mode.String()
+	if resolvedMode == progressModeAuto {
+		resolvedMode = progressModeLog
+		if isTerminal(writer) {
+			resolvedMode = progressModeBar
+		}
+	}
+
+	intervals := map[string]time.Duration{
+		progressModeBar:  200 * time.Millisecond,
+		progressModeLog:  10 * time.Second,
+		progressModeJson: time.Second,
+	}
+	interval, ok := intervals[resolvedMode]
+	if !ok {
+		return nil
+	}
+
+	return &progressTracker{
+		mode:     resolvedMode,
+		interval: interval,
+		writer:   writer,
+	}
+}
+
+// isTerminal 出力先が端末か
+func isTerminal(writer io.Writer) bool {
+	file, ok := writer.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// StartPhase 段階を開始して定期的な表示を始める
+func (progress *progressTracker) StartPhase(phase string) {
+	if progress == nil {
+		return
+	}
+
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	progress.phase = phase
+	progress.phaseStart = time.Now()
+	progress.chStop = make(chan struct{})
+	progress.chStopped = make(chan struct{})
+
+	go func(chStop <-chan struct{}, chStopped chan<- struct{}) {
+		defer close(chStopped)
+		ticker := time.NewTicker(progress.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				progress.render(false)
+			case <-chStop:
+				return
+			}
+		}
+	}(progress.chStop, progress.chStopped)
+}
+
+// EndPhase 段階を終了して最終的な進捗を表示する
+func (progress *progressTracker) EndPhase() {
+	if progress == nil {
+		return
+	}
+
+	progress.mu.Lock()
+	chStop, chStopped := progress.chStop, progress.chStopped
+	progress.chStop = nil
+	progress.mu.Unlock()
+	if chStop == nil {
+		return
+	}
+
+	close(chStop)
+	<-chStopped
+	progress.render(true)
+}
+
+// Discover 走査でファイルを見つけた
+func (progress *progressTracker) Discover(size int64) {
+	if progress == nil {
+		return
+	}
+	progress.discovered.Add(1)
+	progress.totalBytes.Add(size)
+}
+
+// DiscoverDone 走査を終えた
+func (progress *progressTracker) DiscoverDone() {
+	if progress == nil {
+		return
+	}
+	progress.isDiscoveryDone.Store(true)
+}
+
+// Process ファイルを1つ処理し終えた
+func (progress *progressTracker) Process(size int64) {
+	if progress == nil {
+		return
+	}
+	progress.processed.Add(1)
+	progress.bytes.Add(size)
+}
+
+// Hash 画像のハッシュを1つ計算した
+func (progress *progressTracker) Hash() {
+	if progress == nil {
+		return
+	}
+	progress.hashed.Add(1)
+}
+
+// Fail 画像を1つ読めなかった
+func (progress *progressTracker) Fail() {
+	if progress == nil {
+		return
+	}
+	progress.failed.Add(1)
+}
+
+// SetGroupTotal グルーピングする画像の数を設定する
+func (progress *progressTracker) SetGroupTotal(total int) {
+	if progress == nil {
+		return
+	}
+	progress.groupTotal.Store(int64(total))
+	progress.grouped.Store(0)
+}
+
+// SetGrouped グルーピングし終えた画像の数を設定する
+func (progress *progressTracker) SetGrouped(grouped int) {
+	if progress == nil {
+		return
+	}
+	progress.grouped.Store(int64(grouped))
+}
+
+// Snapshot 現在の進捗
+func (progress *progressTracker) Snapshot() ProgressEvent {
+	progress.mu.Lock()
+	phase, phaseStart := progress.phase, progress.phaseStart
+	progress.mu.Unlock()
+
+	now := time.Now()
+	event := ProgressEvent{
+		Time:            now,
+		Phase:           phase,
+		Discovered:      progress.discovered.Load(),
+		IsDiscoveryDone: progress.isDiscoveryDone.Load(),
+		Processed:       progress.processed.Load(),
+		Hashed:          progress.hashed.Load(),
+		Failed:          progress.failed.Load(),
+		Bytes:           progress.bytes.Load(),
+		TotalBytes:      progress.totalBytes.Load(),
+		Grouped:         progress.grouped.Load(),
+		GroupTotal:      progress.groupTotal.Load(),
+		ElapsedSeconds:  now.Sub(phaseStart).Seconds(),
+		EtaSeconds:      -1,
+	}
+	if event.ElapsedSeconds <= 0 {
+		return event
+	}
+
+	switch phase {
+	case progressPhaseScan:
+		event.BytesPerSecond = float64(event.Bytes) / event.ElapsedSeconds
+		// NOTE: 走査し終えるまでは全体の量が分からないので見積もらない
+		if event.IsDiscoveryDone && event.BytesPerSecond > 0 {
+			event.EtaSeconds = float64(event.TotalBytes-event.Bytes) / event.BytesPerSecond
+		}
+	case progressPhaseGroup:
+		if event.Grouped > 0 {
+			event.EtaSeconds = float64(event.GroupTotal-event.Grouped) * event.ElapsedSeconds / float64(event.Grouped)
+		}
+	}
+	return event
+}
+
+// render 進捗を表示する
+func (progress *progressTracker) render(isDone bool) {
+	event := progress.Snapshot()
+	event.Done = isDone
+	if isDone {
+		event.EtaSeconds = 0
+	}
+
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	switch progress.mode {
+	case progressModeJson:
+		if data, err := json.Marshal(event); err == nil {
+			fmt.Fprintf(progress.writer, "%s\n", data)
+		}
+	case progressModeBar:
+		// NOTE: 同じ行を上書きし、段階の終わりで改行する
+		fmt.Fprintf(progress.writer, "\r\033[K%s", formatProgressBar(event))
+		if isDone {
+			fmt.Fprintln(progress.writer)
+		}
+	default:
+		fmt.Fprintf(progress.writer, "Progress: %s\n", formatProgressLine(event))
+	}
+}
+
+// formatProgressLine 進捗を1行の文字列にする
+func formatProgressLine(event ProgressEvent) string {
+	switch event.Phase {
+	case progressPhaseGroup:
+		return fmt.Sprintf("group %d/%d images, ETA %s", event.Grouped, event.GroupTotal, formatEta(event.EtaSeconds))
+	default:
+		discovered := fmt.Sprint(event.Discovered)
+		if !event.IsDiscoveryDone {
+			discovered += "+"
+		}
+		return fmt.Sprintf("scan %d/%s files, hashed %d, failed %d, %s/s, ETA %s",
+			event.Processed, discovered, event.Hashed, event.Failed, formatByteSize(int64(event.BytesPerSecond)), formatEta(event.EtaSeconds))
+	}
+}
+
+// formatProgressBar 進捗をプログレスバー付きの文字列にする
+func formatProgressBar(event ProgressEvent) string {
+	const barWidth = 24
+
+	done, total := event.Processed, event.Discovered
+	if event.Phase == progressPhaseGroup {
+		done, total = event.Grouped, event.GroupTotal
+	}
+
+	bar := strings.Repeat(".", barWidth)
+	percent := "  ?%"
+	if total > 0 && (event.Phase == progressPhaseGroup || event.IsDiscoveryDone) {
+		filled := int(done * barWidth / total)
+		bar = strings.Repeat("#", filled) + strings.Repeat(".", barWidth-filled)
+		percent = fmt.Sprintf("%3d%%", done*100/total)
+	}
+	return fmt.Sprintf("[%s] %s %s", bar, percent, formatProgressLine(event))
+}
+
+// formatEta 残り時間の文字列
+func formatEta(seconds float64) string {
+	if seconds < 0 {
+		return "?"
+	}
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readProgressEvents 出力からjsonの進捗を取り出す
+func readProgressEvents(t *testing.T, output string) []ProgressEvent {
+	t.Helper()
+	events := []ProgressEvent{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		event := ProgressEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err == nil {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// TestProgressJson -progress=jsonで段階ごとの最終的な進捗が出力されるかのテスト
+func TestProgressJson(t *testing.T) {
+	root := t.TempDir()
+	writeTestImages(t, root, map[string]int{"a.png": 0, "b.png": 0, "c.png": 1})
+	if err := os.WriteFile(filepath.Join(root, "broken.png"), []byte("broken"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	midfile := filepath.Join(t.TempDir(), "midfile.json")
+
+	code, _, stderr := runTestCli(t, "scan", "-root", root, "-o", midfile, "-progress", "json")
+	if code != 0 {
+		t.Fatalf("scan failed: %v %s", code, stderr)
+	}
+	events := readProgressEvents(t, stderr)
+	if len(events) == 0 {
+		t.Fatalf("no progress events: %s", stderr)
+	}
+	last := events[len(events)-1]
+	if last.Phase != progressPhaseScan || !last.Done || !last.IsDiscoveryDone ||
+		last.Discovered != 4 || last.Processed != 4 || last.Hashed != 3 || last.Failed != 1 || last.Bytes != last.TotalBytes {
+		t.Fatalf("unexpected scan progress: %+v", last)
+	}
+
+	code, _, stderr = runTestCli(t, "group", "-midfile", midfile, "-o", filepath.Join(t.TempDir(), "groups.json"), "-progress", "json")
+	if code != 0 {
+		t.Fatalf("group failed: %v %s", code, stderr)
+	}
+	events = readProgressEvents(t, stderr)
+	if len(events) == 0 {
+		t.Fatalf("no progress events: %s", stderr)
+	}
+	last = events[len(events)-1]
+	if last.Phase != progressPhaseGroup || !last.Done || last.GroupTotal != 3 || last.Grouped != 3 {
+		t.Fatalf("unexpected group progress: %+v", last)
+	}
+
+	// NOTE: 端末でなければログ行になり、noneなら何も出ない
+	code, _, stderr = runTestCli(t, "scan", "-root", root, "-o", midfile)
+	if code != 0 || !strings.Contains(stderr, "Progress: scan 4/4 files, hashed 3, failed 1") {
+		t.Fatalf("unexpected log progress: %v %s", code, stderr)
+	}
+	code, _, stderr = runTestCli(t, "scan", "-root", root, "-o", midfile, "-progress", "none")
+	if code != 0 || strings.Contains(stderr, "Progress:") {
+		t.Fatalf("unexpected none progress: %v %s", code, stderr)
+	}
+}
+
+func TestProgressFormat(t *testing.T) {
+	// NOTE: 走査中は全体が分からないので割合とETAは表示しない
+	event := ProgressEvent{Phase: progressPhaseScan, Discovered: 10, Processed: 5, Hashed: 4, Failed: 1, BytesPerSecond: 2 << 20, EtaSeconds: -1}
+	if line := formatProgressBar(event); !strings.Contains(line, "  ?%") || !strings.Contains(line, "5/10+ files") || !strings.Contains(line, "2.0MB/s, ETA ?") {
+		t.Errorf("unexpected bar: %s", line)
+	}
+
+	event.IsDiscoveryDone = true
+	event.EtaSeconds = 65
+	if line := formatProgressBar(event); !strings.Contains(line, "[############............]  50%") || !strings.Contains(line, "ETA 1m5s") {
+		t.Errorf("unexpected bar: %s", line)
+	}
+
+	event = ProgressEvent{Phase: progressPhaseGroup, Grouped: 1, GroupTotal: 4, EtaSeconds: 3}
+	if line := formatProgressBar(event); !strings.Contains(line, " 25% group 1/4 images, ETA 3s") {
+		t.Errorf("unexpected bar: %s", line)
+	}
+
+	if progress := newProgressTracker(&bytes.Buffer{}, ""); progress == nil || progress.mode != progressModeLog {
+		t.Errorf("unexpected auto mode: %+v", progress)
+	}
+	if progress := newProgressTracker(&bytes.Buffer{}, progressModeNone); progress != nil {
+		t.Errorf("unexpected none mode: %+v", progress)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+	"os"
+
+	"github.com/akinobufujii/similar_images_grouping/readimageutil"
+	"golang.org/x/sync/errgroup"
+)
+
+// 画質の計算の設定
+const (
+	// NOTE: 鮮明さは長辺をこの大きさに縮小してから比べる（解像度の違いは別に評価する）
+	qualitySharpnessSide = 512
+	// NOTE: 拡大・ブロックノイズの判定は等倍のまま中央のこの大きさだけで計算する
+	qualityNativeSide = 1024
+	// NOTE: 等倍と1/2の鮮明さの比がこれ未満なら拡大した画像とみなす
+	qualityUpscaledRatio = 0.3
+	// NOTE: 8x8ブロックの境目の段差がこの倍率を超えた分をブロックノイズとみなす（超えた分がこの幅で0点になる）
+	qualityBlockinessRange = 0.5
+)
+
+// 画質の点数の重み
+const (
+	qualityWeightResolution  = 0.45
+	qualityWeightCompression = 0.25
+	qualityWeightSharpness   = 0.15
+	qualityWeightArtifacts   = 0.15
+)
+
+// imageQuality 残す画像を選ぶための画質
+// NOTE: Scoreはグループ内での比較（0-100、解像度と鮮明さはグループ内で一番良い画像との比）
+type imageQuality struct {
+	Score  float64
+	Width  int
+	Height int
+	// NOTE: JPEGの量子化テーブルから推定した品質（JPEG以外は0）
+	JpegQuality int `json:",omitempty"`
+	// NOTE: 長辺qualitySharpnessSideでのラプラシアンの分散
+	Sharpness float64
+	// NOTE: 8x8ブロックの境目の段差とそれ以外の段差の比（再圧縮で大きくなる、1前後なら目立たない）
+	Blockiness float64
+	// NOTE: 小さい画像を拡大した画像か
+	IsUpscaled bool `json:",omitempty"`
+}
+
+// grayPlane 画質の計算に使うグレースケールの画素
+type grayPlane struct {
+	width, height int
+	pix           []float64
+}
+
+// newGrayPlane 画像の指定範囲を1/scale倍に平均して縮小したグレースケールにする
+func newGrayPlane(imageData image.Image, region image.Rectangle, scale int) *grayPlane {
+	plane := &grayPlane{width: region.Dx() / scale, height: region.Dy() / scale}
+	plane.pix = make([]float64, plane.width*plane.height)
+	for y := 0; y < plane.height; y++ {
+		for x := 0; x < plane.width; x++ {
+			sum := 0.0
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					r, g, b, _ := imageData.At(region.Min.X+x*scale+dx, region.Min.Y+y*scale+dy).RGBA()
+					sum += (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+				}
+			}
+			plane.pix[y*plane.width+x] = sum / float64(scale*scale)
+		}
+	}
+	return plane
+}
+
+// halve 縦横1/2に平均して縮小する
+func (plane *grayPlane) halve() *grayPlane {
+	half := &grayPlane{width: plane.width / 2, height: plane.height / 2}
+	half.pix = make([]float64, half.width*half.height)
+	for y := 0; y < half.height; y++ {
+		for x := 0; x < half.width; x++ {
+			i := 2*y*plane.width + 2*x
+			half.pix[y*half.width+x] = (plane.pix[i] + plane.pix[i+1] + plane.pix[i+plane.width] + plane.pix[i+plane.width+1]) / 4
+		}
+	}
+	return half
+}
+
+// laplacianVariance ラプラシアンの分散（大きいほど鮮明）
+func (plane *grayPlane) laplacianVariance() float64 {
+	sum, sumSquare, count := 0.0, 0.0, 0
+	for y := 1; y < plane.height-1; y++ {
+		for x := 1; x < plane.width-1; x++ {
+			i := y*plane.width + x
+			value := plane.pix[i-1] + plane.pix[i+1] + plane.pix[i-plane.width] + plane.pix[i+plane.width] - 4*plane.pix[i]
+			sum += value
+			sumSquare += value * value
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	mean := sum / float64(count)
+	return sumSquare/float64(count) - mean*mean
+}
+
+// blockiness 8x8ブロックの境目の段差とそれ以外の段差の比
+// NOTE: 画素の位置が8の倍数から始まっていること
+func (plane *grayPlane) blockiness() float64 {
+	boundary, inner := 0.0, 0.0
+	boundaryCount, innerCount := 0, 0
+	add := func(position int, step float64) {
+		if position%8 == 7 {
+			boundary += step
+			boundaryCount++
+		} else {
+			inner += step
+			innerCount++
+		}
+	}
+	for y := 0; y < plane.height; y++ {
+		for x := 0; x < plane.width; x++ {
+			i := y*plane.width + x
+			if x+1 < plane.width {
+				add(x, math.Abs(plane.pix[i+1]-plane.pix[i]))
+			}
+			if y+1 < plane.height {
+				add(y, math.Abs(plane.pix[i+plane.width]-plane.pix[i]))
+			}
+		}
+	}
+	if boundaryCount == 0 || inner == 0 {
+		return 1
+	}
+	return (boundary / float64(boundaryCount)) / (inner / float64(innerCount))
+}
+
+// measureImageQuality 画像ファイルの画質を計算する（Scoreはまだ計算しない）
+// NOTE: 鮮明さなどは等倍の画素が必要なので縮小デコードはしない
+func measureImageQuality(path string) (*imageQuality, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed os.ReadFile: %s %w", path, err)
+	}
+	imageData, format, err := readimageutil.DecodeImage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed readimageutil.DecodeImage: %s %w", path, err)
+	}
+
+	bounds := imageData.Bounds()
+	quality := &imageQuality{Width: bounds.Dx(), Height: bounds.Dy()}
+	if format == "jpeg" {
+		if jpegQuality, err := readimageutil.EstimateJpegQuality(bytes.NewReader(data)); err == nil {
+			quality.JpegQuality = jpegQuality
+		}
+	}
+
+	scale := max(1, (max(bounds.Dx(), bounds.Dy())+qualitySharpnessSide-1)/qualitySharpnessSide)
+	quality.Sharpness = math.Round(newGrayPlane(imageData, bounds, scale).laplacianVariance()*100) / 100
+
+	// NOTE: JPEGのブロックに合わせて8の倍数の位置から切り出す
+	side := min(qualityNativeSide, bounds.Dx(), bounds.Dy()) &^ 7
+	origin := image.Pt((bounds.Dx()-side)/2&^7, (bounds.Dy()-side)/2&^7).Add(bounds.Min)
+	native := newGrayPlane(imageData, image.Rectangle{Min: origin, Max: origin.Add(image.Pt(side, side))}, 1)
+	quality.Blockiness = math.Round(native.blockiness()*1000) / 1000
+	if halfSharpness := native.halve().laplacianVariance(); halfSharpness > 0 {
+		quality.IsUpscaled = native.laplacianVariance()/halfSharpness < qualityUpscaledRatio
+	}
+	return quality, nil
+}
+
+// effectivePixels 拡大した分を除いた画素数
+func (quality *imageQuality) effectivePixels() float64 {
+	pixels := float64(quality.Width) * float64(quality.Height)
+	if quality.IsUpscaled {
+		// NOTE: 少なくとも縦横2倍に拡大したとみなす
+		pixels /= 4
+	}
+	return pixels
+}
+
+// scoreImageQualities グループ内の画質を比べて点数を付ける（nilは計算できなかった画像）
+func scoreImageQualities(qualities []*imageQuality) {
+	maxPixels, maxSharpness := 0.0, 0.0
+	for _, quality := range qualities {
+		if quality != nil {
+			maxPixels = max(maxPixels, quality.effectivePixels())
+			maxSharpness = max(maxSharpness, quality.Sharpness)
+		}
+	}
+
+	for _, quality := range qualities {
+		if quality == nil {
+			continue
+		}
+		resolution, sharpness := 0.0, 1.0
+		if maxPixels > 0 {
+			// NOTE: 画素数ではなく辺の長さの比にする
+			resolution = math.Sqrt(quality.effectivePixels() / maxPixels)
+		}
+		if maxSharpness > 0 {
+			sharpness = quality.Sharpness / maxSharpness
+		}
+		compression := 1.0
+		if quality.JpegQuality > 0 {
+			compression = float64(quality.JpegQuality) / 100
+		}
+		artifacts := min(1, max(0, 1-(quality.Blockiness-1)/qualityBlockinessRange))
+
+		score := qualityWeightResolution*resolution + qualityWeightCompression*compression + qualityWeightSharpness*sharpness + qualityWeightArtifacts*artifacts
+		quality.Score = math.Round(score*1000) / 10
+	}
+}
+
+// scoreSimilarGroups グループの要素の画質を計算してinfosのQualityに設定する
+// NOTE: parallelsは同時に計算する数。zipの中身や消えたファイルなど読み込めない画像はnilのままにする
+func scoreSimilarGroups(similarGroupsList [][]string, infos map[string]*ImageHashInfo, parallels int) {
+	qualitiesList := make([][]*imageQuality, len(similarGroupsList))
+	eg := errgroup.Group{}
+	eg.SetLimit(max(1, parallels))
+	for i, similarGroups := range similarGroupsList {
+		qualitiesList[i] = make([]*imageQuality, len(similarGroups))
+		for j, path := range similarGroups {
+			eg.Go(func() error {
+				quality, err := measureImageQuality(path)
+				if err != nil {
+					slog.Debug("skipped quality", "path", path, "error", err)
+					return nil
+				}
+				qualitiesList[i][j] = quality
+				return nil
+			})
+		}
+	}
+	eg.Wait()
+
+	for i, similarGroups := range similarGroupsList {
+		scoreImageQualities(qualitiesList[i])
+		for j, path := range similarGroups {
+			if info, ok := infos[path]; ok {
+				info.Quality = qualitiesList[i][j]
+			}
+		}
+	}
+}
+
+// registerQualityFlag グループの要素の画質を計算するかのフラグを登録する
+func registerQualityFlag(flags *flag.FlagSet, isQuality *bool) {
+	flags.BoolVar(isQuality, "quality", false, "score the quality of each member (resolution, jpeg quality, sharpness, block artifacts, upscaling) for apply -keep=quality")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// blurBox 縦横size画素の平均でぼかした画像
+func blurBox(src *image.RGBA, size int) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			sum, count := [3]int{}, 0
+			for dy := -size / 2; dy <= size/2; dy++ {
+				for dx := -size / 2; dx <= size/2; dx++ {
+					if !image.Pt(x+dx, y+dy).In(bounds) {
+						continue
+					}
+					c := src.RGBAAt(x+dx, y+dy)
+					sum[0], sum[1], sum[2] = sum[0]+int(c.R), sum[1]+int(c.G), sum[2]+int(c.B)
+					count++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(sum[0] / count), uint8(sum[1] / count), uint8(sum[2] / count), 255})
+		}
+	}
+	return dst
+}
+
+// TestImageQuality 拡大・ぼかし・強い圧縮を見分けて、元の画像の点数が一番高くなるかのテスト
+func TestImageQuality(t *testing.T) {
+	root := t.TempDir()
+	original := newSyntheticScene(1, 480, 360)
+	jpegData := &bytes.Buffer{}
+	if err := jpeg.Encode(jpegData, original, &jpeg.Options{Quality: 30}); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"original.png": encodeTestPng(t, original),
+		"upscaled.png": encodeTestPng(t, resizeImage(resizeImage(original, 240, 180), 480, 360)),
+		"blurred.png":  encodeTestPng(t, blurBox(original, 5)),
+		"low.jpg":      jpegData.Bytes(),
+	}
+	paths := []string{}
+	for name, data := range files {
+		path := filepath.Join(root, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	infos := map[string]*ImageHashInfo{}
+	for _, path := range paths {
+		infos[path] = &ImageHashInfo{Filepath: path}
+	}
+	scoreSimilarGroups([][]string{paths}, infos, 2)
+
+	qualities := map[string]*imageQuality{}
+	for path, info := range infos {
+		if info.Quality == nil {
+			t.Fatalf("quality is not measured: %v", path)
+		}
+		qualities[filepath.Base(path)] = info.Quality
+		t.Logf("%s: %+v", filepath.Base(path), *info.Quality)
+	}
+	if qualities["original.png"].IsUpscaled || !qualities["upscaled.png"].IsUpscaled {
+		t.Errorf("unexpected upscaled: %+v %+v", qualities["original.png"], qualities["upscaled.png"])
+	}
+	if qualities["blurred.png"].Sharpness >= qualities["original.png"].Sharpness/2 {
+		t.Errorf("unexpected sharpness: %+v %+v", qualities["blurred.png"], qualities["original.png"])
+	}
+	if low := qualities["low.jpg"]; low.JpegQuality != 30 || low.Blockiness <= qualities["original.png"].Blockiness {
+		t.Errorf("unexpected jpeg quality: %+v", low)
+	}
+	for name, quality := range qualities {
+		if name != "original.png" && quality.Score >= qualities["original.png"].Score {
+			t.Errorf("%s: score is not lower than original: %v %v", name, quality.Score, qualities["original.png"].Score)
+		}
+	}
+
+	// NOTE: 画質の点数がないpaths形式のグループでも-keep=qualityで元の画像を残す
+	groups := filepath.Join(t.TempDir(), "groups.json")
+	if err := writeJson(groups, [][]string{paths}); err != nil {
+		t.Fatal(err)
+	}
+	code, stdout, stderr := runTestCli(t, "apply", "-groups", groups, "-keep", "quality")
+	if code != 0 || !strings.Contains(stdout, "keep: "+filepath.Join(root, "original.png")) {
+		t.Errorf("unexpected apply: %v %s %s", code, stdout, stderr)
+	}
+}
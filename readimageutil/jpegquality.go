@@ -0,0 +1,104 @@
+package readimageutil
+
+import (
+	"errors"
+	"io"
+)
+
+// jpegStandardLuminance JPEGの規格書（Annex K）の輝度の量子化テーブル
+// NOTE: 合計だけを比べるので並び順は関係ない
+var jpegStandardLuminance = [64]int{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}
+
+// jpegQualityTableSum 指定の品質でlibjpegと同じように倍率をかけた輝度の量子化テーブルの合計
+func jpegQualityTableSum(quality int) int {
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+
+	sum := 0
+	for _, value := range jpegStandardLuminance {
+		sum += min(max((value*scale+50)/100, 1), 255)
+	}
+	return sum
+}
+
+// EstimateJpegQuality JPEGの輝度の量子化テーブル（DQT）から保存したときの品質（1-100）を推定する
+// NOTE: libjpeg互換の倍率で作ったテーブルを前提にした推定なので、独自のテーブルでは目安になる
+func EstimateJpegQuality(reader io.Reader) (int, error) {
+	decoder := newJpegReducer(reader)
+	if marker, err := decoder.nextMarker(); err != nil || marker != 0xD8 {
+		return 0, errors.New("missing SOI marker")
+	}
+
+	// NOTE: DQTはSOSより前にあるので、SOSかEOIまで読む
+	for {
+		marker, err := decoder.nextMarker()
+		if err != nil {
+			return 0, err
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			return 0, errors.New("missing DQT marker")
+		}
+		if marker >= 0xD0 && marker <= 0xD7 {
+			continue
+		}
+
+		segment, err := decoder.readSegment()
+		if err != nil {
+			return 0, err
+		}
+		if marker != 0xDB {
+			continue
+		}
+
+		for len(segment) > 0 {
+			precision, index := segment[0]>>4, segment[0]&0x03
+			size := 64
+			if precision != 0 {
+				size = 128
+			}
+			if len(segment) < 1+size {
+				return 0, errors.New("invalid DQT segment")
+			}
+
+			// NOTE: 輝度は0番のテーブル
+			if index == 0 {
+				sum := 0
+				for i := 0; i < 64; i++ {
+					if precision != 0 {
+						sum += int(segment[1+i*2])<<8 | int(segment[2+i*2])
+					} else {
+						sum += int(segment[1+i])
+					}
+				}
+				return estimateQualityFromSum(sum), nil
+			}
+			segment = segment[1+size:]
+		}
+	}
+}
+
+// estimateQualityFromSum 量子化テーブルの合計が一番近い品質
+func estimateQualityFromSum(sum int) int {
+	best, bestDiff := 1, -1
+	for quality := 1; quality <= 100; quality++ {
+		diff := jpegQualityTableSum(quality) - sum
+		if diff < 0 {
+			diff = -diff
+		}
+		if bestDiff < 0 || diff < bestDiff {
+			best, bestDiff = quality, diff
+		}
+	}
+	return best
+}
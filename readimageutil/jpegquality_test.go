@@ -0,0 +1,25 @@
+package readimageutil
+
+import (
+	"bytes"
+	"image/jpeg"
+	"testing"
+)
+
+// TestEstimateJpegQuality 保存したときの品質を推定できるかのテスト
+func TestEstimateJpegQuality(t *testing.T) {
+	for _, quality := range []int{30, 50, 75, 90, 100} {
+		encoded := &bytes.Buffer{}
+		if err := jpeg.Encode(encoded, newSmoothImage(64, 48), &jpeg.Options{Quality: quality}); err != nil {
+			t.Fatal(err)
+		}
+		estimated, err := EstimateJpegQuality(encoded)
+		if err != nil || estimated < quality-1 || estimated > quality+1 {
+			t.Errorf("unexpected quality: %v %v, expected %v", estimated, err, quality)
+		}
+	}
+
+	if _, err := EstimateJpegQuality(bytes.NewReader([]byte("not a jpeg"))); err == nil {
+		t.Error("expected error")
+	}
+}
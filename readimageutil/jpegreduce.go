@@ -0,0 +1,604 @@
+package readimageutil
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// JpegReduceScale DecodeJpegReducedで縮小する倍率
+// NOTE: 8x8ブロックごとのDCT係数の直流成分（ブロックの平均）だけを使うので1/8になる
+const JpegReduceScale = 8
+
+// ErrJpegNotReducible 縮小デコードに対応していないJPEG（プログレッシブ・算術符号・CMYKなど）
+var ErrJpegNotReducible = errors.New("jpeg is not reducible")
+
+// ImageHeader 画像をデコードせずに読み込んだ情報
+type ImageHeader struct {
+	image.Config
+	Format string
+	// NOTE: DecodeJpegReducedで縮小デコードできるJPEGならtrue
+	IsReducible bool
+}
+
+// DecodeImageHeader 画像のサイズと形式、縮小デコードできるかだけデコード
+func DecodeImageHeader(reader io.Reader) (ImageHeader, error) {
+	// NOTE: image.DecodeConfigが読んだ分を残しておき、JPEGならSOFマーカーを調べる
+	recorded := &bytes.Buffer{}
+	imageConfig, imageType, err := DecodeImageConfig(io.TeeReader(reader, recorded))
+	if err != nil {
+		return ImageHeader{}, err
+	}
+
+	header := ImageHeader{Config: imageConfig, Format: imageType}
+	if imageType == "jpeg" {
+		decoder := newJpegReducer(recorded)
+		header.IsReducible = decoder.decode(true) == nil
+	}
+	return header, nil
+}
+
+// DecodeJpegReduced ベースラインのJPEGを1/JpegReduceScaleの大きさでデコードする
+// NOTE: 縮小デコードできないJPEGはErrJpegNotReducibleを返す（DecodeImageHeaderで事前に判定できる）
+func DecodeJpegReduced(reader io.Reader) (image.Image, error) {
+	decoder := newJpegReducer(reader)
+	if err := decoder.decode(false); err != nil {
+		return nil, fmt.Errorf("failed DecodeJpegReduced: %w", err)
+	}
+	return decoder.image(), nil
+}
+
+// jpegHuffman ハフマン符号表
+type jpegHuffman struct {
+	// NOTE: 8bit以下の符号は先読みした8bitから引く（(符号長<<8)|値、見つからなければ0）
+	lookup  [256]uint16
+	maxCode [17]int32
+	minCode [17]int32
+	valPtr  [17]int32
+	symbols []byte
+}
+
+func newJpegHuffman(counts [16]byte, symbols []byte) (*jpegHuffman, error) {
+	huffman := &jpegHuffman{symbols: symbols}
+	code, k := int32(0), int32(0)
+	for length := 1; length <= 16; length++ {
+		huffman.valPtr[length] = k
+		huffman.minCode[length] = code
+		for i := 0; i < int(counts[length-1]); i++ {
+			// NOTE: 符号が符号長のビット数に収まらない表は壊れている（先に確かめないとlookupの範囲外に書き込む）
+			if code >= 1<<length {
+				return nil, errors.New("invalid huffman table")
+			}
+			if length <= 8 {
+				base := code << (8 - length)
+				for j := int32(0); j < 1<<(8-length); j++ {
+					huffman.lookup[base+j] = uint16(length)<<8 | uint16(symbols[k])
+				}
+			}
+			code++
+			k++
+		}
+		huffman.maxCode[length] = code - 1
+		if counts[length-1] == 0 {
+			huffman.maxCode[length] = -1
+		}
+		code <<= 1
+	}
+	return huffman, nil
+}
+
+// jpegBitReader エントロピー符号化データを1bitずつ読む
+// NOTE: マーカーに到達したら以降は0を返し、マーカーはmarkerに残す
+type jpegBitReader struct {
+	reader *bufio.Reader
+	acc    uint32
+	n      uint
+	marker byte
+}
+
+func (bits *jpegBitReader) fill() error {
+	for bits.n <= 24 {
+		c := byte(0)
+		if bits.marker == 0 {
+			var err error
+			if c, err = bits.reader.ReadByte(); err != nil {
+				return io.ErrUnexpectedEOF
+			}
+			if c == 0xFF {
+				next, err := bits.reader.ReadByte()
+				for err == nil && next == 0xFF {
+					next, err = bits.reader.ReadByte()
+				}
+				if err != nil {
+					return io.ErrUnexpectedEOF
+				}
+				// NOTE: 0xFF 0x00はデータとしての0xFF
+				if next != 0 {
+					bits.marker = next
+					c = 0
+				}
+			}
+		}
+		bits.acc |= uint32(c) << (24 - bits.n)
+		bits.n += 8
+	}
+	return nil
+}
+
+func (bits *jpegBitReader) consume(n uint) {
+	bits.acc <<= n
+	bits.n -= n
+}
+
+// receive nビット読んで符号付きの値に戻す
+// NOTE: 値の大きさの分類は16までなので、それより大きいnは壊れたハフマン符号表
+func (bits *jpegBitReader) receive(n byte) (int32, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	if n > 16 {
+		return 0, fmt.Errorf("invalid magnitude category: %d", n)
+	}
+	if err := bits.fill(); err != nil {
+		return 0, err
+	}
+	value := int32(bits.acc >> (32 - uint(n)))
+	bits.consume(uint(n))
+	if value < 1<<(n-1) {
+		value += -1<<n + 1
+	}
+	return value, nil
+}
+
+func (bits *jpegBitReader) decodeHuffman(huffman *jpegHuffman) (byte, error) {
+	if err := bits.fill(); err != nil {
+		return 0, err
+	}
+	if entry := huffman.lookup[bits.acc>>24]; entry != 0 {
+		bits.consume(uint(entry >> 8))
+		return byte(entry), nil
+	}
+
+	code := int32(0)
+	for length := 1; length <= 16; length++ {
+		code = code<<1 | int32(bits.acc>>(32-uint(length))&1)
+		if code <= huffman.maxCode[length] {
+			bits.consume(uint(length))
+			return huffman.symbols[huffman.valPtr[length]+code-huffman.minCode[length]], nil
+		}
+	}
+	return 0, errors.New("invalid huffman code")
+}
+
+// jpegComponent 色成分ごとのブロックの平均値
+type jpegComponent struct {
+	id        byte
+	h, v      int
+	quant     byte
+	dcTable   byte
+	acTable   byte
+	blocksW   int
+	blocksH   int
+	plane     []uint8
+	pred      int32
+	isDecoded bool
+}
+
+// jpegReducer ベースラインJPEGの直流成分だけを取り出すデコーダ
+type jpegReducer struct {
+	reader          *bufio.Reader
+	bits            jpegBitReader
+	pendingMarker   byte
+	width, height   int
+	hmax, vmax      int
+	mcusX, mcusY    int
+	components      []*jpegComponent
+	quant           [4]int32
+	dc, ac          [4]*jpegHuffman
+	restartInterval int
+	adobeTransform  int
+}
+
+func newJpegReducer(reader io.Reader) *jpegReducer {
+	bufReader := bufio.NewReader(reader)
+	return &jpegReducer{
+		reader:         bufReader,
+		bits:           jpegBitReader{reader: bufReader},
+		adobeTransform: -1,
+	}
+}
+
+// nextMarker 次のマーカーを読む
+func (decoder *jpegReducer) nextMarker() (byte, error) {
+	if decoder.pendingMarker != 0 {
+		marker := decoder.pendingMarker
+		decoder.pendingMarker = 0
+		return marker, nil
+	}
+
+	// NOTE: マーカーの前の余計なバイトと0xFFの詰め物は読み飛ばす
+	for {
+		c, err := decoder.reader.ReadByte()
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if c != 0xFF {
+			continue
+		}
+		for c == 0xFF {
+			if c, err = decoder.reader.ReadByte(); err != nil {
+				return 0, io.ErrUnexpectedEOF
+			}
+		}
+		if c != 0 {
+			return c, nil
+		}
+	}
+}
+
+// readSegment マーカーに続くセグメントを読む
+func (decoder *jpegReducer) readSegment() ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(decoder.reader, length[:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	size := int(length[0])<<8 | int(length[1]) - 2
+	if size < 0 {
+		return nil, errors.New("invalid segment length")
+	}
+	segment := make([]byte, size)
+	if _, err := io.ReadFull(decoder.reader, segment); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return segment, nil
+}
+
+// decode マーカーを順に処理する
+// NOTE: isHeaderOnlyならSOFまで読んで縮小デコードできるかだけ判定する
+func (decoder *jpegReducer) decode(isHeaderOnly bool) error {
+	if marker, err := decoder.nextMarker(); err != nil || marker != 0xD8 {
+		return errors.New("missing SOI marker")
+	}
+
+	for {
+		marker, err := decoder.nextMarker()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case marker == 0xD9: // NOTE: EOI
+			return errors.New("missing scan data")
+		case marker >= 0xD0 && marker <= 0xD7: // NOTE: スキャン外のRSTは無視する
+			continue
+		case marker == 0xC0 || marker == 0xC1: // NOTE: ベースライン・拡張シーケンシャル（ハフマン符号）
+			segment, err := decoder.readSegment()
+			if err != nil {
+				return err
+			}
+			if err := decoder.parseFrame(segment); err != nil {
+				return err
+			}
+			if isHeaderOnly {
+				return nil
+			}
+			continue
+		case marker >= 0xC2 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC:
+			return ErrJpegNotReducible
+		}
+
+		segment, err := decoder.readSegment()
+		if err != nil {
+			return err
+		}
+
+		switch marker {
+		case 0xC4: // NOTE: DHT
+			err = decoder.parseHuffman(segment)
+		case 0xDB: // NOTE: DQT
+			err = decoder.parseQuant(segment)
+		case 0xDD: // NOTE: DRI
+			if len(segment) < 2 {
+				return errors.New("invalid DRI segment")
+			}
+			decoder.restartInterval = int(segment[0])<<8 | int(segment[1])
+		case 0xEE: // NOTE: APP14（AdobeのRGB・YCbCrの区別）
+			if len(segment) >= 12 && string(segment[:5]) == "Adobe" {
+				decoder.adobeTransform = int(segment[11])
+			}
+		case 0xDA: // NOTE: SOS
+			if len(decoder.components) == 0 {
+				return errors.New("missing SOF marker")
+			}
+			if err := decoder.decodeScan(segment); err != nil {
+				return err
+			}
+			if decoder.isAllDecoded() {
+				return nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseFrame SOFセグメントから画像の大きさと色成分を読む
+func (decoder *jpegReducer) parseFrame(segment []byte) error {
+	if len(segment) < 6 {
+		return errors.New("invalid SOF segment")
+	}
+	if segment[0] != 8 {
+		return ErrJpegNotReducible
+	}
+	decoder.height = int(segment[1])<<8 | int(segment[2])
+	decoder.width = int(segment[3])<<8 | int(segment[4])
+	count := int(segment[5])
+	if count != 1 && count != 3 {
+		return ErrJpegNotReducible
+	}
+	if decoder.width == 0 || decoder.height == 0 || len(segment) < 6+count*3 {
+		return errors.New("invalid SOF segment")
+	}
+
+	decoder.components = make([]*jpegComponent, count)
+	decoder.hmax, decoder.vmax = 1, 1
+	for i := range decoder.components {
+		data := segment[6+i*3:]
+		component := &jpegComponent{id: data[0], h: int(data[1] >> 4), v: int(data[1] & 0x0F), quant: data[2] & 0x03}
+		if count == 1 {
+			// NOTE: 1成分ならサンプリング係数に関係なく8x8ブロック単位
+			component.h, component.v = 1, 1
+		}
+		if component.h < 1 || component.h > 4 || component.v < 1 || component.v > 4 {
+			return errors.New("invalid sampling factor")
+		}
+		decoder.hmax = max(decoder.hmax, component.h)
+		decoder.vmax = max(decoder.vmax, component.v)
+		decoder.components[i] = component
+	}
+
+	decoder.mcusX = (decoder.width + 8*decoder.hmax - 1) / (8 * decoder.hmax)
+	decoder.mcusY = (decoder.height + 8*decoder.vmax - 1) / (8 * decoder.vmax)
+	for _, component := range decoder.components {
+		component.blocksW = decoder.mcusX * component.h
+		component.blocksH = decoder.mcusY * component.v
+	}
+	return nil
+}
+
+// parseHuffman DHTセグメントからハフマン符号表を読む
+func (decoder *jpegReducer) parseHuffman(segment []byte) error {
+	for len(segment) > 0 {
+		if len(segment) < 17 {
+			return errors.New("invalid DHT segment")
+		}
+		class, index := segment[0]>>4, segment[0]&0x03
+		var counts [16]byte
+		copy(counts[:], segment[1:17])
+		total := 0
+		for _, count := range counts {
+			total += int(count)
+		}
+		if len(segment) < 17+total {
+			return errors.New("invalid DHT segment")
+		}
+
+		huffman, err := newJpegHuffman(counts, append([]byte{}, segment[17:17+total]...))
+		if err != nil {
+			return err
+		}
+		if class == 0 {
+			decoder.dc[index] = huffman
+		} else {
+			decoder.ac[index] = huffman
+		}
+		segment = segment[17+total:]
+	}
+	return nil
+}
+
+// parseQuant DQTセグメントから直流成分の量子化係数だけを読む
+func (decoder *jpegReducer) parseQuant(segment []byte) error {
+	for len(segment) > 0 {
+		precision, index := segment[0]>>4, segment[0]&0x03
+		size := 64
+		if precision != 0 {
+			size = 128
+		}
+		if len(segment) < 1+size {
+			return errors.New("invalid DQT segment")
+		}
+		decoder.quant[index] = int32(segment[1])
+		if precision != 0 {
+			decoder.quant[index] = int32(segment[1])<<8 | int32(segment[2])
+		}
+		segment = segment[1+size:]
+	}
+	return nil
+}
+
+// decodeScan スキャンのブロックを順に読み、直流成分をブロックの平均値として記録する
+func (decoder *jpegReducer) decodeScan(segment []byte) error {
+	if len(segment) < 1 || len(segment) < 1+int(segment[0])*2 {
+		return errors.New("invalid SOS segment")
+	}
+
+	components := []*jpegComponent{}
+	for i := 0; i < int(segment[0]); i++ {
+		id, tables := segment[1+i*2], segment[2+i*2]
+		for _, component := range decoder.components {
+			if component.id == id {
+				component.dcTable, component.acTable = tables>>4&0x03, tables&0x03
+				if decoder.dc[component.dcTable] == nil || decoder.ac[component.acTable] == nil {
+					return errors.New("missing huffman table")
+				}
+				if component.plane == nil {
+					component.plane = make([]uint8, component.blocksW*component.blocksH)
+				}
+				component.pred = 0
+				component.isDecoded = true
+				components = append(components, component)
+			}
+		}
+	}
+	if len(components) == 0 {
+		return errors.New("invalid SOS segment")
+	}
+
+	// NOTE: 1成分だけのスキャンはMCUが1ブロックで、ブロック数も成分の大きさで決まる
+	mcusX, mcusY := decoder.mcusX, decoder.mcusY
+	if len(components) == 1 {
+		component := components[0]
+		width := (decoder.width*component.h + decoder.hmax - 1) / decoder.hmax
+		height := (decoder.height*component.v + decoder.vmax - 1) / decoder.vmax
+		mcusX, mcusY = (width+7)/8, (height+7)/8
+	}
+
+	decoder.bits.acc, decoder.bits.n, decoder.bits.marker = 0, 0, 0
+	for mcu := 0; mcu < mcusX*mcusY; mcu++ {
+		if decoder.restartInterval > 0 && mcu > 0 && mcu%decoder.restartInterval == 0 {
+			if err := decoder.restart(components); err != nil {
+				return err
+			}
+		}
+
+		mcuX, mcuY := mcu%mcusX, mcu/mcusX
+		if len(components) == 1 {
+			if err := decoder.decodeBlock(components[0], mcuX, mcuY); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, component := range components {
+			for y := 0; y < component.v; y++ {
+				for x := 0; x < component.h; x++ {
+					if err := decoder.decodeBlock(component, mcuX*component.h+x, mcuY*component.v+y); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	// NOTE: 先読みで到達したマーカーは次に処理する
+	decoder.pendingMarker = decoder.bits.marker
+	decoder.bits.marker = 0
+	return nil
+}
+
+// restart リスタートマーカーでビット列と直流成分の予測値をリセットする
+func (decoder *jpegReducer) restart(components []*jpegComponent) error {
+	marker := decoder.bits.marker
+	decoder.bits.acc, decoder.bits.n, decoder.bits.marker = 0, 0, 0
+	if marker == 0 {
+		var err error
+		if marker, err = decoder.nextMarker(); err != nil {
+			return err
+		}
+	}
+	if marker < 0xD0 || marker > 0xD7 {
+		return errors.New("missing RST marker")
+	}
+
+	for _, component := range components {
+		component.pred = 0
+	}
+	return nil
+}
+
+// decodeBlock 1ブロック分を読み、交流成分は読み飛ばす
+func (decoder *jpegReducer) decodeBlock(component *jpegComponent, blockX, blockY int) error {
+	bits := &decoder.bits
+	size, err := bits.decodeHuffman(decoder.dc[component.dcTable])
+	if err != nil {
+		return err
+	}
+	diff, err := bits.receive(size)
+	if err != nil {
+		return err
+	}
+	component.pred += diff
+
+	ac := decoder.ac[component.acTable]
+	for k := 1; k < 64; k++ {
+		rs, err := bits.decodeHuffman(ac)
+		if err != nil {
+			return err
+		}
+		run, size := rs>>4, rs&0x0F
+		if size == 0 {
+			if run != 15 {
+				break
+			}
+			k += 15
+			continue
+		}
+		k += int(run)
+		if _, err := bits.receive(size); err != nil {
+			return err
+		}
+	}
+
+	if blockX < component.blocksW && blockY < component.blocksH {
+		// NOTE: 直流成分/8がブロックの平均（レベルシフトの128を戻す）
+		value := component.pred * decoder.quant[component.quant]
+		if value >= 0 {
+			value = (value + 4) / 8
+		} else {
+			value = (value - 4) / 8
+		}
+		component.plane[blockY*component.blocksW+blockX] = uint8(min(max(value+128, 0), 255))
+	}
+	return nil
+}
+
+func (decoder *jpegReducer) isAllDecoded() bool {
+	for _, component := range decoder.components {
+		if !component.isDecoded {
+			return false
+		}
+	}
+	return true
+}
+
+// sample 縮小後の座標の成分の値
+func (decoder *jpegReducer) sample(component *jpegComponent, x, y int) uint8 {
+	return component.plane[y*component.v/decoder.vmax*component.blocksW+x*component.h/decoder.hmax]
+}
+
+// image ブロックの平均値を1画素とした画像
+func (decoder *jpegReducer) image() image.Image {
+	width := (decoder.width + JpegReduceScale - 1) / JpegReduceScale
+	height := (decoder.height + JpegReduceScale - 1) / JpegReduceScale
+
+	if len(decoder.components) == 1 {
+		gray := image.NewGray(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				gray.Pix[y*gray.Stride+x] = decoder.sample(decoder.components[0], x, y)
+			}
+		}
+		return gray
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c0 := decoder.sample(decoder.components[0], x, y)
+			c1 := decoder.sample(decoder.components[1], x, y)
+			c2 := decoder.sample(decoder.components[2], x, y)
+			r, g, b := c0, c1, c2
+			if decoder.adobeTransform != 0 {
+				r, g, b = color.YCbCrToRGB(c0, c1, c2)
+			}
+			offset := y*rgba.Stride + x*4
+			rgba.Pix[offset], rgba.Pix[offset+1], rgba.Pix[offset+2], rgba.Pix[offset+3] = r, g, b, 0xFF
+		}
+	}
+	return rgba
+}
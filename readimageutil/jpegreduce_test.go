@@ -0,0 +1,153 @@
+package readimageutil
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// newSmoothImage なめらかに色が変わるテスト画像
+func newSmoothImage(width, height int) *image.RGBA {
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			rgba.Set(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), uint8((x + y) * 127 / (width + height)), 0xFF})
+		}
+	}
+	return rgba
+}
+
+// newSmoothGray なめらかに明るさが変わるグレースケールのテスト画像
+func newSmoothGray(width, height int) *image.Gray {
+	gray := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			gray.SetGray(x, y, color.Gray{uint8((x + y) * 255 / (width + height))})
+		}
+	}
+	return gray
+}
+
+// blockAverage 等倍でデコードした画像の8x8ブロックの平均
+func blockAverage(imageData image.Image, blockX, blockY int) [3]float64 {
+	bounds := imageData.Bounds()
+	sum, count := [3]float64{}, 0.0
+	for y := blockY * JpegReduceScale; y < min((blockY+1)*JpegReduceScale, bounds.Dy()); y++ {
+		for x := blockX * JpegReduceScale; x < min((blockX+1)*JpegReduceScale, bounds.Dx()); x++ {
+			r, g, b, _ := imageData.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			sum[0] += float64(r >> 8)
+			sum[1] += float64(g >> 8)
+			sum[2] += float64(b >> 8)
+			count++
+		}
+	}
+	return [3]float64{sum[0] / count, sum[1] / count, sum[2] / count}
+}
+
+// TestDecodeJpegReduced 1/8デコードの結果が等倍デコードのブロック平均と近いかのテスト
+func TestDecodeJpegReduced(t *testing.T) {
+	sources := map[string]image.Image{
+		"ycbcr": newSmoothImage(643, 479),
+		"gray":  newSmoothGray(100, 60),
+	}
+	for name, source := range sources {
+		encoded := &bytes.Buffer{}
+		if err := jpeg.Encode(encoded, source, &jpeg.Options{Quality: 90}); err != nil {
+			t.Fatal(err)
+		}
+
+		header, err := DecodeImageHeader(bytes.NewReader(encoded.Bytes()))
+		if err != nil || !header.IsReducible || header.Width != source.Bounds().Dx() {
+			t.Fatalf("%s: unexpected header: %+v %v", name, header, err)
+		}
+
+		reduced, err := DecodeJpegReduced(bytes.NewReader(encoded.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		full, err := jpeg.Decode(bytes.NewReader(encoded.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bounds := reduced.Bounds()
+		expectedWidth := (source.Bounds().Dx() + JpegReduceScale - 1) / JpegReduceScale
+		expectedHeight := (source.Bounds().Dy() + JpegReduceScale - 1) / JpegReduceScale
+		if bounds.Dx() != expectedWidth || bounds.Dy() != expectedHeight {
+			t.Fatalf("%s: unexpected size: %v", name, bounds)
+		}
+
+		diff := 0.0
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				r, g, b, _ := reduced.At(x, y).RGBA()
+				average := blockAverage(full, x, y)
+				for i, value := range []uint32{r >> 8, g >> 8, b >> 8} {
+					if d := float64(value) - average[i]; d > 0 {
+						diff += d
+					} else {
+						diff -= d
+					}
+				}
+			}
+		}
+		if meanDiff := diff / float64(bounds.Dx()*bounds.Dy()*3); meanDiff > 3 {
+			t.Errorf("%s: mean diff %v", name, meanDiff)
+		}
+	}
+}
+
+// TestDecodeImageHeader JPEG以外は縮小できないと判定されるかのテスト
+func TestDecodeImageHeader(t *testing.T) {
+	encoded := &bytes.Buffer{}
+	if err := png.Encode(encoded, newSmoothImage(32, 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := DecodeImageHeader(encoded)
+	if err != nil || header.IsReducible || header.Format != "png" || header.Width != 32 || header.Height != 16 {
+		t.Fatalf("unexpected header: %+v %v", header, err)
+	}
+
+	if _, err := DecodeJpegReduced(bytes.NewReader([]byte("not a jpeg"))); err == nil {
+		t.Error("expected error")
+	}
+}
+
+// insertJpegSegment SOSの直前にセグメントを挿入する
+func insertJpegSegment(t *testing.T, encoded []byte, marker byte, segment []byte) []byte {
+	t.Helper()
+	sos := bytes.Index(encoded, []byte{0xFF, 0xDA})
+	if sos < 0 {
+		t.Fatal("SOS not found")
+	}
+	length := len(segment) + 2
+	inserted := append([]byte{}, encoded[:sos]...)
+	inserted = append(inserted, 0xFF, marker, byte(length>>8), byte(length))
+	inserted = append(inserted, segment...)
+	return append(inserted, encoded[sos:]...)
+}
+
+// TestDecodeJpegReducedMalformedHuffman 壊れたハフマン符号表でpanicせずエラーになるかのテスト
+func TestDecodeJpegReducedMalformedHuffman(t *testing.T) {
+	encoded := &bytes.Buffer{}
+	if err := jpeg.Encode(encoded, newSmoothGray(64, 64), &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string][]byte{
+		// NOTE: 1bitの符号が3つある（符号の空間を超える）
+		"overflow": {0x00, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2},
+		// NOTE: 直流成分の大きさの分類が16を超える
+		"dc category": {0x00, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 17, 17},
+	}
+	for name, table := range cases {
+		malformed := insertJpegSegment(t, encoded.Bytes(), 0xC4, table)
+		if _, err := DecodeJpegReduced(bytes.NewReader(malformed)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -34,3 +34,45 @@ func DecodeImage(reader io.Reader) (image.Image, string, error) {
 
 	return imageData, imageType, nil
 }
+
+// ReadImageConfig 画像データをデコードせずにサイズと形式だけ読み込む
+func ReadImageConfig(path string) (image.Config, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, "", fmt.Errorf("failed os.Open: %s %w", path, err)
+	}
+	defer file.Close()
+
+	imageConfig, imageType, err := DecodeImageConfig(file)
+	if err != nil {
+		return image.Config{}, "", fmt.Errorf("failed DecodeImageConfig: %s %w", path, err)
+	}
+
+	return imageConfig, imageType, nil
+}
+
+// DecodeImageConfig 画像のサイズと形式だけデコード
+func DecodeImageConfig(reader io.Reader) (image.Config, string, error) {
+	imageConfig, imageType, err := image.DecodeConfig(reader)
+	if err != nil {
+		return image.Config{}, "", fmt.Errorf("failed image.DecodeConfig: %w", err)
+	}
+
+	return imageConfig, imageType, nil
+}
+
+// ReadImageHeader 画像データをデコードせずにサイズと形式、縮小デコードできるかだけ読み込む
+func ReadImageHeader(path string) (ImageHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ImageHeader{}, fmt.Errorf("failed os.Open: %s %w", path, err)
+	}
+	defer file.Close()
+
+	header, err := DecodeImageHeader(file)
+	if err != nil {
+		return ImageHeader{}, fmt.Errorf("failed DecodeImageHeader: %s %w", path, err)
+	}
+
+	return header, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"slices"
+	"strings"
+)
+
+// グループの基準の画像との関係
+// NOTE: 上から順に強い根拠で判定する
+const (
+	relationIdenticalBytes  = "identical-bytes"
+	relationIdenticalPixels = "identical-pixels"
+	relationReencoded       = "re-encoded"
+	relationResized         = "resized"
+	relationCropped         = "cropped"
+	relationRotated         = "rotated"
+	relationSimilar         = "similar"
+)
+
+// relations 関係の一覧（フラグの説明と確認に使う）
+var relations = []string{
+	relationIdenticalBytes, relationIdenticalPixels, relationReencoded, relationResized, relationCropped, relationRotated, relationSimilar,
+}
+
+const (
+	// NOTE: 再エンコード・リサイズとみなすハッシュの距離の上限（ハッシュのビット数に対する割合）
+	relationMaxDistanceRatio = 1.0 / 16
+	// NOTE: 縦横比がこの割合以内の違いなら同じ縦横比とみなす（リサイズの丸め）
+	relationAspectTolerance = 0.01
+	// NOTE: 特徴点から推定した回転がこの角度（度）以上なら回転とみなす
+	relationMinRotation = 2.0
+)
+
+// calcContentHash ファイルの中身のハッシュ
+func calcContentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// calcPixelHash デコードした画素のハッシュ
+// NOTE: 形式が違っても同じ画素なら同じになるよう、8bitのRGBA（アルファ乗算済み）に揃えてから計算する
+// NOTE: JPEG（YCbCr）はRGBに変換すると遅いので変換前の値で計算する（JPEG同士でだけ一致する）
+func calcPixelHash(imageData image.Image) string {
+	bounds := imageData.Bounds()
+	hash := sha256.New()
+	binary.Write(hash, binary.LittleEndian, [2]int32{int32(bounds.Dx()), int32(bounds.Dy())})
+
+	if src, ok := imageData.(*image.YCbCr); ok {
+		binary.Write(hash, binary.LittleEndian, int32(src.SubsampleRatio))
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			offset := src.YOffset(bounds.Min.X, y)
+			hash.Write(src.Y[offset : offset+bounds.Dx()])
+		}
+		// NOTE: 間引かれた色差は同じ行が続くので一度だけ計算する
+		previous := -1
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			begin, end := src.COffset(bounds.Min.X, y), src.COffset(bounds.Max.X-1, y)+1
+			if begin == previous {
+				continue
+			}
+			previous = begin
+			hash.Write(src.Cb[begin:end])
+			hash.Write(src.Cr[begin:end])
+		}
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+
+	row := make([]byte, 0, bounds.Dx()*4)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row = row[:0]
+		switch src := imageData.(type) {
+		case *image.RGBA:
+			offset := src.PixOffset(bounds.Min.X, y)
+			row = append(row, src.Pix[offset:offset+bounds.Dx()*4]...)
+		case *image.Gray:
+			offset := src.PixOffset(bounds.Min.X, y)
+			for _, gray := range src.Pix[offset : offset+bounds.Dx()] {
+				row = append(row, gray, gray, gray, 0xff)
+			}
+		default:
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				rgba := color.RGBAModel.Convert(imageData.At(x, y)).(color.RGBA)
+				row = append(row, rgba.R, rgba.G, rgba.B, rgba.A)
+			}
+		}
+		hash.Write(row)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// isSameAspect 縦横比が同じとみなせるか
+func isSameAspect(lhsWidth, lhsHeight, rhsWidth, rhsHeight int) bool {
+	lhs := float64(lhsWidth) / float64(lhsHeight)
+	rhs := float64(rhsWidth) / float64(rhsHeight)
+	return math.Abs(lhs-rhs) <= relationAspectTolerance*max(lhs, rhs)
+}
+
+// classifyRelation グループの基準の画像（srcInfo）と似ている画像（info）の関係を判定する
+// NOTE: similarImageにはハッシュの距離・切り抜きが入っていること。rotationは特徴点から推定した回転（確かめていなければ0）
+// NOTE: 古い中間ファイルやqueryの画像など元の大きさが分からなければ判定しない（空を返す）
+func classifyRelation(srcInfo, info *ImageHashInfo, similarImage *SimilarImage, hashBits int, rotation float64) string {
+	if srcInfo.Width <= 0 || srcInfo.Height <= 0 || info.Width <= 0 || info.Height <= 0 {
+		return ""
+	}
+
+	isReencodedDistance := float64(similarImage.Distance) <= float64(hashBits)*relationMaxDistanceRatio
+	switch {
+	case len(srcInfo.ContentHash) != 0 && srcInfo.ContentHash == info.ContentHash:
+		return relationIdenticalBytes
+	case len(srcInfo.PixelHash) != 0 && srcInfo.PixelHash == info.PixelHash:
+		return relationIdenticalPixels
+	case math.Abs(rotation) >= relationMinRotation:
+		return relationRotated
+	case len(similarImage.Crop) != 0 || srcInfo.IsTrimmed != info.IsTrimmed:
+		return relationCropped
+	case srcInfo.Width == info.Width && srcInfo.Height == info.Height:
+		if isReencodedDistance {
+			return relationReencoded
+		}
+		return relationSimilar
+	case isSameAspect(srcInfo.Width, srcInfo.Height, info.Width, info.Height):
+		if isReencodedDistance {
+			return relationResized
+		}
+		return relationSimilar
+	default:
+		// NOTE: 縦横比が違うのにハッシュが似ているのは一部分を切り抜いた画像
+		return relationCropped
+	}
+}
+
+// relationListFlag カンマ区切りの関係のリストを受け取るフラグ
+type relationListFlag []string
+
+func (list *relationListFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *relationListFlag) Set(value string) error {
+	*list = nil
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+		if !slices.Contains(relations, field) {
+			return fmt.Errorf("invalid relation: %s (%s)", field, strings.Join(relations, ", "))
+		}
+		*list = append(*list, field)
+	}
+	return nil
+}
+
+// Contains 指定の関係を含むか
+// NOTE: 空なら全ての関係を含むとみなす
+func (list relationListFlag) Contains(relation string) bool {
+	return len(list) == 0 || slices.Contains(list, relation)
+}
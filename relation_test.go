@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/akinobufujii/similar_images_grouping/readimageutil"
+)
+
+// TestClassifyRelation 基準の画像との関係の判定のテスト
+func TestClassifyRelation(t *testing.T) {
+	newInfo := func(width, height int, contentHash, pixelHash string) *ImageHashInfo {
+		return &ImageHashInfo{Width: width, Height: height, ContentHash: contentHash, PixelHash: pixelHash}
+	}
+	src := newInfo(400, 300, "c1", "p1")
+
+	tests := []struct {
+		name     string
+		info     *ImageHashInfo
+		similar  SimilarImage
+		rotation float64
+		expected string
+	}{
+		{"same bytes", newInfo(400, 300, "c1", "p1"), SimilarImage{}, 0, relationIdenticalBytes},
+		{"same pixels", newInfo(400, 300, "c2", "p1"), SimilarImage{}, 0, relationIdenticalPixels},
+		{"re-encoded", newInfo(400, 300, "c2", "p2"), SimilarImage{Distance: 3}, 0, relationReencoded},
+		{"edited", newInfo(400, 300, "c2", "p2"), SimilarImage{Distance: 9}, 0, relationSimilar},
+		{"resized", newInfo(200, 150, "c2", "p2"), SimilarImage{Distance: 2}, 0, relationResized},
+		{"crop hash", newInfo(320, 240, "c2", "p2"), SimilarImage{Distance: 2, Crop: "center80 vs full"}, 0, relationCropped},
+		{"other aspect", newInfo(300, 300, "c2", "p2"), SimilarImage{Distance: 2}, 0, relationCropped},
+		{"rotated", newInfo(400, 300, "c2", "p2"), SimilarImage{Distance: 6}, -5, relationRotated},
+		{"unknown size", &ImageHashInfo{ContentHash: "c1"}, SimilarImage{Distance: 2}, 0, ""},
+	}
+	for _, test := range tests {
+		if relation := classifyRelation(src, test.info, &test.similar, 64, test.rotation); relation != test.expected {
+			t.Errorf("%s: unexpected relation: %v, expected %v", test.name, relation, test.expected)
+		}
+	}
+}
+
+// TestRelations グループの要素に基準の画像との関係が出力され、applyで関係を絞り込めるかのテスト
+func TestRelations(t *testing.T) {
+	root := t.TempDir()
+	write := func(name string, data []byte) {
+		if err := os.WriteFile(filepath.Join(root, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	encode := func(img image.Image, encoder func(*bytes.Buffer, image.Image) error) []byte {
+		b := &bytes.Buffer{}
+		if err := encoder(b, img); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+
+	// NOTE: タイルの数が違うモザイクは似ていないので、組ごとに別のグループになる
+	bytesImage := encodeTestPng(t, newTestMosaic(256, 256, 6))
+	write("a.png", bytesImage)
+	write("a-copy.png", bytesImage)
+
+	pixelsImage := newTestMosaic(256, 256, 8)
+	write("b.png", encodeTestPng(t, pixelsImage))
+	write("b-best.png", encode(pixelsImage, func(b *bytes.Buffer, img image.Image) error {
+		return (&png.Encoder{CompressionLevel: png.BestSpeed}).Encode(b, img)
+	}))
+
+	jpegImage := newTestMosaic(256, 256, 10)
+	write("c.png", encodeTestPng(t, jpegImage))
+	write("c.jpg", encode(jpegImage, func(b *bytes.Buffer, img image.Image) error {
+		return jpeg.Encode(b, img, &jpeg.Options{Quality: 95})
+	}))
+
+	write("d.png", encodeTestPng(t, newTestMosaic(256, 256, 12)))
+	write("d-small.png", encodeTestPng(t, newTestMosaic(128, 128, 12)))
+
+	expected := map[string]string{"a": relationIdenticalBytes, "b": relationIdenticalPixels, "c": relationReencoded, "d": relationResized}
+
+	groups := filepath.Join(t.TempDir(), "groups.json")
+	args := []string{"run", "-root", root, "-o", groups, "-write-midfile", "", "-threshold", "10", "-group-format", "members", "-progress", "none"}
+	if code, _, stderr := runTestCli(t, args...); code != 0 {
+		t.Fatalf("run failed: %v %s", code, stderr)
+	}
+	membersList, err := readSimilarGroups(groups)
+	if err != nil || len(membersList) != len(expected) {
+		t.Fatalf("unexpected groups: %v %v", membersList, err)
+	}
+	for _, members := range membersList {
+		if len(members) != 2 {
+			t.Errorf("unexpected group: %v", members)
+			continue
+		}
+		// NOTE: 基準の画像（最後の要素）以外に関係が付く
+		name := filepath.Base(members[0].Filepath)
+		if relation := expected[name[:1]]; members[0].Relation != relation || len(members[1].Relation) != 0 {
+			t.Errorf("unexpected relation: %v, expected %v", members, relation)
+		}
+	}
+
+	code, stdout, stderr := runTestCli(t, "apply", "-groups", groups, "-relations", relationIdenticalBytes+","+relationIdenticalPixels)
+	if code != 0 || strings.Count(stdout, "duplicate: ") != 2 || !strings.Contains(stdout, "skip (relation ") {
+		t.Errorf("unexpected apply: %v %s %s", code, stdout, stderr)
+	}
+	if code, _, _ := runTestCli(t, "apply", "-groups", groups, "-relations", "unknown"); code == 0 {
+		t.Errorf("invalid relation is accepted")
+	}
+
+	code, stdout, _ = runTestCli(t, "report", "-groups", groups)
+	if code != 0 || !strings.Contains(stdout, "relation: "+relationResized) {
+		t.Errorf("unexpected report: %v %s", code, stdout)
+	}
+}
+
+// TestPixelHashReducedJpeg DC成分が同じでAC成分だけ違うJPEGを縮小デコードしても同じ画素と判定しないかのテスト
+func TestPixelHashReducedJpeg(t *testing.T) {
+	// NOTE: 8x8のブロックごとの平均（DC成分）は同じで、ブロック内の市松模様（AC成分）だけ違う画像
+	const size = 2048
+	flat, checker := image.NewGray(image.Rect(0, 0, size, size)), image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			value := uint8(64 + (x/8*7+y/8*13)%128)
+			flat.Pix[y*flat.Stride+x] = value
+			checker.Pix[y*checker.Stride+x] = value + 24 - uint8((x+y)%2*48)
+		}
+	}
+	encode := func(img image.Image) []byte {
+		b := &bytes.Buffer{}
+		if err := jpeg.Encode(b, img, &jpeg.Options{Quality: 100}); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+	raws := []*rawImage{{Path: "flat.jpg", Data: encode(flat)}, {Path: "checker.jpg", Data: encode(checker)}}
+
+	// NOTE: 縮小デコードした画素は同じになる（縮小デコードで画素のハッシュを計算すると誤ってidentical-pixelsになる）
+	reduced := []string{}
+	for _, raw := range raws {
+		imageData, err := readimageutil.DecodeJpegReduced(bytes.NewReader(raw.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reduced = append(reduced, calcPixelHash(imageData))
+	}
+	if reduced[0] != reduced[1] {
+		t.Fatal("reduced images differ: the test images do not share DC coefficients")
+	}
+
+	for _, isReduceJpeg := range []bool{false, true} {
+		options := &scanOptions{SampleWidth: 16, SampleHeight: 16, IsReduceJpeg: isReduceJpeg}
+		infos := []*ImageHashInfo{}
+		for _, raw := range raws {
+			info, err := hashRawImage(context.Background(), raw, options)
+			if err != nil || info == nil {
+				t.Fatalf("failed hashRawImage: %s %v", raw.Path, err)
+			}
+			infos = append(infos, info)
+		}
+		if isReduceJpeg == (len(infos[0].PixelHash) != 0) {
+			t.Errorf("reduce %v: unexpected pixel hash: %q", isReduceJpeg, infos[0].PixelHash)
+		}
+		if relation := classifyRelation(infos[0], infos[1], &SimilarImage{}, 256, 0); relation == relationIdenticalPixels {
+			t.Errorf("reduce %v: different images are classified as %v", isReduceJpeg, relation)
+		}
+	}
+}
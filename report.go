@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akinobufujii/similar_images_grouping/readimageutil"
+)
+
+// groupMemberStat グループの要素のファイル情報
+// NOTE: zip内の画像や消えたファイルはIsExistがfalseになる
+type groupMemberStat struct {
+	SimilarGroupMember
+	IsExist bool
+	Size    int64
+	ModTime time.Time
+	Width   int
+	Height  int
+}
+
+// statGroupMember グループの要素のファイル情報を取得する
+func statGroupMember(member SimilarGroupMember) groupMemberStat {
+	stat := groupMemberStat{SimilarGroupMember: member}
+
+	info, err := os.Stat(member.Filepath)
+	if err != nil || !info.Mode().IsRegular() {
+		return stat
+	}
+	stat.IsExist = true
+	stat.Size = info.Size()
+	stat.ModTime = info.ModTime()
+
+	if imageConfig, _, err := readimageutil.ReadImageConfig(member.Filepath); err == nil {
+		stat.Width = imageConfig.Width
+		stat.Height = imageConfig.Height
+	}
+	return stat
+}
+
+// statSimilarGroups グループのすべての要素のファイル情報を取得する
+func statSimilarGroups(membersList [][]SimilarGroupMember) [][]groupMemberStat {
+	statsList := make([][]groupMemberStat, 0, len(membersList))
+	for _, members := range membersList {
+		stats := make([]groupMemberStat, 0, len(members))
+		for _, member := range members {
+			stats = append(stats, statGroupMember(member))
+		}
+		statsList = append(statsList, stats)
+	}
+	return statsList
+}
+
+// reclaimableSize 一番大きいファイルを1つ残した場合に削減できるバイト数
+func reclaimableSize(stats []groupMemberStat) int64 {
+	total := int64(0)
+	largest := int64(0)
+	for _, stat := range stats {
+		total += stat.Size
+		largest = max(largest, stat.Size)
+	}
+	return total - largest
+}
+
+// formatByteSize バイト数を単位付きの文字列にする
+func formatByteSize(size int64) string {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	}
+	for _, unit := range units {
+		if size >= unit.scale {
+			return fmt.Sprintf("%.1f%s", float64(size)/float64(unit.scale), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", size)
+}
+
+// writeTextReport グループごとにテキストで出力する
+func writeTextReport(writer io.Writer, statsList [][]groupMemberStat) error {
+	totalImages := 0
+	totalReclaimable := int64(0)
+	for i, stats := range statsList {
+		fmt.Fprintf(writer, "Group %d (%d images, reclaimable %s)\n", i+1, len(stats), formatByteSize(reclaimableSize(stats)))
+		for _, stat := range stats {
+			size, dimensions := "-", "-"
+			if stat.IsExist {
+				size = formatByteSize(stat.Size)
+			}
+			if stat.Width > 0 {
+				dimensions = fmt.Sprintf("%dx%d", stat.Width, stat.Height)
+			}
+			details := []string{}
+			if len(stat.Crop) != 0 {
+				details = append(details, "crop: "+stat.Crop)
+			}
+			if stat.Inliers != 0 {
+				details = append(details, fmt.Sprintf("inliers: %d", stat.Inliers))
+			}
+			if len(stat.Color) != 0 {
+				details = append(details, fmt.Sprintf("color: %s %.3f", stat.Color, stat.ColorDistance))
+			}
+			if len(stat.Relation) != 0 {
+				details = append(details, "relation: "+stat.Relation)
+			}
+			if stat.Quality != nil {
+				details = append(details, fmt.Sprintf("quality: %.1f", stat.Quality.Score))
+			}
+			if len(details) != 0 {
+				fmt.Fprintf(writer, "  %10s  %11s  %s  (%s)\n", size, dimensions, stat.Filepath, strings.Join(details, ", "))
+				continue
+			}
+			fmt.Fprintf(writer, "  %10s  %11s  %s\n", size, dimensions, stat.Filepath)
+		}
+
+		totalImages += len(stats)
+		totalReclaimable += reclaimableSize(stats)
+	}
+
+	_, err := fmt.Fprintf(writer, "Summary: %d groups, %d images, reclaimable %s\n", len(statsList), totalImages, formatByteSize(totalReclaimable))
+	return err
+}
+
+// writeCsvReport 要素ごとに1行のcsvで出力する
+func writeCsvReport(writer io.Writer, statsList [][]groupMemberStat) error {
+	csvWriter := csv.NewWriter(writer)
+	csvWriter.Write([]string{"group", "filepath", "root", "size", "width", "height", "modtime", "crop", "inliers", "color", "color_distance", "relation", "quality"})
+	for i, stats := range statsList {
+		for _, stat := range stats {
+			record := []string{strconv.Itoa(i + 1), stat.Filepath, stat.Root, "", "", "", "", stat.Crop, "", stat.Color, "", stat.Relation, ""}
+			if stat.IsExist {
+				record[3] = strconv.FormatInt(stat.Size, 10)
+				record[6] = stat.ModTime.Format(time.RFC3339)
+			}
+			if stat.Width > 0 {
+				record[4] = strconv.Itoa(stat.Width)
+				record[5] = strconv.Itoa(stat.Height)
+			}
+			if stat.Inliers != 0 {
+				record[8] = strconv.Itoa(stat.Inliers)
+			}
+			if len(stat.Color) != 0 {
+				record[10] = strconv.FormatFloat(stat.ColorDistance, 'f', 3, 64)
+			}
+			if stat.Quality != nil {
+				record[12] = strconv.FormatFloat(stat.Quality.Score, 'f', 1, 64)
+			}
+			csvWriter.Write(record)
+		}
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return fmt.Errorf("failed csv.Write: %w", err)
+	}
+	return nil
+}
+
+// runReport reportサブコマンド
+func runReport(args []string, env *cliEnv) error {
+	cmd := struct {
+		Groups string
+		Format string
+		Output string
+	}{}
+	flags := env.newFlagSet("report", "", "Show size and dimensions of each image in the groups written by group or run.")
+	flags.StringVar(&cmd.Groups, "groups", "similar_groups.json", "read groups filename(json)")
+	flags.StringVar(&cmd.Format, "format", "text", "output format: text or csv")
+	flags.StringVar(&cmd.Output, "o", "", "output filename (empty is stdout)")
+	if err := env.parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return env.usageError(flags, "report: unexpected arguments: %v", flags.Args())
+	}
+
+	writeReport := writeTextReport
+	switch cmd.Format {
+	case "text":
+	case "csv":
+		writeReport = writeCsvReport
+	default:
+		return env.usageError(flags, "report: invalid format: %s", cmd.Format)
+	}
+
+	membersList, err := readSimilarGroups(cmd.Groups)
+	if err != nil {
+		return err
+	}
+	statsList := statSimilarGroups(membersList)
+
+	if len(cmd.Output) == 0 {
+		return writeReport(env.Stdout, statsList)
+	}
+
+	file, err := os.Create(cmd.Output)
+	if err != nil {
+		return fmt.Errorf("failed os.Create: %s %w", cmd.Output, err)
+	}
+	defer file.Close()
+
+	return writeReport(file, statsList)
+}
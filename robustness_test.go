@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// robustnessThreshold groupやrunのしきい値の初期値
+const robustnessThreshold = 10
+
+// robustnessSeeds 加工する合成画像のseed
+var robustnessSeeds = []int64{1, 2, 3, 4}
+
+// encodeTestJpeg 指定の品質でJPEGにエンコードする
+func encodeTestJpeg(t testing.TB, img image.Image, quality int) []byte {
+	t.Helper()
+	b := bytes.Buffer{}
+	if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// adjustGamma 画素値（0-1）をgamma乗した画像
+func adjustGamma(src *image.RGBA, gamma float64) *image.RGBA {
+	table := [256]uint8{}
+	for i := range table {
+		table[i] = uint8(math.Round(255 * math.Pow(float64(i)/255, gamma)))
+	}
+	dst := image.NewRGBA(src.Rect)
+	for i := 0; i < len(src.Pix); i += 4 {
+		dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = table[src.Pix[i]], table[src.Pix[i+1]], table[src.Pix[i+2]], src.Pix[i+3]
+	}
+	return dst
+}
+
+// addNoise 標準偏差sigmaのガウスノイズを加えた画像
+func addNoise(src *image.RGBA, sigma float64) *image.RGBA {
+	random := rand.New(rand.NewSource(1))
+	dst := image.NewRGBA(src.Rect)
+	for i, value := range src.Pix {
+		if i%4 == 3 {
+			dst.Pix[i] = value
+			continue
+		}
+		dst.Pix[i] = uint8(min(255, max(0, math.Round(float64(value)+random.NormFloat64()*sigma))))
+	}
+	return dst
+}
+
+// addWatermark 右下に幅percent%の半透明の白い帯（透かし）を重ねた画像
+func addWatermark(src *image.RGBA, percent int) *image.RGBA {
+	dst := image.NewRGBA(src.Rect)
+	copy(dst.Pix, src.Pix)
+	width, height := src.Rect.Dx()*percent/100, src.Rect.Dy()*percent/300
+	margin := src.Rect.Dx() / 50
+	region := image.Rect(src.Rect.Dx()-width-margin, src.Rect.Dy()-height-margin, src.Rect.Dx()-margin, src.Rect.Dy()-margin)
+	draw.DrawMask(dst, region, image.NewUniform(color.White), image.Point{}, image.NewUniform(color.Alpha{A: 160}), image.Point{}, draw.Over)
+	return dst
+}
+
+// robustnessCases 既知の加工と、しきい値の初期値で元の画像と同じグループになるか
+// NOTE: groupedにないハッシュは画像によって結果が変わる加工（ログだけ出して判定しない）
+var robustnessCases = []struct {
+	name    string
+	encode  func(t testing.TB, scene *image.RGBA) []byte
+	grouped map[string]bool
+}{
+	{"scale50", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestPng(t, resizeImage(scene, scene.Rect.Dx()/2, scene.Rect.Dy()/2))
+	}, map[string]bool{"phash": true, "ahash": true, "dhash": true}},
+	{"scale25", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestPng(t, resizeImage(scene, scene.Rect.Dx()/4, scene.Rect.Dy()/4))
+	}, map[string]bool{"phash": true, "ahash": true, "dhash": true}},
+	{"scale200", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestPng(t, resizeImage(scene, scene.Rect.Dx()*2, scene.Rect.Dy()*2))
+	}, map[string]bool{"phash": true, "ahash": true, "dhash": true}},
+	{"jpeg90", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestJpeg(t, scene, 90)
+	}, map[string]bool{"phash": true, "ahash": true, "dhash": true}},
+	{"jpeg50", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestJpeg(t, scene, 50)
+	}, map[string]bool{"phash": true, "ahash": true, "dhash": true}},
+	// NOTE: dhashは平坦なグラデーションの隣り合う画素の大小がブロックノイズやノイズで入れ替わりやすい
+	{"jpeg20", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestJpeg(t, scene, 20)
+	}, map[string]bool{"phash": true, "ahash": true}},
+	{"jpeg5", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestJpeg(t, scene, 5)
+	}, map[string]bool{"dhash": false}},
+	{"gamma0.9", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestPng(t, adjustGamma(scene, 0.9))
+	}, map[string]bool{"phash": true, "ahash": true, "dhash": true}},
+	{"gamma1.1", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestPng(t, adjustGamma(scene, 1.1))
+	}, map[string]bool{"phash": true, "ahash": true, "dhash": true}},
+	{"gamma2.5", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestPng(t, adjustGamma(scene, 2.5))
+	}, map[string]bool{"phash": false, "ahash": false, "dhash": false}},
+	// NOTE: 切り抜きはどのハッシュでも10%で別の画像になる（-cropsで中央の切り抜きのハッシュを追加する）
+	{"crop90", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestPng(t, subImage(scene, centerCrop(scene.Rect, 90)))
+	}, map[string]bool{"phash": false, "ahash": false, "dhash": false}},
+	{"crop80", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestPng(t, subImage(scene, centerCrop(scene.Rect, 80)))
+	}, map[string]bool{"phash": false, "ahash": false, "dhash": false}},
+	{"watermark10", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestPng(t, addWatermark(scene, 10))
+	}, map[string]bool{"ahash": true, "dhash": true}},
+	{"watermark50", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestPng(t, addWatermark(scene, 50))
+	}, map[string]bool{"phash": false, "dhash": true}},
+	{"noise4", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestPng(t, addNoise(scene, 4))
+	}, map[string]bool{"phash": true, "ahash": true, "dhash": true}},
+	{"noise8", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestPng(t, addNoise(scene, 8))
+	}, map[string]bool{"phash": true, "ahash": true}},
+	{"noise64", func(t testing.TB, scene *image.RGBA) []byte {
+		return encodeTestPng(t, addNoise(scene, 64))
+	}, map[string]bool{"dhash": false}},
+}
+
+// TestTransformRobustness 合成画像に既知の加工をして、ハッシュごとにしきい値の初期値で元の画像とグループになる加工を確かめる
+// NOTE: ハッシュの計算方法やデコード、縮小の挙動が変わるとここで失敗する
+func TestTransformRobustness(t *testing.T) {
+	scanned := map[int64][]*rawImage{}
+	for _, seed := range robustnessSeeds {
+		scene := newSyntheticScene(seed, 480, 360)
+		raws := []*rawImage{{Path: "original", Data: encodeTestPng(t, scene)}}
+		for _, test := range robustnessCases {
+			raws = append(raws, &rawImage{Path: test.name, Data: test.encode(t, scene)})
+		}
+		// NOTE: 別の画像はどの加工とも同じグループにならない
+		raws = append(raws, &rawImage{Path: "other", Data: encodeTestPng(t, newSyntheticScene(seed+100, 480, 360))})
+		scanned[seed] = raws
+	}
+
+	for _, algorithm := range []string{"phash", "ahash", "dhash"} {
+		options := &scanOptions{HashAlgorithm: hashAlgorithmFlag(algorithm), SampleWidth: 16, SampleHeight: 16}
+		rates := map[string]int{}
+		for _, seed := range robustnessSeeds {
+			raws := scanned[seed]
+			// NOTE: 元の画像を先頭にして、元の画像のグループに入った加工を調べる
+			container := ParallelCompList{}
+			for _, raw := range raws {
+				info, err := hashRawImage(context.Background(), raw, options)
+				if err != nil || info == nil {
+					t.Fatalf("%s %s: failed hashRawImage: %v", algorithm, raw.Path, err)
+				}
+				container.Append(info)
+			}
+			groups, err := groupingSimilarImages(&container, &groupingOptions{Threshold: robustnessThreshold, Parallels: 2}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			grouped := []string{}
+			for _, group := range groups {
+				if slices.Contains(group, "other") {
+					t.Errorf("%s seed %d: other scene is grouped: %v", algorithm, seed, group)
+				}
+				if slices.Contains(group, "original") {
+					grouped = group
+				}
+			}
+			for _, test := range robustnessCases {
+				isGrouped := slices.Contains(grouped, test.name)
+				if isGrouped {
+					rates[test.name]++
+				}
+				if expected, ok := test.grouped[algorithm]; ok && isGrouped != expected {
+					t.Errorf("%s seed %d: %s grouped %v, expected %v", algorithm, seed, test.name, isGrouped, expected)
+				}
+			}
+		}
+		for _, test := range robustnessCases {
+			t.Logf("%s %s: grouped %d/%d", algorithm, test.name, rates[test.name], len(robustnessSeeds))
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 読み込めなかった・除外したファイルの理由
+const (
+	issueReasonUnsupported = "unsupported-format"
+	issueReasonCorrupt     = "corrupt"
+	issueReasonEncrypted   = "encrypted"
+	issueReasonTooLarge    = "too-large"
+	issueReasonUnreadable  = "unreadable"
+)
+
+// ScanIssue 読み込めなかった・除外したファイル
+type ScanIssue struct {
+	Filepath string
+	Root     string `json:",omitempty"`
+	Reason   string
+	Error    string `json:",omitempty"`
+}
+
+// scanIssueLog 走査中に読み込めなかった・除外したファイルを集める
+// NOTE: nilでもログは出力する
+type scanIssueLog struct {
+	mu     sync.Mutex
+	issues []ScanIssue
+}
+
+// classifyReadError 読み込みエラーの理由を判定する
+func classifyReadError(err error) string {
+	var pathError *fs.PathError
+	switch {
+	case errors.Is(err, errTooManyPixels):
+		return issueReasonTooLarge
+	case errors.Is(err, image.ErrFormat):
+		return issueReasonUnsupported
+	case errors.As(err, &pathError):
+		return issueReasonUnreadable
+	default:
+		return issueReasonCorrupt
+	}
+}
+
+// Add ファイルを記録してログを出力する
+func (issueLog *scanIssueLog) Add(path, root, reason string, err error) {
+	issue := ScanIssue{
+		Filepath: path,
+		Root:     root,
+		Reason:   reason,
+	}
+	if err != nil {
+		issue.Error = err.Error()
+	}
+	slog.Warn("skipped file", "path", path, "reason", reason, "error", issue.Error)
+	metrics.ScanIssues.Add(reason, 1)
+
+	if issueLog == nil {
+		return
+	}
+
+	issueLog.mu.Lock()
+	defer issueLog.mu.Unlock()
+
+	issueLog.issues = append(issueLog.issues, issue)
+}
+
+// Issues 記録したファイルをパス順に返す
+func (issueLog *scanIssueLog) Issues() []ScanIssue {
+	if issueLog == nil {
+		return nil
+	}
+
+	issueLog.mu.Lock()
+	defer issueLog.mu.Unlock()
+
+	issues := append([]ScanIssue{}, issueLog.issues...)
+	sort.Slice(issues, func(i, j int) bool {
+		return issues[i].Filepath < issues[j].Filepath
+	})
+	return issues
+}
+
+// String 理由ごとの数（例: "corrupt=1 unsupported-format=2"）
+func (issueLog *scanIssueLog) String() string {
+	counts := map[string]int{}
+	for _, issue := range issueLog.Issues() {
+		counts[issue.Reason]++
+	}
+	if len(counts) == 0 {
+		return "none"
+	}
+
+	texts := []string{}
+	for _, reason := range sortedKeys(counts) {
+		texts = append(texts, fmt.Sprintf("%s=%d", reason, counts[reason]))
+	}
+	return strings.Join(texts, " ")
+}
+
+// WriteJsonLines 1行に1ファイルのjsonで書き出す
+func (issueLog *scanIssueLog) WriteJsonLines(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed os.Create: %s %w", path, err)
+	}
+	defer file.Close()
+
+	return writeJsonLines(file, issueLog.Issues())
+}
+
+// writeJsonLines 要素ごとに1行のjsonを書き出す
+func writeJsonLines[T any](writer io.Writer, values []T) error {
+	encoder := json.NewEncoder(writer)
+	for _, value := range values {
+		if err := encoder.Encode(value); err != nil {
+			return fmt.Errorf("failed json.Encode: %w", err)
+		}
+	}
+	return nil
+}
+
+// logFlags ログ出力のフラグ
+type logFlags struct {
+	Level  slog.Level
+	Format string
+}
+
+// registerLogFlags ログ出力のフラグを登録する
+func registerLogFlags(flags *flag.FlagSet, logs *logFlags) {
+	flags.TextVar(&logs.Level, "log-level", slog.LevelInfo, "log level: debug, info, warn or error")
+	flags.Func("log-format", "log format: text or json (default text)", func(value string) error {
+		if value != "text" && value != "json" {
+			return fmt.Errorf("unknown log format: %s (text or json)", value)
+		}
+		logs.Format = value
+		return nil
+	})
+}
+
+// newLogger フラグに応じたロガーを作成する
+func (logs *logFlags) newLogger(writer io.Writer) *slog.Logger {
+	options := &slog.HandlerOptions{Level: logs.Level}
+	if logs.Format == "json" {
+		return slog.New(slog.NewJSONHandler(writer, options))
+	}
+	return slog.New(slog.NewTextHandler(writer, options))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestScanIssues 読み込めなかったファイルが理由付きで書き出されるかのテスト
+func TestScanIssues(t *testing.T) {
+	root := t.TempDir()
+	writeTestImages(t, root, map[string]int{"good.png": 0})
+
+	png := encodeTestPng(t, newTestImage(1, 64, 64))
+	files := map[string][]byte{
+		"corrupt.png": png[:len(png)/2],
+		"notes.txt":   []byte("not an image"),
+		"huge.png":    make([]byte, 32<<10),
+		"broken.zip":  []byte("PK\x03\x04broken"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(root, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// NOTE: 暗号化されたエントリを含むzip
+	zipFile, err := os.Create(filepath.Join(root, "secret.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipWriter := zip.NewWriter(zipFile)
+	writer, err := zipWriter.CreateHeader(&zip.FileHeader{Name: "locked.png", Flags: 0x1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(png)
+	zipWriter.Close()
+	zipFile.Close()
+
+	work := t.TempDir()
+	errorsOut := filepath.Join(work, "errors.jsonl")
+	code, stdout, stderr := runTestCli(t, "scan", "-root", root, "-o", filepath.Join(work, "midfile.json"),
+		"-errors-out", errorsOut, "-max-size", "16K", "-progress", "none")
+	if code != 0 {
+		t.Fatalf("scan failed: %v %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "Errors: corrupt=2 encrypted=1 too-large=1 unsupported-format=1") {
+		t.Fatalf("unexpected summary: %s", stdout)
+	}
+	if !strings.Contains(stderr, "level=WARN") || !strings.Contains(stderr, "reason=encrypted") {
+		t.Fatalf("unexpected log: %s", stderr)
+	}
+
+	file, err := os.Open(errorsOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	reasons := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		issue := ScanIssue{}
+		if err := json.Unmarshal(scanner.Bytes(), &issue); err != nil {
+			t.Fatal(err)
+		}
+		if issue.Root != root {
+			t.Errorf("unexpected root: %+v", issue)
+		}
+		relPath, _ := filepath.Rel(root, issue.Filepath)
+		reasons[relPath] = issue.Reason
+	}
+	expected := map[string]string{
+		"corrupt.png": issueReasonCorrupt,
+		"notes.txt":   issueReasonUnsupported,
+		"huge.png":    issueReasonTooLarge,
+		"broken.zip":  issueReasonCorrupt,
+		filepath.Join("secret.zip", "locked.png"): issueReasonEncrypted,
+	}
+	if !reflect.DeepEqual(reasons, expected) {
+		t.Fatalf("unexpected reasons: %v", reasons)
+	}
+
+	// NOTE: ログレベルを上げれば警告は出ない
+	code, _, stderr = runTestCli(t, "scan", "-root", root, "-o", filepath.Join(work, "midfile.json"), "-log-level", "error", "-progress", "none")
+	if code != 0 || strings.Contains(stderr, "level=WARN") {
+		t.Fatalf("unexpected log: %v %s", code, stderr)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// imageIndex 複数goroutineから参照・更新されるインメモリのハッシュインデックス
+type imageIndex struct {
+	mu      sync.RWMutex
+	list    ParallelCompList
+	isDirty bool
+
+	// NOTE: 検索用にlistを詰めたもの。一度作ったらlistの変更に合わせて追加・削除する
+	//       追加できない画像（切り抜きの数が増えるなど）の場合だけnilにして次の検索で作り直す
+	matrixMu sync.Mutex
+	matrix   *hashMatrix
+}
+
+// Search 指定ハッシュと似ている画像を返す
+func (index *imageIndex) Search(info *ImageHashInfo, threshold int) ([]SimilarImage, error) {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	matrix, err := index.matrixLocked()
+	if err != nil {
+		return nil, err
+	}
+	return matrix.Search(info, threshold, 0)
+}
+
+// matrixLocked 検索用のhashMatrixを返す（読み込みロック中に呼ぶ）
+func (index *imageIndex) matrixLocked() (*hashMatrix, error) {
+	index.matrixMu.Lock()
+	defer index.matrixMu.Unlock()
+
+	if index.matrix == nil {
+		matrix, err := newHashMatrix(index.list)
+		if err != nil {
+			return nil, fmt.Errorf("failed newHashMatrix: %w", err)
+		}
+		index.matrix = matrix
+	}
+	return index.matrix, nil
+}
+
+// Add 画像を追加する（同じパスがあれば置き換える）
+// NOTE: ハッシュの種類やビット数がインデックスと合わなければ何も変更せずエラーを返す
+func (index *imageIndex) Add(info *ImageHashInfo) error {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	matrix, err := index.matrixLocked()
+	if err != nil {
+		return err
+	}
+	for _, imageHash := range packCropHashes(info) {
+		if imageHash == nil {
+			return errors.New("hash is required")
+		}
+		if _, err := matrix.Pack(imageHash); err != nil {
+			return fmt.Errorf("failed hashMatrix.Pack: %s %w", info.Filepath, err)
+		}
+	}
+
+	index.removeLocked(info.Filepath)
+	index.list.Append(info)
+	index.isDirty = true
+	if index.matrix.Append(info) != nil {
+		index.matrix = nil
+	}
+	return nil
+}
+
+// Remove 指定パスの画像を削除する
+func (index *imageIndex) Remove(path string) bool {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	isRemoved := index.removeLocked(path)
+	if isRemoved {
+		index.isDirty = true
+	}
+	return isRemoved
+}
+
+// RemoveUnder 指定パスとそれ以下（ディレクトリやzipの中身）の画像を削除する
+func (index *imageIndex) RemoveUnder(path string) int {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	prefix := path + string(filepath.Separator)
+	newList := make(ParallelCompList, 0, len(index.list))
+	for _, info := range index.list {
+		if info.Filepath != path && !strings.HasPrefix(info.Filepath, prefix) {
+			newList = append(newList, info)
+		}
+	}
+
+	removed := len(index.list) - len(newList)
+	if removed > 0 {
+		index.list = newList
+		index.isDirty = true
+		if index.matrix != nil {
+			index.matrix.RemoveFunc(func(info *ImageHashInfo) bool {
+				return info.Filepath == path || strings.HasPrefix(info.Filepath, prefix)
+			})
+		}
+	}
+	return removed
+}
+
+func (index *imageIndex) removeLocked(path string) bool {
+	for i, info := range index.list {
+		if info.Filepath == path {
+			index.list = append(index.list[:i], index.list[i+1:]...)
+			if index.matrix != nil {
+				index.matrix.RemoveFunc(func(info *ImageHashInfo) bool {
+					return info.Filepath == path
+				})
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Len 登録されている画像数
+func (index *imageIndex) Len() int {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	return len(index.list)
+}
+
+// Snapshot 変更があれば中間ファイル形式で書き出す
+func (index *imageIndex) Snapshot(path string) error {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if !index.isDirty {
+		return nil
+	}
+
+	// NOTE: 書き込み途中で落ちても壊れないように一時ファイルに書いてから置き換える
+	tempPath := path + ".tmp"
+	if err := index.list.Serialize(tempPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed os.Rename: %s %w", path, err)
+	}
+
+	index.isDirty = false
+	return nil
+}
+
+// imageIndexServer インデックスをHTTPで公開するサーバ
+type imageIndexServer struct {
+	index *imageIndex
+	// NOTE: ハッシュの計算と画像のデコードの上限（走査と同じ設定）
+	options        *scanOptions
+	threshold      int
+	maxRequestSize int64
+}
+
+// Handler ルーティング済みのhttp.Handlerを返す
+func (server *imageIndexServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /hash", server.handleHash)
+	mux.HandleFunc("POST /search", server.handleSearch)
+	mux.HandleFunc("POST /add", server.handleAdd)
+	mux.HandleFunc("DELETE /remove", server.handleRemove)
+	return mux
+}
+
+// readImageHashInfo リクエストボディからImageHashInfoを取得する
+// NOTE: Content-Typeがapplication/jsonなら中間ファイルと同じ形式のImageHashInfo、それ以外は画像データとして扱う
+func (server *imageIndexServer) readImageHashInfo(r *http.Request) (*ImageHashInfo, error) {
+	body := http.MaxBytesReader(nil, r.Body, server.maxRequestSize)
+	defer body.Close()
+
+	if r.Header.Get("Content-Type") == "application/json" {
+		info := &ImageHashInfo{}
+		if err := json.NewDecoder(body).Decode(info); err != nil {
+			return nil, fmt.Errorf("failed json.Decode: %w", err)
+		}
+		if len(r.URL.Query().Get("path")) != 0 {
+			info.Filepath = r.URL.Query().Get("path")
+		}
+		metrics.HashesReused.Add("posted", 1)
+		return info, nil
+	}
+
+	// NOTE: 画素数とデコード中のメモリの上限を確かめるため、ヘッダとデータの2回読めるように先に読み込む
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed io.ReadAll: %w", err)
+	}
+	open := func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	imageData, _, release, err := decodeImageBounded(r.Context(), open, server.options)
+	if err != nil {
+		return nil, fmt.Errorf("failed decodeImageBounded: %w", err)
+	}
+	if imageData == nil {
+		return nil, errors.New("image is excluded by the filter")
+	}
+	defer release()
+
+	options := server.options
+	return calcCroppedImageHash(imageData, r.URL.Query().Get("path"), options.HashAlgorithm, options.SampleWidth, options.SampleHeight, &options.Crop)
+}
+
+// requestThreshold クエリで閾値が指定されていればそれを返す
+func (server *imageIndexServer) requestThreshold(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("threshold")
+	if len(value) == 0 {
+		return server.threshold, nil
+	}
+
+	threshold, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed strconv.Atoi: threshold %w", err)
+	}
+	return threshold, nil
+}
+
+// handleHash 画像のハッシュを返す
+func (server *imageIndexServer) handleHash(w http.ResponseWriter, r *http.Request) {
+	info, err := server.readImageHashInfo(r)
+	if err != nil {
+		writeHttpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeHttpJson(w, http.StatusOK, info)
+}
+
+// handleSearch 画像またはハッシュと似ている画像を返す
+func (server *imageIndexServer) handleSearch(w http.ResponseWriter, r *http.Request) {
+	threshold, err := server.requestThreshold(r)
+	if err != nil {
+		writeHttpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	info, err := server.readImageHashInfo(r)
+	if err != nil {
+		writeHttpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	similarImages, err := server.index.Search(info, threshold)
+	if err != nil {
+		writeHttpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeHttpJson(w, http.StatusOK, struct {
+		Matches []SimilarImage
+	}{
+		Matches: similarImages,
+	})
+}
+
+// handleAdd 画像またはハッシュをインデックスに追加する
+func (server *imageIndexServer) handleAdd(w http.ResponseWriter, r *http.Request) {
+	info, err := server.readImageHashInfo(r)
+	if err != nil {
+		writeHttpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(info.Filepath) == 0 {
+		writeHttpError(w, http.StatusBadRequest, errors.New("path is required"))
+		return
+	}
+
+	if err := server.index.Add(info); err != nil {
+		writeHttpError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeHttpJson(w, http.StatusOK, info)
+}
+
+// handleRemove 指定パスをインデックスから削除する
+func (server *imageIndexServer) handleRemove(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if len(path) == 0 {
+		writeHttpError(w, http.StatusBadRequest, errors.New("path is required"))
+		return
+	}
+
+	if !server.index.Remove(path) {
+		writeHttpError(w, http.StatusNotFound, fmt.Errorf("not found: %s", path))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeHttpJson レスポンスとしてjsonを書き込む
+func writeHttpJson(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		slog.Error("failed json.Encode", "error", err)
+	}
+}
+
+// writeHttpError レスポンスとしてエラーを書き込む
+func writeHttpError(w http.ResponseWriter, status int, err error) {
+	writeHttpJson(w, status, struct {
+		Error string
+	}{
+		Error: err.Error(),
+	})
+}
+
+// runServe serveサブコマンド
+func runServe(args []string, env *cliEnv) error {
+	cmd := struct {
+		Addr             string
+		Midfile          string
+		SnapshotInterval time.Duration
+		HashAlgorithm    hashAlgorithmFlag
+		SampleWidth      int
+		SampleHeight     int
+		Crop             cropOptions
+		Threshold        int
+		MaxRequestSize   int64
+	}{}
+	flags := env.newFlagSet("serve", "", "Serve a midfile over HTTP (POST /hash, POST /search, POST /add, DELETE /remove).\nThe index is written back to the midfile periodically and on exit.")
+	flags.StringVar(&cmd.Addr, "addr", "localhost:8080", "listen address")
+	flags.StringVar(&cmd.Midfile, "midfile", "midfile.json", "intermediate filename(json) to load and snapshot")
+	flags.DurationVar(&cmd.SnapshotInterval, "snapshot-interval", time.Minute, "snapshot interval to midfile (0 is disabled)")
+	flags.Var(&cmd.HashAlgorithm, "hash", "hash algorithm (same as the midfile): phash, ahash or dhash")
+	flags.IntVar(&cmd.SampleWidth, "samplew", 16, "hash width")
+	flags.IntVar(&cmd.SampleHeight, "sampleh", 16, "hash height")
+	registerCropFlags(flags, &cmd.Crop)
+	flags.IntVar(&cmd.Threshold, "threshold", 10, "default pHash threshold of search")
+	flags.Int64Var(&cmd.MaxRequestSize, "max-request-size", 64<<20, "max request body size(bytes)")
+	decode := &decodeFlags{}
+	registerDecodeFlags(flags, decode)
+	if err := env.parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	index := &imageIndex{}
+	if _, err := os.Stat(cmd.Midfile); err == nil {
+		if err := index.list.Deserialize(cmd.Midfile); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(env.Stdout, "LoadedImages: %v\n", index.Len())
+
+	options := &scanOptions{
+		HashAlgorithm: cmd.HashAlgorithm,
+		SampleWidth:   cmd.SampleWidth,
+		SampleHeight:  cmd.SampleHeight,
+		Crop:          cmd.Crop,
+	}
+	decode.Apply(options)
+	server := &imageIndexServer{
+		index:          index,
+		options:        options,
+		threshold:      cmd.Threshold,
+		maxRequestSize: cmd.MaxRequestSize,
+	}
+	httpServer := &http.Server{
+		Addr:    cmd.Addr,
+		Handler: server.Handler(),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// NOTE: 定期的にインデックスを中間ファイルに書き戻すgoroutine
+	if cmd.SnapshotInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(cmd.SnapshotInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if err := index.Snapshot(cmd.Midfile); err != nil {
+						slog.Error("failed Snapshot", "path", cmd.Midfile, "error", err)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Fprintf(env.Stdout, "Listen: %v\n", cmd.Addr)
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed ListenAndServe: %w", err)
+	}
+
+	// NOTE: 終了時にも変更を書き戻す
+	return index.Snapshot(cmd.Midfile)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/corona10/goimagehash"
+)
+
+// newTestImage テスト用の画像を手続き的に生成する
+// NOTE: patternごとに明暗の配置が異なるのでハッシュが大きく離れる
+func newTestImage(pattern, width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var v int
+			switch pattern % 4 {
+			case 0: // NOTE: 横グラデーション
+				v = x * 255 / width
+			case 1: // NOTE: 縦グラデーション
+				v = y * 255 / height
+			case 2: // NOTE: 市松模様
+				if (x*8/width+y*8/height)%2 == 0 {
+					v = 255
+				}
+			case 3: // NOTE: 同心円
+				dx, dy := x-width/2, y-height/2
+				v = ((dx*dx + dy*dy) * 16 / (width * width / 4)) % 2 * 255
+			}
+			img.Set(x, y, color.RGBA{uint8(v), uint8(v), uint8(255 - v), 255})
+		}
+	}
+	return img
+}
+
+// encodeTestPng テスト用の画像をpngにエンコードする
+func encodeTestPng(t testing.TB, img image.Image) []byte {
+	t.Helper()
+	b := bytes.Buffer{}
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func newTestImageIndexServer() (*imageIndexServer, *httptest.Server) {
+	server := &imageIndexServer{
+		index:          &imageIndex{},
+		options:        &scanOptions{SampleWidth: 16, SampleHeight: 16},
+		threshold:      10,
+		maxRequestSize: 16 << 20,
+	}
+	return server, httptest.NewServer(server.Handler())
+}
+
+func doTestRequest(t *testing.T, method, url, contentType string, body []byte, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contentType) != 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if out != nil && res.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.StatusCode
+}
+
+// TestImageIndexServer 追加・検索・削除の一連の流れのテスト
+func TestImageIndexServer(t *testing.T) {
+	server, ts := newTestImageIndexServer()
+	defer ts.Close()
+
+	for i := 0; i < 3; i++ {
+		data := encodeTestPng(t, newTestImage(i, 64, 64))
+		path := filepath.Join("library", string(rune('a'+i))+".png")
+		if status := doTestRequest(t, http.MethodPost, ts.URL+"/add?path="+path, "image/png", data, nil); status != http.StatusOK {
+			t.Fatalf("add %s: status %v", path, status)
+		}
+	}
+	if server.index.Len() != 3 {
+		t.Fatalf("index len: %v", server.index.Len())
+	}
+
+	// NOTE: 縮小した画像で検索しても見つかること
+	query := encodeTestPng(t, newTestImage(1, 48, 48))
+	searchResult := struct{ Matches []SimilarImage }{}
+	if status := doTestRequest(t, http.MethodPost, ts.URL+"/search", "image/png", query, &searchResult); status != http.StatusOK {
+		t.Fatalf("search: status %v", status)
+	}
+	if len(searchResult.Matches) != 1 || searchResult.Matches[0].Filepath != filepath.Join("library", "b.png") {
+		t.Fatalf("unexpected search result: %+v", searchResult)
+	}
+
+	// NOTE: /hashの結果をそのままjsonで検索に使えること
+	hashResult := ImageHashInfo{}
+	if status := doTestRequest(t, http.MethodPost, ts.URL+"/hash", "image/png", query, &hashResult); status != http.StatusOK {
+		t.Fatalf("hash: status %v", status)
+	}
+	hashJson, err := json.Marshal(&hashResult)
+	if err != nil {
+		t.Fatal(err)
+	}
+	searchResult.Matches = nil
+	if status := doTestRequest(t, http.MethodPost, ts.URL+"/search", "application/json", hashJson, &searchResult); status != http.StatusOK {
+		t.Fatalf("search by hash: status %v", status)
+	}
+	if len(searchResult.Matches) != 1 || searchResult.Matches[0].Filepath != filepath.Join("library", "b.png") {
+		t.Fatalf("unexpected search by hash result: %+v", searchResult)
+	}
+
+	if status := doTestRequest(t, http.MethodDelete, ts.URL+"/remove?path="+filepath.Join("library", "b.png"), "", nil, nil); status != http.StatusNoContent {
+		t.Fatalf("remove: status %v", status)
+	}
+	if status := doTestRequest(t, http.MethodDelete, ts.URL+"/remove?path="+filepath.Join("library", "b.png"), "", nil, nil); status != http.StatusNotFound {
+		t.Fatalf("remove twice: status %v", status)
+	}
+
+	searchResult.Matches = nil
+	if status := doTestRequest(t, http.MethodPost, ts.URL+"/search", "image/png", query, &searchResult); status != http.StatusOK {
+		t.Fatalf("search after remove: status %v", status)
+	}
+	if len(searchResult.Matches) != 0 {
+		t.Fatalf("unexpected search result after remove: %+v", searchResult)
+	}
+
+	if status := doTestRequest(t, http.MethodPost, ts.URL+"/search", "image/png", []byte("not image"), nil); status != http.StatusBadRequest {
+		t.Fatalf("search invalid image: status %v", status)
+	}
+}
+
+// TestImageIndexServerMaxPixels 画素数の上限を超える画像は走査と同じようにデコードせず400を返すかのテスト
+func TestImageIndexServerMaxPixels(t *testing.T) {
+	server, ts := newTestImageIndexServer()
+	defer ts.Close()
+	server.options.MaxPixels = 64 * 64
+
+	if status := doTestRequest(t, http.MethodPost, ts.URL+"/add?path=small.png", "image/png", encodeTestPng(t, newTestImage(0, 64, 64)), nil); status != http.StatusOK {
+		t.Fatalf("add small: status %v", status)
+	}
+	if status := doTestRequest(t, http.MethodPost, ts.URL+"/add?path=large.png", "image/png", encodeTestPng(t, newTestImage(1, 65, 64)), nil); status != http.StatusBadRequest {
+		t.Fatalf("add large: status %v", status)
+	}
+	if status := doTestRequest(t, http.MethodPost, ts.URL+"/search", "image/png", encodeTestPng(t, newTestImage(1, 65, 64)), nil); status != http.StatusBadRequest {
+		t.Fatalf("search large: status %v", status)
+	}
+	if server.index.Len() != 1 {
+		t.Fatalf("index len: %v", server.index.Len())
+	}
+}
+
+// TestImageIndexServerLayoutMismatch 種類やビット数の違うハッシュは追加せず、インデックスを変更しないかのテスト
+func TestImageIndexServerLayoutMismatch(t *testing.T) {
+	server, ts := newTestImageIndexServer()
+	defer ts.Close()
+
+	if status := doTestRequest(t, http.MethodPost, ts.URL+"/add?path=a.png", "image/png", encodeTestPng(t, newTestImage(0, 64, 64)), nil); status != http.StatusOK {
+		t.Fatalf("add: status %v", status)
+	}
+
+	mismatches := map[string]*ImageHashInfo{
+		"bits": newTestImageHashInfo("a.png", 1, 2),
+		"kind": {Filepath: "a.png", ImageHash: goimagehash.NewExtImageHash(make([]uint64, 4), goimagehash.AHash, 256)},
+		"crop": {Filepath: "b.png", ImageHash: goimagehash.NewExtImageHash(make([]uint64, 4), goimagehash.PHash, 256), Crops: []CropHash{{Name: "center80", ImageHash: goimagehash.NewExtImageHash([]uint64{1}, goimagehash.PHash, 64)}}},
+	}
+	for name, info := range mismatches {
+		data, err := json.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := doTestRequest(t, http.MethodPost, ts.URL+"/add", "application/json", data, nil); status != http.StatusBadRequest {
+			t.Errorf("%s: status %v", name, status)
+		}
+	}
+
+	// NOTE: 置き換えようとした画像も残り、検索できること
+	if server.index.Len() != 1 {
+		t.Fatalf("index len: %v", server.index.Len())
+	}
+	searchResult := struct{ Matches []SimilarImage }{}
+	if status := doTestRequest(t, http.MethodPost, ts.URL+"/search", "image/png", encodeTestPng(t, newTestImage(0, 64, 64)), &searchResult); status != http.StatusOK {
+		t.Fatalf("search: status %v", status)
+	}
+	if len(searchResult.Matches) != 1 || searchResult.Matches[0].Filepath != "a.png" {
+		t.Fatalf("unexpected search result: %+v", searchResult)
+	}
+}
+
+// TestImageIndexSnapshot スナップショットを中間ファイルとして読み戻せるかのテスト
+func TestImageIndexSnapshot(t *testing.T) {
+	index := &imageIndex{}
+	index.Add(newTestImageHashInfo("a.jpg", 1, 2, 3, 4))
+	index.Add(newTestImageHashInfo("b.jpg", 5, 6, 7, 8))
+
+	path := filepath.Join(t.TempDir(), "midfile.json")
+	if err := index.Snapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temp file remains: %v", err)
+	}
+
+	container := &ParallelCompList{}
+	if err := container.Deserialize(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(*container) != 2 || (*container)[1].Filepath != "b.jpg" {
+		t.Fatalf("unexpected snapshot: %+v", *container)
+	}
+}
+
+// TestImageIndexIncremental 追加・削除で検索用の行列を作り直さないかのテスト
+func TestImageIndexIncremental(t *testing.T) {
+	index := &imageIndex{}
+	index.Add(newTestImageHashInfo("a/x.jpg", 0x0f))
+	index.Add(newTestImageHashInfo("b/y.jpg", 0xf0))
+	if _, err := index.Search(newTestImageHashInfo("q.jpg", 0), 4); err != nil {
+		t.Fatal(err)
+	}
+	matrix := index.matrix
+
+	index.Add(newTestImageHashInfo("c/z.jpg", 0x01))
+	index.Add(newTestImageHashInfo("a/x.jpg", 0xff))
+	if index.RemoveUnder("b") != 1 || !index.Remove("c/z.jpg") {
+		t.Fatal("failed remove")
+	}
+	index.Add(newTestImageHashInfo("d/w.jpg", 0x03))
+
+	similarImages, err := index.Search(newTestImageHashInfo("q.jpg", 0), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.matrix != matrix {
+		t.Error("matrix is rebuilt")
+	}
+	if len(similarImages) != 1 || similarImages[0].Filepath != "d/w.jpg" || similarImages[0].Distance != 2 {
+		t.Errorf("unexpected result: %+v", similarImages)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/bits"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// statsResolutions 解像度の集計の区切り（メガピクセル未満）
+var statsResolutions = []struct {
+	Label     string
+	MaxPixels int
+}{
+	{"<0.5MP", 500_000},
+	{"0.5-2MP", 2_000_000},
+	{"2-8MP", 8_000_000},
+	{"8-24MP", 24_000_000},
+	{">=24MP", math.MaxInt},
+}
+
+// statsUnknown 大きさが記録されていない画像（大きさを記録する前の中間ファイル）の区分
+const statsUnknown = "unknown"
+
+// statsBiasedBit ビットが立つ割合がこれ未満か1からこれを引いた値を超える位置を偏ったビットとみなす
+const statsBiasedBit = 0.1
+
+// thresholdListFlag カンマ区切りのしきい値のリストを受け取るフラグ
+type thresholdListFlag []int
+
+func (thresholds *thresholdListFlag) String() string {
+	values := make([]string, 0, len(*thresholds))
+	for _, threshold := range *thresholds {
+		values = append(values, strconv.Itoa(threshold))
+	}
+	return strings.Join(values, ",")
+}
+
+func (thresholds *thresholdListFlag) Set(value string) error {
+	*thresholds = nil
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+		threshold, err := strconv.Atoi(field)
+		if err != nil || threshold < 0 {
+			return fmt.Errorf("invalid threshold: %s (0 or more)", field)
+		}
+		*thresholds = append(*thresholds, threshold)
+	}
+	slices.Sort(*thresholds)
+	*thresholds = slices.Compact(*thresholds)
+	return nil
+}
+
+// labelCount 区分ごとの数
+type labelCount struct {
+	Label string
+	Count int
+}
+
+// distanceHistogram 2枚の組のハミング距離の分布
+type distanceHistogram struct {
+	// NOTE: 全ての組の数と、そのうち数えた組の数（全ての組がmaxPairsを超えたら無作為に選んだ組だけ数える）
+	TotalPairs   int64
+	CountedPairs int
+	IsSampled    bool
+	// NOTE: 距離ごとの組の数（添字が距離）
+	Counts []int
+}
+
+// Percentile 距離の小さいほうから指定の割合（0-1）の組が収まる距離
+func (histogram *distanceHistogram) Percentile(rate float64) int {
+	target := int(math.Ceil(rate * float64(histogram.CountedPairs)))
+	sum := 0
+	for distance, count := range histogram.Counts {
+		sum += count
+		if sum >= max(1, target) {
+			return distance
+		}
+	}
+	return len(histogram.Counts) - 1
+}
+
+// Within 距離がthreshold以下の組の数
+func (histogram *distanceHistogram) Within(threshold int) int {
+	sum := 0
+	for _, count := range histogram.Counts[:min(threshold+1, len(histogram.Counts))] {
+		sum += count
+	}
+	return sum
+}
+
+// thresholdGroupStats しきい値ごとのグループの大きさの分布
+type thresholdGroupStats struct {
+	Threshold     int
+	Groups        int
+	GroupedImages int
+	// NOTE: グループの大きさごとのグループの数
+	Sizes map[int]int
+}
+
+// datasetStats statsサブコマンドの結果
+type datasetStats struct {
+	Images      int
+	HashBits    int
+	Formats     []labelCount
+	Resolutions []labelCount
+	Distances   distanceHistogram
+	// NOTE: ハッシュの位置ごとにビットが立っている画像の割合（0.5に近いほど画像を見分けるのに役立つ）
+	BitBalance []float64
+	// NOTE: 立っているビットの数ごとの画像の数（添字がビットの数）
+	OnesCounts []int
+	Groups     []thresholdGroupStats
+}
+
+// BiasedBits ビットが立つ割合が偏っている位置の数
+func (stats *datasetStats) BiasedBits() int {
+	count := 0
+	for _, rate := range stats.BitBalance {
+		if rate < statsBiasedBit || rate > 1-statsBiasedBit {
+			count++
+		}
+	}
+	return count
+}
+
+// countFormats 拡張子ごとの画像の数（多い順）
+func countFormats(list ParallelCompList) []labelCount {
+	counts := map[string]int{}
+	for _, info := range list {
+		format := strings.TrimPrefix(strings.ToLower(filepath.Ext(info.Filepath)), ".")
+		if format == "jpeg" {
+			format = "jpg"
+		}
+		if len(format) == 0 {
+			format = statsUnknown
+		}
+		counts[format]++
+	}
+
+	formats := []labelCount{}
+	for label, count := range counts {
+		formats = append(formats, labelCount{Label: label, Count: count})
+	}
+	slices.SortFunc(formats, func(lhs, rhs labelCount) int {
+		return cmp.Or(rhs.Count-lhs.Count, strings.Compare(lhs.Label, rhs.Label))
+	})
+	return formats
+}
+
+// countResolutions 解像度の区分ごとの画像の数（区分の順、大きさの分からない画像は最後）
+func countResolutions(list ParallelCompList) []labelCount {
+	resolutions := make([]labelCount, len(statsResolutions)+1)
+	for i, resolution := range statsResolutions {
+		resolutions[i].Label = resolution.Label
+	}
+	resolutions[len(statsResolutions)].Label = statsUnknown
+	for _, info := range list {
+		if info.Width == 0 || info.Height == 0 {
+			resolutions[len(statsResolutions)].Count++
+			continue
+		}
+		for i, resolution := range statsResolutions {
+			if info.Width*info.Height < resolution.MaxPixels {
+				resolutions[i].Count++
+				break
+			}
+		}
+	}
+	return resolutions
+}
+
+// calcDistanceHistogram 2枚の組のハミング距離の分布
+// NOTE: 組がmaxPairsを超える場合は無作為に選んだmaxPairs組だけ数える（seedは固定なので同じ中間ファイルなら同じ結果）
+func calcDistanceHistogram(matrix *hashMatrix, maxPairs int) distanceHistogram {
+	count := matrix.Len()
+	histogram := distanceHistogram{TotalPairs: int64(count) * int64(count-1) / 2, Counts: make([]int, matrix.bits+1)}
+	stride := matrix.variants * matrix.words
+	hash := func(i int) []uint64 {
+		return matrix.hashes[i*stride : i*stride+matrix.words]
+	}
+
+	if histogram.TotalPairs <= int64(maxPairs) {
+		for i := 0; i < count; i++ {
+			for j := i + 1; j < count; j++ {
+				histogram.Counts[matrix.distance(hash(i), hash(j), matrix.bits)]++
+			}
+		}
+		histogram.CountedPairs = int(histogram.TotalPairs)
+		return histogram
+	}
+
+	random := rand.New(rand.NewSource(1))
+	for n := 0; n < maxPairs; n++ {
+		i, j := random.Intn(count), random.Intn(count-1)
+		if j >= i {
+			j++
+		}
+		histogram.Counts[matrix.distance(hash(i), hash(j), matrix.bits)]++
+	}
+	histogram.CountedPairs = maxPairs
+	histogram.IsSampled = true
+	return histogram
+}
+
+// calcBitStats ハッシュの位置ごとにビットが立っている割合と、立っているビットの数の分布
+func calcBitStats(matrix *hashMatrix) ([]float64, []int) {
+	setCounts := make([]int, matrix.bits)
+	onesCounts := make([]int, matrix.bits+1)
+	stride := matrix.variants * matrix.words
+	for i := 0; i < matrix.Len(); i++ {
+		ones := 0
+		for word, value := range matrix.hashes[i*stride : i*stride+matrix.words] {
+			ones += bits.OnesCount64(value)
+			for bit := 0; bit < 64 && word*64+bit < matrix.bits; bit++ {
+				if value&(1<<bit) != 0 {
+					setCounts[word*64+bit]++
+				}
+			}
+		}
+		onesCounts[ones]++
+	}
+
+	balance := make([]float64, matrix.bits)
+	for i, setCount := range setCounts {
+		balance[i] = math.Round(float64(setCount)/float64(matrix.Len())*1000) / 1000
+	}
+	return balance, onesCounts
+}
+
+// calcThresholdGroups しきい値ごとにgroupと同じ方法でグループにしたときの大きさの分布
+func calcThresholdGroups(list ParallelCompList, thresholds []int, parallels int) ([]thresholdGroupStats, error) {
+	groupsStats := []thresholdGroupStats{}
+	for _, threshold := range thresholds {
+		// NOTE: グルーピングでcontainerは空になるので毎回複製する
+		container := append(ParallelCompList{}, list...)
+		similarGroupsList, err := groupingSimilarImages(&container, &groupingOptions{Threshold: threshold, Parallels: parallels}, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		groupStats := thresholdGroupStats{Threshold: threshold, Groups: len(similarGroupsList), Sizes: map[int]int{}}
+		for _, similarGroups := range similarGroupsList {
+			groupStats.GroupedImages += len(similarGroups)
+			groupStats.Sizes[len(similarGroups)]++
+		}
+		groupsStats = append(groupsStats, groupStats)
+	}
+	return groupsStats, nil
+}
+
+// calcDatasetStats 中間ファイルの画像の統計
+func calcDatasetStats(list ParallelCompList, thresholds []int, maxPairs, parallels int) (*datasetStats, error) {
+	if len(list) < 2 {
+		return nil, fmt.Errorf("not enough images: %d (2 or more)", len(list))
+	}
+	matrix, err := newHashMatrix(list)
+	if err != nil {
+		return nil, fmt.Errorf("failed newHashMatrix: %w", err)
+	}
+
+	stats := &datasetStats{
+		Images:      len(list),
+		HashBits:    matrix.bits,
+		Formats:     countFormats(list),
+		Resolutions: countResolutions(list),
+		Distances:   calcDistanceHistogram(matrix, maxPairs),
+	}
+	stats.BitBalance, stats.OnesCounts = calcBitStats(matrix)
+	stats.Groups, err = calcThresholdGroups(list, thresholds, parallels)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// writeStatsText 統計の要約を書き出す
+func writeStatsText(writer io.Writer, stats *datasetStats) error {
+	text := &strings.Builder{}
+	fmt.Fprintf(text, "images: %d (%d bit hash)\n", stats.Images, stats.HashBits)
+
+	formats := []string{}
+	for _, format := range stats.Formats {
+		formats = append(formats, fmt.Sprintf("%s %d", format.Label, format.Count))
+	}
+	fmt.Fprintf(text, "formats: %s\n", strings.Join(formats, ", "))
+	resolutions := []string{}
+	for _, resolution := range stats.Resolutions {
+		if resolution.Count > 0 {
+			resolutions = append(resolutions, fmt.Sprintf("%s %d", resolution.Label, resolution.Count))
+		}
+	}
+	fmt.Fprintf(text, "resolutions: %s\n", strings.Join(resolutions, ", "))
+
+	distances := &stats.Distances
+	sampled := ""
+	if distances.IsSampled {
+		sampled = fmt.Sprintf(", sampled from %d", distances.TotalPairs)
+	}
+	fmt.Fprintf(text, "\ndistances: %d pairs%s\n", distances.CountedPairs, sampled)
+	fmt.Fprintf(text, "percentiles: p1 %d, p5 %d, p25 %d, p50 %d, p75 %d\n", distances.Percentile(0.01), distances.Percentile(0.05), distances.Percentile(0.25), distances.Percentile(0.5), distances.Percentile(0.75))
+	// NOTE: 距離をハッシュのビット数の1/32ずつの幅でまとめて棒グラフにする
+	width := max(1, stats.HashBits/32)
+	buckets := make([]int, (len(distances.Counts)+width-1)/width)
+	maxBucket := 0
+	for distance, count := range distances.Counts {
+		buckets[distance/width] += count
+		maxBucket = max(maxBucket, buckets[distance/width])
+	}
+	for i, count := range buckets {
+		if count == 0 {
+			continue
+		}
+		bar := strings.Repeat("#", (count*40+maxBucket-1)/maxBucket)
+		fmt.Fprintf(text, "%4d-%-4d %8d %s\n", i*width, min((i+1)*width, len(distances.Counts))-1, count, bar)
+	}
+
+	minBalance, maxBalance := slices.Min(stats.BitBalance), slices.Max(stats.BitBalance)
+	fmt.Fprintf(text, "\nbit balance: %.3f-%.3f, biased bits %d/%d (set in less than %.0f%% or more than %.0f%% of images)\n", minBalance, maxBalance, stats.BiasedBits(), stats.HashBits, statsBiasedBit*100, (1-statsBiasedBit)*100)
+
+	fmt.Fprintln(text)
+	for _, groups := range stats.Groups {
+		sizeCounts := []string{}
+		for _, size := range slices.Sorted(maps.Keys(groups.Sizes)) {
+			sizeCounts = append(sizeCounts, fmt.Sprintf("%d:%d", size, groups.Sizes[size]))
+		}
+		within := distances.Within(groups.Threshold)
+		fmt.Fprintf(text, "threshold %d: %d pairs within (%.2f%%), %d groups of %d images (sizes %s)\n", groups.Threshold, within, float64(within)*100/float64(distances.CountedPairs), groups.Groups, groups.GroupedImages, strings.Join(sizeCounts, " "))
+	}
+
+	if _, err := io.WriteString(writer, text.String()); err != nil {
+		return fmt.Errorf("failed io.WriteString: %w", err)
+	}
+	return nil
+}
+
+// runStats statsサブコマンド
+func runStats(args []string, env *cliEnv) error {
+	cmd := struct {
+		Midfile    string
+		Format     string
+		Output     string
+		Thresholds thresholdListFlag
+		MaxPairs   int
+		Parallels  int
+	}{
+		Thresholds: thresholdListFlag{0, 5, 10, 15, 20},
+	}
+	flags := env.newFlagSet("stats", "", "Show the distance histogram, hash bit balance, formats, resolutions and group sizes at several thresholds of a midfile.")
+	flags.StringVar(&cmd.Midfile, "midfile", "midfile.json", "read intermediate filename(json)")
+	flags.StringVar(&cmd.Format, "format", "text", "output format: text or json")
+	flags.StringVar(&cmd.Output, "o", "", "output filename (empty is stdout)")
+	flags.Var(&cmd.Thresholds, "thresholds", "thresholds of the group size distribution (comma separated)")
+	flags.IntVar(&cmd.MaxPairs, "max-pairs", 1_000_000, "count distances of all pairs up to this number, otherwise of this number of random pairs")
+	flags.IntVar(&cmd.Parallels, "j", runtime.NumCPU(), "parallel num of comparisons")
+	if err := env.parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return env.usageError(flags, "stats: unexpected arguments: %v", flags.Args())
+	}
+	if cmd.MaxPairs < 1 {
+		return env.usageError(flags, "stats: invalid max-pairs: %d", cmd.MaxPairs)
+	}
+
+	writeStats := writeStatsText
+	switch cmd.Format {
+	case "text":
+	case "json":
+		writeStats = func(writer io.Writer, stats *datasetStats) error {
+			return writeJsonTo(writer, stats)
+		}
+	default:
+		return env.usageError(flags, "stats: invalid format: %s", cmd.Format)
+	}
+
+	container := &ParallelCompList{}
+	if err := container.Deserialize(cmd.Midfile); err != nil {
+		return err
+	}
+	stats, err := calcDatasetStats(*container, cmd.Thresholds, cmd.MaxPairs, cmd.Parallels)
+	if err != nil {
+		return err
+	}
+
+	if len(cmd.Output) == 0 {
+		return writeStats(env.Stdout, stats)
+	}
+
+	file, err := os.Create(cmd.Output)
+	if err != nil {
+		return fmt.Errorf("failed os.Create: %s %w", cmd.Output, err)
+	}
+	defer file.Close()
+
+	return writeStats(file, stats)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+// TestDatasetStats 距離の分布とグループの大きさの分布が総当たりと一致するかのテスト
+func TestDatasetStats(t *testing.T) {
+	list := newRandomHashList(200, 4)
+	for i, info := range list {
+		info.Filepath = []string{"a.jpg", "b.JPEG", "c.png"}[i%3]
+		info.Width, info.Height = 1000*(i%3), 800
+	}
+
+	stats, err := calcDatasetStats(list, []int{0, 24}, 1_000_000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Images != 200 || stats.HashBits != 256 || len(stats.BitBalance) != 256 || stats.Distances.IsSampled || stats.Distances.CountedPairs != 200*199/2 {
+		t.Fatalf("unexpected stats: %v %v %v %+v", stats.Images, stats.HashBits, len(stats.BitBalance), stats.Distances)
+	}
+	if stats.Formats[0] != (labelCount{Label: "jpg", Count: 134}) || stats.Resolutions[1].Count != 133 || stats.Resolutions[len(stats.Resolutions)-1].Count != 67 {
+		t.Errorf("unexpected formats or resolutions: %v %v", stats.Formats, stats.Resolutions)
+	}
+
+	within := 0
+	for i := range list {
+		for j := i + 1; j < len(list); j++ {
+			distance, err := list[i].ImageHash.Distance(list[j].ImageHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if distance <= 24 {
+				within++
+			}
+		}
+	}
+	if stats.Distances.Within(24) != within || within == 0 {
+		t.Errorf("unexpected pairs within: %v, expected %v", stats.Distances.Within(24), within)
+	}
+
+	container := append(ParallelCompList{}, list...)
+	groups, err := groupingSimilarImages(&container, &groupingOptions{Threshold: 24, Parallels: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Groups[1].Threshold != 24 || stats.Groups[1].Groups != len(groups) {
+		t.Errorf("unexpected groups: %+v, expected %v groups", stats.Groups, len(groups))
+	}
+
+	// NOTE: 組が多い場合は指定の数だけ数える
+	sampled, err := calcDatasetStats(list, nil, 1000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sampled.Distances.IsSampled || sampled.Distances.CountedPairs != 1000 || sampled.Distances.Within(256) != 1000 {
+		t.Errorf("unexpected sampled distances: %+v", sampled.Distances)
+	}
+}
+
+// TestStatsCli 中間ファイルからjsonとテキストの統計を書き出せるかのテスト
+func TestStatsCli(t *testing.T) {
+	midfile := filepath.Join(t.TempDir(), "midfile.json")
+	container := newRandomHashList(20, 4)
+	if err := container.Serialize(midfile); err != nil {
+		t.Fatal(err)
+	}
+
+	code, stdout, stderr := runTestCli(t, "stats", "-midfile", midfile, "-format", "json", "-thresholds", "10,5,10")
+	if code != 0 {
+		t.Fatalf("unexpected exit code: %v %s %s", code, stdout, stderr)
+	}
+	stats := datasetStats{}
+	if err := json.Unmarshal([]byte(stdout), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Images != 20 || len(stats.Groups) != 2 || stats.Groups[0].Threshold != 5 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	if code, stdout, stderr := runTestCli(t, "stats", "-midfile", midfile); code != 0 || len(stdout) == 0 {
+		t.Errorf("unexpected text stats: %v %s %s", code, stdout, stderr)
+	}
+}
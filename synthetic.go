@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+)
+
+// syntheticTransform 合成した画像に加える加工
+type syntheticTransform struct {
+	Name string
+	// NOTE: 加工した画像と、保存する形式（"png"か"jpg"）
+	Apply func(src *image.RGBA) (image.Image, string)
+}
+
+// syntheticTransforms calibrateの合成データで似ている組にする加工
+var syntheticTransforms = []syntheticTransform{
+	{Name: "resize50", Apply: func(src *image.RGBA) (image.Image, string) {
+		return resizeImage(src, src.Bounds().Dx()/2, src.Bounds().Dy()/2), "png"
+	}},
+	{Name: "jpeg50", Apply: func(src *image.RGBA) (image.Image, string) {
+		return src, "jpg"
+	}},
+	{Name: "crop90", Apply: func(src *image.RGBA) (image.Image, string) {
+		return subImage(src, centerCrop(src.Bounds(), 90)), "png"
+	}},
+	{Name: "rotate3", Apply: func(src *image.RGBA) (image.Image, string) {
+		// NOTE: 回転ではみ出した角が入らないよう中央を切り抜く（傾きを直した写真の代わり）
+		rotated := rotateImage(src, 3)
+		return subImage(rotated, centerCrop(rotated.Bounds(), 90)), "png"
+	}},
+}
+
+// syntheticJpegQuality 合成データをJPEGで保存するときの品質
+const syntheticJpegQuality = 50
+
+// newSyntheticScene グラデーションの背景に大きさと色がばらばらの四角と円を重ねた画像
+// NOTE: seedが同じなら同じ画像になる
+func newSyntheticScene(seed int64, width, height int) *image.RGBA {
+	random := rand.New(rand.NewSource(seed))
+	scene := image.NewRGBA(image.Rect(0, 0, width, height))
+	base := [2]color.RGBA{
+		{uint8(random.Intn(256)), uint8(random.Intn(256)), uint8(random.Intn(256)), 255},
+		{uint8(random.Intn(256)), uint8(random.Intn(256)), uint8(random.Intn(256)), 255},
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			t := float64(x+y) / float64(width+height)
+			mix := func(a, b uint8) uint8 {
+				return uint8(float64(a)*(1-t) + float64(b)*t)
+			}
+			scene.SetRGBA(x, y, color.RGBA{mix(base[0].R, base[1].R), mix(base[0].G, base[1].G), mix(base[0].B, base[1].B), 255})
+		}
+	}
+
+	for i := 0; i < 60; i++ {
+		c := color.RGBA{uint8(random.Intn(256)), uint8(random.Intn(256)), uint8(random.Intn(256)), 255}
+		x, y := random.Intn(width), random.Intn(height)
+		size := 8 + random.Intn(width/4)
+		if i%2 == 0 {
+			draw.Draw(scene, image.Rect(x, y, x+size, y+size*2/3), image.NewUniform(c), image.Point{}, draw.Src)
+			continue
+		}
+		for dy := -size / 2; dy <= size/2; dy++ {
+			for dx := -size / 2; dx <= size/2; dx++ {
+				if dx*dx+dy*dy <= size*size/4 && image.Pt(x+dx, y+dy).In(scene.Bounds()) {
+					scene.SetRGBA(x+dx, y+dy, c)
+				}
+			}
+		}
+	}
+	return scene
+}
+
+// resizeImage 双線形補間で拡大縮小する（縮小は先に整数倍の平均を取ってぼかす）
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+
+	// NOTE: 縮小で細かい模様が折り返さないよう、整数倍の分は平均を取って縮小しておく
+	if factor := min(bounds.Dx()/max(1, width), bounds.Dy()/max(1, height)); factor >= 2 {
+		averaged := image.NewRGBA(image.Rect(0, 0, bounds.Dx()/factor, bounds.Dy()/factor))
+		for y := 0; y < averaged.Rect.Dy(); y++ {
+			for x := 0; x < averaged.Rect.Dx(); x++ {
+				sum := [4]int{}
+				for dy := 0; dy < factor; dy++ {
+					for dx := 0; dx < factor; dx++ {
+						c := rgba.RGBAAt(x*factor+dx, y*factor+dy)
+						sum[0], sum[1], sum[2], sum[3] = sum[0]+int(c.R), sum[1]+int(c.G), sum[2]+int(c.B), sum[3]+int(c.A)
+					}
+				}
+				count := factor * factor
+				averaged.SetRGBA(x, y, color.RGBA{uint8(sum[0] / count), uint8(sum[1] / count), uint8(sum[2] / count), uint8(sum[3] / count)})
+			}
+		}
+		rgba = averaged
+	}
+
+	srcWidth, srcHeight := rgba.Rect.Dx(), rgba.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		srcY := max(0, (float64(y)+0.5)*float64(srcHeight)/float64(height)-0.5)
+		y0 := min(int(srcY), srcHeight-1)
+		y1, fy := min(y0+1, srcHeight-1), srcY-float64(y0)
+		for x := 0; x < width; x++ {
+			srcX := max(0, (float64(x)+0.5)*float64(srcWidth)/float64(width)-0.5)
+			x0 := min(int(srcX), srcWidth-1)
+			x1, fx := min(x0+1, srcWidth-1), srcX-float64(x0)
+			c00, c10, c01, c11 := rgba.RGBAAt(x0, y0), rgba.RGBAAt(x1, y0), rgba.RGBAAt(x0, y1), rgba.RGBAAt(x1, y1)
+			mix := func(v00, v10, v01, v11 uint8) uint8 {
+				top := float64(v00)*(1-fx) + float64(v10)*fx
+				bottom := float64(v01)*(1-fx) + float64(v11)*fx
+				return uint8(math.Round(top*(1-fy) + bottom*fy))
+			}
+			dst.SetRGBA(x, y, color.RGBA{mix(c00.R, c10.R, c01.R, c11.R), mix(c00.G, c10.G, c01.G, c11.G), mix(c00.B, c10.B, c01.B, c11.B), mix(c00.A, c10.A, c01.A, c11.A)})
+		}
+	}
+	return dst
+}
+
+// rotateImage 中心で指定の角度（度）だけ回転する（はみ出した部分は黒）
+func rotateImage(src *image.RGBA, degrees float64) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	sin, cos := math.Sincos(degrees * math.Pi / 180)
+	centerX, centerY := float64(bounds.Dx())/2, float64(bounds.Dy())/2
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			// NOTE: 回転後の画素から回転前の画素を逆に求める
+			dx, dy := float64(x)+0.5-centerX, float64(y)+0.5-centerY
+			srcX := int(math.Floor(cos*dx + sin*dy + centerX))
+			srcY := int(math.Floor(-sin*dx + cos*dy + centerY))
+			if point := image.Pt(srcX, srcY).Add(bounds.Min); point.In(bounds) {
+				dst.SetRGBA(x, y, src.RGBAAt(point.X, point.Y))
+			}
+		}
+	}
+	return dst
+}
+
+// encodeSyntheticImage 合成した画像を指定の形式でエンコードする
+func encodeSyntheticImage(img image.Image, format string) ([]byte, error) {
+	encoded := &bytes.Buffer{}
+	var err error
+	if format == "jpg" {
+		err = jpeg.Encode(encoded, img, &jpeg.Options{Quality: syntheticJpegQuality})
+	} else {
+		err = png.Encode(encoded, img)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed encodeSyntheticImage(%s): %w", format, err)
+	}
+	return encoded.Bytes(), nil
+}
+
+// generateSyntheticPairs 合成した画像と加工した画像をdirに書き出し、ラベル付きの組のcsvのパスを返す
+// NOTE: 元の画像と加工した画像を"same"、別の画像を加工した画像との組を"different"として同じ数だけ作る
+func generateSyntheticPairs(dir string, count int) (string, error) {
+	if count < 2 {
+		return "", fmt.Errorf("invalid synthetic count: %d (2 or more)", count)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed os.MkdirAll: %s %w", dir, err)
+	}
+
+	write := func(name string, img image.Image, format string) error {
+		data, err := encodeSyntheticImage(img, format)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			return fmt.Errorf("failed os.WriteFile: %s %w", path, err)
+		}
+		return nil
+	}
+
+	originalName := func(i int) string { return fmt.Sprintf("scene%03d.png", i) }
+	variantName := func(i int, transform syntheticTransform, format string) string {
+		return fmt.Sprintf("scene%03d_%s.%s", i, transform.Name, format)
+	}
+
+	records := [][]string{{"path_a", "path_b", "label"}}
+	variantNames := make([][]string, count)
+	for i := 0; i < count; i++ {
+		// NOTE: 縦横比もばらばらにする
+		scene := newSyntheticScene(int64(i+1), 480, 320+i%3*80)
+		if err := write(originalName(i), scene, "png"); err != nil {
+			return "", err
+		}
+		for _, transform := range syntheticTransforms {
+			variant, format := transform.Apply(scene)
+			name := variantName(i, transform, format)
+			if err := write(name, variant, format); err != nil {
+				return "", err
+			}
+			variantNames[i] = append(variantNames[i], name)
+			records = append(records, []string{originalName(i), name, pairLabelSame})
+		}
+	}
+	for i := 0; i < count; i++ {
+		for j := range syntheticTransforms {
+			other := (i + 1 + j%(count-1)) % count
+			records = append(records, []string{originalName(i), variantNames[other][j], pairLabelDifferent})
+		}
+	}
+
+	pairsPath := filepath.Join(dir, "pairs.csv")
+	file, err := os.Create(pairsPath)
+	if err != nil {
+		return "", fmt.Errorf("failed os.Create: %s %w", pairsPath, err)
+	}
+	defer file.Close()
+
+	csvWriter := csv.NewWriter(file)
+	csvWriter.WriteAll(records)
+	if err := csvWriter.Error(); err != nil {
+		return "", fmt.Errorf("failed csv.Write: %s %w", pairsPath, err)
+	}
+	return pairsPath, nil
+}
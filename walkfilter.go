@@ -0,0 +1,296 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 除外理由
+const (
+	filterReasonInclude       = "include"
+	filterReasonExclude       = "exclude"
+	filterReasonHidden        = "hidden"
+	filterReasonMinSize       = "min-size"
+	filterReasonMaxSize       = "max-size"
+	filterReasonMinDimensions = "min-dimensions"
+)
+
+// stringListFlag 複数回指定できる文字列フラグ
+type stringListFlag []string
+
+func (list *stringListFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringListFlag) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// byteSizeFlag 単位付き（K, M, G）で指定できるバイト数フラグ
+type byteSizeFlag int64
+
+func (size *byteSizeFlag) String() string {
+	return strconv.FormatInt(int64(*size), 10)
+}
+
+func (size *byteSizeFlag) Set(value string) error {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	}
+
+	upper := strings.ToUpper(strings.TrimSpace(value))
+	scale := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSuffix(upper, unit.suffix)
+			scale = unit.scale
+			break
+		}
+	}
+
+	number, err := strconv.ParseInt(strings.TrimSpace(upper), 10, 64)
+	if err != nil || number < 0 {
+		return fmt.Errorf("invalid size: %s", value)
+	}
+	*size = byteSizeFlag(number * scale)
+	return nil
+}
+
+// dimensionsFlag WxH形式で指定する画像サイズフラグ
+type dimensionsFlag struct {
+	Width  int
+	Height int
+}
+
+func (dimensions *dimensionsFlag) String() string {
+	return fmt.Sprintf("%vx%v", dimensions.Width, dimensions.Height)
+}
+
+func (dimensions *dimensionsFlag) Set(value string) error {
+	if _, err := fmt.Sscanf(strings.ToLower(value), "%dx%d", &dimensions.Width, &dimensions.Height); err != nil {
+		return fmt.Errorf("invalid dimensions: %s (expected WxH)", value)
+	}
+	return nil
+}
+
+// filterStats 除外した数を理由ごとに数える
+type filterStats struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (stats *filterStats) Add(reason string) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	if stats.counts == nil {
+		stats.counts = map[string]int{}
+	}
+	stats.counts[reason]++
+}
+
+// Counts 理由ごとの除外数のコピーを返す
+func (stats *filterStats) Counts() map[string]int {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	counts := map[string]int{}
+	for reason, count := range stats.counts {
+		counts[reason] = count
+	}
+	return counts
+}
+
+func (stats *filterStats) String() string {
+	counts := stats.Counts()
+	reasons := make([]string, 0, len(counts))
+	total := 0
+	for reason, count := range counts {
+		reasons = append(reasons, fmt.Sprintf("%s=%v", reason, count))
+		total += count
+	}
+	sort.Strings(reasons)
+
+	if total == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%v (%s)", total, strings.Join(reasons, " "))
+}
+
+// walkFilter 走査するファイルを絞り込むフィルタ
+// NOTE: nilなら何も除外しない
+type walkFilter struct {
+	Includes      stringListFlag
+	Excludes      stringListFlag
+	MinSize       byteSizeFlag
+	MaxSize       byteSizeFlag
+	MinDimensions dimensionsFlag
+	SkipHidden    bool
+
+	Stats filterStats
+}
+
+// registerFilterFlags フィルタ用のフラグを登録する
+func registerFilterFlags(flags *flag.FlagSet, filter *walkFilter) {
+	flags.Var(&filter.Includes, "include", "include glob pattern (repeatable, basename if no separator)")
+	flags.Var(&filter.Excludes, "exclude", "exclude glob pattern (repeatable, basename if no separator)")
+	flags.Var(&filter.MinSize, "min-size", "min file size (e.g. 10K, 0 is unlimited)")
+	flags.Var(&filter.MaxSize, "max-size", "max file size (e.g. 200M, 0 is unlimited)")
+	flags.Var(&filter.MinDimensions, "min-dimensions", "min image dimensions WxH (e.g. 64x64)")
+	flags.BoolVar(&filter.SkipHidden, "skip-hidden", false, "skip hidden files and dirs (dot prefixed)")
+}
+
+// matchGlob パターンに区切り文字がなければファイル名、あればパス全体とその末尾部分に対して一致を調べる
+func matchGlob(pattern, path string) bool {
+	path = filepath.ToSlash(path)
+	pattern = filepath.ToSlash(pattern)
+
+	if !strings.Contains(pattern, "/") {
+		isMatch, _ := filepath.Match(pattern, filepath.Base(path))
+		return isMatch
+	}
+
+	// NOTE: 相対パターンでも一致するよう区切りごとに末尾部分と比較する
+	for {
+		if isMatch, _ := filepath.Match(pattern, path); isMatch {
+			return true
+		}
+		index := strings.Index(path, "/")
+		if index < 0 {
+			return false
+		}
+		path = path[index+1:]
+	}
+}
+
+func isHiddenName(name string) bool {
+	return len(name) > 1 && strings.HasPrefix(name, ".") && name != ".."
+}
+
+// FilterDir ディレクトリを走査しない理由を返す（走査するなら空文字）
+func (filter *walkFilter) FilterDir(path string) string {
+	if filter == nil {
+		return ""
+	}
+
+	if filter.SkipHidden && isHiddenName(filepath.Base(path)) {
+		return filterReasonHidden
+	}
+	for _, pattern := range filter.Excludes {
+		if matchGlob(pattern, path) {
+			return filterReasonExclude
+		}
+	}
+	return ""
+}
+
+// FilterPath ファイルを除外する理由を返す（除外しないなら空文字）
+func (filter *walkFilter) FilterPath(path string) string {
+	if filter == nil {
+		return ""
+	}
+
+	if filter.SkipHidden && isHiddenName(filepath.Base(path)) {
+		return filterReasonHidden
+	}
+	return filter.filterPattern(path)
+}
+
+// FilterArchiveEntry zip内のファイルを除外する理由を返す
+// NOTE: パターンは仮想パス（zipのパス/中のパス）、隠しファイルはzip内の各階層で判定する
+func (filter *walkFilter) FilterArchiveEntry(virtualPath, entryName string) string {
+	if filter == nil {
+		return ""
+	}
+
+	if filter.SkipHidden {
+		for _, name := range strings.Split(filepath.ToSlash(entryName), "/") {
+			if isHiddenName(name) {
+				return filterReasonHidden
+			}
+		}
+	}
+	return filter.filterPattern(virtualPath)
+}
+
+func (filter *walkFilter) filterPattern(path string) string {
+	for _, pattern := range filter.Excludes {
+		if matchGlob(pattern, path) {
+			return filterReasonExclude
+		}
+	}
+	if len(filter.Includes) != 0 {
+		for _, pattern := range filter.Includes {
+			if matchGlob(pattern, path) {
+				return ""
+			}
+		}
+		return filterReasonInclude
+	}
+	return ""
+}
+
+// FilterContainerPath zipなど中身を展開するファイル自体を除外する理由を返す
+// NOTE: includeは中身の仮想パスに対して判定するのでここでは見ない
+func (filter *walkFilter) FilterContainerPath(path string) string {
+	if filter == nil {
+		return ""
+	}
+
+	reason := filter.FilterPath(path)
+	if reason == filterReasonInclude {
+		return ""
+	}
+	return reason
+}
+
+// FilterSize ファイルサイズで除外する理由を返す
+func (filter *walkFilter) FilterSize(size int64) string {
+	if filter == nil {
+		return ""
+	}
+
+	if filter.MinSize > 0 && size < int64(filter.MinSize) {
+		return filterReasonMinSize
+	}
+	if filter.MaxSize > 0 && size > int64(filter.MaxSize) {
+		return filterReasonMaxSize
+	}
+	return ""
+}
+
+// NeedDimensions 画像サイズの判定が必要か
+func (filter *walkFilter) NeedDimensions() bool {
+	return filter != nil && (filter.MinDimensions.Width > 0 || filter.MinDimensions.Height > 0)
+}
+
+// FilterDimensions 画像サイズで除外する理由を返す
+func (filter *walkFilter) FilterDimensions(width, height int) string {
+	if filter == nil {
+		return ""
+	}
+
+	if width < filter.MinDimensions.Width || height < filter.MinDimensions.Height {
+		return filterReasonMinDimensions
+	}
+	return ""
+}
+
+// Skip 除外理由があれば数えてtrueを返す
+func (filter *walkFilter) Skip(reason string) bool {
+	if len(reason) == 0 {
+		return false
+	}
+	filter.Stats.Add(reason)
+	return true
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		isMatch bool
+	}{
+		{"*.png", "/root/a/x.png", true},
+		{"*.png", "/root/a/x.jpg", false},
+		{"Thumbs.db", "/root/a/Thumbs.db", true},
+		{"a/*.png", "/root/a/x.png", true},
+		{"a/*.png", "/root/b/x.png", false},
+		{"archive.zip/inner/*", "/root/archive.zip/inner/x.png", true},
+	}
+
+	for _, c := range cases {
+		if isMatch := matchGlob(c.pattern, c.path); isMatch != c.isMatch {
+			t.Errorf("matchGlob(%q, %q) = %v", c.pattern, c.path, isMatch)
+		}
+	}
+}
+
+// TestWalkFilter 走査時に条件ごとに除外され、理由ごとに数えられるかのテスト
+func TestWalkFilter(t *testing.T) {
+	root := t.TempDir()
+	writeTestImages(t, root, map[string]int{"keep.png": 0, "skip.png": 1, filepath.Join(".git", "objects", "x.png"): 2})
+	if err := os.WriteFile(filepath.Join(root, ".DS_Store"), []byte("dummy"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "Thumbs.db"), []byte("dummy"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// NOTE: 小さすぎる画像
+	tiny := encodeTestPng(t, newTestImage(3, 8, 8))
+	if err := os.WriteFile(filepath.Join(root, "tiny.png"), tiny, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// NOTE: zip内のファイルも仮想パスで判定される
+	zipFile, err := os.Create(filepath.Join(root, "archive.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipWriter := zip.NewWriter(zipFile)
+	for name, pattern := range map[string]int{"inner/keep.png": 3, "inner/skip.png": 0, ".hidden/x.png": 1} {
+		writer, err := zipWriter.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write(encodeTestPng(t, newTestImage(pattern, 64, 64))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	zipWriter.Close()
+	zipFile.Close()
+
+	filter := &walkFilter{SkipHidden: true}
+	filter.Excludes.Set("skip.png")
+	filter.Excludes.Set("Thumbs.db")
+	filter.MinDimensions.Set("16x16")
+
+	container := &ParallelCompList{}
+	options := &scanOptions{SampleWidth: 16, SampleHeight: 16, Parallels: 2, Filter: filter}
+	if err := createParallelCompList(context.Background(), container, newRootSources(root), options); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{}
+	for _, info := range *container {
+		paths = append(paths, info.Filepath)
+	}
+	sort.Strings(paths)
+	expected := []string{filepath.Join(root, "archive.zip", "inner", "keep.png"), filepath.Join(root, "keep.png")}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("unexpected paths: %v", paths)
+	}
+
+	expectedCounts := map[string]int{
+		filterReasonHidden:        3, // NOTE: .git, .DS_Store, zip内の.hidden
+		filterReasonExclude:       3, // NOTE: skip.png, Thumbs.db, zip内のskip.png
+		filterReasonMinDimensions: 1,
+	}
+	if counts := filter.Stats.Counts(); !reflect.DeepEqual(counts, expectedCounts) {
+		t.Fatalf("unexpected counts: %v", counts)
+	}
+
+	// NOTE: includeはzip自体ではなく中身に対して判定される
+	filter = &walkFilter{}
+	filter.Includes.Set("*/inner/*")
+	filter.MaxSize.Set("1M")
+	container = &ParallelCompList{}
+	options.Filter = filter
+	if err := createParallelCompList(context.Background(), container, newRootSources(root), options); err != nil {
+		t.Fatal(err)
+	}
+	if len(*container) != 2 {
+		t.Fatalf("unexpected include result: %v", len(*container))
+	}
+}
+
+func TestByteSizeFlag(t *testing.T) {
+	cases := map[string]int64{"100": 100, "10K": 10 << 10, "2MB": 2 << 20, "1g": 1 << 30}
+	for value, expected := range cases {
+		size := byteSizeFlag(0)
+		if err := size.Set(value); err != nil {
+			t.Fatal(err)
+		}
+		if int64(size) != expected {
+			t.Errorf("byteSizeFlag(%q) = %v", value, size)
+		}
+	}
+
+	size := byteSizeFlag(0)
+	if err := size.Set("abc"); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// scanSources 走査元（rootディレクトリとファイルリスト）
+type scanSources struct {
+	Roots        []string
+	FileList     io.Reader
+	FileListName string
+}
+
+// newRootSources rootディレクトリだけの走査元を作成する
+func newRootSources(roots ...string) *scanSources {
+	sources := &scanSources{}
+	for _, root := range roots {
+		sources.Roots = append(sources.Roots, filepath.Clean(root))
+	}
+	return sources
+}
+
+// IsMultiple 走査元が複数あるか
+func (sources *scanSources) IsMultiple() bool {
+	count := len(sources.Roots)
+	if sources.FileList != nil {
+		count++
+	}
+	return count > 1
+}
+
+// sendPaths すべての走査元のファイルのパスを送信する
+func (sources *scanSources) sendPaths(ctx context.Context, options *scanOptions, chPath chan<- walkPath) error {
+	for _, root := range sources.Roots {
+		if err := sendRootPaths(ctx, root, options, chPath); err != nil {
+			return err
+		}
+	}
+
+	if sources.FileList != nil {
+		return sendFileListPaths(ctx, sources.FileList, sources.FileListName, options, chPath)
+	}
+	return nil
+}
+
+// walkPath 走査で見つけたファイルとその走査元
+type walkPath struct {
+	Path string
+	Root string
+	Size int64
+}
+
+// fileID ファイルの実体を識別するID
+type fileID struct {
+	Device uint64
+	Inode  uint64
+}
+
+// hardLinkTracker 同じ実体のファイルを一度だけ処理し、まとめたパスを記録する
+type hardLinkTracker struct {
+	mu     sync.Mutex
+	first  map[fileID]string
+	linked map[string][]string
+}
+
+func newHardLinkTracker() *hardLinkTracker {
+	return &hardLinkTracker{
+		first:  map[fileID]string{},
+		linked: map[string][]string{},
+	}
+}
+
+// Visit 初めて見た実体ならtrue、既に見た実体なら最初のパスにまとめてfalseを返す
+func (tracker *hardLinkTracker) Visit(path string, info fs.FileInfo) bool {
+	if tracker == nil {
+		return true
+	}
+
+	id, ok := getFileID(info)
+	if !ok {
+		return true
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	firstPath, ok := tracker.first[id]
+	if !ok {
+		tracker.first[id] = path
+		return true
+	}
+	tracker.linked[firstPath] = append(tracker.linked[firstPath], path)
+	// NOTE: 最初のパスのハッシュを使い回すので再利用として数える
+	metrics.HashesReused.Add("hard-link", 1)
+	return false
+}
+
+// LinksOf 指定パスにまとめられたパスを返す
+func (tracker *hardLinkTracker) LinksOf(path string) []string {
+	if tracker == nil {
+		return nil
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	return tracker.linked[path]
+}
+
+// Count まとめられたパスの数
+func (tracker *hardLinkTracker) Count() int {
+	if tracker == nil {
+		return 0
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	count := 0
+	for _, links := range tracker.linked {
+		count += len(links)
+	}
+	return count
+}
+
+// linkFlags シンボリックリンク・ハードリンク・マウント境界の扱いを指定するフラグ
+type linkFlags struct {
+	FollowSymlinks  bool
+	OneFileSystem   bool
+	DedupeHardLinks bool
+}
+
+// registerLinkFlags リンク関連のフラグを登録する
+func registerLinkFlags(flags *flag.FlagSet, links *linkFlags) {
+	flags.BoolVar(&links.FollowSymlinks, "follow-symlinks", false, "follow symbolic links (with cycle detection)")
+	flags.BoolVar(&links.OneFileSystem, "one-file-system", false, "do not cross file system boundaries")
+	flags.BoolVar(&links.DedupeHardLinks, "dedupe-hardlinks", true, "hash hard links (same device and inode) only once")
+}
+
+// Apply フラグの内容を走査設定に反映する
+func (links *linkFlags) Apply(options *scanOptions) {
+	options.FollowSymlinks = links.FollowSymlinks
+	options.OneFileSystem = links.OneFileSystem
+	if links.DedupeHardLinks {
+		options.HardLinks = newHardLinkTracker()
+	}
+}
+
+// treeWalker シンボリックリンクやマウント境界を考慮してディレクトリを走査する
+type treeWalker struct {
+	ctx         context.Context
+	options     *scanOptions
+	chPath      chan<- walkPath
+	root        string
+	rootDevice  uint64
+	visitedDirs map[fileID]bool
+}
+
+// sendRootPaths root以下のファイルのパスを送信する
+func sendRootPaths(ctx context.Context, root string, options *scanOptions, chPath chan<- walkPath) error {
+	walker := &treeWalker{
+		ctx:         ctx,
+		options:     options,
+		chPath:      chPath,
+		root:        root,
+		visitedDirs: map[fileID]bool{},
+	}
+
+	if info, err := os.Stat(root); err == nil {
+		if id, ok := getFileID(info); ok {
+			walker.rootDevice = id.Device
+		}
+	}
+
+	return walker.walk(root)
+}
+
+func (walker *treeWalker) walk(dir string) error {
+	// NOTE: WalkDirは起点がシンボリックリンクだとたどらないので、ディレクトリを指すなら末尾に区切り文字を付けて解決させる
+	walkRoot := dir
+	if info, err := os.Lstat(dir); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			walkRoot = dir + string(filepath.Separator)
+		}
+	}
+
+	return filepath.WalkDir(walkRoot, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed filepath.WalkDir func: %w", err)
+		}
+		path = filepath.Clean(path)
+
+		if d.IsDir() {
+			return walker.enterDir(path, dir)
+		}
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			if !walker.options.FollowSymlinks {
+				return nil
+			}
+			return walker.followSymlink(path)
+		}
+
+		if path != walker.root {
+			isSkip, err := filterWalkPath(walker.options, path, walker.root, d)
+			if isSkip || err != nil {
+				return err
+			}
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("failed DirEntry.Info: %s %w", path, err)
+		}
+		return walker.send(path, info)
+	})
+}
+
+// enterDir ディレクトリに入るか判定する
+func (walker *treeWalker) enterDir(path, walkRoot string) error {
+	if path != walker.root {
+		if walker.options.Filter.Skip(walker.options.Filter.FilterDir(path)) {
+			return filepath.SkipDir
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed os.Stat: %s %w", path, err)
+	}
+
+	id, ok := getFileID(info)
+	if !ok {
+		return nil
+	}
+
+	if walker.options.OneFileSystem && id.Device != walker.rootDevice {
+		// NOTE: 別のファイルシステムはマウントポイントごと走査しない
+		return filepath.SkipDir
+	}
+
+	if walker.options.FollowSymlinks {
+		// NOTE: リンクをたどると同じディレクトリに戻ってくることがあるので一度入ったディレクトリには入らない
+		// NOTE: シンボリックリンク経由で入った場合(path == walkRoot)は呼び出し元で登録済み
+		if walker.visitedDirs[id] && path != walkRoot {
+			return filepath.SkipDir
+		}
+		walker.visitedDirs[id] = true
+	}
+	return nil
+}
+
+// followSymlink シンボリックリンクの先をたどる
+func (walker *treeWalker) followSymlink(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		// NOTE: リンク切れは記録して継続
+		walker.options.Issues.Add(path, walker.root, issueReasonUnreadable, fmt.Errorf("failed os.Stat: %w", err))
+		return nil
+	}
+
+	if info.IsDir() {
+		if walker.options.Filter.Skip(walker.options.Filter.FilterDir(path)) {
+			return nil
+		}
+
+		id, ok := getFileID(info)
+		if ok {
+			if walker.visitedDirs[id] {
+				// NOTE: 循環しているか、既に走査したディレクトリ
+				return nil
+			}
+			if walker.options.OneFileSystem && id.Device != walker.rootDevice {
+				return nil
+			}
+			walker.visitedDirs[id] = true
+		}
+		return walker.walk(path)
+	}
+
+	isSkip, err := filterWalkPath(walker.options, path, walker.root, fs.FileInfoToDirEntry(info))
+	if isSkip || err != nil {
+		return err
+	}
+	return walker.send(path, info)
+}
+
+// send 同じ実体のファイルでなければワーカーに送信する
+func (walker *treeWalker) send(path string, info fs.FileInfo) error {
+	if !walker.options.HardLinks.Visit(path, info) {
+		return nil
+	}
+
+	select {
+	case walker.chPath <- walkPath{Path: path, Root: walker.root, Size: info.Size()}:
+	case <-walker.ctx.Done():
+		return walker.ctx.Err()
+	}
+	walker.options.Progress.Discover(info.Size())
+	return nil
+}
+
+// sendFileListPaths ファイルリストに書かれたパスを送信する
+// NOTE: ディレクトリが書かれていればその中も走査する
+func sendFileListPaths(ctx context.Context, reader io.Reader, listName string, options *scanOptions, chPath chan<- walkPath) error {
+	scanner := newFileListScanner(reader)
+	for scanner.Scan() {
+		path := scanner.Text()
+		if len(path) == 0 {
+			continue
+		}
+		path = filepath.Clean(path)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			// NOTE: リストにあっても存在しないものは記録して継続
+			options.Issues.Add(path, listName, issueReasonUnreadable, fmt.Errorf("failed os.Stat: %w", err))
+			continue
+		}
+
+		if info.IsDir() {
+			if err := sendRootPaths(ctx, path, options, chPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		isSkip, err := filterWalkPath(options, path, listName, fs.FileInfoToDirEntry(info))
+		if err != nil {
+			return err
+		}
+		if isSkip || !options.HardLinks.Visit(path, info) {
+			continue
+		}
+
+		select {
+		case chPath <- walkPath{Path: path, Root: listName, Size: info.Size()}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		options.Progress.Discover(info.Size())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read file list: %s %w", listName, err)
+	}
+	return nil
+}
+
+// newFileListScanner 改行区切りまたはNUL区切り（find -print0）のファイルリストを読むScannerを作成する
+// NOTE: 先頭部分にNULが含まれていればNUL区切りとして扱う
+func newFileListScanner(reader io.Reader) *bufio.Scanner {
+	bufReader := bufio.NewReaderSize(reader, 64*1024)
+	head, _ := bufReader.Peek(64 * 1024)
+	isNulSeparated := bytes.IndexByte(head, 0) >= 0
+
+	scanner := bufio.NewScanner(bufReader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	if isNulSeparated {
+		scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+			if index := bytes.IndexByte(data, 0); index >= 0 {
+				return index + 1, data[:index], nil
+			}
+			if atEOF && len(data) > 0 {
+				return len(data), data, nil
+			}
+			return 0, nil, nil
+		})
+	}
+	return scanner
+}
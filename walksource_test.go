@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFileListScanner(t *testing.T) {
+	cases := map[string][]string{
+		"a.png\nb c.png\r\n\nd.png":      {"a.png", "b c.png", "", "d.png"},
+		"a.png\x00b\nc.png\x00d.png\x00": {"a.png", "b\nc.png", "d.png"},
+	}
+
+	for input, expected := range cases {
+		scanner := newFileListScanner(strings.NewReader(input))
+		paths := []string{}
+		for scanner.Scan() {
+			paths = append(paths, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("unexpected paths: %q", paths)
+		}
+	}
+}
+
+// TestScanSources 複数rootとファイルリストから走査し、走査元が記録されるかのテスト
+func TestScanSources(t *testing.T) {
+	rootA := t.TempDir()
+	writeTestImages(t, rootA, map[string]int{"x.png": 0})
+	rootB := t.TempDir()
+	writeTestImages(t, rootB, map[string]int{"y.png": 1})
+	rootC := t.TempDir()
+	writeTestImages(t, rootC, map[string]int{"z.png": 2, filepath.Join("sub", "w.png"): 3})
+
+	// NOTE: find -print0 の出力を想定
+	fileList := filepath.Join(rootC, "z.png") + "\x00" + filepath.Join(rootC, "sub") + "\x00" + filepath.Join(rootC, "missing.png") + "\x00"
+	sources := newRootSources(rootA, rootB)
+	sources.FileList = strings.NewReader(fileList)
+	sources.FileListName = "-"
+	if !sources.IsMultiple() {
+		t.Fatal("expected multiple sources")
+	}
+
+	container := &ParallelCompList{}
+	if err := createParallelCompList(context.Background(), container, sources, &scanOptions{SampleWidth: 16, SampleHeight: 16, Parallels: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	roots := map[string]string{}
+	for path, info := range container.InfoMap() {
+		roots[path] = info.Root
+	}
+	expected := map[string]string{
+		filepath.Join(rootA, "x.png"):        rootA,
+		filepath.Join(rootB, "y.png"):        rootB,
+		filepath.Join(rootC, "z.png"):        "-",
+		filepath.Join(rootC, "sub", "w.png"): filepath.Join(rootC, "sub"),
+	}
+	if !reflect.DeepEqual(roots, expected) {
+		t.Fatalf("unexpected roots: %v", roots)
+	}
+
+	members := toSimilarGroupMembers([][]string{{filepath.Join(rootA, "x.png")}}, container.InfoMap())
+	if members[0][0].Root != rootA {
+		t.Fatalf("unexpected members: %+v", members)
+	}
+}
+
+// TestTreeWalkerLinks シンボリックリンクの循環検出とハードリンクのまとめのテスト
+func TestTreeWalkerLinks(t *testing.T) {
+	root := t.TempDir()
+	writeTestImages(t, root, map[string]int{"a.png": 0})
+	other := t.TempDir()
+	writeTestImages(t, other, map[string]int{"c.png": 1})
+
+	if err := os.Link(filepath.Join(root, "a.png"), filepath.Join(root, "b.png")); err != nil {
+		t.Skip(err)
+	}
+	if err := os.Symlink(root, filepath.Join(root, "loop")); err != nil {
+		t.Skip(err)
+	}
+	if err := os.Symlink(other, filepath.Join(root, "ext")); err != nil {
+		t.Skip(err)
+	}
+
+	scan := func(links *linkFlags) (*ParallelCompList, *scanOptions) {
+		options := &scanOptions{SampleWidth: 16, SampleHeight: 16, Parallels: 2}
+		links.Apply(options)
+		container := &ParallelCompList{}
+		if err := createParallelCompList(context.Background(), container, newRootSources(root), options); err != nil {
+			t.Fatal(err)
+		}
+		return container, options
+	}
+
+	// NOTE: 既定ではシンボリックリンクはたどらず、ハードリンクは1つにまとめる
+	container, options := scan(&linkFlags{DedupeHardLinks: true})
+	if len(*container) != 1 || options.HardLinks.Count() != 1 {
+		t.Fatalf("unexpected result: %v %v", len(*container), options.HardLinks.Count())
+	}
+	info := (*container)[0]
+	if len(info.HardLinks) != 1 || filepath.Base(info.HardLinks[0]) == filepath.Base(info.Filepath) {
+		t.Fatalf("unexpected hard links: %+v", info)
+	}
+
+	// NOTE: シンボリックリンクをたどっても循環せず、リンク先のファイルも見つかる
+	container, _ = scan(&linkFlags{FollowSymlinks: true, DedupeHardLinks: true})
+	paths := []string{}
+	for _, info := range *container {
+		paths = append(paths, info.Filepath)
+	}
+	sort.Strings(paths)
+	if len(paths) != 2 || paths[1] != filepath.Join(root, "ext", "c.png") {
+		t.Fatalf("unexpected paths: %v", paths)
+	}
+
+	// NOTE: まとめなければ両方ハッシュを計算する
+	container, _ = scan(&linkFlags{})
+	if len(*container) != 2 {
+		t.Fatalf("unexpected result without dedupe: %v", len(*container))
+	}
+}
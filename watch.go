@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/sync/errgroup"
+)
+
+// DuplicateEvent 監視中に新しく見つかった似ている画像のイベント
+type DuplicateEvent struct {
+	Time     time.Time
+	Filepath string
+	Matches  []SimilarImage
+}
+
+// imageWatcher ディレクトリを監視してインデックスを最新に保つ
+type imageWatcher struct {
+	index     *imageIndex
+	watcher   *fsnotify.Watcher
+	root      string
+	options   *scanOptions
+	threshold int
+	settle    time.Duration
+
+	// NOTE: 検索と追加の間に別の画像が追加されると見逃すので直列にする
+	//       削除も同じく直列にする（検索してから出力するまでの間に消えた画像と一致したと出力しないため）
+	updateMu sync.Mutex
+
+	outputMu sync.Mutex
+	encoder  *json.Encoder
+
+	pendingMu sync.Mutex
+	pending   map[string]*time.Timer
+}
+
+func newImageWatcher(index *imageIndex, root string, output io.Writer, options *scanOptions, threshold int, settle time.Duration) (*imageWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed fsnotify.NewWatcher: %w", err)
+	}
+
+	return &imageWatcher{
+		index:     index,
+		watcher:   watcher,
+		root:      root,
+		options:   options,
+		threshold: threshold,
+		settle:    settle,
+		encoder:   json.NewEncoder(output),
+		pending:   map[string]*time.Timer{},
+	}, nil
+}
+
+// AddTree root以下のディレクトリをすべて監視対象にする
+// NOTE: inotifyは再帰的に監視できないのでディレクトリごとに登録する
+func (w *imageWatcher) AddTree(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed filepath.WalkDir func: %w", err)
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		if path != root && w.options.Filter.Skip(w.options.Filter.FilterDir(path)) {
+			return filepath.SkipDir
+		}
+
+		if err := w.watcher.Add(path); err != nil {
+			return fmt.Errorf("failed watcher.Add: %s %w", path, err)
+		}
+		return nil
+	})
+}
+
+// Run イベントを処理し続ける
+func (w *imageWatcher) Run(ctx context.Context, parallels int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	eg, ctx := errgroup.WithContext(ctx)
+
+	// NOTE: 書き込みが落ち着いたファイルのパスを送り続ける
+	// NOTE: タイマーから遅れて送信されることがあるのでchPathはcloseせずctxで終了を伝える
+	chPath := make(chan string, parallels)
+	eg.Go(func() error {
+		defer cancel()
+		for {
+			select {
+			case event, ok := <-w.watcher.Events:
+				if !ok {
+					return nil
+				}
+				w.handleEvent(ctx, event, chPath)
+			case err, ok := <-w.watcher.Errors:
+				if !ok {
+					return nil
+				}
+				slog.Error("failed watcher", "error", err)
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+
+	// NOTE: 画像のハッシュを計算してインデックスを更新し続けるgoroutine
+	for i := 0; i < parallels; i++ {
+		eg.Go(func() error {
+			for {
+				select {
+				case path := <-chPath:
+					if err := w.updateImage(ctx, path); err != nil {
+						return err
+					}
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		})
+	}
+
+	err := eg.Wait()
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// handleEvent fsnotifyのイベントをインデックスの更新に変換する
+func (w *imageWatcher) handleEvent(ctx context.Context, event fsnotify.Event, chPath chan<- string) {
+	path := event.Name
+
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		// NOTE: 名前の変更は変更後のパスでCreateが来るので削除として扱う
+		w.cancelPending(path)
+		w.updateMu.Lock()
+		w.index.RemoveUnder(path)
+		w.updateMu.Unlock()
+		return
+	}
+
+	if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	if info.IsDir() {
+		if event.Has(fsnotify.Create) {
+			// NOTE: 新しいディレクトリも監視し、既に中にあるファイルも処理する
+			if err := w.AddTree(path); err != nil {
+				slog.Warn("failed to watch directory", "path", path, "error", err)
+			}
+			filepath.WalkDir(path, func(childPath string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return nil
+				}
+				isSkip, err := filterWalkPath(w.options, childPath, w.root, d)
+				if !isSkip && err == nil {
+					w.schedule(ctx, childPath, chPath)
+				}
+				return err
+			})
+		}
+		return
+	}
+
+	if w.options.Filter != nil {
+		if isSkip, _ := filterWalkPath(w.options, path, w.root, fs.FileInfoToDirEntry(info)); isSkip {
+			return
+		}
+	}
+
+	w.schedule(ctx, path, chPath)
+}
+
+// schedule 書き込み途中のファイルを読まないよう、一定時間イベントが来なくなってから処理する
+func (w *imageWatcher) schedule(ctx context.Context, path string, chPath chan<- string) {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+
+	if timer, ok := w.pending[path]; ok {
+		timer.Reset(w.settle)
+		return
+	}
+
+	w.pending[path] = time.AfterFunc(w.settle, func() {
+		w.pendingMu.Lock()
+		delete(w.pending, path)
+		w.pendingMu.Unlock()
+
+		select {
+		case chPath <- path:
+		case <-ctx.Done():
+		}
+	})
+}
+
+func (w *imageWatcher) cancelPending(path string) {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+
+	if timer, ok := w.pending[path]; ok {
+		timer.Stop()
+		delete(w.pending, path)
+	}
+}
+
+// updateImage 画像のハッシュを計算し直してインデックスを更新し、似ている画像があればイベントを出力する
+func (w *imageWatcher) updateImage(ctx context.Context, path string) error {
+	imageHashes, err := readImageHashList(ctx, path, w.root, w.options)
+	if err != nil {
+		return err
+	}
+
+	w.updateMu.Lock()
+	defer w.updateMu.Unlock()
+
+	// NOTE: 変更されたファイルは古いハッシュと比較しないよう先に消す
+	w.index.RemoveUnder(path)
+
+	for _, imageHash := range imageHashes {
+		similarImages, err := w.index.Search(imageHash, w.threshold)
+		if err != nil {
+			return fmt.Errorf("failed Search: %s %w", imageHash.Filepath, err)
+		}
+		if err := w.index.Add(imageHash); err != nil {
+			return fmt.Errorf("failed Add: %s %w", imageHash.Filepath, err)
+		}
+
+		if len(similarImages) > 0 {
+			if err := w.emit(&DuplicateEvent{Time: time.Now(), Filepath: imageHash.Filepath, Matches: similarImages}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// emit イベントをjson linesとして書き出す
+func (w *imageWatcher) emit(event *DuplicateEvent) error {
+	w.outputMu.Lock()
+	defer w.outputMu.Unlock()
+
+	if err := w.encoder.Encode(event); err != nil {
+		return fmt.Errorf("failed json.Encode: %w", err)
+	}
+	return nil
+}
+
+func (w *imageWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+// readImageHashList 1ファイル分（zipなら中身すべて）のハッシュを計算する
+func readImageHashList(ctx context.Context, path, root string, options *scanOptions) ([]*ImageHashInfo, error) {
+	chCalcImagehash := make(chan *ImageHashInfo)
+	var err error
+	go func() {
+		defer close(chCalcImagehash)
+		err = readImageHash(ctx, path, root, chCalcImagehash, options)
+	}()
+
+	imageHashes := []*ImageHashInfo{}
+	for imageHash := range chCalcImagehash {
+		imageHashes = append(imageHashes, imageHash)
+	}
+	return imageHashes, err
+}
+
+// runWatch watchサブコマンド
+func runWatch(args []string, env *cliEnv) error {
+	cmd := struct {
+		Root          string
+		Output        string
+		Parallels     int
+		HashAlgorithm hashAlgorithmFlag
+		SampleWidth   int
+		SampleHeight  int
+		Threshold     int
+		Settle        time.Duration
+		Crop          cropOptions
+	}{}
+	flags := env.newFlagSet("watch", "", "Watch a directory and write new duplicates as json lines.")
+	flags.StringVar(&cmd.Root, "root", "", "watch dir")
+	flags.StringVar(&cmd.Output, "o", "", "output filename of duplicate events(json lines, empty is stdout)")
+	flags.IntVar(&cmd.Parallels, "j", runtime.NumCPU(), "parallel num")
+	flags.Var(&cmd.HashAlgorithm, "hash", "hash algorithm: phash, ahash or dhash")
+	flags.IntVar(&cmd.SampleWidth, "samplew", 16, "hash width")
+	flags.IntVar(&cmd.SampleHeight, "sampleh", 16, "hash height")
+	flags.IntVar(&cmd.Threshold, "threshold", 10, "pHash threshold")
+	flags.DurationVar(&cmd.Settle, "settle", 500*time.Millisecond, "wait time after the last write before hashing")
+	filter := &walkFilter{}
+	registerFilterFlags(flags, filter)
+	decode := &decodeFlags{}
+	registerDecodeFlags(flags, decode)
+	registerCropFlags(flags, &cmd.Crop)
+	if err := env.parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	output := env.Stdout
+	if len(cmd.Output) != 0 {
+		file, err := os.OpenFile(cmd.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed os.OpenFile: %s %w", cmd.Output, err)
+		}
+		defer file.Close()
+		output = file
+	}
+
+	parallels := cmd.Parallels
+	if parallels < 1 {
+		parallels = 1
+	}
+	rootPath := filepath.Clean(cmd.Root)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	index := &imageIndex{}
+	options := &scanOptions{
+		HashAlgorithm: cmd.HashAlgorithm,
+		SampleWidth:   cmd.SampleWidth,
+		SampleHeight:  cmd.SampleHeight,
+		Parallels:     parallels,
+		Filter:        filter,
+		Crop:          cmd.Crop,
+	}
+	decode.Apply(options)
+	watcher, err := newImageWatcher(index, rootPath, output, options, cmd.Threshold, cmd.Settle)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// NOTE: 初回スキャン中の変更も取りこぼさないよう先に監視を始める
+	if err := watcher.AddTree(rootPath); err != nil {
+		return err
+	}
+	if err := createParallelCompList(ctx, &index.list, newRootSources(rootPath), options); err != nil {
+		return err
+	}
+	fmt.Fprintf(env.Stderr, "Watching: %v (%v images)\n", rootPath, index.Len())
+
+	return watcher.Run(ctx, parallels)
+}
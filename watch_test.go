@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestImageWatcher 監視中に追加された画像の重複がイベントとして出力されるかのテスト
+func TestImageWatcher(t *testing.T) {
+	root := t.TempDir()
+	writeTestImages(t, root, map[string]int{"x.png": 0, "y.png": 1})
+
+	reader, writer := io.Pipe()
+	defer reader.Close()
+
+	index := &imageIndex{}
+	options := &scanOptions{SampleWidth: 16, SampleHeight: 16, Parallels: 2}
+	watcher, err := newImageWatcher(index, root, writer, options, 10, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	if err := watcher.AddTree(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := createParallelCompList(context.Background(), &index.list, newRootSources(root), options); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	chDone := make(chan error, 1)
+	go func() {
+		chDone <- watcher.Run(ctx, 2)
+		writer.Close()
+	}()
+
+	// NOTE: 重複しない画像、サブディレクトリ内の重複画像の順に追加する
+	writeTestImages(t, root, map[string]int{"z.png": 2})
+	time.Sleep(100 * time.Millisecond)
+	writeTestImages(t, root, map[string]int{filepath.Join("incoming", "x-copy.png"): 0})
+
+	chEvent := make(chan DuplicateEvent, 1)
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			event := DuplicateEvent{}
+			if err := json.Unmarshal(scanner.Bytes(), &event); err == nil {
+				chEvent <- event
+			}
+		}
+	}()
+
+	select {
+	case event := <-chEvent:
+		if event.Filepath != filepath.Join(root, "incoming", "x-copy.png") {
+			t.Fatalf("unexpected event filepath: %+v", event)
+		}
+		if len(event.Matches) != 1 || event.Matches[0].Filepath != filepath.Join(root, "x.png") {
+			t.Fatalf("unexpected event matches: %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for duplicate event")
+	}
+
+	if index.Len() != 4 {
+		t.Fatalf("unexpected index size: %v", index.Len())
+	}
+
+	// NOTE: 削除したらインデックスからも消えること
+	if err := os.RemoveAll(filepath.Join(root, "incoming")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for index.Len() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected index size after remove: %v", index.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-chDone; err != nil {
+		t.Fatal(err)
+	}
+}